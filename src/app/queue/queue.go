@@ -0,0 +1,156 @@
+// Package queue keeps FIFO-ish work queues on the DHT, built only from what
+// a node offers every client: put-if-absent claims a slot for a new item, and
+// a key lease claims an item for the consumer working on it.
+//
+// Items of queue q live under q's name at increasing sequence numbers. An
+// enqueue takes the first free slot at or after the tail hint; a dequeue
+// takes the first item at or after the head hint that is neither acked nor
+// leased to another consumer. An item whose consumer does not ack it before
+// its lease runs out is handed out again, so delivery is at least once.
+package queue
+
+import (
+	"chord"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+const (
+	itemPrefix = "v:"
+	ackedMark  = "acked"
+)
+
+var (
+	// ErrEmpty: No item is waiting.
+	ErrEmpty = errors.New("queue is empty")
+	// ErrClaimLost: The lease on the item ran out before the ack, and the item
+	// may have gone to another consumer.
+	ErrClaimLost = errors.New("claim on the item was lost")
+)
+
+type Queue struct {
+	node *chord.NodeWrapper
+	name string
+}
+
+// Task is an item handed to a consumer, to be acked once it is done.
+type Task struct {
+	Seq   uint64
+	Value string
+	lease chord.KeyLease
+}
+
+func New(node *chord.NodeWrapper, name string) *Queue {
+	return &Queue{node: node, name: name}
+}
+
+func (q *Queue) itemKey(seq uint64) string {
+	return fmt.Sprintf("queue/%v/item/%020d", q.name, seq)
+}
+
+func (q *Queue) hintKey(end string) string {
+	return fmt.Sprintf("queue/%v/%v", q.name, end)
+}
+
+// hint reads the head or tail hint. A hint only says where to start
+// looking: it may lag behind, or even step back when two writers race.
+func (q *Queue) hint(end string) (uint64, error) {
+	val, err := q.node.GetValue(q.hintKey(end))
+	if err == chord.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(val, 10, 64)
+}
+
+func (q *Queue) advance(end string, seq uint64) {
+	_ = q.node.Put(q.hintKey(end), strconv.FormatUint(seq, 10))
+}
+
+// Enqueue appends value and returns its sequence number.
+func (q *Queue) Enqueue(value string) (uint64, error) {
+	seq, err := q.hint("tail")
+	if err != nil {
+		return 0, err
+	}
+	for ; ; seq++ {
+		if q.node.PutIfAbsent(q.itemKey(seq), itemPrefix+value) {
+			q.advance("tail", seq+1)
+			return seq, nil
+		}
+		// Taken by another enqueue, or the owner could not be reached.
+		if _, err := q.node.GetValue(q.itemKey(seq)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Dequeue claims the oldest waiting item for consumer for visibility, after
+// which it is handed out again unless acked. It returns ErrEmpty if no item
+// is waiting.
+func (q *Queue) Dequeue(consumer string, visibility time.Duration) (Task, error) {
+	head, err := q.hint("head")
+	if err != nil {
+		return Task{}, err
+	}
+	skipped := true
+	for seq := head; ; seq++ {
+		val, err := q.node.GetValue(q.itemKey(seq))
+		if err == chord.ErrNotFound {
+			return Task{}, ErrEmpty
+		}
+		if err != nil {
+			return Task{}, err
+		}
+		if val == ackedMark {
+			if skipped {
+				q.advance("head", seq+1)
+			}
+			continue
+		}
+		skipped = false
+		// A lease renews for its own holder, so every claim holds it under a
+		// name of its own, or a consumer would be handed its own items again.
+		holder := fmt.Sprintf("%v/%x", consumer, rand.Uint64())
+		lease, err := q.node.AcquireLease(q.itemKey(seq), holder, visibility)
+		if err == chord.ErrKeyLeased {
+			continue
+		}
+		if err != nil {
+			return Task{}, err
+		}
+		// Acked between the read and the claim.
+		val, err = q.node.GetValue(q.itemKey(seq))
+		if err != nil || val == ackedMark {
+			_ = q.node.ReleaseLease(lease)
+			if err != nil {
+				return Task{}, err
+			}
+			continue
+		}
+		return Task{Seq: seq, Value: val[len(itemPrefix):], lease: lease}, nil
+	}
+}
+
+// Ack marks t done, so it is never handed out again.
+func (q *Queue) Ack(t Task) error {
+	err := q.node.PutLeased(t.lease, ackedMark)
+	if err == chord.ErrLeaseLost {
+		return ErrClaimLost
+	}
+	if err != nil {
+		return err
+	}
+	return q.node.ReleaseLease(t.lease)
+}
+
+// Release gives t up before its visibility runs out, for another consumer
+// to take.
+func (q *Queue) Release(t Task) error {
+	return q.node.ReleaseLease(t.lease)
+}
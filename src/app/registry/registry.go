@@ -0,0 +1,264 @@
+// Package registry keeps a service registry on the DHT. Every endpoint of a
+// service holds an entry under the service's name until it stops
+// heartbeating and its TTL runs out; clients resolve a name to its live
+// endpoints from a short-lived cache, or watch it for changes.
+//
+// All endpoints of a name share one key, written under a key lease so that
+// concurrent registrations do not overwrite each other. Expiry compares wall
+// clocks, so the clocks of registering and resolving machines should agree
+// to well within the TTLs in use.
+package registry
+
+import (
+	"chord"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	updateLeaseTime  = time.Second
+	updateAttempts   = 50
+	updatePauseTime  = 20 * time.Millisecond
+	defaultCacheTime = time.Second
+)
+
+// ErrBusy: The name's lease stayed with other writers through every attempt.
+var ErrBusy = errors.New("registry entry stayed leased by other writers")
+
+type Registry struct {
+	node      *chord.NodeWrapper
+	cacheTime time.Duration
+	lock      sync.Mutex
+	cache     map[string]resolved
+}
+
+type resolved struct {
+	addrs   []string
+	fetched time.Time
+}
+
+// Registration is an endpoint kept registered by heartbeats until it is
+// deregistered.
+type Registration struct {
+	r    *Registry
+	name string
+	addr string
+	ttl  time.Duration
+	stop chan struct{}
+	done chan struct{}
+	lock sync.Mutex
+	err  error
+}
+
+func New(node *chord.NodeWrapper) *Registry {
+	return &Registry{node: node, cacheTime: defaultCacheTime, cache: make(map[string]resolved)}
+}
+
+// SetCacheTime sets how long a resolved name is served from the cache. Zero
+// turns the cache off.
+func (r *Registry) SetCacheTime(d time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cacheTime = d
+	r.cache = make(map[string]resolved)
+}
+
+func key(name string) string {
+	return fmt.Sprintf("registry/%v", name)
+}
+
+// fetch reads the entries of name. A missing name has none.
+func (r *Registry) fetch(name string) (map[string]time.Time, error) {
+	entries := make(map[string]time.Time)
+	val, err := r.node.GetValue(key(name))
+	if err == chord.ErrNotFound {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(val), &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func live(entries map[string]time.Time) []string {
+	now := time.Now()
+	addrs := make([]string, 0, len(entries))
+	for addr, expires := range entries {
+		if now.Before(expires) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// update applies f to the entries of name under the name's lease, and drops
+// expired entries on the way.
+func (r *Registry) update(name string, f func(entries map[string]time.Time)) error {
+	holder := fmt.Sprintf("registry/%v/%x", r.node.Addr(), rand.Uint64())
+	for i := 0; i < updateAttempts; i++ {
+		lease, err := r.node.AcquireLease(key(name), holder, updateLeaseTime)
+		if err == chord.ErrKeyLeased {
+			time.Sleep(updatePauseTime)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = r.write(name, lease, f)
+		_ = r.node.ReleaseLease(lease)
+		if err == nil {
+			r.forget(name)
+		}
+		return err
+	}
+	return ErrBusy
+}
+
+func (r *Registry) write(name string, lease chord.KeyLease, f func(entries map[string]time.Time)) error {
+	entries, err := r.fetch(name)
+	if err != nil {
+		return err
+	}
+	f(entries)
+	now := time.Now()
+	for addr, expires := range entries {
+		if !now.Before(expires) {
+			delete(entries, addr)
+		}
+	}
+	if len(entries) == 0 {
+		return r.node.DeleteLeased(lease)
+	}
+	val, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return r.node.PutLeased(lease, string(val))
+}
+
+func (r *Registry) forget(name string) {
+	r.lock.Lock()
+	delete(r.cache, name)
+	r.lock.Unlock()
+}
+
+// Register adds addr to name for ttl, and heartbeats every third of ttl to
+// keep it there until Deregister.
+func (r *Registry) Register(name, addr string, ttl time.Duration) (*Registration, error) {
+	g := &Registration{r: r, name: name, addr: addr, ttl: ttl, stop: make(chan struct{}), done: make(chan struct{})}
+	if err := g.heartbeat(); err != nil {
+		return nil, err
+	}
+	go g.run()
+	return g, nil
+}
+
+func (g *Registration) heartbeat() error {
+	return g.r.update(g.name, func(entries map[string]time.Time) {
+		entries[g.addr] = time.Now().Add(g.ttl)
+	})
+}
+
+func (g *Registration) run() {
+	defer close(g.done)
+	ticker := time.NewTicker(g.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+			err := g.heartbeat()
+			g.lock.Lock()
+			g.err = err
+			g.lock.Unlock()
+		}
+	}
+}
+
+// Err returns the error of the last heartbeat, nil if it went through.
+func (g *Registration) Err() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.err
+}
+
+// Deregister stops the heartbeats and removes the endpoint at once, rather
+// than leaving it to expire.
+func (g *Registration) Deregister() error {
+	close(g.stop)
+	<-g.done
+	return g.r.update(g.name, func(entries map[string]time.Time) {
+		delete(entries, g.addr)
+	})
+}
+
+// Resolve returns the live endpoints of name, sorted.
+func (r *Registry) Resolve(name string) ([]string, error) {
+	r.lock.Lock()
+	c, ok := r.cache[name]
+	cacheTime := r.cacheTime
+	r.lock.Unlock()
+	if ok && time.Since(c.fetched) < cacheTime {
+		return c.addrs, nil
+	}
+	entries, err := r.fetch(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := live(entries)
+	if cacheTime > 0 {
+		r.lock.Lock()
+		r.cache[name] = resolved{addrs: addrs, fetched: time.Now()}
+		r.lock.Unlock()
+	}
+	return addrs, nil
+}
+
+// Watch reads name every interval, past the cache, and calls f with its live
+// endpoints whenever they differ from the last call, starting with the
+// first read. It stops once the returned func is called.
+func (r *Registry) Watch(name string, interval time.Duration, f func(addrs []string)) (stop func()) {
+	quit := make(chan struct{})
+	go func() {
+		var last []string
+		first := true
+		for {
+			if entries, err := r.fetch(name); err == nil {
+				if addrs := live(entries); first || !equal(addrs, last) {
+					first = false
+					last = addrs
+					f(addrs)
+				}
+			}
+			select {
+			case <-quit:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(quit) }) }
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,185 @@
+package chord
+
+import (
+	"math/big"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type routeEntry struct {
+	id       *big.Int
+	lastSeen time.Time
+}
+
+// accordionTable holds routing entries learned from lookups and maintenance
+// traffic on top of the finger table. Its capacity follows the node's budget:
+// it doubles while the RPC rate stays under budget and no failures are seen,
+// and halves when the rate exceeds the budget or peers keep failing, so
+// entries are only kept when the node can afford to learn and use them.
+type accordionTable struct {
+	lock      sync.Mutex
+	entries   map[string]*routeEntry
+	capacity  int
+	budget    int64
+	calls     int64
+	failures  int64
+	lastCalls int64
+	lastTime  time.Time
+}
+
+type RoutingTableStats struct {
+	Entries  int
+	Capacity int
+	Budget   int64
+	Rate     float64
+	Failures int64
+}
+
+func (a *accordionTable) countCall() {
+	atomic.AddInt64(&a.calls, 1)
+}
+
+func (a *accordionTable) noteFailure() {
+	atomic.AddInt64(&a.failures, 1)
+}
+
+func (a *accordionTable) learn(addrs ...string) {
+	now := time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.entries == nil {
+		a.entries = make(map[string]*routeEntry)
+		a.capacity = accordionMinCapacity
+	}
+	for _, addr := range addrs {
+		if addr == NULL {
+			continue
+		}
+		if e, ok := a.entries[addr]; ok {
+			e.lastSeen = now
+		} else {
+			a.entries[addr] = &routeEntry{id: NodeId(addr), lastSeen: now}
+		}
+	}
+	a.evictLocked()
+}
+
+func (a *accordionTable) forget(addr string) {
+	a.lock.Lock()
+	delete(a.entries, addr)
+	a.lock.Unlock()
+}
+
+func (a *accordionTable) evictLocked() {
+	if len(a.entries) <= a.capacity {
+		return
+	}
+	addrs := make([]string, 0, len(a.entries))
+	for addr := range a.entries {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return a.entries[addrs[i]].lastSeen.Before(a.entries[addrs[j]].lastSeen)
+	})
+	for _, addr := range addrs[:len(addrs)-a.capacity] {
+		delete(a.entries, addr)
+	}
+}
+
+// candidates lists the learned nodes strictly between from and kId, the one
+// making the most progress towards kId first.
+func (a *accordionTable) candidates(from, kId *big.Int) []string {
+	a.lock.Lock()
+	type candidate struct {
+		addr string
+		id   *big.Int
+	}
+	var list []candidate
+	for addr, e := range a.entries {
+		if within(e.id, from, kId, false) {
+			list = append(list, candidate{addr, e.id})
+		}
+	}
+	a.lock.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return within(list[i].id, list[j].id, kId, false)
+	})
+	ret := make([]string, len(list))
+	for i, c := range list {
+		ret[i] = c.addr
+	}
+	return ret
+}
+
+func (a *accordionTable) adjust() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.entries == nil {
+		a.entries = make(map[string]*routeEntry)
+		a.capacity = accordionMinCapacity
+	}
+	now := time.Now()
+	calls := atomic.LoadInt64(&a.calls)
+	failures := atomic.SwapInt64(&a.failures, 0)
+	if !a.lastTime.IsZero() {
+		rate := float64(calls-a.lastCalls) / now.Sub(a.lastTime).Seconds()
+		budget := a.budget
+		if budget == 0 {
+			budget = accordionDefaultBudget
+		}
+		if rate > float64(budget) || failures > accordionChurnFailures {
+			if a.capacity > accordionMinCapacity {
+				a.capacity /= 2
+			}
+		} else if failures == 0 && a.capacity < accordionMaxCapacity {
+			a.capacity *= 2
+		}
+		if a.capacity < accordionMinCapacity {
+			a.capacity = accordionMinCapacity
+		}
+		if a.capacity > accordionMaxCapacity {
+			a.capacity = accordionMaxCapacity
+		}
+	}
+	a.lastCalls, a.lastTime = calls, now
+	for addr, e := range a.entries {
+		if now.Sub(e.lastSeen) > accordionEntryTimeout {
+			delete(a.entries, addr)
+		}
+	}
+	a.evictLocked()
+}
+
+func (a *accordionTable) stats() RoutingTableStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ret := RoutingTableStats{Entries: len(a.entries), Capacity: a.capacity, Budget: a.budget, Failures: atomic.LoadInt64(&a.failures)}
+	if ret.Budget == 0 {
+		ret.Budget = accordionDefaultBudget
+	}
+	if !a.lastTime.IsZero() {
+		ret.Rate = float64(atomic.LoadInt64(&a.calls)-a.lastCalls) / time.Since(a.lastTime).Seconds()
+	}
+	return ret
+}
+
+func (n *ChordNode) closerLearnedRoute(kId *big.Int, cur string) string {
+	candidates := n.accordion.candidates(NodeId(cur), kId)
+	for i, c := range candidates {
+		if i == accordionProbeAttempts {
+			break
+		}
+		if c == n.addr || n.peers.blacklisted(c) {
+			continue
+		}
+		if n.alive(c) {
+			n.routingLog().Tracef("Node [%v] routes key [%v] through learned entry [%v] instead of [%v].", n.addr, kId, c, cur)
+			return c
+		}
+		n.accordion.forget(c)
+		n.accordion.noteFailure()
+	}
+	return cur
+}
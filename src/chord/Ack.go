@@ -0,0 +1,27 @@
+package chord
+
+// AckLevel reports how far a write got before put returned. While every key
+// has a single pre backup on the owner's successor, AckBackup means the whole
+// replica set has the write.
+type AckLevel int
+
+const (
+	AckNone AckLevel = iota
+	AckPrimary
+	AckBackup
+)
+
+func (a AckLevel) String() string {
+	switch a {
+	case AckPrimary:
+		return "primary"
+	case AckBackup:
+		return "backup"
+	default:
+		return "none"
+	}
+}
+
+func (w *NodeWrapper) PutWithAck(key string, value string) AckLevel {
+	return w.node.putWithAck(key, value, nil)
+}
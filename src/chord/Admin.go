@@ -0,0 +1,166 @@
+package chord
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimePprof "runtime/pprof"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type AdminOptions struct {
+	Addr      string
+	Profiling bool
+}
+
+type RuntimeStats struct {
+	Goroutines   int
+	HeapAlloc    uint64
+	HeapObjects  uint64
+	TotalAlloc   uint64
+	NumGC        uint32
+	PauseTotalNs uint64
+}
+
+type adminServer struct {
+	options  AdminOptions
+	mux      *http.ServeMux
+	server   *http.Server
+	listener net.Listener
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Errorf("Write admin response failed, error message: [%v].", err)
+	}
+}
+
+func writeProfile(w http.ResponseWriter, name string, debug int) {
+	p := runtimePprof.Lookup(name)
+	if p == nil {
+		http.Error(w, "unknown profile "+name, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_ = p.WriteTo(w, debug)
+}
+
+func (n *ChordNode) registerAdminRoutes() {
+	mux := n.admin.mux
+	mux.HandleFunc("/debug/runtime", func(w http.ResponseWriter, _ *http.Request) {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		writeJSON(w, RuntimeStats{
+			Goroutines:   runtime.NumGoroutine(),
+			HeapAlloc:    m.HeapAlloc,
+			HeapObjects:  m.HeapObjects,
+			TotalAlloc:   m.TotalAlloc,
+			NumGC:        m.NumGC,
+			PauseTotalNs: m.PauseTotalNs,
+		})
+	})
+	mux.HandleFunc("/events", n.serveEvents)
+	mux.HandleFunc("/slowops", n.serveSlowOps)
+	mux.HandleFunc("/topkeys", n.serveTopKeys)
+	mux.HandleFunc("/replication", n.serveReplication)
+	mux.HandleFunc("/replication/seeding", n.serveSeeding)
+	mux.HandleFunc("/replication/queue", n.serveReplicationQueue)
+	mux.HandleFunc("/cache/hot", n.serveHotKeyCache)
+	mux.HandleFunc("/cache/negative", n.serveNegativeCache)
+	mux.HandleFunc("/keys/filter", n.serveKeyFilter)
+	mux.HandleFunc("/successors/check", n.serveSuccessorCheck)
+	mux.HandleFunc("/migrate", n.serveMigrate)
+	mux.HandleFunc("/audit", n.serveAudit)
+	mux.HandleFunc("/admission", n.serveAdmission)
+	mux.HandleFunc("/peers", n.servePeers)
+	mux.HandleFunc("/maintenance", n.serveMaintenance)
+	mux.HandleFunc("/maintenance/rounds", n.serveMaintenanceRounds)
+	mux.HandleFunc("/rpc/classes", n.serveRPCClasses)
+	mux.HandleFunc("/rpc/limit", n.serveMessageLimit)
+	mux.HandleFunc("/peers/rtt", n.servePeerRTTs)
+	mux.HandleFunc("/overload", n.serveOverload)
+	mux.HandleFunc("/liveness", n.serveLiveness)
+	mux.HandleFunc("/aggregates", n.serveAggregates)
+	mux.HandleFunc("/membership/journal", n.serveMembershipJournal)
+	mux.HandleFunc("/admission/approve", n.serveApprove)
+	mux.HandleFunc("/promote", n.servePromote)
+	mux.HandleFunc("/backup", n.serveBackup)
+	mux.HandleFunc("/joins", n.serveJoins)
+	mux.HandleFunc("/ring/freeze", n.serveRingFreeze)
+	mux.HandleFunc("/ring/thaw", n.serveRingThaw)
+	mux.HandleFunc("/conflicts", n.serveConflicts)
+	mux.HandleFunc("/crdt", n.serveCRDT)
+	mux.HandleFunc("/metrics/rpc", n.serveRPCMetrics)
+	mux.HandleFunc("/metrics/zones", n.serveZoneMetrics)
+	mux.HandleFunc("/routing", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, n.accordion.stats())
+	})
+	mux.HandleFunc("/routing/efficiency", n.serveRoutingReport)
+	mux.HandleFunc("/leaves", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, n.leafList())
+	})
+	mux.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, _ *http.Request) {
+		writeProfile(w, "goroutine", 2)
+	})
+	if !n.admin.options.Profiling {
+		return
+	}
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/contention", func(w http.ResponseWriter, r *http.Request) {
+		debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+		if debug == 0 {
+			debug = 1
+		}
+		writeProfile(w, "mutex", debug)
+		writeProfile(w, "block", debug)
+	})
+}
+
+func (n *ChordNode) startAdmin() {
+	if n.admin.options.Addr == NULL {
+		return
+	}
+	n.admin.mux = http.NewServeMux()
+	n.registerAdminRoutes()
+	// The profile rates are the process's: profiling one node profiles
+	// every node sharing its process.
+	if n.admin.options.Profiling {
+		runtime.SetMutexProfileFraction(adminMutexProfileFraction)
+		runtime.SetBlockProfileRate(adminBlockProfileRate)
+	}
+	var err error
+	n.admin.listener, err = net.Listen("tcp", n.admin.options.Addr)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.startAdmin", "net.Listen", err)
+		return
+	}
+	n.admin.server = &http.Server{Handler: n.admin.mux}
+	n.log().Infof("Node [%v] serves admin api on [%v].", n.addr, n.admin.options.Addr)
+	go func() {
+		err := n.admin.server.Serve(n.admin.listener)
+		if err != nil && err != http.ErrServerClosed {
+			n.logErrorFunctionCall(n.addr, "ChordNode.startAdmin", "http.Server.Serve", err)
+		}
+	}()
+}
+
+func (n *ChordNode) stopAdmin() {
+	if n.admin.server == nil {
+		return
+	}
+	err := n.admin.server.Close()
+	if err != nil {
+		n.log().Errorf("close admin server failed, error message: [%v]", err)
+	}
+	n.admin.server = nil
+}
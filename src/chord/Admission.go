@@ -0,0 +1,302 @@
+package chord
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AdmissionOptions gate who may join the ring. A joiner is admitted by the
+// node assisting its join, which hands back the ring's options and a ticket
+// signed with Secret; the joiner presents the ticket to every new successor,
+// and a node only takes a predecessor through Notify or hands it data once it
+// has seen a valid ticket for it.
+type AdmissionOptions struct {
+	Allowlist       []string
+	Token           string
+	RequireApproval bool
+	Secret          string
+}
+
+type JoinRequest struct {
+	Addr  string
+	Token string
+}
+
+type AdmissionGrant struct {
+	Ticket  string
+	Options AdmissionOptions
+	// Successor is the joiner's successor, looked up by the assisting node
+	// while it holds the joiner's assist slot.
+	Successor string
+}
+
+type AdmissionTicket struct {
+	Addr   string
+	Ticket string
+}
+
+type AdmissionStatus struct {
+	Pending  []string
+	Admitted []string
+}
+
+var (
+	// ErrNotAdmitted: The ring's admission control turned the join down.
+	ErrNotAdmitted      = errors.New("join not admitted")
+	errAwaitingApproval = errors.New("join awaiting operator approval")
+)
+
+type admissionState struct {
+	lock     sync.Mutex
+	options  AdmissionOptions
+	enabled  bool
+	pending  map[string]time.Time
+	approved map[string]bool
+	admitted map[string]bool
+	ticket   string
+	token    string
+}
+
+func (a *admissionState) sign(addr string) string {
+	mac := hmac.New(sha256.New, []byte(a.options.Secret))
+	mac.Write([]byte(addr))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *admissionState) listed(addr string) bool {
+	if len(a.options.Allowlist) == 0 {
+		return true
+	}
+	for _, allowed := range a.options.Allowlist {
+		if allowed == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether addr may become this node's predecessor or receive
+// its data. Callers must hold lock.
+func (a *admissionState) allows(addr string) bool {
+	if !a.enabled {
+		return true
+	}
+	if !a.listed(addr) {
+		return false
+	}
+	if a.options.Secret == NULL {
+		return true
+	}
+	return a.admitted[addr]
+}
+
+// RequestJoin admits a joiner and looks its successor up, one of a bounded
+// number of assists at a time.
+func (n *ChordNode) RequestJoin(req JoinRequest, grant *AdmissionGrant) error {
+	if n.frozen(true) {
+		n.maintenanceLog().Errorf("Node [%v] turns the join of [%v] away, the ring is frozen.", n.addr, req.Addr)
+		return ErrRingFrozen
+	}
+	release, err := n.joinThrottle.acquire()
+	if err != nil {
+		n.maintenanceLog().Errorf("Node [%v] turns the join of [%v] away, too many joins are waiting.", n.addr, req.Addr)
+		return err
+	}
+	defer release()
+	if err = n.admit(req, grant); err != nil {
+		return err
+	}
+	return n.FindSuccessor(NodeId(req.Addr), &grant.Successor)
+}
+
+func (n *ChordNode) admit(req JoinRequest, grant *AdmissionGrant) error {
+	a := &n.admission
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.enabled {
+		return nil
+	}
+	if !a.listed(req.Addr) || a.options.Token != NULL && !hmac.Equal([]byte(req.Token), []byte(a.options.Token)) {
+		n.maintenanceLog().Errorf("Node [%v] refuses join request of [%v].", n.addr, req.Addr)
+		return ErrNotAdmitted
+	}
+	if a.options.RequireApproval && !a.approved[req.Addr] {
+		if a.pending == nil {
+			a.pending = make(map[string]time.Time)
+		}
+		a.pending[req.Addr] = time.Now()
+		n.maintenanceLog().Infof("Join request of [%v] waits for approval on node [%v].", req.Addr, n.addr)
+		return errAwaitingApproval
+	}
+	delete(a.pending, req.Addr)
+	grant.Options = a.options
+	if a.options.Secret != NULL {
+		grant.Ticket = a.sign(req.Addr)
+	}
+	n.maintenanceLog().Infof("Node [%v] admits [%v].", n.addr, req.Addr)
+	return nil
+}
+
+func (n *ChordNode) PresentTicket(t AdmissionTicket, _ *string) error {
+	a := &n.admission
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.enabled || a.options.Secret == NULL {
+		return nil
+	}
+	if !a.listed(t.Addr) || !hmac.Equal([]byte(t.Ticket), []byte(a.sign(t.Addr))) {
+		return ErrNotAdmitted
+	}
+	if a.admitted == nil {
+		a.admitted = make(map[string]bool)
+	}
+	a.admitted[t.Addr] = true
+	return nil
+}
+
+func (n *ChordNode) admits(addr string) bool {
+	n.admission.lock.Lock()
+	defer n.admission.lock.Unlock()
+	if addr == n.addr {
+		return true
+	}
+	return n.admission.allows(addr)
+}
+
+// requestAdmission asks assist to admit this node, waiting out its join
+// throttle, and returns the successor assist found for it, if any.
+func (n *ChordNode) requestAdmission(assist string) (string, error) {
+	a := &n.admission
+	a.lock.Lock()
+	token := a.token
+	a.lock.Unlock()
+	var grant AdmissionGrant
+	var err error
+	for i := 0; i < joinThrottleRetries; i++ {
+		if i > 0 {
+			time.Sleep(joinThrottlePauseTime + time.Duration(rand.Int63n(int64(joinThrottlePauseTime))))
+		}
+		err = n.call(assist, "ChordNode.RequestJoin", JoinRequest{Addr: n.addr, Token: token}, &grant)
+		if err == nil || err.Error() != ErrJoinThrottled.Error() {
+			break
+		}
+	}
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.requestAdmission", "ChordNode.RequestJoin", err)
+		if isTransportError(err) {
+			return NULL, ErrUnavailable
+		}
+		if err.Error() == ErrJoinThrottled.Error() {
+			return NULL, ErrJoinThrottled
+		}
+		if err.Error() == ErrRingFrozen.Error() {
+			return NULL, ErrRingFrozen
+		}
+		return NULL, ErrNotAdmitted
+	}
+	if grant.Options.enabled() {
+		a.lock.Lock()
+		a.options = grant.Options
+		a.enabled = true
+		a.ticket = grant.Ticket
+		a.lock.Unlock()
+	}
+	return grant.Successor, nil
+}
+
+func (n *ChordNode) presentTicket(suc string) {
+	n.admission.lock.Lock()
+	ticket := n.admission.ticket
+	n.admission.lock.Unlock()
+	if ticket == NULL || suc == n.addr {
+		return
+	}
+	err := n.call(suc, "ChordNode.PresentTicket", AdmissionTicket{Addr: n.addr, Ticket: ticket}, nil)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.presentTicket", "ChordNode.PresentTicket", err)
+	}
+}
+
+func (n *ChordNode) admissionStatus() AdmissionStatus {
+	a := &n.admission
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var ret AdmissionStatus
+	for addr := range a.pending {
+		ret.Pending = append(ret.Pending, addr)
+	}
+	for addr := range a.admitted {
+		ret.Admitted = append(ret.Admitted, addr)
+	}
+	return ret
+}
+
+func (n *ChordNode) approve(addr string) {
+	a := &n.admission
+	a.lock.Lock()
+	if a.approved == nil {
+		a.approved = make(map[string]bool)
+	}
+	a.approved[addr] = true
+	delete(a.pending, addr)
+	a.lock.Unlock()
+	n.maintenanceLog().Infof("Operator approves join of [%v] on node [%v].", addr, n.addr)
+}
+
+func (n *ChordNode) serveAdmission(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.admissionStatus())
+}
+
+func (n *ChordNode) serveApprove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "approve needs POST", http.StatusMethodNotAllowed)
+		return
+	}
+	addr := r.URL.Query().Get("addr")
+	if addr == NULL {
+		http.Error(w, "missing addr", http.StatusBadRequest)
+		return
+	}
+	n.approve(addr)
+	writeJSON(w, n.admissionStatus())
+}
+
+func (o AdmissionOptions) enabled() bool {
+	return len(o.Allowlist) > 0 || o.Token != NULL || o.RequireApproval
+}
+
+// SetAdmission turns admission control on for the node creating the ring;
+// members joining through it take the options over. Token and approval
+// policies need a Secret so that the other members can check the tickets.
+func (w *NodeWrapper) SetAdmission(options AdmissionOptions) bool {
+	if (options.Token != NULL || options.RequireApproval) && options.Secret == NULL {
+		w.node.log().Errorf("Admission by token or approval needs a secret.")
+		return false
+	}
+	a := &w.node.admission
+	a.lock.Lock()
+	a.options = options
+	a.enabled = options.enabled()
+	if options.Secret != NULL {
+		a.ticket = a.sign(w.node.addr)
+	}
+	a.lock.Unlock()
+	return true
+}
+
+// SetJoinToken sets the token this node presents when asking to join.
+func (w *NodeWrapper) SetJoinToken(token string) {
+	w.node.admission.lock.Lock()
+	w.node.admission.token = token
+	w.node.admission.lock.Unlock()
+}
+
+func (w *NodeWrapper) Approve(addr string) {
+	w.node.approve(addr)
+}
@@ -0,0 +1,203 @@
+package chord
+
+import (
+	"math"
+	"math/big"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Aggregates are ring-wide totals as estimated by gossip, so they are
+// approximate and lag behind the ring by an epoch or two.
+type Aggregates struct {
+	Nodes int64
+	Keys  int64
+	Bytes int64
+	// Epoch is the gossip epoch the estimate comes from, and At when it
+	// ended here. An epoch of zero means no estimate yet.
+	Epoch uint64
+	At    time.Time
+}
+
+// AggregateShare is the part of a node's push-sum mass sent to a peer.
+type AggregateShare struct {
+	Epoch  uint64
+	Value  [3]float64
+	Weight float64
+}
+
+// aggregator runs push-sum: every round a node keeps half of its value and
+// weight and pushes the other half to a random peer. Values start as the
+// node's own counts, and weight starts at one on the node owning identifier
+// zero and nothing elsewhere, so value over weight converges to the totals
+// on every node. The owner of zero opens a new epoch every
+// aggregateEpochRounds rounds; a node that hears of a newer epoch takes its
+// estimate from the one it was in and starts again from its own counts.
+type aggregator struct {
+	lock     sync.Mutex
+	epoch    uint64
+	rounds   int
+	value    [3]float64
+	weight   float64
+	estimate Aggregates
+}
+
+func (a *aggregator) finishLocked() {
+	if a.epoch == 0 || a.weight <= 0 {
+		return
+	}
+	round := func(v float64) int64 { return int64(math.Round(v / a.weight)) }
+	a.estimate = Aggregates{
+		Nodes: round(a.value[0]),
+		Keys:  round(a.value[1]),
+		Bytes: round(a.value[2]),
+		Epoch: a.epoch,
+		At:    time.Now(),
+	}
+}
+
+func (a *aggregator) startLocked(epoch uint64, own [3]float64, initiator bool) {
+	a.epoch = epoch
+	a.rounds = 0
+	a.value = own
+	a.weight = 0
+	if initiator {
+		a.weight = 1
+	}
+}
+
+func (a *aggregator) get() Aggregates {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.estimate
+}
+
+// ownCounts returns this node's share of the totals: itself, and the keys and
+// bytes of its store.
+func (n *ChordNode) ownCounts() [3]float64 {
+	var bytes int
+	n.storeLock.RLock()
+	keys := n.store.Size()
+	n.store.Iterate(func(k, v string) bool {
+		bytes += len(k) + len(v)
+		return true
+	})
+	n.storeLock.RUnlock()
+	return [3]float64{1, float64(keys), float64(bytes)}
+}
+
+// ownsZero tells whether identifier zero falls in this node's range.
+func (n *ChordNode) ownsZero() bool {
+	var pre string
+	_ = n.GetPredecessor(NULL, &pre)
+	return pre == NULL || pre == n.addr || within(new(big.Int), NodeId(pre), NodeId(n.addr), true)
+}
+
+// gossipPeer picks a random live peer from the finger table and the
+// successor list.
+func (n *ChordNode) gossipPeer() string {
+	n.fingerLock.RLock()
+	fingers := n.fingerTable
+	n.fingerLock.RUnlock()
+	n.sucLock.RLock()
+	list := n.successorList
+	n.sucLock.RUnlock()
+	candidates := append(fingers[:], list[:]...)
+	seen := make(map[string]bool)
+	var peers []string
+	for _, addr := range candidates {
+		if addr == NULL || addr == n.addr || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		if !n.peers.blacklisted(addr) && n.alive(addr) {
+			peers = append(peers, addr)
+		}
+	}
+	if len(peers) == 0 {
+		return NULL
+	}
+	return peers[rand.Intn(len(peers))]
+}
+
+// gossipAggregate runs one round of push-sum.
+func (n *ChordNode) gossipAggregate() {
+	a := &n.aggregator
+	initiator := n.ownsZero()
+	a.lock.Lock()
+	if initiator && (a.epoch == 0 || a.rounds >= aggregateEpochRounds) {
+		a.finishLocked()
+		epoch := a.epoch + 1
+		a.lock.Unlock()
+		own := n.ownCounts()
+		a.lock.Lock()
+		if a.epoch < epoch {
+			a.startLocked(epoch, own, true)
+		}
+	}
+	a.rounds++
+	if a.epoch == 0 {
+		a.lock.Unlock()
+		return
+	}
+	peer := n.gossipPeer()
+	if peer == NULL {
+		// Alone on the ring: the own counts are the totals.
+		a.finishLocked()
+		a.lock.Unlock()
+		return
+	}
+	share := AggregateShare{Epoch: a.epoch, Weight: a.weight / 2}
+	for i := range a.value {
+		share.Value[i] = a.value[i] / 2
+		a.value[i] -= share.Value[i]
+	}
+	a.weight -= share.Weight
+	a.lock.Unlock()
+	if err := n.call(peer, "ChordNode.GossipAggregate", share, nil); err != nil {
+		n.logErrorFunctionCall(peer, "ChordNode.gossipAggregate", "ChordNode.GossipAggregate", err)
+		// Mass that did not arrive comes back, or the totals would drift.
+		n.mergeAggregate(share, false)
+	}
+}
+
+func (n *ChordNode) mergeAggregate(share AggregateShare, remote bool) {
+	a := &n.aggregator
+	a.lock.Lock()
+	if remote && share.Epoch > a.epoch {
+		a.finishLocked()
+		a.lock.Unlock()
+		own := n.ownCounts()
+		a.lock.Lock()
+		if share.Epoch > a.epoch {
+			a.startLocked(share.Epoch, own, false)
+		}
+	}
+	defer a.lock.Unlock()
+	// Mass of a finished epoch no longer counts anywhere.
+	if share.Epoch != a.epoch {
+		return
+	}
+	for i := range a.value {
+		a.value[i] += share.Value[i]
+	}
+	a.weight += share.Weight
+}
+
+// GossipAggregate takes a share of a peer's push-sum mass.
+func (n *ChordNode) GossipAggregate(share AggregateShare, _ *struct{}) error {
+	n.mergeAggregate(share, true)
+	return nil
+}
+
+func (n *ChordNode) serveAggregates(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.aggregator.get())
+}
+
+// Aggregates returns this node's latest estimate of the ring-wide node, key
+// and byte counts, without contacting any other node.
+func (w *NodeWrapper) Aggregates() Aggregates {
+	return w.node.aggregator.get()
+}
@@ -0,0 +1,305 @@
+package chord
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+type AuditReport struct {
+	Time time.Time
+	// Misplaced keys are in this node's store although its range does not
+	// cover them.
+	Misplaced []string
+	// Orphaned keys are in the pre backup although the predecessor's range
+	// does not cover them, so no primary backs them up through this node.
+	Orphaned []string
+	// Backup compares this node's range with its copy in the successor's pre
+	// backup.
+	Backup   BackupComparison
+	Repaired int
+}
+
+// BackupDigest is the digest of every key of Owner's range, (From, Owner].
+type BackupDigest struct {
+	Owner   string
+	From    string
+	Digests map[string]uint64
+}
+
+// BackupComparison tells how a pre backup differs from the range it copies.
+type BackupComparison struct {
+	Successor string
+	Keys      int
+	// Missing keys are in the store but not in the backup, Stale ones hold
+	// another value there, and Extra ones are only in the backup.
+	Missing []string
+	Stale   []string
+	Extra   []string
+	Error   string
+}
+
+func (c BackupComparison) diverged() int {
+	return len(c.Missing) + len(c.Stale) + len(c.Extra)
+}
+
+type auditState struct {
+	lock     sync.Mutex
+	interval time.Duration
+	repair   bool
+	last     time.Time
+	report   AuditReport
+}
+
+func (n *ChordNode) audit(repair bool) AuditReport {
+	n.replicationLog().Infof("Start auditing node [%v]'s store and pre backup.", n.addr)
+	report := AuditReport{Time: time.Now()}
+	n.preLock.RLock()
+	pre, prePre := n.predecessor, n.predecessorList[1]
+	n.preLock.RUnlock()
+	if pre == NULL {
+		return report
+	}
+	misplaced := make(map[string]string)
+	n.storeLock.RLock()
+	n.store.Iterate(func(k, v string) bool {
+		if !within(n.keyId(k), NodeId(pre), NodeId(n.addr), true) && !n.hosts(k) {
+			misplaced[k] = v
+			report.Misplaced = append(report.Misplaced, k)
+		}
+		return true
+	})
+	n.storeLock.RUnlock()
+	orphaned := make(map[string]string)
+	if prePre != NULL {
+		adopted := n.hostedBy(pre)
+		n.preBackupLock.RLock()
+		n.preBackup.Iterate(func(k, v string) bool {
+			if !within(n.keyId(k), NodeId(prePre), NodeId(pre), true) && !adopted(k) && !n.hosts(k) && !n.tombstones.has(k) {
+				orphaned[k] = v
+				report.Orphaned = append(report.Orphaned, k)
+			}
+			return true
+		})
+		n.preBackupLock.RUnlock()
+	}
+	if _, ok := n.replicator.(successorReplicator); ok {
+		report.Backup = n.compareBackup(pre)
+	}
+	if repair {
+		report.Repaired = n.repairMisplaced(misplaced) + n.repairOrphaned(orphaned) + n.repairBackup(report.Backup)
+	}
+	if diverged := report.Backup.diverged(); len(report.Misplaced)+len(report.Orphaned)+diverged > 0 {
+		n.replicationLog().Errorf("Audit of node [%v] found %v misplaced and %v orphaned keys and %v keys its backup differs in, repaired %v.", n.addr, len(report.Misplaced), len(report.Orphaned), diverged, report.Repaired)
+	}
+	n.auditor.lock.Lock()
+	n.auditor.last = report.Time
+	n.auditor.report = report
+	n.auditor.lock.Unlock()
+	return report
+}
+
+// hostedBy tells the keys in the ranges migrated onto addr, whose backups
+// this node keeps as well. A node that cannot be asked hosts none, so its
+// keys out of range still read as orphaned.
+func (n *ChordNode) hostedBy(addr string) func(key string) bool {
+	var hosted []Migration
+	if err := n.call(addr, "ChordNode.HostedRanges", NULL, &hosted); err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.hostedBy", "ChordNode.HostedRanges", err)
+	}
+	ranges := make([]keyRange, 0, len(hosted))
+	for _, m := range hosted {
+		if r, err := parseKeyRange(m); err == nil {
+			ranges = append(ranges, r)
+		}
+	}
+	return func(key string) bool {
+		for _, r := range ranges {
+			if r.contains(n.keyId(key)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// compareBackup has the successor check its pre backup against the digests
+// of this node's range. Writes whose backup is still on the way show up as
+// divergence too; a repair sends what the store holds by then.
+func (n *ChordNode) compareBackup(pre string) BackupComparison {
+	var ret BackupComparison
+	if err := n.FirstAvailableSuccessor(NULL, &ret.Successor); err != nil || ret.Successor == n.addr {
+		return ret
+	}
+	req := BackupDigest{Owner: n.addr, From: pre, Digests: make(map[string]uint64)}
+	n.storeLock.RLock()
+	n.store.Iterate(func(k, v string) bool {
+		if within(n.keyId(k), NodeId(pre), NodeId(n.addr), true) {
+			req.Digests[k] = digest(v)
+		}
+		return true
+	})
+	n.storeLock.RUnlock()
+	if err := n.call(ret.Successor, "ChordNode.CompareBackup", req, &ret); err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.compareBackup", "ChordNode.CompareBackup", err)
+		ret.Error = err.Error()
+	}
+	ret.Keys = len(req.Digests)
+	n.replication.backupAudited(ret.diverged())
+	return ret
+}
+
+// CompareBackup tells how the pre backup differs from the range of the
+// predecessor whose digests req holds.
+func (n *ChordNode) CompareBackup(req BackupDigest, ret *BackupComparison) error {
+	if !n.admits(req.Owner) {
+		return ErrNotAdmitted
+	}
+	n.preBackupLock.RLock()
+	defer n.preBackupLock.RUnlock()
+	for k, d := range req.Digests {
+		if v, ok := n.preBackup.Get(k); !ok {
+			ret.Missing = append(ret.Missing, k)
+		} else if digest(v) != d {
+			ret.Stale = append(ret.Stale, k)
+		}
+	}
+	n.preBackup.Iterate(func(k, _ string) bool {
+		if _, ok := req.Digests[k]; !ok && within(n.keyId(k), NodeId(req.From), NodeId(req.Owner), true) {
+			ret.Extra = append(ret.Extra, k)
+		}
+		return true
+	})
+	return nil
+}
+
+// repairBackup sends the successor the current value of every key its backup
+// lacks or holds another value of, and has it drop the extra keys the store
+// still does not hold. A CRDT the backup holds another value of is merged
+// from it first.
+func (n *ChordNode) repairBackup(c BackupComparison) int {
+	if c.Error != NULL || c.diverged() == 0 {
+		return 0
+	}
+	pulled := n.pullBackupCRDTs(c.Successor, c.Stale)
+	data := make(map[string]string)
+	var removed []string
+	n.storeLock.RLock()
+	for _, k := range append(append([]string(nil), c.Missing...), c.Stale...) {
+		if pulled[k] {
+			continue
+		}
+		if v, ok := n.store.Get(k); ok {
+			data[k] = v
+		}
+	}
+	for _, k := range c.Extra {
+		if _, ok := n.store.Get(k); !ok {
+			removed = append(removed, k)
+		}
+	}
+	n.storeLock.RUnlock()
+	repaired := len(pulled)
+	if len(data) > 0 {
+		if err := n.appendPreBackup(c.Successor, &BackupBatch{Owner: n.addr, Data: data}); err != nil {
+			n.logErrorFunctionCall(n.addr, "ChordNode.repairBackup", "ChordNode.AppendPreBackup", err)
+		} else {
+			repaired += len(data)
+		}
+	}
+	if len(removed) > 0 {
+		if err := n.call(c.Successor, "ChordNode.DeleteManyInPreBackup", removed, nil); err != nil {
+			n.logErrorFunctionCall(n.addr, "ChordNode.repairBackup", "ChordNode.DeleteManyInPreBackup", err)
+		} else {
+			repaired += len(removed)
+		}
+	}
+	return repaired
+}
+
+// repairMisplaced routes each misplaced key to its owner and only then drops
+// the local copy, unless the store changed underneath.
+func (n *ChordNode) repairMisplaced(misplaced map[string]string) int {
+	repaired := 0
+	for k, v := range misplaced {
+		var tar string
+		if n.FindSuccessor(n.keyId(k), &tar) != nil || tar == n.addr {
+			continue
+		}
+		if n.call(tar, "ChordNode.PutAcceptedInStore", Pair{First: k, Second: v}, nil) != nil {
+			continue
+		}
+		n.storeLock.Lock()
+		if cur, ok := n.store.Get(k); ok && cur == v {
+			n.storeDelete(n.store, k, "ChordNode.repairMisplaced")
+			delete(n.meta, k)
+		}
+		n.storeLock.Unlock()
+		repaired++
+	}
+	return repaired
+}
+
+// repairOrphaned hands each orphaned entry to the key's owner if the owner has
+// lost it. A key the owner deleted within tombstoneTTL stays deleted; one
+// deleted longer ago than that comes back this way.
+func (n *ChordNode) repairOrphaned(orphaned map[string]string) int {
+	repaired := 0
+	for k, v := range orphaned {
+		var tar string
+		if n.FindSuccessor(n.keyId(k), &tar) != nil {
+			continue
+		}
+		if n.call(tar, "ChordNode.AdoptOrphanInStore", Pair{First: k, Second: v}, nil) != nil {
+			continue
+		}
+		n.preBackupLock.Lock()
+		n.backupDelete(k, "ChordNode.repairOrphaned")
+		n.preBackupLock.Unlock()
+		repaired++
+	}
+	return repaired
+}
+
+// AdoptOrphanInStore takes a backup copy of a key found backed up by no
+// owner, unless the store holds the key already or deleted it lately.
+func (n *ChordNode) AdoptOrphanInStore(kv Pair, ack *AckLevel) error {
+	if target, ok := n.migratedTo(kv.First); ok {
+		return n.call(target, "ChordNode.AdoptOrphanInStore", kv, ack)
+	}
+	if n.tombstones.has(kv.First) {
+		return nil
+	}
+	err := n.putInStore(kv, true, ack)
+	if err == errKeyExists {
+		return nil
+	}
+	if err == nil {
+		// As putAccepted, but only for a copy the store took.
+		if err := n.cache.write(cacheWrite{key: kv.First, value: kv.Second}); err != nil {
+			n.logErrorFunctionCall(n.addr, "ChordNode.AdoptOrphanInStore", "CacheSource.Store", err)
+		}
+		n.touchCached(kv.First)
+	}
+	return err
+}
+
+func (n *ChordNode) auditIfDue() {
+	n.auditor.lock.Lock()
+	interval, repair, last := n.auditor.interval, n.auditor.repair, n.auditor.last
+	n.auditor.lock.Unlock()
+	if interval > 0 && time.Since(last) >= interval && !n.deferring() {
+		n.audit(repair)
+	}
+}
+
+func (n *ChordNode) serveAudit(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("run") == NULL {
+		n.auditor.lock.Lock()
+		report := n.auditor.report
+		n.auditor.lock.Unlock()
+		writeJSON(w, report)
+		return
+	}
+	writeJSON(w, n.audit(r.URL.Query().Get("repair") == "1"))
+}
@@ -0,0 +1,312 @@
+package chord
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackupOptions schedule backups of a node's store. Backups are JSON lines
+// of pairs, as Export writes them, named by node and time, so that the names
+// of one node sort oldest first.
+type BackupOptions struct {
+	Destination BackupDestination
+	// Interval between backups. Zero turns the schedule off; BackupNow still
+	// takes one on demand.
+	Interval time.Duration
+	// PrimaryOnly leaves out keys the node holds outside its own range.
+	PrimaryOnly bool
+	// Keep is how many of the node's newest backups survive each backup, and
+	// MaxAge how old they may get. Zero keeps them all.
+	Keep   int
+	MaxAge time.Duration
+	// Journal also records every write the node takes as owner and ships
+	// the records along with the backups, so RestoreRangeAt can go back to
+	// any time after the oldest backup kept.
+	Journal bool
+}
+
+type BackupStatus struct {
+	Last  string
+	At    time.Time
+	Keys  int
+	Error string
+}
+
+type backupState struct {
+	lock       sync.Mutex
+	options    BackupOptions
+	running    bool
+	tried      time.Time
+	status     BackupStatus
+	journaling int32
+	journal    []JournalRecord
+	shipped    time.Time
+}
+
+// ErrNoBackup: Restore found no backup to restore from.
+var ErrNoBackup = errors.New("no backup")
+
+const backupTimeLayout = "20060102T150405.000Z"
+
+func backupDir(addr string) string {
+	return "node-" + strings.NewReplacer(":", "_", "/", "_").Replace(addr) + "/"
+}
+
+func backupTime(name string) (time.Time, bool) {
+	t, err := time.Parse(backupTimeLayout, strings.TrimSuffix(path.Base(name), ".jsonl"))
+	return t, err == nil
+}
+
+// primaryData returns a copy of the store, or of the part of it in this
+// node's range.
+func (n *ChordNode) primaryData(primaryOnly bool) map[string]string {
+	var pre string
+	_ = n.GetPredecessor(NULL, &pre)
+	n.storeLock.RLock()
+	defer n.storeLock.RUnlock()
+	data := n.store.Snapshot()
+	if !primaryOnly || pre == NULL {
+		return data
+	}
+	for k := range data {
+		if !within(n.keyId(k), NodeId(pre), NodeId(n.addr), true) && !n.hosts(k) {
+			delete(data, k)
+		}
+	}
+	return data
+}
+
+func (n *ChordNode) backup() (string, error) {
+	b := &n.backups
+	b.lock.Lock()
+	options := b.options
+	if options.Destination == nil {
+		b.lock.Unlock()
+		return NULL, errors.New("no backup destination")
+	}
+	if b.running {
+		b.lock.Unlock()
+		return NULL, errors.New("a backup is running")
+	}
+	now := time.Now().UTC()
+	b.running = true
+	b.tried = now
+	b.lock.Unlock()
+	name := backupDir(n.addr) + now.Format(backupTimeLayout) + ".jsonl"
+	data := n.primaryData(options.PrimaryOnly)
+	n.storageLog().Infof("Start backing node [%v]'s %v keys up to [%v].", n.addr, len(data), name)
+	r, w := io.Pipe()
+	go func() {
+		enc := json.NewEncoder(w)
+		for k, v := range data {
+			if err := enc.Encode(Pair{First: k, Second: v}); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		_ = w.Close()
+	}()
+	err := options.Destination.Put(name, r)
+	_ = r.Close()
+	if err == nil {
+		n.expireBackups(options, now)
+	} else {
+		n.logErrorFunctionCall(n.addr, "ChordNode.backup", "BackupDestination.Put", err)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.running = false
+	if err != nil {
+		b.status.Error = err.Error()
+		return NULL, err
+	}
+	b.status = BackupStatus{Last: name, At: now, Keys: len(data)}
+	return name, nil
+}
+
+// expireBackups applies the retention policy to this node's backups, and
+// drops the journal segments older than the oldest backup left, which no
+// restore can start from.
+func (n *ChordNode) expireBackups(options BackupOptions, now time.Time) {
+	if options.Keep <= 0 && options.MaxAge <= 0 {
+		return
+	}
+	names, err := options.Destination.List(backupDir(n.addr))
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.expireBackups", "BackupDestination.List", err)
+		return
+	}
+	var snapshots, journals []string
+	for _, name := range names {
+		if _, ok := backupTime(name); ok {
+			snapshots = append(snapshots, name)
+		} else if _, _, ok = journalSpan(name); ok {
+			journals = append(journals, name)
+		}
+	}
+	sort.Strings(snapshots)
+	var oldest time.Time
+	for i, name := range snapshots {
+		t, _ := backupTime(name)
+		tooMany := options.Keep > 0 && i < len(snapshots)-options.Keep
+		tooOld := options.MaxAge > 0 && now.Sub(t) > options.MaxAge
+		if !tooMany && !tooOld {
+			if oldest.IsZero() {
+				oldest = t
+			}
+			continue
+		}
+		n.deleteBackup(options.Destination, name)
+	}
+	for _, name := range journals {
+		if _, to, _ := journalSpan(name); to.Before(oldest) {
+			n.deleteBackup(options.Destination, name)
+		}
+	}
+}
+
+func (n *ChordNode) deleteBackup(dest BackupDestination, name string) {
+	if err := dest.Delete(name); err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.expireBackups", "BackupDestination.Delete", err)
+	}
+}
+
+func (n *ChordNode) backupIfDue() {
+	n.backups.lock.Lock()
+	interval, tried := n.backups.options.Interval, n.backups.tried
+	n.backups.lock.Unlock()
+	if atomic.LoadInt32(&n.backups.journaling) != 0 {
+		n.shipJournalIfDue()
+	}
+	if interval > 0 && time.Since(tried) >= interval && !n.deferring() {
+		_, _ = n.backup()
+	}
+}
+
+// LatestBackups returns the newest backup of every node in dest.
+func LatestBackups(dest BackupDestination) ([]string, error) {
+	names, err := dest.List("node-")
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]string)
+	for _, name := range names {
+		if _, ok := backupTime(name); !ok {
+			continue
+		}
+		dir := path.Dir(name)
+		if name > latest[dir] {
+			latest[dir] = name
+		}
+	}
+	ret := make([]string, 0, len(latest))
+	for _, name := range latest {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// readBackups reads the named backups, or the newest of every node if none
+// are named, into one data set. A key in several of them, as in the backups
+// of nodes that took turns owning it, keeps the value of the newest backup.
+func readBackups(dest BackupDestination, names []string) (map[string]string, error) {
+	if len(names) == 0 {
+		var err error
+		if names, err = LatestBackups(dest); err != nil {
+			return nil, err
+		}
+	}
+	if len(names) == 0 {
+		return nil, ErrNoBackup
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ti, _ := backupTime(names[i])
+		tj, _ := backupTime(names[j])
+		return ti.Before(tj)
+	})
+	data := make(map[string]string)
+	for _, name := range names {
+		f, err := dest.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bufio.NewReader(f))
+		for {
+			var kv Pair
+			if err = dec.Decode(&kv); err != nil {
+				break
+			}
+			data[kv.First] = kv.Second
+		}
+		_ = f.Close()
+		if err != io.EOF {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// RestoreBackup writes the named backups, or the newest of every node if
+// none are named, into the ring addr is on, through addr. It returns the
+// number of keys written.
+func RestoreBackup(addr string, codec Codec, dest BackupDestination, names ...string) (int, error) {
+	data, err := readBackups(dest, names)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), RPCCallWithCodec(addr, codec, "ChordNode.LeafBulkLoad", &data, nil)
+}
+
+func (n *ChordNode) serveBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if _, err := n.backup(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	n.backups.lock.Lock()
+	status := n.backups.status
+	n.backups.lock.Unlock()
+	writeJSON(w, status)
+}
+
+// SetBackup schedules backups of the node's store to options.Destination.
+func (w *NodeWrapper) SetBackup(options BackupOptions) {
+	w.node.backups.lock.Lock()
+	w.node.backups.options = options
+	journaling := int32(0)
+	if options.Journal && options.Destination != nil {
+		journaling = 1
+	}
+	atomic.StoreInt32(&w.node.backups.journaling, journaling)
+	w.node.backups.lock.Unlock()
+}
+
+// BackupNow backs the node's store up and returns the backup's name.
+func (w *NodeWrapper) BackupNow() (string, error) {
+	return w.node.backup()
+}
+
+// Restore writes the named backups, or the newest of every node if none are
+// named, into the ring through this node, and returns the number of keys
+// written.
+func (w *NodeWrapper) Restore(dest BackupDestination, names ...string) (int, error) {
+	data, err := readBackups(dest, names)
+	if err != nil {
+		return 0, err
+	}
+	if !w.node.bulkLoad(data) {
+		return len(data), ErrUnavailable
+	}
+	return len(data), nil
+}
@@ -0,0 +1,315 @@
+package chord
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupDestination is where backups are kept. Names are slash separated
+// paths relative to the destination.
+type BackupDestination interface {
+	Put(name string, r io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	// List returns the names under prefix, in any order.
+	List(prefix string) ([]string, error)
+	Delete(name string) error
+}
+
+// OpenBackupDestination opens a destination from a location: a directory
+// path or file:// URL, or s3://bucket/prefix for an S3-compatible endpoint.
+// S3 locations take the endpoint from the endpoint query parameter, AWS by
+// default, speak plain HTTP with insecure=1, and sign with the credentials
+// and region in AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_REGION.
+func OpenBackupDestination(location string) (BackupDestination, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme == "" {
+		return &FileDestination{Dir: location}, nil
+	}
+	switch u.Scheme {
+	case "file":
+		return &FileDestination{Dir: u.Path}, nil
+	case "s3":
+		d := &S3Destination{
+			Endpoint:  u.Query().Get("endpoint"),
+			Bucket:    u.Host,
+			Prefix:    strings.Trim(u.Path, "/"),
+			Insecure:  u.Query().Get("insecure") == "1",
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Region:    os.Getenv("AWS_REGION"),
+		}
+		if d.Bucket == "" {
+			return nil, errors.New("s3 location without a bucket")
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("unknown backup location scheme %v", u.Scheme)
+}
+
+// FileDestination keeps backups as files under Dir.
+type FileDestination struct {
+	Dir string
+}
+
+func (d *FileDestination) path(name string) string {
+	return filepath.Join(d.Dir, filepath.FromSlash(name))
+}
+
+// Put writes to a temporary file first, so a backup cut short never shows up
+// under its name.
+func (d *FileDestination) Put(name string, r io.Reader) error {
+	p := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".backup-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+func (d *FileDestination) Get(name string) (io.ReadCloser, error) {
+	return os.Open(d.path(name))
+}
+
+func (d *FileDestination) List(prefix string) ([]string, error) {
+	var ret []string
+	err := filepath.Walk(d.Dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.Dir, p)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			ret = append(ret, name)
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func (d *FileDestination) Delete(name string) error {
+	return os.Remove(d.path(name))
+}
+
+// S3Destination keeps backups as objects under Prefix in Bucket, addressed
+// path-style so that any S3-compatible endpoint works. Requests are signed
+// with signature version 4.
+type S3Destination struct {
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Insecure  bool
+	AccessKey string
+	SecretKey string
+	Region    string
+	Client    *http.Client
+}
+
+func (d *S3Destination) key(name string) string {
+	if d.Prefix == "" {
+		return name
+	}
+	return d.Prefix + "/" + name
+}
+
+func (d *S3Destination) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	endpoint, region := d.Endpoint, d.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = "s3." + region + ".amazonaws.com"
+	}
+	scheme := "https"
+	if d.Insecure {
+		scheme = "http"
+	}
+	path := "/" + d.Bucket
+	if key != "" {
+		path += "/" + s3Escape(key, false)
+	}
+	rawQuery := s3Query(query)
+	req, err := http.NewRequest(method, scheme+"://"+endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawPath = path
+	req.URL.RawQuery = rawQuery
+	now := time.Now().UTC()
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	date := now.Format("20060102T150405Z")
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", date)
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		method,
+		path,
+		rawQuery,
+		"host:" + endpoint + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + date + "\n",
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := now.Format("20060102") + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	signingKey := []byte("AWS4" + d.SecretKey)
+	for _, part := range strings.Split(scope, "/") {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", d.AccessKey, scope, signed, signature))
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("s3 %v %v: %v: %s", method, key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape encodes s the way signature version 4 expects: everything but
+// unreserved characters, and slashes too unless they separate the path.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Put reads the whole backup first: the payload is signed, and S3 wants its
+// length up front.
+func (d *S3Destination) Put(name string, r io.Reader) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	resp, err := d.do(http.MethodPut, d.key(name), nil, body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (d *S3Destination) Get(name string) (io.ReadCloser, error) {
+	resp, err := d.do(http.MethodGet, d.key(name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (d *S3Destination) List(prefix string) ([]string, error) {
+	var ret []string
+	query := url.Values{"list-type": {"2"}, "prefix": {d.key(prefix)}}
+	for {
+		resp, err := d.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			name := c.Key
+			if d.Prefix != "" {
+				name = strings.TrimPrefix(name, d.Prefix+"/")
+			}
+			ret = append(ret, name)
+		}
+		if !result.IsTruncated {
+			return ret, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (d *S3Destination) Delete(name string) error {
+	resp, err := d.do(http.MethodDelete, d.key(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,281 @@
+package chord
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// errNotOwner: A batched write reached a node that does not own the key,
+	// its range having moved since the writer placed it.
+	errNotOwner = errors.New("not the key's owner")
+	// ErrWriterClosed: The batch writer was closed before the write.
+	ErrWriterClosed = errors.New("batch writer closed")
+)
+
+// MultiPutResult has a failure for each pair of a batch not written.
+type MultiPutResult struct {
+	Failures []KeyFailure
+}
+
+// ownsKey tells whether this node's range, or a range migrated onto it, has
+// key. A node without a predecessor takes itself for the owner, as lookups
+// do.
+func (n *ChordNode) ownsKey(key string) bool {
+	var pre string
+	_ = n.GetPredecessor(NULL, &pre)
+	return pre == NULL || within(n.keyId(key), NodeId(pre), NodeId(n.addr), true) || n.hosts(key)
+}
+
+// PutManyInStore writes each pair of batch as PutInStore does, but only if
+// this node owns the key, so that a writer that placed the keys a while ago
+// never leaves one on a node that lookups no longer lead to.
+func (n *ChordNode) PutManyInStore(batch map[string]string, ret *MultiPutResult) error {
+	n.storageLog().Infof("Put %v k-v pairs to node [%v]'s store.", len(batch), n.addr)
+	*ret = MultiPutResult{}
+	for k, v := range batch {
+		if !n.ownsKey(k) {
+			ret.Failures = append(ret.Failures, KeyFailure{Key: k, Owner: n.addr, Cause: errNotOwner.Error()})
+			continue
+		}
+		var ack AckLevel
+		if err := n.PutInStore(Pair{First: k, Second: v}, &ack); err != nil {
+			ret.Failures = append(ret.Failures, KeyFailure{Key: k, Owner: n.addr, Cause: err.Error()})
+		}
+	}
+	return nil
+}
+
+// BatchWriterOptions bound a batch writer: it flushes once MaxBatch writes
+// wait, or FlushInterval after the first of them. Zero means clientBatchLen
+// and clientBatchFlushTime.
+type BatchWriterOptions struct {
+	MaxBatch      int
+	FlushInterval time.Duration
+}
+
+type batchedWrite struct {
+	key   string
+	value string
+	done  func(err error)
+}
+
+// A BatchWriter puts keys through a client asynchronously. It groups the
+// writes waiting by the node that would store them, as WhereWouldItGo tells,
+// and sends each node its writes with one call. A write that its node turns
+// away, the key having moved, or whose node does not answer, is put again the
+// usual way. Batches go out one at a time, so of two writes of a key the
+// later always lands last.
+type BatchWriter struct {
+	c       *Client
+	options BatchWriterOptions
+	lock    sync.Mutex
+	pending []batchedWrite
+	closed  bool
+	kick    chan struct{}
+	flushes chan chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewBatchWriter returns a writer putting keys through c, flushing in the
+// background until it is closed.
+func (c *Client) NewBatchWriter(options BatchWriterOptions) *BatchWriter {
+	if options.MaxBatch <= 0 {
+		options.MaxBatch = clientBatchLen
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = clientBatchFlushTime
+	}
+	w := &BatchWriter{
+		c:       c,
+		options: options,
+		kick:    make(chan struct{}, 1),
+		flushes: make(chan chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Put queues a write of key, and done, if not nil, is called with its
+// outcome once it is made. Callbacks run on the writer's goroutine, one at a
+// time, and must not call Flush or Close.
+func (w *BatchWriter) Put(key, value string, done func(err error)) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.pending = append(w.pending, batchedWrite{key: key, value: value, done: done})
+	if len(w.pending) >= w.options.MaxBatch {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Flush makes the writes queued so far and waits for them.
+func (w *BatchWriter) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case w.flushes <- flushed:
+		<-flushed
+	case <-w.done:
+	}
+}
+
+// Close makes the writes queued and stops the writer. Later puts fail with
+// ErrWriterClosed.
+func (w *BatchWriter) Close() {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		<-w.done
+		return
+	}
+	w.closed = true
+	w.lock.Unlock()
+	close(w.stop)
+	<-w.done
+}
+
+func (w *BatchWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.options.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.flush()
+		case <-w.kick:
+			w.flush()
+		case flushed := <-w.flushes:
+			w.flush()
+			close(flushed)
+		case <-w.stop:
+			w.flush()
+			return
+		}
+	}
+}
+
+func (w *BatchWriter) flush() {
+	for {
+		w.lock.Lock()
+		writes := w.pending
+		if len(writes) > w.options.MaxBatch {
+			writes = writes[:w.options.MaxBatch]
+		}
+		w.pending = w.pending[len(writes):]
+		w.lock.Unlock()
+		if len(writes) == 0 {
+			return
+		}
+		w.send(writes)
+	}
+}
+
+// send makes a batch of writes, the last of each key's, and calls back
+// every write of the batch.
+func (w *BatchWriter) send(writes []batchedWrite) {
+	latest := make(map[string]string, len(writes))
+	for _, bw := range writes {
+		latest[bw.key] = bw.value
+	}
+	keys := make([]string, 0, len(latest))
+	for k := range latest {
+		keys = append(keys, k)
+	}
+	w.c.cache.drop(keys)
+	errs := make(map[string]error, len(keys))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for holder, ks := range w.group(keys) {
+		wg.Add(1)
+		go func(holder string, ks []string) {
+			defer wg.Done()
+			failed := w.sendTo(holder, ks, latest)
+			lock.Lock()
+			for k, err := range failed {
+				errs[k] = err
+			}
+			lock.Unlock()
+		}(holder, ks)
+	}
+	wg.Wait()
+	for _, bw := range writes {
+		if bw.done != nil {
+			bw.done(errs[bw.key])
+		}
+	}
+}
+
+// group places keys and groups them by the node that would store them. Keys
+// that could not be placed are grouped under NULL.
+func (w *BatchWriter) group(keys []string) map[string][]string {
+	ret := make(map[string][]string)
+	placements, err := w.c.WhereWouldItGo(keys...)
+	if err != nil || len(placements) != len(keys) {
+		ret[NULL] = keys
+		return ret
+	}
+	for _, p := range placements {
+		holder := p.Holder
+		if p.Error != "" {
+			holder = NULL
+		}
+		ret[holder] = append(ret[holder], p.Key)
+	}
+	return ret
+}
+
+// sendTo writes keys to holder with one call, and the ones it does not take
+// the usual way, returning the errors of those that failed.
+func (w *BatchWriter) sendTo(holder string, keys []string, values map[string]string) map[string]error {
+	if holder == NULL {
+		return w.putEach(keys, values)
+	}
+	batch := make(map[string]string, len(keys))
+	for _, k := range keys {
+		batch[k] = values[k]
+	}
+	var res MultiPutResult
+	err := RPCCallWithCodec(holder, w.c.codec, "ChordNode.PutManyInStore", batch, &res)
+	if isTransportError(err) {
+		return w.putEach(keys, values)
+	}
+	ret := make(map[string]error)
+	if err != nil {
+		for _, k := range keys {
+			ret[k] = classifyError(err)
+		}
+		return ret
+	}
+	var moved []string
+	for _, f := range res.Failures {
+		if f.Cause == errNotOwner.Error() {
+			moved = append(moved, f.Key)
+		} else {
+			ret[f.Key] = f.Err()
+		}
+	}
+	for k, err := range w.putEach(moved, values) {
+		ret[k] = err
+	}
+	return ret
+}
+
+func (w *BatchWriter) putEach(keys []string, values map[string]string) map[string]error {
+	ret := make(map[string]error)
+	for _, k := range keys {
+		if err := w.c.Put(k, values[k]); err != nil {
+			ret[k] = err
+		}
+	}
+	return ret
+}
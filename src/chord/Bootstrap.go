@@ -0,0 +1,170 @@
+package chord
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Membership is a whole ring declared up front: every node bootstrapped
+// from the same membership takes its place on the ring at once, with
+// successors, predecessors and fingers worked out from the list instead of
+// learned through a join.
+type Membership struct {
+	Addrs []string
+}
+
+// ErrNotMember: A node was bootstrapped from a membership that does not
+// list it.
+var ErrNotMember = errors.New("node is not in the membership")
+
+// ParseMembership reads one node per line, as an address optionally
+// followed by its identifier in hex. Identifiers derive from addresses, so
+// one that is given only checks the address it goes with. Blank lines and
+// lines starting with # are skipped.
+func ParseMembership(r io.Reader) (Membership, error) {
+	var ret Membership
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) > 2 {
+			return ret, fmt.Errorf("line %v: want an address and an optional id", line)
+		}
+		addr := fields[0]
+		if len(fields) == 2 {
+			given, ok := new(big.Int).SetString(strings.TrimPrefix(fields[1], "0x"), 16)
+			if !ok {
+				return ret, fmt.Errorf("line %v: bad id %v", line, fields[1])
+			}
+			if given.Cmp(NodeId(addr)) != 0 {
+				return ret, fmt.Errorf("line %v: %v is not the id of %v, which is %x", line, fields[1], addr, NodeId(addr))
+			}
+		}
+		if seen[addr] {
+			return ret, fmt.Errorf("line %v: %v listed twice", line, addr)
+		}
+		seen[addr] = true
+		ret.Addrs = append(ret.Addrs, addr)
+	}
+	if err := scanner.Err(); err != nil {
+		return ret, err
+	}
+	if len(ret.Addrs) == 0 {
+		return ret, errors.New("empty membership")
+	}
+	return ret, nil
+}
+
+// InRingOrder returns the addresses sorted by identifier.
+func (m Membership) InRingOrder() []string {
+	addrs := append([]string(nil), m.Addrs...)
+	sort.Slice(addrs, func(i, j int) bool {
+		return NodeId(addrs[i]).Cmp(NodeId(addrs[j])) < 0
+	})
+	return addrs
+}
+
+func LoadMembership(path string) (Membership, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Membership{}, err
+	}
+	defer file.Close()
+	return ParseMembership(file)
+}
+
+// bootstrap puts the node on the ring m declares. Nodes of m that are not up
+// yet are taken as members all the same; stabilization routes around them
+// like around failed nodes until they come up.
+func (n *ChordNode) bootstrap(m Membership) error {
+	if n.tier == TierLeaf {
+		n.maintenanceLog().Errorf("Trying to bootstrap a leaf.")
+		return ErrNotMember
+	}
+	addrs := m.InRingOrder()
+	self := -1
+	for i, addr := range addrs {
+		if addr == n.addr {
+			self = i
+		}
+	}
+	if self < 0 {
+		n.maintenanceLog().Errorf("Node [%v] is not in the membership it bootstraps from.", n.addr)
+		return ErrNotMember
+	}
+	if _, ok := n.enter(StateJoining, StateCreated, StateOffline); !ok {
+		n.maintenanceLog().Errorf("Trying to bootstrap a joined node.")
+		return ErrAlreadyJoined
+	}
+	n.maintenanceLog().Infof("Node [%v] bootstraps a ring of %v nodes.", n.addr, len(addrs))
+	at := func(offset int) string {
+		return addrs[((self+offset)%len(addrs)+len(addrs))%len(addrs)]
+	}
+	var list [SuccessorListLen]string
+	for i := 0; i < SuccessorListLen && i < len(addrs)-1; i++ {
+		list[i] = at(i + 1)
+	}
+	if len(addrs) == 1 {
+		list[0] = n.addr
+	}
+	var preList [PredecessorListLen]string
+	for i := 0; i < PredecessorListLen && i < len(addrs)-1; i++ {
+		preList[i] = at(-i - 1)
+	}
+	var fingers [M]string
+	nId := NodeId(n.addr)
+	for i := 0; i < M; i++ {
+		tar := start(nId, i)
+		k := sort.Search(len(addrs), func(j int) bool {
+			return NodeId(addrs[j]).Cmp(tar) >= 0
+		})
+		fingers[i] = addrs[k%len(addrs)]
+	}
+	a := &n.admission
+	a.lock.Lock()
+	if a.admitted == nil {
+		a.admitted = make(map[string]bool)
+	}
+	for _, addr := range addrs {
+		a.admitted[addr] = true
+	}
+	a.lock.Unlock()
+	n.accordion.learn(addrs...)
+	n.sucLock.Lock()
+	old := n.successorList[0]
+	n.successorList = list
+	n.sucLock.Unlock()
+	n.fireSuccessorChanged(old, list[0])
+	pre := n.addr
+	if len(addrs) > 1 {
+		pre = preList[0]
+	}
+	_ = n.SetPredecessor(pre, nil)
+	n.preLock.Lock()
+	n.predecessorList = preList
+	n.preLock.Unlock()
+	n.fingerLock.Lock()
+	n.fingerTable = fingers
+	n.fingerLock.Unlock()
+	n.enter(StateOnline, StateJoining)
+	n.maintenanceLog().Infoln("Bootstrap finished.")
+	n.fireJoinComplete(n.addr)
+	return nil
+}
+
+// Bootstrap puts the node on the ring m declares, in place of Create or Join.
+// Every member bootstraps from the same membership, before any keys are
+// written: no data moves.
+func (w *NodeWrapper) Bootstrap(m Membership) error {
+	return w.node.bootstrap(m)
+}
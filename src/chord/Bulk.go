@@ -0,0 +1,221 @@
+package chord
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// bulkBackupTable remembers keys written by BulkPutInStore whose pre backup
+// has been deferred to FinishBulkLoad.
+type bulkBackupTable struct {
+	lock    sync.Mutex
+	pending map[string]struct{}
+}
+
+// BulkPutInStore takes the batch only if no key of it is leased and the
+// write hooks take every pair.
+func (n *ChordNode) BulkPutInStore(batch *map[string]string, _ *string) error {
+	n.storageLog().Infof("Bulk put %v k-v pairs to node [%v]'s store.", len(*batch), n.addr)
+	for k := range *batch {
+		if err := n.keyLeases.admits(k, nil); err != nil {
+			return err
+		}
+	}
+	accepted, err := n.acceptBatch(*batch)
+	if err != nil {
+		return err
+	}
+	n.bulkPut(accepted)
+	return nil
+}
+
+// BulkPutAcceptedInStore is BulkPutInStore for pairs the write hooks took
+// already, those a quitting node hands off.
+func (n *ChordNode) BulkPutAcceptedInStore(batch *map[string]string, _ *string) error {
+	n.storageLog().Infof("Bulk put %v accepted k-v pairs to node [%v]'s store.", len(*batch), n.addr)
+	n.bulkPut(*batch)
+	return nil
+}
+
+func (n *ChordNode) bulkPut(batch map[string]string) {
+	n.storeLock.Lock()
+	for k, v := range batch {
+		n.storePut(n.store, k, v, "ChordNode.BulkPutInStore")
+		n.wroteLocked(k, v)
+		n.tombstones.clear(k)
+	}
+	at := time.Now()
+	n.storeLock.Unlock()
+	for k, v := range batch {
+		n.journal(at, k, v, false)
+		n.watchers.fire(k)
+	}
+	n.bulk.lock.Lock()
+	if n.bulk.pending == nil {
+		n.bulk.pending = make(map[string]struct{})
+	}
+	for k := range batch {
+		n.bulk.pending[k] = struct{}{}
+	}
+	n.bulk.lock.Unlock()
+}
+
+func (n *ChordNode) FinishBulkLoad(_ string, _ *string) error {
+	n.bulk.lock.Lock()
+	pending := n.bulk.pending
+	n.bulk.pending = nil
+	n.bulk.lock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	backup := make(map[string]string, len(pending))
+	n.storeLock.RLock()
+	for k := range pending {
+		if v, ok := n.store.Get(k); ok {
+			backup[k] = v
+		}
+	}
+	n.storeLock.RUnlock()
+	return n.replicateBatch(backup)
+}
+
+type ownerRange struct {
+	pre   *big.Int
+	owner string
+	id    *big.Int
+}
+
+// partitionByOwner resolves the owners of keys with a pool of lookups and
+// groups the keys by owner. Each resolved owner's range is remembered, so the
+// number of lookups grows with the number of nodes rather than the number of
+// keys. A key whose owner could not be found is returned with the error.
+func (n *ChordNode) partitionByOwner(keys []string) (map[string][]string, map[string]error) {
+	queue := make(chan string)
+	var lock sync.Mutex
+	var ranges []ownerRange
+	partitions := make(map[string][]string)
+	failed := make(map[string]error)
+	assign := func(k string, kId *big.Int) bool {
+		for _, r := range ranges {
+			if within(kId, r.pre, r.id, true) {
+				partitions[r.owner] = append(partitions[r.owner], k)
+				return true
+			}
+		}
+		return false
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < bulkLoadLookupWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range queue {
+				kId := n.keyId(k)
+				lock.Lock()
+				found := assign(k, kId)
+				lock.Unlock()
+				if found {
+					continue
+				}
+				var tar, pre string
+				err := n.FindSuccessor(kId, &tar)
+				if err == nil {
+					err = n.call(tar, "ChordNode.GetPredecessor", NULL, &pre)
+				}
+				lock.Lock()
+				if err != nil {
+					failed[k] = err
+				} else {
+					if pre != NULL {
+						ranges = append(ranges, ownerRange{pre: NodeId(pre), owner: tar, id: NodeId(tar)})
+					}
+					partitions[tar] = append(partitions[tar], k)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, k := range keys {
+		queue <- k
+	}
+	close(queue)
+	wg.Wait()
+	return partitions, failed
+}
+
+// bulkLoad resolves owners with partitionByOwner, then sends each owner its
+// keys in large batches and asks it to back them up once at the end.
+func (n *ChordNode) bulkLoad(data map[string]string) bool {
+	n.storageLog().Infof("Start bulk loading %v k-v pairs from node [%v].", len(data), n.addr)
+	if n.tier == TierLeaf {
+		return n.leafCall("ChordNode.LeafBulkLoad", &data, nil) == nil
+	}
+	if !n.isOnline() {
+		n.storageLog().Errorf("Trying to bulk load in an offline node.")
+		return false
+	}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	n.negCache.drop(keys...)
+	owners, unresolved := n.partitionByOwner(keys)
+	failed := len(unresolved)
+	if failed > 0 {
+		n.storageLog().Errorf("Bulk load failed to resolve the owners of %v keys.", failed)
+	}
+	partitions := make(map[string]map[string]string, len(owners))
+	for tar, ks := range owners {
+		partitions[tar] = make(map[string]string, len(ks))
+		for _, k := range ks {
+			partitions[tar][k] = data[k]
+		}
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for tar, partition := range partitions {
+		wg.Add(1)
+		go func(tar string, partition map[string]string) {
+			defer wg.Done()
+			cnt := n.bulkSend(tar, partition)
+			lock.Lock()
+			failed += len(partition) - cnt
+			lock.Unlock()
+		}(tar, partition)
+	}
+	wg.Wait()
+	return failed == 0
+}
+
+func (n *ChordNode) bulkSend(tar string, partition map[string]string) int {
+	sent := 0
+	batch := make(map[string]string, bulkLoadBatchSize)
+	for k, v := range partition {
+		batch[k] = v
+		if len(batch) < bulkLoadBatchSize && sent+len(batch) < len(partition) {
+			continue
+		}
+		err := n.call(tar, "ChordNode.BulkPutInStore", &batch, nil)
+		if err != nil {
+			n.logErrorFunctionCall(n.addr, "ChordNode.bulkSend", "ChordNode.BulkPutInStore", err)
+			break
+		}
+		sent += len(batch)
+		batch = make(map[string]string, bulkLoadBatchSize)
+	}
+	_ = n.call(tar, "ChordNode.FinishBulkLoad", NULL, nil)
+	return sent
+}
+
+func (n *ChordNode) LeafBulkLoad(data *map[string]string, _ *string) error {
+	if !n.bulkLoad(*data) {
+		return errors.New("bulk load failed")
+	}
+	return nil
+}
+
+func (w *NodeWrapper) BulkLoad(data map[string]string) bool {
+	return w.node.bulkLoad(data)
+}
@@ -0,0 +1,418 @@
+package chord
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCRDTType: The key holds a value that is not a CRDT of the type the
+// operation is for.
+var ErrCRDTType = errors.New("value is not a crdt of this type")
+
+// The CRDT value types, as CRDT.Type names them.
+const (
+	// CRDTGCounter: A counter that only grows, each node adding to its own
+	// count.
+	CRDTGCounter = "g-counter"
+	// CRDTORSet: A set whose removes only take out the adds they saw, so an
+	// add concurrent with a remove wins.
+	CRDTORSet = "or-set"
+	// CRDTLWWRegister: A value that the last write replaces.
+	CRDTLWWRegister = "lww-register"
+)
+
+// The merges a CRDT value can meet another in, besides the conflict
+// sources.
+const (
+	crdtMergePut    = "put"
+	crdtMergeBackup = "backup"
+	crdtMergeRepair = "repair"
+)
+
+const (
+	crdtIncrement = "increment"
+	crdtAdd       = "add"
+	crdtRemove    = "remove"
+	crdtAssign    = "assign"
+)
+
+const crdtPrefix = "\x00crdt\x00"
+
+// CRDT is a value that merges with any other of its Type without a conflict:
+// two copies of a key that each took writes, on both sides of a partition or
+// across a failover, come together holding the writes of both. The owner of
+// a key merges a CRDT put over the one it stores, a backup merges the copies
+// it is sent, and promotions, joins, deltas and adopted ranges merge them in
+// place of the conflict resolver.
+type CRDT struct {
+	Type string
+	// Counts are a G-Counter's counts of each node.
+	Counts map[string]uint64 `json:",omitempty"`
+	// Adds are the tags each element of an OR-Set was added under and not
+	// removed since, and Removed every tag a remove took out.
+	Adds    map[string][]string `json:",omitempty"`
+	Removed map[string]bool     `json:",omitempty"`
+	// Value is an LWW-Register's value, set at Time in nanoseconds by Node,
+	// which breaks ties.
+	Value string `json:",omitempty"`
+	Time  int64  `json:",omitempty"`
+	Node  string `json:",omitempty"`
+}
+
+// ParseCRDT decodes a stored value, and tells whether it is a CRDT.
+func ParseCRDT(value string) (CRDT, bool) {
+	var c CRDT
+	if !strings.HasPrefix(value, crdtPrefix) {
+		return c, false
+	}
+	if err := json.Unmarshal([]byte(value[len(crdtPrefix):]), &c); err != nil {
+		return c, false
+	}
+	switch c.Type {
+	case CRDTGCounter, CRDTORSet, CRDTLWWRegister:
+		return c, true
+	}
+	return c, false
+}
+
+// Encode returns c as the value to store.
+func (c CRDT) Encode() string {
+	b, _ := json.Marshal(c)
+	return crdtPrefix + string(b)
+}
+
+// Count is a G-Counter's value.
+func (c CRDT) Count() uint64 {
+	var ret uint64
+	for _, v := range c.Counts {
+		ret += v
+	}
+	return ret
+}
+
+// Members are the elements of an OR-Set, sorted.
+func (c CRDT) Members() []string {
+	ret := make([]string, 0, len(c.Adds))
+	for e := range c.Adds {
+		ret = append(ret, e)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (c CRDT) Contains(element string) bool {
+	return len(c.Adds[element]) > 0
+}
+
+// Merge returns the merge of c and o, which holds the writes of both; false
+// if they are not of the same type.
+func (c CRDT) Merge(o CRDT) (CRDT, bool) {
+	if c.Type != o.Type {
+		return c, false
+	}
+	ret := CRDT{Type: c.Type}
+	switch c.Type {
+	case CRDTGCounter:
+		ret.Counts = make(map[string]uint64, len(c.Counts))
+		for _, counts := range []map[string]uint64{c.Counts, o.Counts} {
+			for node, v := range counts {
+				if v > ret.Counts[node] {
+					ret.Counts[node] = v
+				}
+			}
+		}
+	case CRDTORSet:
+		ret.Removed = make(map[string]bool, len(c.Removed)+len(o.Removed))
+		for _, removed := range []map[string]bool{c.Removed, o.Removed} {
+			for tag := range removed {
+				ret.Removed[tag] = true
+			}
+		}
+		ret.Adds = make(map[string][]string, len(c.Adds))
+		for _, adds := range []map[string][]string{c.Adds, o.Adds} {
+			for e, tags := range adds {
+				for _, tag := range tags {
+					ret.addTag(e, tag)
+				}
+			}
+		}
+	case CRDTLWWRegister:
+		ret = c
+		if o.Time > c.Time || o.Time == c.Time && (o.Node > c.Node || o.Node == c.Node && o.Value > c.Value) {
+			ret = o
+		}
+	}
+	return ret, true
+}
+
+// addTag adds element under tag, unless a remove took the tag out or the
+// element has it already.
+func (c *CRDT) addTag(element, tag string) {
+	if c.Removed[tag] {
+		return
+	}
+	for _, t := range c.Adds[element] {
+		if t == tag {
+			return
+		}
+	}
+	if c.Adds == nil {
+		c.Adds = make(map[string][]string)
+	}
+	c.Adds[element] = append(c.Adds[element], tag)
+}
+
+// CRDTUpdate is one write to the CRDT of Key, applied by its owner: Op adds
+// By to a G-Counter, adds or removes Element in an OR-Set, or assigns
+// Element to an LWW-Register.
+type CRDTUpdate struct {
+	Key     string
+	Type    string
+	Op      string
+	Element string
+	By      uint64
+}
+
+// apply makes u on c as node, with tag for an OR-Set add.
+func (c *CRDT) apply(node, tag string, u CRDTUpdate) error {
+	switch {
+	case u.Type == CRDTGCounter && u.Op == crdtIncrement:
+		if c.Counts == nil {
+			c.Counts = make(map[string]uint64)
+		}
+		c.Counts[node] += u.By
+	case u.Type == CRDTORSet && u.Op == crdtAdd:
+		c.addTag(u.Element, tag)
+	case u.Type == CRDTORSet && u.Op == crdtRemove:
+		if c.Removed == nil {
+			c.Removed = make(map[string]bool)
+		}
+		for _, t := range c.Adds[u.Element] {
+			c.Removed[t] = true
+		}
+		delete(c.Adds, u.Element)
+	case u.Type == CRDTLWWRegister && u.Op == crdtAssign:
+		// A write the owner takes is the last, even if its clock is behind
+		// the node that wrote before.
+		at := time.Now().UnixNano()
+		if at <= c.Time {
+			at = c.Time + 1
+		}
+		c.Value, c.Time, c.Node = u.Element, at, node
+	default:
+		return errors.New("invalid crdt update")
+	}
+	return nil
+}
+
+// CRDTStatus counts the CRDT values the node merged that kept writes the
+// incoming copy lacked, by where they met: a put, a backup, an anti-entropy
+// repair, or a conflict source; and the updates it applied as owner, by
+// type.
+type CRDTStatus struct {
+	Merges  map[string]uint64
+	Updates map[string]uint64
+}
+
+// crdtTable runs the updates of the keys this node owns one at a time, so
+// that none reads the value another is about to replace.
+type crdtTable struct {
+	updating sync.Mutex
+	tag      uint64
+	lock     sync.Mutex
+	status   CRDTStatus
+}
+
+func (t *crdtTable) merged(where string) {
+	t.lock.Lock()
+	if t.status.Merges == nil {
+		t.status.Merges = make(map[string]uint64)
+	}
+	t.status.Merges[where]++
+	t.lock.Unlock()
+}
+
+func (t *crdtTable) snapshot() CRDTStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ret := CRDTStatus{Merges: make(map[string]uint64, len(t.status.Merges)), Updates: make(map[string]uint64, len(t.status.Updates))}
+	for k, v := range t.status.Merges {
+		ret.Merges[k] = v
+	}
+	for k, v := range t.status.Updates {
+		ret.Updates[k] = v
+	}
+	return ret
+}
+
+// mergeCRDT returns the merge of incoming into cur, and false unless both
+// are CRDTs of the same type.
+func (n *ChordNode) mergeCRDT(where, cur, incoming string) (string, bool) {
+	if cur == incoming || n.contentAddressed {
+		return incoming, false
+	}
+	a, ok := ParseCRDT(cur)
+	if !ok {
+		return incoming, false
+	}
+	b, ok := ParseCRDT(incoming)
+	if !ok {
+		return incoming, false
+	}
+	m, ok := a.Merge(b)
+	if !ok {
+		return incoming, false
+	}
+	ret := m.Encode()
+	if ret != incoming {
+		n.crdts.merged(where)
+	}
+	return ret, true
+}
+
+// UpdateCRDTInStore applies u to the CRDT of a key this node owns, making
+// one of that type if the key is not there.
+func (n *ChordNode) UpdateCRDTInStore(u CRDTUpdate, ack *AckLevel) error {
+	n.storageLog().Infof("Update crdt [key:%v][%v %v] in node [%v]'s store.", u.Key, u.Op, u.Element, n.addr)
+	if target, ok := n.migratedTo(u.Key); ok {
+		return n.call(target, "ChordNode.UpdateCRDTInStore", u, ack)
+	}
+	if err := n.keyLeases.admits(u.Key, nil); err != nil {
+		return err
+	}
+	t := &n.crdts
+	t.updating.Lock()
+	defer t.updating.Unlock()
+	n.storeLock.RLock()
+	cur, ok := n.store.Get(u.Key)
+	n.storeLock.RUnlock()
+	c := CRDT{Type: u.Type}
+	if ok {
+		var isCRDT bool
+		if c, isCRDT = ParseCRDT(cur); !isCRDT || c.Type != u.Type {
+			return ErrCRDTType
+		}
+	}
+	if t.tag == 0 {
+		t.tag = uint64(time.Now().UnixNano())
+	}
+	t.tag++
+	if err := c.apply(n.addr, n.addr+"/"+strconv.FormatUint(t.tag, 10), u); err != nil {
+		return err
+	}
+	val, err := n.acceptWrite(u.Key, c.Encode())
+	if err != nil {
+		return err
+	}
+	if err := n.putAccepted(Pair{First: u.Key, Second: val}, ack); err != nil {
+		return err
+	}
+	t.lock.Lock()
+	if t.status.Updates == nil {
+		t.status.Updates = make(map[string]uint64)
+	}
+	t.status.Updates[u.Type]++
+	t.lock.Unlock()
+	return nil
+}
+
+func (n *ChordNode) updateCRDT(u CRDTUpdate) error {
+	if n.tier == TierLeaf || !n.isOnline() {
+		n.storageLog().Errorf("Trying to update a crdt from a leaf or an offline node.")
+		return ErrUnavailable
+	}
+	if n.contentAddressed {
+		return ErrNotContentAddress
+	}
+	t := n.startOp("put", u.Key)
+	var ack AckLevel
+	tar, err := n.ownerCall(t, u.Key, "UpdateCRDTInStore", u, &ack)
+	t.finish(err == nil)
+	if err != nil {
+		n.logErrorFunctionCall(tar, "ChordNode.updateCRDT", "ChordNode.UpdateCRDTInStore", err)
+		return classifyError(err)
+	}
+	n.hotCache.drop([]string{u.Key})
+	n.negCache.drop(u.Key)
+	return nil
+}
+
+// pullBackupCRDTs merges into the store the backup copies on suc of those
+// keys in stale whose value is a CRDT, as the backup may hold writes this
+// node missed, and returns the keys merged. Each goes back to the backup
+// merged, as any put does.
+func (n *ChordNode) pullBackupCRDTs(suc string, stale []string) map[string]bool {
+	ret := make(map[string]bool)
+	for _, k := range stale {
+		n.storeLock.RLock()
+		cur, ok := n.store.Get(k)
+		n.storeLock.RUnlock()
+		if _, isCRDT := ParseCRDT(cur); !ok || !isCRDT {
+			continue
+		}
+		var backup string
+		if err := n.call(suc, "ChordNode.GetRawInReplica", k, &backup); err != nil {
+			n.logErrorFunctionCall(n.addr, "ChordNode.pullBackupCRDTs", "ChordNode.GetRawInReplica", err)
+			continue
+		}
+		merged, ok := n.mergeCRDT(crdtMergeRepair, cur, backup)
+		if !ok {
+			continue
+		}
+		// The put merges again over any write since cur was read.
+		if err := n.putInStore(Pair{First: k, Second: merged}, false, nil); err == nil {
+			ret[k] = true
+		}
+	}
+	return ret
+}
+
+func (n *ChordNode) serveCRDT(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.crdts.snapshot())
+}
+
+// GetCRDT reads the CRDT value of key.
+func (w *NodeWrapper) GetCRDT(key string) (CRDT, error) {
+	val, err := w.node.getValue(key, nil)
+	if err != nil {
+		return CRDT{}, err
+	}
+	c, ok := ParseCRDT(val)
+	if !ok {
+		return CRDT{}, ErrCRDTType
+	}
+	return c, nil
+}
+
+// IncrementCounter adds by to the G-Counter of key, on the count of the
+// key's owner.
+func (w *NodeWrapper) IncrementCounter(key string, by uint64) error {
+	return w.node.updateCRDT(CRDTUpdate{Key: key, Type: CRDTGCounter, Op: crdtIncrement, By: by})
+}
+
+func (w *NodeWrapper) AddToSet(key, element string) error {
+	return w.node.updateCRDT(CRDTUpdate{Key: key, Type: CRDTORSet, Op: crdtAdd, Element: element})
+}
+
+// RemoveFromSet removes element from the OR-Set of key, as added so far; an
+// add on a copy the owner has not merged yet survives it. The tags removed
+// stay in the set, to remove the add again wherever another copy brings it.
+func (w *NodeWrapper) RemoveFromSet(key, element string) error {
+	return w.node.updateCRDT(CRDTUpdate{Key: key, Type: CRDTORSet, Op: crdtRemove, Element: element})
+}
+
+// AssignRegister sets the LWW-Register of key to value, with the time of the
+// key's owner.
+func (w *NodeWrapper) AssignRegister(key, value string) error {
+	return w.node.updateCRDT(CRDTUpdate{Key: key, Type: CRDTLWWRegister, Op: crdtAssign, Element: value})
+}
+
+func (w *NodeWrapper) CRDTStatus() CRDTStatus {
+	return w.node.crdts.snapshot()
+}
@@ -0,0 +1,280 @@
+package chord
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// CacheOff: The ring is the store of record.
+	CacheOff = iota
+	// CacheAside: A get that misses loads the key from the source on its
+	// owner. Writes only reach the ring; the application writes the source.
+	CacheAside
+	// CacheWriteThrough: As CacheAside, and the owner writes puts and deletes
+	// to the source before taking them, failing them if the source does.
+	CacheWriteThrough
+	// CacheWriteBack: As CacheAside, and the owner queues puts and deletes
+	// for the source and writes them after answering.
+	CacheWriteBack
+)
+
+// CacheSource is the store of record a ring in cache mode sits in front of.
+// Found is false for a key the source does not have.
+type CacheSource interface {
+	Load(key string) (value string, found bool, err error)
+	Store(key, value string) error
+	Delete(key string) error
+}
+
+// CacheOptions turn a node into a cache in front of Source. Entries held for
+// TTL, counted from when they were loaded or written, are dropped and loaded
+// again on the next get; zero keeps them until deleted. Every node of the ring
+// needs the same options, since only a key's owner talks to the source.
+type CacheOptions struct {
+	Mode   int
+	Source CacheSource
+	TTL    time.Duration
+}
+
+type cacheWrite struct {
+	key    string
+	value  string
+	delete bool
+}
+
+type cacheLoad struct {
+	done  chan struct{}
+	value string
+	found bool
+	err   error
+}
+
+type cacheState struct {
+	lock    sync.Mutex
+	options CacheOptions
+	loading map[string]*cacheLoad
+	queue   chan cacheWrite
+	pending int
+}
+
+func (c *cacheState) mode() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.options.Source == nil {
+		return CacheOff
+	}
+	return c.options.Mode
+}
+
+func (c *cacheState) ttl() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.options.Source == nil {
+		return 0
+	}
+	return c.options.TTL
+}
+
+// touchCached restarts the TTL of key, kept in its metadata, which goes with
+// the key when it is deleted or moves.
+func (n *ChordNode) touchCached(key string) {
+	ttl := n.cache.ttl()
+	if ttl <= 0 {
+		return
+	}
+	n.storeLock.Lock()
+	if _, ok := n.store.Get(key); ok {
+		n.metaLocked(key).expires = time.Now().Add(ttl)
+	}
+	n.storeLock.Unlock()
+}
+
+// cacheExpired tells whether a held key has outlived its TTL. A key with no
+// expiry, one promoted from a backup for instance, starts its TTL now.
+func (n *ChordNode) cacheExpired(key string) bool {
+	ttl := n.cache.ttl()
+	if ttl <= 0 {
+		return false
+	}
+	var at time.Time
+	n.storeLock.RLock()
+	if m, ok := n.meta[key]; ok {
+		at = m.expires
+	}
+	n.storeLock.RUnlock()
+	if !at.IsZero() {
+		return time.Now().After(at)
+	}
+	n.storeLock.Lock()
+	if _, ok := n.store.Get(key); ok {
+		if m := n.metaLocked(key); m.expires.IsZero() {
+			m.expires = time.Now().Add(ttl)
+		}
+	}
+	n.storeLock.Unlock()
+	return false
+}
+
+// cacheDue lists the held keys that outlived their TTL.
+func (n *ChordNode) cacheDue() []string {
+	if n.cache.ttl() <= 0 {
+		return nil
+	}
+	var ret []string
+	now := time.Now()
+	n.storeLock.RLock()
+	for k, m := range n.meta {
+		if !m.expires.IsZero() && now.After(m.expires) {
+			ret = append(ret, k)
+		}
+	}
+	n.storeLock.RUnlock()
+	return ret
+}
+
+// load asks the source for key once, however many gets miss it at the same
+// time.
+func (c *cacheState) load(key string) (string, bool, error) {
+	c.lock.Lock()
+	if l, ok := c.loading[key]; ok {
+		c.lock.Unlock()
+		<-l.done
+		return l.value, l.found, l.err
+	}
+	l := &cacheLoad{done: make(chan struct{})}
+	c.loading[key] = l
+	source := c.options.Source
+	c.lock.Unlock()
+	l.value, l.found, l.err = source.Load(key)
+	c.lock.Lock()
+	delete(c.loading, key)
+	c.lock.Unlock()
+	close(l.done)
+	return l.value, l.found, l.err
+}
+
+// write hands a put or delete to the source as the mode says.
+func (c *cacheState) write(w cacheWrite) error {
+	c.lock.Lock()
+	mode, source, queue := c.options.Mode, c.options.Source, c.queue
+	if queue != nil {
+		c.pending++
+	}
+	c.lock.Unlock()
+	switch {
+	case source == nil:
+		return nil
+	case mode == CacheWriteThrough:
+		return writeToSource(source, w)
+	case queue != nil:
+		queue <- w
+	}
+	return nil
+}
+
+func writeToSource(source CacheSource, w cacheWrite) error {
+	if w.delete {
+		return source.Delete(w.key)
+	}
+	return source.Store(w.key, w.value)
+}
+
+func (n *ChordNode) writeBack(source CacheSource, queue chan cacheWrite) {
+	for w := range queue {
+		var err error
+		for i := 0; i < attempt; i++ {
+			if i > 0 {
+				time.Sleep(cacheWriteBackPauseTime)
+			}
+			if err = writeToSource(source, w); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			n.logErrorFunctionCall(n.addr, "ChordNode.writeBack", "CacheSource.Store", err)
+		}
+		n.cache.lock.Lock()
+		n.cache.pending--
+		n.cache.lock.Unlock()
+	}
+}
+
+// flushCache waits up to timeout for queued write-backs to reach the source.
+func (n *ChordNode) flushCache(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		n.cache.lock.Lock()
+		pending := n.cache.pending
+		n.cache.lock.Unlock()
+		if pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			n.storageLog().Errorf("Node [%v] quits with %v writes not yet written back.", n.addr, pending)
+			return
+		}
+		time.Sleep(drainPollTime)
+	}
+}
+
+// getThroughCache answers a get the store missed, or whose entry expired,
+// from the source, and keeps what it loaded.
+func (n *ChordNode) getThroughCache(key string, val *string) error {
+	value, found, err := n.cache.load(key)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.getThroughCache", "CacheSource.Load", err)
+		return ErrUnavailable
+	}
+	if !found {
+		*val = NULL
+		return ErrNotFound
+	}
+	if err := n.putInStore(Pair{First: key, Second: value}, true, nil); err != nil && err != errKeyExists {
+		n.logErrorFunctionCall(n.addr, "ChordNode.getThroughCache", "ChordNode.putInStore", err)
+	}
+	n.touchCached(key)
+	*val = value
+	return nil
+}
+
+// evictExpired drops the entries that outlived their TTL, from the store and
+// its backup, but not from the source.
+func (n *ChordNode) evictExpired() {
+	for _, k := range n.cacheDue() {
+		if _, err := n.deleteInStore(k, nil); err != nil {
+			n.logErrorFunctionCall(n.addr, "ChordNode.evictExpired", "ChordNode.deleteInStore", err)
+		}
+	}
+}
+
+// SetCache puts the node in front of options.Source, or takes it out with
+// CacheOff, before it creates or joins a ring. Conditional writes and bulk
+// loads do not go to the source.
+func (w *NodeWrapper) SetCache(options CacheOptions) bool {
+	if s := w.node.life.get(); s != StateCreated && s != StateOffline {
+		w.node.log().Errorf("Trying to change the cache mode of an online node.")
+		return false
+	}
+	if options.Mode != CacheOff && options.Source == nil || options.Mode < CacheOff || options.Mode > CacheWriteBack {
+		w.node.log().Errorf("Invalid cache options.")
+		return false
+	}
+	if options.Mode == CacheOff {
+		options.Source = nil
+	}
+	c := &w.node.cache
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.queue != nil {
+		close(c.queue)
+		c.queue = nil
+	}
+	c.options = options
+	c.loading = make(map[string]*cacheLoad)
+	if options.Mode == CacheWriteBack {
+		c.queue = make(chan cacheWrite, cacheWriteBackQueueLen)
+		go w.node.writeBack(options.Source, c.queue)
+	}
+	return true
+}
@@ -3,67 +3,322 @@ package chord
 import (
 	"errors"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"math/big"
 	"net"
 	"net/rpc"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ChordNode struct {
-	addr          string
-	predecessor   string
-	preLock       sync.RWMutex
-	successorList [SuccessorListLen]string
-	sucLock       sync.RWMutex
-	fingerTable   [M]string
-	fingerLock    sync.RWMutex
-	next          int
-
-	store         map[string]string
-	storeLock     sync.RWMutex
-	preBackup     map[string]string
-	preBackupLock sync.RWMutex
-
-	online     bool
-	onlineLock sync.RWMutex
-	server     *rpc.Server
-	listener   net.Listener
-	quitSignal chan bool
+	addr            string
+	predecessor     string
+	predecessorList [PredecessorListLen]string
+	preLock         nodeLock
+	successorList   [SuccessorListLen]string
+	sucLock         nodeLock
+	fingerTable     [M]string
+	fingerLock      nodeLock
+	next            int
+
+	store         KVStore
+	meta          map[string]*valueMeta
+	versionClock  uint64
+	storeLock     nodeLock
+	preBackup     KVStore
+	backupOwners  backupOwners
+	preBackupLock nodeLock
+	snapshots     snapshotTable
+
+	logs          atomic.Value
+	logLock       sync.Mutex
+	logFile       io.Closer
+	life          lifecycle
+	server        *rpc.Server
+	listener      net.Listener
+	conns         connTable
+	codec         Codec
+	admin         adminServer
+	hooks         hookTable
+	events        eventBus
+	slowOps       slowOpLog
+	hotKeys       hotKeyTracker
+	tier          int
+	leaf          leafState
+	leaves        leafTable
+	accordion     accordionTable
+	routingHealth routingHealth
+	router        Router
+	services      []service
+
+	contentAddressed bool
+	erasure          erasureConfig
+	shards           shardStore
+	replication      replicationTracker
+	bulk             bulkBackupTable
+	migrations       migrationTable
+	auditor          auditState
+	overload         overloadDetector
+	transfers        storeWatch
+	admission        admissionState
+	peers            peerScoreTable
+	lookups          lookupLimiter
+	pacer            maintenancePacer
+	detector         FailureDetector
+	peerSubscribers  subscriberList
+	replicator       Replicator
+	seeding          seedTracker
+	repairs          repairTable
+	tombstones       tombstoneTable
+	joinLease        joinLeaseTable
+	keyHash          KeyHasher
+	cache            cacheState
+	keyLeases        keyLeaseTable
+	aggregator       aggregator
+	memberJournal    membershipJournal
+	replQueue        replicationQueue
+	workers          workerPool
+	hotCache         hotKeyCache
+	negCache         negativeCache
+	sucCheck         successorCheck
+	rounds           roundLog
+	rpcSched         rpcScheduler
+	msgLimit         messageLimit
+	outbox           transferOutbox
+	filters          keyFilters
+	watchers         keyWatchers
+	invalidations    invalidationFeed
+	adoptions        repairTable
+	rtt              rttTable
+	fingerSelection  int32
+	zones            zoneTable
+	freeze           freezeState
+	conflicts        conflictTable
+	crdts            crdtTable
+	readRouter       readRouter
+	standbyState     standbyState
+	backups          backupState
+	joinThrottle     joinThrottle
+	relocation       relocationState
 }
 
 func (n *ChordNode) initialize(addr string) {
 	n.addr = addr
-	n.store = make(map[string]string)
-	n.preBackup = make(map[string]string)
-	n.quitSignal = make(chan bool, 2)
+	n.setLogger(log.StandardLogger())
+	n.nameLocks()
+	n.store = NewMemoryStore()
+	n.meta = make(map[string]*valueMeta)
+	n.preBackup = NewMemoryStore()
+	n.replicator = successorReplicator{n: n}
+	n.useDetector(NewCachedDetector(Ping))
+	n.codec = defaultCodec
 }
 
-func (n *ChordNode) FindSuccessor(kId *big.Int, ret *string) error {
+func (n *ChordNode) call(addr string, serviceMethod string, args interface{}, reply interface{}) error {
+	n.accordion.countCall()
+	begin := time.Now()
+	traffic, err := rpcCallMetered(addr, n.codec, serviceMethod, args, reply)
+	n.accountZoneTraffic(addr, serviceMethod, traffic, err)
+	if isTransportError(err) {
+		n.rtt.forget(addr)
+	} else if n.rpcSched.class(serviceMethod) != RPCClassBulk {
+		// A bulk call takes as long as its data, not the round trip.
+		n.rtt.observe(addr, time.Since(begin))
+	}
+	n.observeCall(addr, err)
+	if err != nil {
+		n.checkCallError(addr, err)
+	}
+	return err
+}
+
+func (n *ChordNode) nextHop(kId *big.Int) (addr string, final bool, err error) {
 	var suc string
-	err := n.FirstAvailableSuccessor(NULL, &suc)
+	err = n.FirstAvailableSuccessor(NULL, &suc)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.nextHop", "ChordNode.FirstAvailableSuccessor", err)
+		return NULL, false, err
+	}
+	if within(kId, NodeId(n.addr), NodeId(suc), true) {
+		return suc, true, nil
+	}
+	addr, err = n.closestPrecedingFinger(kId)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.nextHop", "ChordNode.closestPrecedingFinger", err)
+		return NULL, false, err
+	}
+	return addr, false, nil
+}
+
+func (n *ChordNode) FindSuccessor(kId *big.Int, ret *string) error {
+	return n.findSuccessor(LookupRequest{Key: kId, Origin: n.addr}, ret)
+}
+
+func (n *ChordNode) findSuccessor(req LookupRequest, ret *string) error {
+	if n.router != nil {
+		var err error
+		*ret, err = n.router.FindSuccessor(req.Key)
+		return err
+	}
+	hop, final, err := n.nextHop(req.Key)
 	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.FindSuccessor", "ChordNode.FirstAvailableSuccessor", err)
 		return err
 	}
-	if within(kId, id(n.addr), id(suc), true) {
-		*ret = suc
+	if final {
+		*ret = hop
 		return nil
 	}
-	var cpf string
-	cpf, err = n.closestPrecedingFinger(kId)
+	if !n.lookups.acquire(req.Origin) {
+		return errLookupOverloaded
+	}
+	defer n.lookups.release(req.Origin)
+	return n.call(hop, "ChordNode.ForwardFindSuccessor", req, ret)
+}
+
+// FindSuccessorPath resolves like FindSuccessor and also reports the nodes the
+// request was forwarded through. A hop's latency is the round trip seen by the
+// node that forwarded to it, so it includes every hop after it.
+func (n *ChordNode) FindSuccessorPath(kId *big.Int, ret *LookupPath) error {
+	return n.findSuccessorPath(LookupRequest{Key: kId, Origin: n.addr}, ret)
+}
+
+func (n *ChordNode) findSuccessorPath(req LookupRequest, ret *LookupPath) error {
+	if n.router != nil {
+		ret.Hops = nil
+		return n.findSuccessor(req, &ret.Successor)
+	}
+	hop, final, err := n.nextHop(req.Key)
 	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.FindSuccessor", "ChordNode.closestPrecedingFinger", err)
 		return err
 	}
-	return RPCCall(cpf, "ChordNode.FindSuccessor", kId, ret)
+	if final {
+		ret.Successor = hop
+		ret.Hops = nil
+		return nil
+	}
+	if !n.lookups.acquire(req.Origin) {
+		return errLookupOverloaded
+	}
+	defer n.lookups.release(req.Origin)
+	begin := time.Now()
+	var sub LookupPath
+	err = n.call(hop, "ChordNode.ForwardFindSuccessorPath", req, &sub)
+	if err != nil {
+		return err
+	}
+	ret.Successor = sub.Successor
+	ret.Hops = append([]Hop{{Addr: hop, Latency: time.Since(begin)}}, sub.Hops...)
+	return nil
+}
+
+func (n *ChordNode) lookup(t *opTimer, key string) (string, error) {
+	begin := time.Now()
+	var path LookupPath
+	err := n.FindSuccessorPath(n.keyId(key), &path)
+	for i := 1; lookupRetryable(err) && i < attempt; i++ {
+		t.retries++
+		time.Sleep(time.Duration(i) * lookupRetryPauseTime)
+		err = n.FindSuccessorPath(n.keyId(key), &path)
+	}
+	t.owner, t.hops = path.Successor, path.Hops
+	n.routingHealth.lookup(len(path.Hops), err == nil)
+	for _, h := range path.Hops {
+		n.accordion.learn(h.Addr)
+	}
+	n.accordion.learn(path.Successor)
+	t.phase("lookup", path.Successor, begin)
+	if err == nil && len(path.Hops) > 0 && !n.confirmedAlive(path.Successor) {
+		n.penalize(path.Hops[len(path.Hops)-1].Addr, OffenceBogusRouting)
+	}
+	return path.Successor, err
+}
+
+// lookupRetryable tells a failed lookup that may pass if tried again: one
+// cut short by a hop that could not be reached or was too busy, and not one
+// refused for a cause that will not change, such as an offline node.
+func lookupRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	c := classifyError(err)
+	if c == ErrUnavailable || c == ErrBusy || c.Error() == errLookupOverloaded.Error() {
+		return true
+	}
+	for _, cause := range causes {
+		if c == cause {
+			return false
+		}
+	}
+	return true
+}
+
+// idempotentMethods are the store methods ownerCall sends again after a
+// transport error. The error may come after the owner applied the call, so
+// a conditional write, a delete, which fails on a key already gone, or a
+// CRDT update would apply twice or report wrongly.
+var idempotentMethods = map[string]bool{
+	"GetInStore":             true,
+	"GetVersionedInStore":    true,
+	"StatInStore":            true,
+	"GetAndWatch":            true,
+	"PutInStore":             true,
+	"PutContentInStore":      true,
+	"AcquireKeyLeaseInStore": true,
+	"ReleaseKeyLeaseInStore": true,
+}
+
+// ownerCall calls serviceMethod on the owner of key. An owner that cannot be
+// reached is marked dead by the failure detector, so the next lookup routes
+// around an owner that died after it was last seen alive; idempotentMethods
+// are retried there.
+func (n *ChordNode) ownerCall(t *opTimer, key string, serviceMethod string, args interface{}, reply interface{}) (tar string, err error) {
+	tries := 1
+	if idempotentMethods[serviceMethod] {
+		tries = attempt
+	}
+	for i := 0; i < tries; i++ {
+		if i > 0 {
+			t.retries++
+		}
+		tar, err = n.lookup(t, key)
+		if err != nil {
+			return
+		}
+		n.routingLog().Infof("Found key [%v]'s successor [%v].", key, tar)
+		begin := time.Now()
+		err = n.call(tar, "ChordNode."+serviceMethod, args, reply)
+		t.phase(serviceMethod, tar, begin)
+		if !isTransportError(err) {
+			return
+		}
+	}
+	return
+}
+
+// callSuccessor calls serviceMethod on the first available successor, failing
+// over once to the next one if it turns out to be unreachable.
+func (n *ChordNode) callSuccessor(serviceMethod string, args interface{}, reply interface{}) (suc string, err error) {
+	for i := 0; i < 2; i++ {
+		err = n.FirstAvailableSuccessor(NULL, &suc)
+		if err != nil {
+			return
+		}
+		err = n.call(suc, serviceMethod, args, reply)
+		if !isTransportError(err) {
+			return
+		}
+	}
+	return
 }
 
 func (n *ChordNode) FirstAvailableSuccessor(_ string, ret *string) error {
 	n.sucLock.RLock()
 	suc0 := n.successorList[0]
 	n.sucLock.RUnlock()
-	if Ping(suc0) {
+	if n.confirmedAlive(suc0) {
 		*ret = suc0
 		return nil
 	}
@@ -71,15 +326,28 @@ func (n *ChordNode) FirstAvailableSuccessor(_ string, ret *string) error {
 		n.sucLock.RLock()
 		sucI := n.successorList[i]
 		n.sucLock.RUnlock()
-		if sucI != NULL && Ping(sucI) {
+		if sucI != NULL && n.confirmedAlive(sucI) {
 			*ret = sucI
+			n.publish(EventFailureDetected, suc0, 0, "successor")
+			n.accordion.forget(suc0)
+			n.accordion.noteFailure()
 			n.sucLock.Lock()
+			// Stabilize may have rewritten the list since it was read; the
+			// shift is only right for the entries skipped.
+			if n.successorList[0] != suc0 || n.successorList[i] != sucI {
+				n.sucLock.Unlock()
+				return nil
+			}
 			for j := i; j < SuccessorListLen; j++ {
 				n.successorList[j-i] = n.successorList[j]
 			}
+			for j := SuccessorListLen - i; j < SuccessorListLen; j++ {
+				n.successorList[j] = NULL
+			}
 			n.sucLock.Unlock()
-			time.Sleep(maintainPauseTime * 2)
-			_ = RPCCall(sucI, "ChordNode.Notify", n.addr, nil)
+			n.fireSuccessorChanged(suc0, sucI)
+			n.pacer.churn()
+			n.adoptSuccessor(sucI)
 			return nil
 		}
 	}
@@ -87,23 +355,117 @@ func (n *ChordNode) FirstAvailableSuccessor(_ string, ret *string) error {
 	return errors.New("no available successor")
 }
 
+// adoptSuccessor settles in with suc, a successor reached by skipping dead
+// ones, off the caller's path: lookups waiting on FirstAvailableSuccessor
+// should not wait on suc. The list is refilled from suc's, and suc notified
+// until it takes this node as its predecessor; it ignores the notify while
+// it still holds a dead predecessor between the two, which its own
+// maintenance drops shortly.
+func (n *ChordNode) adoptSuccessor(suc string) {
+	if !n.adoptions.begin(suc) {
+		return
+	}
+	go func() {
+		defer n.adoptions.end(suc)
+		n.refillSuccessors(suc)
+		n.presentTicket(suc)
+		for i := 0; i < adoptNotifyAttempts; i++ {
+			_ = n.call(suc, "ChordNode.Notify", n.addr, nil)
+			var pre string
+			if n.call(suc, "ChordNode.GetPredecessor", NULL, &pre) != nil {
+				return
+			}
+			// Taken, or a live node sits in between, which stabilize finds.
+			if pre == n.addr || pre != NULL && within(NodeId(pre), NodeId(n.addr), NodeId(suc), false) && n.alive(pre) {
+				return
+			}
+			time.Sleep(adoptNotifyPauseTime)
+		}
+	}()
+}
+
+// refillSuccessors rebuilds the successor list behind suc from suc's own
+// list, so that a list shortened by skipping dead successors does not wait
+// for the next stabilize to grow back.
+func (n *ChordNode) refillSuccessors(suc string) {
+	var list [SuccessorListLen]string
+	err := n.call(suc, "ChordNode.GetSuccessorList", NULL, &list)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.refillSuccessors", "ChordNode.GetSuccessorList", err)
+		return
+	}
+	n.accordion.learn(list[:]...)
+	var usable [SuccessorListLen]bool
+	for i := 1; i < SuccessorListLen; i++ {
+		usable[i] = !n.peers.blacklisted(list[i-1]) && n.alive(list[i-1])
+	}
+	n.sucLock.Lock()
+	defer n.sucLock.Unlock()
+	// Stabilize got there first.
+	if n.successorList[0] != suc {
+		return
+	}
+	var refilled [SuccessorListLen]string
+	refilled[0] = suc
+	cnt := 1
+	for i := 1; i < SuccessorListLen; i++ {
+		if usable[i] {
+			refilled[cnt] = list[i-1]
+			cnt++
+		}
+	}
+	n.successorList = refilled
+}
+
+// precedingFinger is the index of the highest usable finger strictly between
+// nId and kId, or -1. Usable is asked once per address, however many fingers
+// hold it.
+func precedingFinger(nId, kId *big.Int, fingers []string, usable func(addr string) bool) int {
+	var unusable map[string]bool
+	for i := len(fingers) - 1; i >= 0; i-- {
+		finI := fingers[i]
+		if finI == NULL || unusable[finI] || !within(NodeId(finI), nId, kId, false) {
+			continue
+		}
+		if usable(finI) {
+			return i
+		}
+		if unusable == nil {
+			unusable = make(map[string]bool)
+		}
+		unusable[finI] = true
+	}
+	return -1
+}
+
 func (n *ChordNode) closestPrecedingFinger(kId *big.Int) (string, error) {
-	nId := id(n.addr)
 	n.fingerLock.RLock()
-	defer n.fingerLock.RUnlock()
-	for i := M - 1; i >= 0; i-- {
-		finI := n.fingerTable[i]
-		if finI != NULL && Ping(finI) && within(id(finI), nId, kId, false) {
-			return finI, nil
+	fingers := n.fingerTable
+	n.fingerLock.RUnlock()
+	i := precedingFinger(NodeId(n.addr), kId, fingers[:], func(addr string) bool {
+		if n.peers.blacklisted(addr) {
+			return false
+		}
+		if !n.alive(addr) {
+			n.routingHealth.skippedDead()
+			return false
 		}
+		return true
+	})
+	if i >= 0 {
+		route := n.closerLearnedRoute(kId, fingers[i])
+		n.routingHealth.forwarded(i, route != fingers[i])
+		return route, nil
 	}
 	var suc string
 	err := n.FirstAvailableSuccessor(NULL, &suc)
 	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.closestPrecedingFinger", "ChordNode.FirstAvailableSuccessor", err)
+		n.logErrorFunctionCall(n.addr, "ChordNode.closestPrecedingFinger", "ChordNode.FirstAvailableSuccessor", err)
 		return NULL, errors.New("not found")
 	}
-	return suc, nil
+	route := n.closerLearnedRoute(kId, suc)
+	n.routingHealth.forwarded(-1, route != suc)
+	return route, nil
 }
 
 func (n *ChordNode) GetPredecessor(_ string, ret *string) error {
@@ -115,8 +477,10 @@ func (n *ChordNode) GetPredecessor(_ string, ret *string) error {
 
 func (n *ChordNode) SetPredecessor(pre string, _ *string) error {
 	n.preLock.Lock()
+	old := n.predecessor
 	n.predecessor = pre
 	n.preLock.Unlock()
+	n.firePredecessorChanged(old, pre)
 	return nil
 }
 
@@ -131,61 +495,141 @@ func (n *ChordNode) initializeServer() {
 	n.server = rpc.NewServer()
 	err := n.server.Register(n)
 	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.initializeServer", "rpc.Server.Register", err)
+		n.logErrorFunctionCall(n.addr, "ChordNode.initializeServer", "rpc.Server.Register", err)
 		return
 	}
-	n.listener, err = net.Listen("tcp", n.addr)
+	for _, s := range n.services {
+		err = n.server.RegisterName(s.name, s.rcvr)
+		if err != nil {
+			n.logErrorFunctionCall(n.addr, "ChordNode.initializeServer", "rpc.Server.RegisterName", err)
+			return
+		}
+	}
+	n.conns.open()
+	n.listener, err = net.Listen("tcp", NetAddr(n.addr))
 	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.initializeServer", "net.Listen", err)
+		n.logErrorFunctionCall(n.addr, "ChordNode.initializeServer", "net.Listen", err)
 		return
 	}
 	go Accept(n.server, n.listener, n)
 }
 
 func (n *ChordNode) run() {
-	n.initializeServer()
+	n.serve()
 	n.maintain()
 }
 
-func (n *ChordNode) Notify(nAlter string, _ *string) error {
+func (n *ChordNode) Notify(nAlter string, _ *bool) error {
+	if !n.admits(nAlter) {
+		n.maintenanceLog().Errorf("Node [%v] ignores notify from unadmitted [%v].", n.addr, nAlter)
+		return ErrNotAdmitted
+	}
 	var pre string
 	_ = n.GetPredecessor(NULL, &pre)
-	if pre == NULL || pre != nAlter && within(id(nAlter), id(pre), id(n.addr), false) {
+	if pre == NULL || pre != nAlter && within(NodeId(nAlter), NodeId(pre), NodeId(n.addr), false) {
 		_ = n.SetPredecessor(nAlter, nil)
-		n.mergeBackup()
-		n.updateSuccessorBackupAfterMerge()
-		_ = RPCCall(nAlter, "ChordNode.GetStore", NULL, &n.preBackup)
+		n.pacer.churn()
+		if pre != NULL && pre != n.addr {
+			// The old predecessor may be pacing its rounds slowly, so nudge
+			// it to pick up its new successor now.
+			go func() { _ = n.call(pre, "ChordNode.Stabilize", NULL, nil) }()
+		}
+		err := n.replicator.OnTopologyChange(TopologyChange{Kind: TopologyPredecessorJoined, Peer: nAlter})
+		if err != nil {
+			n.penalize(nAlter, OffenceFailedTransfer)
+		}
 	}
 	return nil
 }
 
-func (n *ChordNode) stabilize() {
-	var suc string
-	err := n.FirstAvailableSuccessor(NULL, &suc)
+func (n *ChordNode) stabilize() bool {
+	var reply StabilizeReply
+	suc, err := n.callSuccessor("ChordNode.StabilizeExchange", n.stabilizeRequest(), &reply)
+	if suc != NULL && err != nil && err.Error() == ErrNotAdmitted.Error() {
+		n.presentTicket(suc)
+		err = n.call(suc, "ChordNode.StabilizeExchange", n.stabilizeRequest(), &reply)
+	}
 	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.stabilize", "ChordNode.FirstAvailableSuccessor", err)
-		return
+		n.logErrorFunctionCall(n.addr, "ChordNode.stabilize", "ChordNode.StabilizeExchange", err)
+		n.rounds.record(MaintenanceRound{Task: taskStabilize, Changed: true, Failed: true, OldSuccessor: suc, NewSuccessor: suc, Finger: -1})
+		return true
 	}
-	var x string
-	_ = RPCCall(suc, "ChordNode.GetPredecessor", NULL, &x)
-
-	if x != NULL && Ping(x) && within(id(x), id(n.addr), id(suc), false) {
-		log.Infof("stabilize: update address [%v]'s successor from [%v] to [%v]", n.addr, suc, x)
-		suc = x
+	if x := reply.Predecessor; x != NULL && x != n.addr && within(NodeId(x), NodeId(n.addr), NodeId(suc), false) {
+		n.presentTicket(x)
+		var closer StabilizeReply
+		if n.call(x, "ChordNode.StabilizeExchange", n.stabilizeRequest(), &closer) == nil {
+			n.maintenanceLog().Infof("stabilize: update address [%v]'s successor from [%v] to [%v]", n.addr, suc, x)
+			suc, reply = x, closer
+		}
+	}
+	n.mergeLiveness(reply.Liveness)
+	n.learnRingFreeze(reply.Freeze)
+	list := reply.SuccessorList
+	n.accordion.learn(list[:]...)
+	var usable [SuccessorListLen]bool
+	for i := 1; i < SuccessorListLen; i++ {
+		usable[i] = !n.peers.blacklisted(list[i-1]) && n.alive(list[i-1])
 	}
-	var list [SuccessorListLen]string
-	_ = RPCCall(suc, "ChordNode.GetSuccessorList", NULL, &list)
 	n.sucLock.Lock()
+	before := n.successorList
+	old := n.successorList[0]
 	n.successorList[0] = suc
 	cnt := 1
 	for i := 1; i < SuccessorListLen; i++ {
-		if Ping(list[i-1]) {
+		if usable[i] {
 			n.successorList[cnt] = list[i-1]
 			cnt++
 		}
 	}
+	changed := before != n.successorList
 	n.sucLock.Unlock()
-	_ = RPCCall(suc, "ChordNode.Notify", n.addr, nil)
+	n.rounds.record(MaintenanceRound{Task: taskStabilize, Changed: changed, OldSuccessor: old, NewSuccessor: suc, Finger: -1})
+	n.fireSuccessorChanged(old, suc)
+	if reply.Seeded {
+		n.replication.fullSync()
+	}
+	if reply.Seeding {
+		// Come back soon to learn when the successor holds the copy.
+		n.pacer.churn()
+	}
+	return changed
+}
+
+type StabilizeRequest struct {
+	Notifier string
+	Liveness []LivenessObservation
+	Freeze   RingFreeze
+}
+
+type StabilizeReply struct {
+	Predecessor   string
+	SuccessorList [SuccessorListLen]string
+	Seeded        bool
+	Seeding       bool
+	Liveness      []LivenessObservation
+	Freeze        RingFreeze
+}
+
+func (n *ChordNode) stabilizeRequest() StabilizeRequest {
+	return StabilizeRequest{Notifier: n.addr, Liveness: n.recentLiveness(), Freeze: n.freeze.current()}
+}
+
+// StabilizeExchange takes the notifier as a predecessor candidate and then
+// returns the predecessor and successor list, so a stabilize round that finds
+// nothing new costs a single round trip. Both sides also swap their freshest
+// liveness observations, and the ring freeze they know.
+func (n *ChordNode) StabilizeExchange(req StabilizeRequest, ret *StabilizeReply) error {
+	n.mergeLiveness(req.Liveness)
+	n.learnRingFreeze(req.Freeze)
+	err := n.Notify(req.Notifier, nil)
+	if err != nil {
+		return err
+	}
+	ret.Seeded, ret.Seeding = n.seeding.report(req.Notifier)
+	ret.Liveness = n.recentLiveness()
+	ret.Freeze = n.freeze.current()
+	_ = n.GetPredecessor(NULL, &ret.Predecessor)
+	return n.GetSuccessorList(NULL, &ret.SuccessorList)
 }
 
 func (n *ChordNode) Stabilize(_ string, _ *string) error {
@@ -193,31 +637,109 @@ func (n *ChordNode) Stabilize(_ string, _ *string) error {
 	return nil
 }
 
-func (n *ChordNode) fixFinger() {
+func (n *ChordNode) fixFinger() bool {
 	var suc string
-	tar := start(id(n.addr), n.next)
+	tar := start(NodeId(n.addr), n.next)
+	t := n.startOp("lookup", tar.String())
 	err := n.FindSuccessor(tar, &suc)
+	t.finish(err == nil)
 	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.fixFinger", "ChordNode.FindSuccessor", err)
-		return
+		n.logErrorFunctionCall(n.addr, "ChordNode.fixFinger", "ChordNode.FindSuccessor", err)
+		n.rounds.record(MaintenanceRound{Task: taskFixFinger, Changed: true, Failed: true, Finger: n.next})
+		return true
+	}
+	if n.peers.blacklisted(suc) {
+		n.rounds.record(MaintenanceRound{Task: taskFixFinger, Finger: n.next})
+		n.next = (n.next + 1) % M
+		return false
+	}
+	if n.next > 0 && atomic.LoadInt32(&n.fingerSelection) == FingerProximity {
+		suc = n.proximateFinger(n.next, suc)
 	}
 	n.fingerLock.Lock()
-	if n.fingerTable[n.next] != suc {
-		log.Infof("fixFinger: update address [%v]'s finger table %vth element from [%v] to [%v]", n.addr, n.next, n.fingerTable[n.next], suc)
+	old := n.fingerTable[n.next]
+	changed := old != suc
+	if changed {
+		n.maintenanceLog().Infof("fixFinger: update address [%v]'s finger table %vth element from [%v] to [%v]", n.addr, n.next, n.fingerTable[n.next], suc)
 		n.fingerTable[n.next] = suc
 	}
 	n.fingerLock.Unlock()
+	n.routingHealth.fixed(changed)
+	n.rounds.record(MaintenanceRound{Task: taskFixFinger, Changed: changed, Finger: n.next, OldFinger: old, NewFinger: suc})
 	n.next = (n.next + 1) % M
+	return changed
 }
 
-func (n *ChordNode) checkPredecessor() {
+func (n *ChordNode) checkPredecessor() bool {
 	var pre string
 	_ = n.GetPredecessor(NULL, &pre)
-	if pre != NULL && !Ping(pre) {
-		log.Infof("Address [%v]'s predecessor failed, set to nil.", n.addr)
+	if pre != NULL && !n.ping(pre) {
+		n.maintenanceLog().Infof("Address [%v]'s predecessor failed, set to nil.", n.addr)
+		n.publish(EventFailureDetected, pre, 0, "predecessor")
+		n.accordion.forget(pre)
+		n.accordion.noteFailure()
 		_ = n.SetPredecessor(NULL, nil)
-		n.mergeBackup()
-		n.updateSuccessorBackupAfterMerge()
+		_ = n.replicator.OnTopologyChange(TopologyChange{Kind: TopologyPredecessorFailed, Peer: pre})
+		n.adoptPredecessor(pre)
+		n.pacer.churn()
+		n.rounds.record(MaintenanceRound{Task: taskCheckPredecessor, Changed: true, Finger: -1, ClearedPredecessor: pre})
+		return true
+	}
+	if pre != NULL && pre != n.addr {
+		n.updatePredecessorList(pre)
+	}
+	n.rounds.record(MaintenanceRound{Task: taskCheckPredecessor, Finger: -1})
+	return false
+}
+
+func (n *ChordNode) GetPredecessorList(_ string, ret *[PredecessorListLen]string) error {
+	n.preLock.RLock()
+	*ret = n.predecessorList
+	n.preLock.RUnlock()
+	return nil
+}
+
+func (n *ChordNode) updatePredecessorList(pre string) {
+	var list [PredecessorListLen]string
+	err := n.call(pre, "ChordNode.GetPredecessorList", NULL, &list)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.updatePredecessorList", "ChordNode.GetPredecessorList", err)
+		return
+	}
+	var newList [PredecessorListLen]string
+	newList[0] = pre
+	for i := 1; i < PredecessorListLen; i++ {
+		if list[i-1] == NULL || list[i-1] == n.addr {
+			break
+		}
+		newList[i] = list[i-1]
+	}
+	n.preLock.Lock()
+	n.predecessorList = newList
+	n.preLock.Unlock()
+}
+
+// adoptPredecessor takes the closest live node behind the failed predecessor
+// as the new predecessor right away and seeds the pre backup from it, rather
+// than waiting for that node to notify.
+func (n *ChordNode) adoptPredecessor(failed string) {
+	n.preLock.RLock()
+	list := n.predecessorList
+	n.preLock.RUnlock()
+	for _, candidate := range list {
+		if candidate == NULL || candidate == failed || candidate == n.addr || !n.ping(candidate) {
+			continue
+		}
+		var pre string
+		_ = n.GetPredecessor(NULL, &pre)
+		if pre != NULL {
+			return
+		}
+		n.maintenanceLog().Infof("Address [%v] adopts [%v] from its predecessor list.", n.addr, candidate)
+		_ = n.SetPredecessor(candidate, nil)
+		_ = n.replicator.OnTopologyChange(TopologyChange{Kind: TopologyPredecessorAdopted, Peer: candidate})
+		n.updatePredecessorList(candidate)
+		return
 	}
 }
 
@@ -226,391 +748,1025 @@ func (n *ChordNode) CheckPredecessor(_ string, _ *string) error {
 	return nil
 }
 
+// maintain starts the maintenance workers, unless they are running already.
 func (n *ChordNode) maintain() {
-	go func() {
-		for {
-			if n.online {
-				n.stabilize()
+	online := n.isOnline
+	ring := func() bool { return n.isOnline() && n.tier != TierLeaf }
+	n.workers.start([]worker{
+		{name: "stabilize", step: func() time.Duration {
+			changed := true
+			if n.isOnline() {
+				changed = n.stabilize()
 			}
-			time.Sleep(maintainPauseTime)
-		}
-	}()
-	go func() {
-		for {
-			if n.online {
-				n.fixFinger()
+			return n.pause(taskStabilize, changed)
+		}},
+		{name: "fix-finger", step: func() time.Duration {
+			if n.isOnline() && n.router != nil {
+				n.router.Maintain()
+				return maintainPauseTime
 			}
-			time.Sleep(maintainPauseTime)
-		}
-	}()
-	go func() {
-		for {
-			if n.online {
-				n.checkPredecessor()
+			changed := true
+			if n.isOnline() {
+				changed = n.fixFinger()
 			}
-			time.Sleep(maintainPauseTime)
-		}
-	}()
+			return n.pause(taskFixFinger, changed)
+		}},
+		{name: "check-predecessor", step: func() time.Duration {
+			changed := true
+			if n.isOnline() {
+				changed = n.checkPredecessor()
+			}
+			return n.pause(taskCheckPredecessor, changed)
+		}},
+		periodic("accordion", accordionAdjustTime, online, n.accordion.adjust),
+		periodic("audit", auditCheckTime, online, n.auditIfDue),
+		periodic("backup", backupCheckTime, online, n.backupIfDue),
+		periodic("cache-sweep", cacheSweepTime, func() bool { return n.isOnline() && n.cache.mode() != CacheOff }, n.evictExpired),
+		periodic("aggregate", aggregateGossipTime, ring, n.gossipAggregate),
+		periodic("invalidation", invalidationFlushTime, online, func() { n.invalidateWatched(false) }),
+		periodic("replication-queue", replicationQueuePollTime, online, n.drainReplicationQueue),
+		periodic("backup-reclaim", backupReclaimTime, func() bool { return ring() && !n.deferring() && !n.frozen(false) }, func() { n.reclaimPreBackup() }),
+		periodic("membership", membershipGossipTime, ring, n.gossipMembership),
+		periodic("successor-check", successorCheckTime, ring, n.checkSuccessorList),
+		periodic("rtt-probe", rttProbeTime, ring, n.probePeers),
+		{name: "key-filter", step: func() time.Duration {
+			if ring() && n.filters.on() {
+				n.refreshKeyFilters()
+			}
+			return n.filters.refreshTime()
+		}},
+	})
 }
 
 func (n *ChordNode) create() {
-	log.Infoln("Start creating a dht network...")
-	n.onlineLock.Lock()
-	n.online = true
-	n.onlineLock.Unlock()
+	if n.tier == TierLeaf {
+		n.maintenanceLog().Errorf("Trying to create a network from a leaf.")
+		return
+	}
+	if _, ok := n.enter(StateJoining, StateCreated, StateOffline); !ok {
+		return
+	}
+	n.serve()
+	n.maintain()
+	n.maintenanceLog().Infoln("Start creating a dht network...")
 	n.sucLock.Lock()
+	old := n.successorList[0]
 	n.successorList[0] = n.addr
 	n.sucLock.Unlock()
+	n.fireSuccessorChanged(old, n.addr)
 	_ = n.SetPredecessor(n.addr, nil)
 	n.fingerLock.Lock()
 	for i := 0; i < M; i++ {
 		n.fingerTable[i] = n.addr
 	}
 	n.fingerLock.Unlock()
-	log.Infoln("Create finished.")
+	n.enter(StateOnline, StateJoining)
+	n.maintenanceLog().Infoln("Create finished.")
+	n.fireJoinComplete(n.addr)
 }
 
 func (n *ChordNode) EraseRedundantPreBackup(redundant *map[string]string, _ *string) error {
 	n.preBackupLock.Lock()
 	for k, v := range *redundant {
-		log.Infof("Erase k-v pair [key:%v][value:%v] from node [%v]'s pre backup.", k, v, n.addr)
-		delete(n.preBackup, k)
+		n.replicationLog().Infof("Erase k-v pair [key:%v][value:%v] from node [%v]'s pre backup.", k, v, n.addr)
+		n.backupDelete(k, "ChordNode.EraseRedundantPreBackup")
+		n.seeding.note(k, nil)
 	}
 	n.preBackupLock.Unlock()
 	return nil
 }
 
+// TransferData moves to pre the keys it takes over. A transfer too large for
+// one message returns its first part, and pre fetches the rest with
+// NextTransferChunk.
 func (n *ChordNode) TransferData(pre string, preStore *map[string]string) error {
-	log.Infof("Start transfer data from [%v] to [%v].", n.addr, pre)
-	nId := id(pre)
-	thisId := id(n.addr)
-	n.storeLock.Lock()
-	n.preBackupLock.Lock()
-	n.preBackup = make(map[string]string)
-	log.Infof("Clear node [%v]'s pre backup.", n.addr)
-	for k, v := range n.store {
-		if !within(id(k), nId, thisId, true) {
-			log.Infof("node [%v] transfer k-v pair [key:%v][value:%v] to node [%v], and add this pair to node[%v]'s pre backup.", n.addr, k, v, pre, n.addr)
-			(*preStore)[k] = v
-			n.preBackup[k] = v
-			delete(n.store, k)
-		}
+	if n.frozen(true) {
+		n.maintenanceLog().Errorf("Node [%v] refuses to transfer data to [%v], the ring is frozen.", n.addr, pre)
+		return ErrRingFrozen
 	}
-	n.storeLock.Unlock()
-	n.preBackupLock.Unlock()
-	var suc string
-	err := n.FirstAvailableSuccessor(NULL, &suc)
-	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.TransferData", "ChordNode.FirstAvailableSuccessor", err)
+	var data map[string]string
+	if err := n.transferData(pre, &data); err != nil {
 		return err
 	}
-	if suc != pre {
-		log.Infof("Start erasing redundant data in node [%v]'s pre backup.", suc)
-		_ = RPCCall(suc, "ChordNode.EraseRedundantPreBackup", preStore, nil)
+	*preStore = n.outbox.stage(pre, n.msgLimit.splitReply(TransferReply{Changed: data})).Changed
+	return nil
+}
+
+// transferData moves the keys of pre's range to pre. It takes the store lock
+// a chunk of keys at a time, so that writes go on during a large transfer,
+// and moves the keys of the range written meanwhile in a last pass.
+func (n *ChordNode) transferData(pre string, preStore *map[string]string) error {
+	if !n.admits(pre) {
+		n.maintenanceLog().Errorf("Node [%v] refuses to transfer data to unadmitted [%v].", n.addr, pre)
+		return ErrNotAdmitted
+	}
+	if n.joinLease.heldByOther(pre) {
+		n.maintenanceLog().Errorf("Node [%v] refuses to transfer data to [%v] during another join.", n.addr, pre)
+		return errJoinLeaseHeld
+	}
+	n.maintenanceLog().Infof("Start transfer data from [%v] to [%v].", n.addr, pre)
+	n.publish(EventTransferStarted, pre, 0, "out")
+	nId := NodeId(pre)
+	thisId := NodeId(n.addr)
+	leaving := func(k string) bool {
+		return !within(n.keyId(k), nId, thisId, true) && !n.hosts(k)
+	}
+	n.transfers.start()
+	var keys []string
+	n.storeLock.RLock()
+	n.store.Iterate(func(k, _ string) bool {
+		if leaving(k) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	n.storeLock.RUnlock()
+	*preStore = make(map[string]string)
+	var moved []string
+	// move runs under the store lock.
+	move := func(keys []string) {
+		for _, k := range keys {
+			v, ok := n.store.Get(k)
+			if !ok || !leaving(k) {
+				continue
+			}
+			n.maintenanceLog().Infof("node [%v] transfer k-v pair [key:%v][value:%v] to node [%v], and add this pair to node[%v]'s pre backup.", n.addr, k, v, pre, n.addr)
+			if _, again := (*preStore)[k]; !again {
+				moved = append(moved, k)
+			}
+			(*preStore)[k] = v
+			n.storeDelete(n.store, k, "ChordNode.transferData")
+			delete(n.meta, k)
+		}
+	}
+	for len(keys) > 0 {
+		chunk := keys
+		if len(chunk) > snapshotChunkSize {
+			chunk = chunk[:snapshotChunkSize]
+		}
+		keys = keys[len(chunk):]
+		n.storeLock.Lock()
+		move(chunk)
+		n.storeLock.Unlock()
 	}
+	n.storeLock.Lock()
+	move(n.transfers.stop())
+	n.storeLock.Unlock()
+	n.publish(EventTransferFinished, pre, len(moved), "out")
+	n.handShardsTo(pre, *preStore)
+	n.fireKeysTransferredOut(pre, moved)
+	_ = n.replicator.OnTopologyChange(TopologyChange{Kind: TopologyKeysHandedOff, Peer: pre, Keys: *preStore})
 	return nil
 }
 
 func (n *ChordNode) join(addr string) bool {
-	log.Infof("Start join node [%v] by the assist of [%v].", n.addr, addr)
-	if n.online {
-		log.Errorf("Trying to join a joined node.")
-		return false
+	_, err := n.joinRing(addr)
+	return err == nil
+}
+
+// joinRing joins the ring addr is on, in front of suc, or attaches a leaf to
+// addr.
+func (n *ChordNode) joinRing(addr string) (suc string, err error) {
+	n.maintenanceLog().Infof("Start join node [%v] by the assist of [%v].", n.addr, addr)
+	if n.tier == TierLeaf {
+		n.serve()
+		return addr, n.attach(addr)
+	}
+	was, ok := n.enter(StateJoining, StateCreated, StateOffline, StateStandby)
+	if !ok {
+		n.maintenanceLog().Errorf("Trying to join a joined node.")
+		return NULL, ErrAlreadyJoined
+	}
+	joined := false
+	defer func() {
+		if !joined {
+			n.life.move(was, StateJoining)
+		}
+	}()
+	// A node that quit before joins on a fresh listener, with its
+	// maintenance started over.
+	n.serve()
+	n.maintain()
+	if suc, err = n.requestAdmission(addr); err != nil {
+		return NULL, err
 	}
 	_ = n.SetPredecessor(NULL, nil)
-	var suc string
-	err := RPCCall(addr, "ChordNode.FindSuccessor", id(n.addr), &suc)
-	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.join", "ChordNode.FindSuccessor", err)
-		return false
+	if suc == NULL {
+		err = n.call(addr, "ChordNode.FindSuccessor", NodeId(n.addr), &suc)
+		if err != nil {
+			n.logErrorFunctionCall(n.addr, "ChordNode.join", "ChordNode.FindSuccessor", err)
+			return NULL, ErrUnavailable
+		}
 	}
-	log.Infof("Get node [%v]'s successor: [%v].", n.addr, suc)
-	log.Infoln("Start initializing successor list...")
+	if suc, err = n.leaseJoin(suc); err != nil {
+		return NULL, err
+	}
+	defer func() { _ = n.call(suc, "ChordNode.ReleaseJoinLease", n.addr, nil) }()
+	n.maintenanceLog().Infof("Get node [%v]'s successor: [%v].", n.addr, suc)
+	n.maintenanceLog().Infoln("Start initializing successor list...")
 	var list [SuccessorListLen]string
-	_ = RPCCall(suc, "ChordNode.GetSuccessorList", NULL, &list)
+	_ = n.call(suc, "ChordNode.GetSuccessorList", NULL, &list)
+	n.accordion.learn(list[:]...)
+	var alive [SuccessorListLen]bool
+	for i := 1; i < SuccessorListLen; i++ {
+		alive[i] = n.alive(list[i-1])
+	}
 	n.sucLock.Lock()
+	old := n.successorList[0]
 	n.successorList[0] = suc
-	log.Infof("Set [%v]'s successor list %vth element to %v", n.addr, 0, suc)
+	n.maintenanceLog().Infof("Set [%v]'s successor list %vth element to %v", n.addr, 0, suc)
 	cnt := 1
 	for i := 1; i < SuccessorListLen; i++ {
-		if Ping(list[i-1]) {
+		if alive[i] {
 			n.successorList[cnt] = list[i-1]
-			log.Infof("Set [%v]'s successor list %vth element to %v", n.addr, cnt, list[i-1])
+			n.maintenanceLog().Infof("Set [%v]'s successor list %vth element to %v", n.addr, cnt, list[i-1])
 			cnt++
 		}
 		// n.successorList[i] = list[i-1]
 	}
 	n.sucLock.Unlock()
-	log.Infoln("Initializing successor list finished.")
+	n.fireSuccessorChanged(old, suc)
+	n.maintenanceLog().Infoln("Initializing successor list finished.")
 	if suc != n.addr {
-		log.Infof("Transfer node [%v]'s data to [%v].", suc, n.addr)
+		n.presentTicket(suc)
+		n.maintenanceLog().Infof("Transfer node [%v]'s data to [%v].", suc, n.addr)
+		n.publish(EventTransferStarted, suc, 0, "in")
+		t := n.startOp("transfer", NULL)
+		begin := time.Now()
+		var data map[string]string
+		if relocated := n.relocation.relocating(); was == StateStandby || relocated {
+			data, err = n.transferDelta(suc, relocated)
+		} else {
+			err = n.call(suc, "ChordNode.TransferData", n.addr, &data)
+			if err == nil {
+				reply := TransferReply{Changed: data}
+				err = n.transferRest(suc, &reply)
+				data = reply.Changed
+			}
+		}
+		t.phase("TransferData", suc, begin)
+		t.finish(err == nil)
+		if classifyError(err) == ErrRingFrozen {
+			n.maintenanceLog().Errorf("Node [%v] gives up joining before [%v], the ring is frozen.", n.addr, suc)
+			return NULL, ErrRingFrozen
+		}
+		if err != nil {
+			n.penalize(suc, OffenceFailedTransfer)
+		}
+		received := make([]string, 0, len(data))
 		n.storeLock.Lock()
-		_ = RPCCall(suc, "ChordNode.TransferData", n.addr, &n.store)
+		for k, v := range data {
+			// A write that reached this node during the transfer is newer,
+			// unless a resolver has it otherwise.
+			if cur, ok := n.store.Get(k); ok {
+				if v = n.resolveConflictLocked(ConflictJoin, k, v, time.Time{}, ResolveLocal); v == cur {
+					continue
+				}
+			}
+			n.storePut(n.store, k, v, "ChordNode.join")
+			// The metadata of a key held before belongs to the copy replaced.
+			delete(n.meta, k)
+			received = append(received, k)
+		}
 		n.storeLock.Unlock()
+		n.publish(EventTransferFinished, suc, len(received), "in")
+		n.fireKeysTransferredIn(suc, received)
 	}
-	log.Infoln("Start initializing finger table...")
+	n.maintenanceLog().Infoln("Start initializing finger table...")
 	n.fingerLock.Lock()
 	n.fingerTable[0] = suc
-	log.Infof("Set node [%v]'s finger table %vth element to [%v].", n.addr, 0, suc)
+	n.maintenanceLog().Infof("Set node [%v]'s finger table %vth element to [%v].", n.addr, 0, suc)
 	n.fingerLock.Unlock()
-	nId := id(n.addr)
+	if !n.deriveFingerTable(suc) {
+		nId := NodeId(n.addr)
+		for i := 1; i < M; i++ {
+			var finI string
+			err = n.call(suc, "ChordNode.FindSuccessor", start(nId, i), &finI)
+			if err != nil {
+				n.logErrorFunctionCall(n.addr, "ChordNode.join", "ChordNode.FindSuccessor", err)
+				finI = NULL
+			}
+			n.fingerLock.Lock()
+			n.fingerTable[i] = finI
+			n.maintenanceLog().Infof("Set node [%v]'s finger table %vth element to [%v].", n.addr, i, finI)
+			n.fingerLock.Unlock()
+		}
+	}
+	joined = true
+	n.enter(StateOnline, StateJoining)
+	// Take the arc over before the lease goes, so the next join behind this
+	// one finds this node as the successor's predecessor.
+	_ = n.call(suc, "ChordNode.Notify", n.addr, nil)
+	n.maintenanceLog().Infof("Node [%v] successfully joined network by the assist of [%v].", n.addr, addr)
+	n.fireJoinComplete(addr)
+	return suc, nil
+}
+
+func (n *ChordNode) GetFingerTable(_ string, ret *[M]string) error {
+	n.fingerLock.RLock()
+	*ret = n.fingerTable
+	n.fingerLock.RUnlock()
+	return nil
+}
+
+// deriveFingerTable fills the finger table from the nodes the successor
+// already knows about: a joining node sits right before its successor, so the
+// successor's fingers are close to the ones this node needs. Each entry takes
+// the first known node at or after its start; fixFinger corrects whatever the
+// successor did not know.
+func (n *ChordNode) deriveFingerTable(suc string) bool {
+	var table [M]string
+	err := n.call(suc, "ChordNode.GetFingerTable", NULL, &table)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.deriveFingerTable", "ChordNode.GetFingerTable", err)
+		return false
+	}
+	type known struct {
+		addr string
+		id   *big.Int
+	}
+	seen := map[string]bool{n.addr: true, suc: true}
+	nodes := []known{{n.addr, NodeId(n.addr)}, {suc, NodeId(suc)}}
+	for _, f := range table {
+		if f != NULL && !seen[f] {
+			seen[f] = true
+			nodes = append(nodes, known{f, NodeId(f)})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].id.Cmp(nodes[j].id) < 0
+	})
+	nId := NodeId(n.addr)
+	n.fingerLock.Lock()
 	for i := 1; i < M; i++ {
-		var finI string
-		err = RPCCall(suc, "ChordNode.FindSuccessor", start(nId, i), &finI)
-		if err != nil {
-			logErrorFunctionCall(n.addr, "ChordNode.join", "ChordNode.FindSuccessor", err)
-			finI = NULL
-		}
-		n.fingerLock.Lock()
-		n.fingerTable[i] = finI
-		log.Infof("Set node [%v]'s finger table %vth element to [%v].", n.addr, i, finI)
-		n.fingerLock.Unlock()
-	}
-	n.onlineLock.Lock()
-	n.online = true
-	n.onlineLock.Unlock()
-	log.Infof("Node [%v] successfully joined network by the assist of [%v].", n.addr, addr)
+		tar := start(nId, i)
+		k := sort.Search(len(nodes), func(j int) bool {
+			return nodes[j].id.Cmp(tar) >= 0
+		})
+		n.fingerTable[i] = nodes[k%len(nodes)].addr
+	}
+	n.fingerLock.Unlock()
+	n.maintenanceLog().Infof("Derive node [%v]'s finger table from [%v]'s with %v known nodes.", n.addr, suc, len(nodes))
 	return true
 }
 
-func (n *ChordNode) AppendPreBackup(appendStore *map[string]string, _ *string) error {
+func (n *ChordNode) AppendPreBackup(batch *BackupBatch, _ *string) error {
+	n.tombstones.filter(batch.Data)
 	n.preBackupLock.Lock()
-	for k, v := range *appendStore {
-		n.preBackup[k] = v
+	var ret error
+	for k, v := range batch.Data {
+		v, err := n.backupPut(k, v, batch.Owner, "ChordNode.AppendPreBackup")
+		if err != nil {
+			// The rest still goes in; the writer sends the whole batch again.
+			ret = err
+			continue
+		}
+		n.seeding.note(k, &v)
 	}
 	n.preBackupLock.Unlock()
-	return nil
+	n.replication.backupUpdated()
+	return ret
 }
 
-func (n *ChordNode) mergeBackup() {
+// promoteBackup takes over the keys of failed, and of the other owners in the
+// pre backup that are gone.
+func (n *ChordNode) promoteBackup(failed string) {
+	owners := n.mergeOwners(failed)
+	merged := n.mergeBackup(owners)
+	if n.updateSuccessorBackupAfterMerge(owners) {
+		n.assertPromoted(merged)
+	}
+}
+
+// mergeBackup promotes the keys of the given owners, and those without one,
+// from the pre backup to the store, and returns them.
+func (n *ChordNode) mergeBackup(owners map[string]bool) []string {
 	n.storeLock.Lock()
 	n.preBackupLock.RLock()
-	for k, v := range n.preBackup {
-		n.store[k] = v
-	}
+	var merged, promoted []string
+	n.preBackup.Iterate(func(k, v string) bool {
+		if !n.merging(k, owners) || n.tombstones.has(k) {
+			return true
+		}
+		merged = append(merged, k)
+		if _, ok := n.store.Get(k); !ok {
+			promoted = append(promoted, k)
+		}
+		v = n.resolveConflictLocked(ConflictPromotion, k, v, n.backupOwners.at[k], ResolveIncoming)
+		n.storePut(n.store, k, v, "ChordNode.mergeBackup")
+		delete(n.meta, k)
+		return true
+	})
 	n.storeLock.Unlock()
 	n.preBackupLock.RUnlock()
+	if len(promoted) > 0 {
+		n.publish(EventBackupPromoted, NULL, len(promoted), NULL)
+	}
+	n.fireKeysTransferredIn(NULL, promoted)
+	return merged
 }
 
-func (n *ChordNode) updateSuccessorBackupAfterMerge() {
+// updateSuccessorBackupAfterMerge hands the keys mergeBackup promoted from
+// the pre backup on to the successor's, as this node's own, with the values
+// the store kept, which a conflict resolver may have chosen over the copies
+// promoted. A key the store no longer holds is not handed on. It tells
+// whether it took them out of the pre backup, which it does not while this
+// node is its own successor.
+func (n *ChordNode) updateSuccessorBackupAfterMerge(owners map[string]bool) bool {
 	var suc string
 	err := n.FirstAvailableSuccessor(NULL, &suc)
 	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.updateSuccessorBackupAfterMerge", "ChordNode.FirstAvailableSuccessor", err)
-		return
+		n.logErrorFunctionCall(n.addr, "ChordNode.updateSuccessorBackupAfterMerge", "ChordNode.FirstAvailableSuccessor", err)
+		return false
 	}
-	if suc != n.addr {
-		n.preBackupLock.Lock()
-		_ = RPCCall(suc, "ChordNode.AppendPreBackup", &n.preBackup, nil)
-		n.preBackup = make(map[string]string)
-		n.preBackupLock.Unlock()
+	if suc == n.addr {
+		return false
 	}
-}
-
-func (n *ChordNode) GetStore(_ string, ret *map[string]string) error {
+	backup := BackupBatch{Owner: n.addr, Data: make(map[string]string)}
 	n.storeLock.RLock()
-	*ret = make(map[string]string)
-	for k, v := range n.store {
-		(*ret)[k] = v
-	}
+	n.preBackupLock.Lock()
+	n.preBackup.Iterate(func(k, _ string) bool {
+		if n.merging(k, owners) {
+			if v, ok := n.store.Get(k); ok {
+				backup.Data[k] = v
+			}
+			n.backupDelete(k, "ChordNode.updateSuccessorBackupAfterMerge")
+		}
+		return true
+	})
+	n.preBackupLock.Unlock()
 	n.storeLock.RUnlock()
-	return nil
-}
-
-func (n *ChordNode) shutDownServer() {
-	n.onlineLock.Lock()
-	n.online = false
-	n.onlineLock.Unlock()
-	n.quitSignal <- true
-	err := n.listener.Close()
-	if err != nil {
-		log.Errorf("close listener failed in force quit, error message: [%v]", err)
-		return
+	err = n.appendPreBackup(suc, &backup)
+	if err == nil {
+		n.replication.fullSync()
 	}
+	return true
 }
 
 func (n *ChordNode) clear() {
 	n.storeLock.Lock()
-	n.store = make(map[string]string)
+	n.storeReset(n.store, nil, "ChordNode.clear")
+	n.meta = make(map[string]*valueMeta)
 	n.storeLock.Unlock()
 	n.preBackupLock.Lock()
-	n.preBackup = make(map[string]string)
+	n.backupReset(nil, NULL, "ChordNode.clear")
 	n.preBackupLock.Unlock()
-	n.quitSignal = make(chan bool, 2)
+	n.replQueue.reset()
+	n.hotCache.reset()
+	n.negCache.reset()
+	n.filters.reset()
+	n.watchers.reset()
+	n.invalidations.reset()
+	n.tombstones.reset()
+	n.bulk.lock.Lock()
+	n.bulk.pending = nil
+	n.bulk.lock.Unlock()
+	// Routing state of this life would only point the next one at nodes
+	// that may be gone.
+	n.sucLock.Lock()
+	n.successorList = [SuccessorListLen]string{}
+	n.sucLock.Unlock()
+	n.fingerLock.Lock()
+	n.fingerTable = [M]string{}
+	n.next = 0
+	n.fingerLock.Unlock()
+	n.preLock.Lock()
+	n.predecessor = NULL
+	n.predecessorList = [PredecessorListLen]string{}
+	n.preLock.Unlock()
+	n.migrations.lock.Lock()
+	n.migrations.outgoing = nil
+	n.migrations.hosted = nil
+	n.migrations.lock.Unlock()
 }
 
 func (n *ChordNode) quit() {
-	if !n.online {
-		log.Errorf("Trying to force quit node that has quitted.")
+	if n.tier == TierLeaf {
+		n.detach()
+		n.stopWorkers()
+		n.fireQuit(false)
+		return
+	}
+	if _, ok := n.life.move(StateOffline, StateStandby); ok {
+		// A standby holds nothing the ring needs.
+		n.shutDownServer(true)
+		n.stopWorkers()
+		n.clear()
+		n.fireQuit(false)
 		return
 	}
-	n.shutDownServer()
-	var suc, pre string
+	if _, ok := n.life.move(StateDraining, StateOnline); !ok {
+		n.maintenanceLog().Errorf("Trying to quit node that has quitted.")
+		return
+	}
+	n.shutDownServer(true)
+	var pre string
 	_ = n.GetPredecessor(NULL, &pre)
+	n.handOffShards()
+	n.storeLock.RLock()
+	data := n.store.Snapshot()
+	n.storeLock.RUnlock()
+	handedOff := false
+	for i := 0; i < quitHandoffAttempts && !handedOff; i++ {
+		if i > 0 {
+			time.Sleep(quitRetryPauseTime)
+		}
+		handedOff = n.handOff(data)
+	}
+	if !handedOff {
+		n.maintenanceLog().Errorf("Node [%v] quits without its successor confirming it took over %v keys.", n.addr, len(data))
+	}
+	detached := pre == NULL || pre == n.addr
+	for i := 0; i < quitHandoffAttempts && !detached; i++ {
+		if i > 0 {
+			time.Sleep(quitRetryPauseTime)
+		}
+		detached = n.detachFrom(pre)
+	}
+	if !detached {
+		n.maintenanceLog().Errorf("Node [%v] quits while predecessor [%v] may still point at it.", n.addr, pre)
+	}
+	n.flushCache(drainTimeout)
+	n.invalidateWatched(true)
+	n.shipJournal()
+	n.announceLeave()
+	n.stopWorkers()
+	n.clear()
+	n.enter(StateOffline, StateDraining)
+	n.fireQuit(false)
+}
+
+// handOff has the successor notice this node is gone, which promotes its
+// backup of data, and then checks that it holds every key, pushing the ones
+// it lacks.
+func (n *ChordNode) handOff(data map[string]string) bool {
+	var suc string
 	err := n.FirstAvailableSuccessor(NULL, &suc)
 	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.quit", "ChordNode.FirstAvailableSuccessor", err)
-		return
+		n.logErrorFunctionCall(n.addr, "ChordNode.handOff", "ChordNode.FirstAvailableSuccessor", err)
+		return false
 	}
-	err = RPCCall(suc, "ChordNode.CheckPredecessor", NULL, nil)
+	if suc == n.addr {
+		return true
+	}
+	err = n.call(suc, "ChordNode.CheckPredecessor", NULL, nil)
 	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.quit", "ChordNode.CheckPredecessor", err)
-		return
+		n.logErrorFunctionCall(n.addr, "ChordNode.handOff", "ChordNode.CheckPredecessor", err)
+		return false
 	}
-	err = RPCCall(pre, "ChordNode.Stabilize", NULL, nil)
+	var sucPre string
+	err = n.call(suc, "ChordNode.GetPredecessor", NULL, &sucPre)
+	if err != nil || sucPre == n.addr {
+		n.maintenanceLog().Errorf("Successor [%v] of quitting node [%v] still takes it as predecessor.", suc, n.addr)
+		return false
+	}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	var missing []string
+	err = n.call(suc, "ChordNode.MissingInStore", keys, &missing)
 	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.quit", "ChordNode.Stabilize", err)
-		return
+		n.logErrorFunctionCall(n.addr, "ChordNode.handOff", "ChordNode.MissingInStore", err)
+		return false
 	}
-	n.clear()
+	if len(missing) == 0 {
+		return true
+	}
+	n.maintenanceLog().Infof("Successor [%v] lacks %v keys of quitting node [%v], pushing them.", suc, len(missing), n.addr)
+	batch := make(map[string]string, len(missing))
+	for _, k := range missing {
+		batch[k] = data[k]
+	}
+	err = n.call(suc, "ChordNode.BulkPutAcceptedInStore", &batch, nil)
+	if err == nil {
+		err = n.call(suc, "ChordNode.FinishBulkLoad", NULL, nil)
+	}
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.handOff", "ChordNode.BulkPutAcceptedInStore", err)
+		return false
+	}
+	// Check again next round rather than trusting the push.
+	err = n.call(suc, "ChordNode.MissingInStore", missing, &missing)
+	return err == nil && len(missing) == 0
+}
+
+// detachFrom has the predecessor stabilize past this node and checks that
+// it did.
+func (n *ChordNode) detachFrom(pre string) bool {
+	err := n.call(pre, "ChordNode.Stabilize", NULL, nil)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.detachFrom", "ChordNode.Stabilize", err)
+		// A predecessor that is gone does not point anywhere.
+		return !isTransportError(err) || !n.ping(pre)
+	}
+	var list [SuccessorListLen]string
+	err = n.call(pre, "ChordNode.GetSuccessorList", NULL, &list)
+	return err == nil && list[0] != n.addr
 }
 
 func (n *ChordNode) forceQuit() {
-	if !n.online {
-		log.Errorf("Trying to force quit node that has quitted.")
+	if n.tier == TierLeaf {
+		n.leaf.lock.Lock()
+		if n.leaf.attached {
+			n.leaf.attached = false
+			n.leaf.stop <- true
+		}
+		n.leaf.lock.Unlock()
+		n.shutDownServer(false)
+		n.stopWorkers()
+		n.fireQuit(true)
 		return
 	}
-	n.shutDownServer()
+	if _, ok := n.life.move(StateOffline, StateOnline, StateJoining, StateStandby); !ok {
+		n.maintenanceLog().Errorf("Trying to force quit node that has quitted.")
+		return
+	}
+	n.shutDownServer(false)
+	n.stopWorkers()
 	n.clear()
+	n.fireQuit(true)
 }
 
-func (n *ChordNode) ping(addr string) bool {
-	return Ping(addr)
+func (n *ChordNode) put(key string, val string) bool {
+	return n.putWithAck(key, val, nil) != AckNone
 }
 
-func (n *ChordNode) put(key string, val string) bool {
-	log.Infof("Start put k-v pair [key:%v][value:%v] from node [%v].", key, val, n.addr)
-	if !n.online {
-		log.Errorf("Trying to put in an offline node.")
-		return false
+func (n *ChordNode) putWithAck(key string, val string, trace *OpTrace) AckLevel {
+	ack, _ := n.putValue(key, val, trace)
+	return ack
+}
+
+// putValue is putWithAck that also tells why a put got no ack.
+func (n *ChordNode) putValue(key string, val string, trace *OpTrace) (AckLevel, error) {
+	n.storageLog().Infof("Start put k-v pair [key:%v][value:%v] from node [%v].", key, val, n.addr)
+	if n.contentAddressed && key != ContentAddress(val) {
+		n.storageLog().Errorf("Trying to put a key that is not the content address of its value.")
+		return AckNone, ErrNotContentAddress
 	}
-	var tar string
-	err := n.FindSuccessor(id(key), &tar)
-	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.put", "ChordNode.FindSuccessor", err)
-		return false
+	if err := n.acceptSize(key, val); err != nil {
+		return AckNone, err
 	}
-	log.Infof("Found key [%v]'s successor [%v].", key, tar)
-	err = RPCCall(tar, "ChordNode.PutInStore", Pair{First: key, Second: val}, nil)
-	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.put", "ChordNode.PutInStore", err)
-		return false
+	// This node reads its own write, whoever else still caches the old value
+	// until the owner tells them.
+	n.hotCache.drop([]string{key})
+	n.negCache.drop(key)
+	if n.tier == TierLeaf {
+		var ack AckLevel
+		if err := n.leafCall("ChordNode.LeafPut", Pair{First: key, Second: val}, &ack); err != nil {
+			return AckNone, classifyError(err)
+		}
+		return ack, nil
 	}
-	return true
+	var ack AckLevel
+	switch {
+	case n.contentAddressed:
+		_, ack = n.putContent(val, trace)
+	case !n.isOnline():
+		n.storageLog().Errorf("Trying to put in an offline node.")
+		return AckNone, ErrOffline
+	case n.erasure.data > 0 && len(val) >= n.erasure.minSize:
+		var err error
+		if val, err = n.acceptWrite(key, val); err != nil {
+			return AckNone, err
+		}
+		ack = n.putErasure(key, val, trace)
+	default:
+		t := n.startOp("put", key).tracing(trace)
+		_, err := n.ownerCall(t, key, "PutInStore", Pair{First: key, Second: val}, &ack)
+		t.finish(err == nil)
+		if err != nil {
+			n.logErrorFunctionCall(n.addr, "ChordNode.put", "ChordNode.PutInStore", err)
+			return AckNone, classifyError(err)
+		}
+	}
+	if ack == AckNone {
+		return ack, ErrUnavailable
+	}
+	return ack, nil
+}
+
+func (n *ChordNode) PutInStore(kv Pair, ack *AckLevel) error {
+	n.storageLog().Infof("Put k-v pair [key:%v][value:%v] to node [%v]'s store.", kv.First, kv.Second, n.addr)
+	if target, ok := n.migratedTo(kv.First); ok {
+		return n.call(target, "ChordNode.PutInStore", kv, ack)
+	}
+	if err := n.keyLeases.admits(kv.First, nil); err != nil {
+		return err
+	}
+	var err error
+	if kv.Second, err = n.acceptWrite(kv.First, kv.Second); err != nil {
+		return err
+	}
+	return n.putAccepted(kv, ack)
+}
+
+// PutAcceptedInStore is PutInStore for a value the write hooks took already,
+// one that moves between nodes.
+func (n *ChordNode) PutAcceptedInStore(kv Pair, ack *AckLevel) error {
+	n.storageLog().Infof("Put accepted k-v pair [key:%v][value:%v] to node [%v]'s store.", kv.First, kv.Second, n.addr)
+	if target, ok := n.migratedTo(kv.First); ok {
+		return n.call(target, "ChordNode.PutAcceptedInStore", kv, ack)
+	}
+	if err := n.keyLeases.admits(kv.First, nil); err != nil {
+		return err
+	}
+	return n.putAccepted(kv, ack)
 }
 
-func (n *ChordNode) PutInStore(kv Pair, _ *string) error {
-	log.Infof("Put k-v pair [key:%v][value:%v] to node [%v]'s store.", kv.First, kv.Second, n.addr)
+func (n *ChordNode) putAccepted(kv Pair, ack *AckLevel) error {
+	if err := n.cache.write(cacheWrite{key: kv.First, value: kv.Second}); err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.PutInStore", "CacheSource.Store", err)
+		return err
+	}
+	if err := n.putInStore(kv, false, ack); err != nil {
+		return err
+	}
+	n.touchCached(kv.First)
+	return nil
+}
+
+func (n *ChordNode) putInStore(kv Pair, ifAbsent bool, ack *AckLevel) error {
+	if !ifAbsent {
+		return n.putInStoreIf(kv, nil, ack)
+	}
+	return n.putInStoreIf(kv, func(_ string, ok bool) error {
+		if ok {
+			return errKeyExists
+		}
+		return nil
+	}, ack)
+}
+
+// putInStoreIf is putInStore that first asks cond, if not nil, about the
+// value the key holds, and puts nothing if it returns an error.
+func (n *ChordNode) putInStoreIf(kv Pair, cond func(cur string, ok bool) error, ack *AckLevel) error {
+	n.hotKeys.hit(kv.First)
 	n.storeLock.Lock()
-	n.store[kv.First] = kv.Second
-	n.storeLock.Unlock()
-	var suc string
-	err := n.FirstAvailableSuccessor(NULL, &suc)
+	cur, ok := n.store.Get(kv.First)
+	if cond != nil {
+		if err := cond(cur, ok); err != nil {
+			n.storeLock.Unlock()
+			return err
+		}
+	}
+	if ok {
+		kv.Second, _ = n.mergeCRDT(crdtMergePut, cur, kv.Second)
+	}
+	err := n.store.Put(kv.First, kv.Second)
+	n.transfers.note(kv.First)
+	n.filters.add(kv.First)
 	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.PutInStore", "ChordNode.FirstAvailableSuccessor", err)
+		n.storeLock.Unlock()
+		n.logErrorFunctionCall(n.addr, "ChordNode.putInStore", "KVStore.Put", err)
 		return err
 	}
-	log.Infof("Found node [%v]'s successor [%v].", n.addr, suc)
-	_ = RPCCall(suc, "ChordNode.PutInPreBackup", kv, nil)
+	n.wroteLocked(kv.First, kv.Second)
+	n.tombstones.clear(kv.First)
+	at := time.Now()
+	n.storeLock.Unlock()
+	n.journal(at, kv.First, kv.Second, false)
+	n.watchers.fire(kv.First)
+	err = n.replicator.OnPut(kv)
+	if ack != nil {
+		*ack = AckPrimary
+		if err == nil {
+			*ack = AckBackup
+		}
+	}
 	return nil
 }
 
-func (n *ChordNode) PutInPreBackup(kv Pair, _ *string) error {
-	log.Infof("Put k-v pair [key:%v][value:%v] to node [%v]'s pre backup.", kv.First, kv.Second, n.addr)
+func (n *ChordNode) PutInPreBackup(put BackupPair, _ *string) error {
+	kv := put.Pair
+	n.replicationLog().Infof("Put k-v pair [key:%v][value:%v] of [%v] to node [%v]'s pre backup.", kv.First, kv.Second, put.Owner, n.addr)
 	n.preBackupLock.Lock()
-	n.preBackup[kv.First] = kv.Second
+	var err error
+	kv.Second, err = n.backupPut(kv.First, kv.Second, put.Owner, "ChordNode.PutInPreBackup")
+	n.seeding.note(kv.First, &kv.Second)
+	n.tombstones.clear(kv.First)
 	n.preBackupLock.Unlock()
+	if err != nil {
+		return err
+	}
+	n.replication.backupUpdated()
 	return nil
 }
 
 func (n *ChordNode) get(key string) (ok bool, val string) {
-	log.Infof("Start get key [%v] from node [%v].", key, n.addr)
-	if !n.online {
-		log.Errorf("Trying to get in an offline node.")
+	val, err := n.getValue(key, nil)
+	if err != nil {
 		return false, NULL
 	}
+	return true, val
+}
+
+// getValue tells a key that does not exist, ErrNotFound, from one that could
+// not be read, ErrUnavailable. An owner that cannot be reached is retried on
+// the replica after it, so churn does not read as data loss.
+func (n *ChordNode) getValue(key string, trace *OpTrace) (val string, err error) {
+	n.storageLog().Infof("Start get key [%v] from node [%v].", key, n.addr)
+	if n.tier == TierLeaf {
+		err = classifyError(n.leafCall("ChordNode.LeafGet", key, &val))
+		if err == nil && n.contentAddressed && !verifyContent(key, val) {
+			return NULL, errContentMismatch
+		}
+		return val, err
+	}
+	if !n.isOnline() {
+		n.storageLog().Errorf("Trying to get in an offline node.")
+		return NULL, ErrOffline
+	}
+	missing, drops := n.negCache.missing(key)
+	if missing {
+		return NULL, ErrNotFound
+	}
+	hot := n.hotCache.on()
+	if hot {
+		if val, ok := n.hotCache.get(key); ok {
+			return val, nil
+		}
+		hot = n.hotCache.hot(key)
+	}
+	t := n.startOp("get", key).tracing(trace)
 	var tar string
-	err := n.FindSuccessor(id(key), &tar)
-	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.get", "ChordNode.FindSuccessor", err)
-		return false, NULL
+	var watched WatchedValue
+	if hot {
+		tar, err = n.getWatched(t, key, n.hotCache.ttlOf(), &watched)
+		val = watched.Value
+	} else if atomic.LoadInt32(&n.readRouter.mode) == ReadNearest {
+		tar, err = n.readNearest(t, key, &val)
+	} else {
+		tar, err = n.ownerCall(t, key, "GetInStore", key, &val)
+	}
+	if isTransportError(err) && tar != NULL {
+		val, err = n.getFromReplica(t, key, tar)
 	}
-	log.Infof("Found key [%v]'s successor [%v].", key, tar)
-	err = RPCCall(tar, "ChordNode.GetInStore", key, &val)
+	t.finish(err == nil)
 	if err != nil {
-		logErrorFunctionCall(tar, "ChordNode.get", "ChordNode.GetInStore", err)
-		return false, NULL
+		n.logErrorFunctionCall(tar, "ChordNode.get", "ChordNode.GetInStore", err)
+		if err = classifyError(err); err == ErrNotFound {
+			n.negCache.add(key, drops)
+		}
+		return NULL, err
 	}
-	ok = true
-	return
+	if m, isManifest := parseManifest(val); isManifest {
+		var ok bool
+		if ok, val = n.getErasure(key, m); !ok {
+			return NULL, ErrUnavailable
+		}
+		if val, err = n.readValue(key, val); err != nil {
+			return NULL, err
+		}
+	}
+	if n.contentAddressed && !verifyContent(key, val) {
+		return NULL, errContentMismatch
+	}
+	if hot && !n.invalidations.heardSince(key, InvalidationCursor{Epoch: watched.Epoch, Seq: watched.Seq}) {
+		n.hotCache.put(key, val)
+	}
+	return val, nil
+}
+
+// MissingInStore returns the keys this node's store neither holds nor has
+// seen deleted.
+func (n *ChordNode) MissingInStore(keys []string, missing *[]string) error {
+	n.storeLock.RLock()
+	defer n.storeLock.RUnlock()
+	*missing = nil
+	for _, k := range keys {
+		if _, ok := n.store.Get(k); !ok && !n.tombstones.has(k) {
+			*missing = append(*missing, k)
+		}
+	}
+	return nil
 }
 
 func (n *ChordNode) GetInStore(key string, val *string) error {
-	log.Infof("Get key [%v] in node [%v]'s store.", key, n.addr)
+	n.storageLog().Infof("Get key [%v] in node [%v]'s store.", key, n.addr)
+	if target, ok := n.migratedTo(key); ok {
+		return n.call(target, "ChordNode.GetInStore", key, val)
+	}
+	n.hotKeys.hit(key)
 	var ok bool
 	n.storeLock.RLock()
-	*val, ok = n.store[key]
+	*val, ok = n.store.Get(key)
+	if ok {
+		n.accessedLocked(key)
+	}
 	n.storeLock.RUnlock()
+	caching := n.cache.mode() != CacheOff
+	if ok && caching && n.cacheExpired(key) {
+		_, _ = n.deleteInStore(key, nil)
+		ok = false
+	}
+	if !ok && caching {
+		return n.getThroughCache(key, val)
+	}
 	if !ok {
 		*val = NULL
-		return errors.New("not found")
+		return ErrNotFound
 	}
-	return nil
+	var err error
+	*val, err = n.readValue(key, *val)
+	return err
 }
 
 func (n *ChordNode) delete(key string) bool {
-	log.Infof("Start delete key [%v] from node [%v].", key, n.addr)
-	if !n.online {
-		log.Errorf("Trying to delete in an offline node.")
-		return false
+	existed, err := n.deleteValue(key, nil)
+	return err == nil && existed
+}
+
+// deleteValue tells a delete that failed from one of a key that was not
+// there, which succeeds with existed false.
+func (n *ChordNode) deleteValue(key string, trace *OpTrace) (existed bool, err error) {
+	n.storageLog().Infof("Start delete key [%v] from node [%v].", key, n.addr)
+	n.hotCache.drop([]string{key})
+	if n.tier == TierLeaf {
+		err = classifyError(n.leafCall("ChordNode.LeafDelete", key, nil))
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return err == nil, err
 	}
-	var tar string
-	err := n.FindSuccessor(id(key), &tar)
-	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.delete", "ChordNode.FindSuccessor", err)
-		return false
+	if !n.isOnline() {
+		n.storageLog().Errorf("Trying to delete in an offline node.")
+		return false, ErrOffline
 	}
-	log.Infof("Found key [%v]'s successor [%v].", key, tar)
-	err = RPCCall(tar, "ChordNode.DeleteInStore", key, nil)
+	t := n.startOp("delete", key).tracing(trace)
+	tar, err := n.ownerCall(t, key, "DeleteInStore", key, &existed)
+	t.finish(err == nil)
 	if err != nil {
-		logErrorFunctionCall(tar, "ChordNode.delete", "ChordNode.DeleteInStore", err)
-		return false
+		n.logErrorFunctionCall(tar, "ChordNode.delete", "ChordNode.DeleteInStore", err)
+		return false, classifyError(err)
 	}
-	return true
+	return existed, nil
 }
 
-func (n *ChordNode) DeleteInStore(key string, _ *string) error {
-	log.Infof("Delete key [%v] in node [%v]'s store.", key, n.addr)
-	n.storeLock.Lock()
-	_, ok := n.store[key]
-	delete(n.store, key)
-	n.storeLock.Unlock()
-	if !ok {
-		return errors.New("trying to delete nonexistent key in store")
+// DeleteInStore is idempotent: deleting a key that is not there succeeds,
+// and existed tells the two cases apart.
+func (n *ChordNode) DeleteInStore(key string, existed *bool) error {
+	n.storageLog().Infof("Delete key [%v] in node [%v]'s store.", key, n.addr)
+	if target, ok := n.migratedTo(key); ok {
+		return n.call(target, "ChordNode.DeleteInStore", key, existed)
 	}
-	var suc string
-	err := n.FirstAvailableSuccessor(NULL, &suc)
-	if err != nil {
-		logErrorFunctionCall(n.addr, "ChordNode.DeleteInStore", "ChordNode.FirstAvailableSuccessor", err)
+	if err := n.keyLeases.admits(key, nil); err != nil {
 		return err
 	}
-	log.Infof("Found node [%v]'s successor [%v].", n.addr, suc)
-	err = RPCCall(suc, "ChordNode.DeleteInPreBackup", key, nil)
-	if err != nil {
-		logErrorFunctionCall(suc, "ChordNode.DeleteInStore", "ChordNode.DeleteInPreBackup", err)
+	if err := n.cache.write(cacheWrite{key: key, delete: true}); err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.DeleteInStore", "CacheSource.Delete", err)
 		return err
 	}
-	return nil
+	ok, err := n.deleteInStore(key, nil)
+	if existed != nil {
+		*existed = ok
+	}
+	return err
+}
+
+func (n *ChordNode) deleteInStore(key string, cond *DeleteCondition) (bool, error) {
+	n.hotKeys.hit(key)
+	if cond != nil && !cond.ByVersion {
+		raw, existed, holds := n.rawCondition(*cond)
+		if !holds {
+			return existed, errConditionFailed
+		}
+		cond = raw
+	}
+	n.storeLock.Lock()
+	val, ok := n.store.Get(key)
+	if cond != nil && (!ok || !cond.holds(val, n.versionLocked(key))) {
+		n.storeLock.Unlock()
+		return ok, errConditionFailed
+	}
+	err := n.store.Delete(key)
+	delete(n.meta, key)
+	n.tombstones.add(key)
+	at := time.Now()
+	n.storeLock.Unlock()
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.deleteInStore", "KVStore.Delete", err)
+		return ok, err
+	}
+	n.journal(at, key, NULL, true)
+	n.watchers.fire(key)
+	if m, isManifest := parseManifest(val); ok && isManifest {
+		go n.dropShards(key, m)
+	}
+	// The backup may hold the key even if this store did not, so the
+	// tombstone goes out either way; a failure to send it leaves the write
+	// unreplicated, not undone.
+	_ = n.replicator.OnDelete(key)
+	return ok, nil
 }
 
 func (n *ChordNode) DeleteInPreBackup(key string, _ *string) error {
-	log.Infof("Delete key [%v] in node [%v]'s pre backup.", key, n.addr)
+	n.replicationLog().Infof("Delete key [%v] in node [%v]'s pre backup.", key, n.addr)
 	n.preBackupLock.Lock()
-	_, ok := n.preBackup[key]
-	delete(n.preBackup, key)
+	n.backupDelete(key, "ChordNode.DeleteInPreBackup")
+	n.seeding.note(key, nil)
+	n.tombstones.add(key)
 	n.preBackupLock.Unlock()
-	if !ok {
-		return errors.New("trying to delete nonexistent key in pre backup")
-	}
+	n.replication.backupUpdated()
 	return nil
 }
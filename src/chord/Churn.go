@@ -0,0 +1,430 @@
+package chord
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ChurnJoin      = "join"
+	ChurnQuit      = "quit"
+	ChurnForceQuit = "forcequit"
+	ChurnPut       = "put"
+	ChurnGet       = "get"
+	ChurnDelete    = "delete"
+	ChurnSettle    = "settle"
+)
+
+// ChurnStep is one line of a churn script. Node is the slot of the node that
+// joins, leaves or serves the operation; a join on an empty ring creates it.
+// A step with At set is not played before that long after the run began.
+type ChurnStep struct {
+	Op    string
+	Node  int
+	Key   string
+	Value string
+	At    time.Duration
+}
+
+func (s ChurnStep) String() string {
+	switch s.Op {
+	case ChurnSettle:
+		return s.Op
+	case ChurnPut:
+		return fmt.Sprintf("%v %v %v %v", s.Op, s.Node, s.Key, s.Value)
+	case ChurnGet, ChurnDelete:
+		return fmt.Sprintf("%v %v %v", s.Op, s.Node, s.Key)
+	}
+	return fmt.Sprintf("%v %v", s.Op, s.Node)
+}
+
+// ParseChurnStep reads the form String writes.
+func ParseChurnStep(line string) (ChurnStep, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ChurnStep{}, errors.New("empty churn step")
+	}
+	s := ChurnStep{Op: fields[0]}
+	want := map[string]int{ChurnJoin: 2, ChurnQuit: 2, ChurnForceQuit: 2, ChurnPut: 4, ChurnGet: 3, ChurnDelete: 3, ChurnSettle: 1}
+	n, ok := want[s.Op]
+	if !ok {
+		return s, fmt.Errorf("unknown churn step %v", s.Op)
+	}
+	if len(fields) != n {
+		return s, fmt.Errorf("churn step %v takes %v fields", s.Op, n)
+	}
+	if n > 1 {
+		var err error
+		s.Node, err = strconv.Atoi(fields[1])
+		if err != nil || s.Node < 0 || s.Node >= ChurnMaxNodes {
+			return s, fmt.Errorf("churn node must be a slot below %v", ChurnMaxNodes)
+		}
+	}
+	if n > 2 {
+		s.Key = fields[2]
+	}
+	if n > 3 {
+		s.Value = fields[3]
+	}
+	return s, nil
+}
+
+// ChurnRecord is the seed and schedule of one run: every step with the time
+// it was played at, and what the run found.
+type ChurnRecord struct {
+	Seed       int64
+	Steps      []ChurnStep
+	Violations []string
+}
+
+// Write prints the record in the form ParseChurnRecord reads, one step per
+// line after the seed, each prefixed with its offset, and the violations as
+// comments.
+func (r ChurnRecord) Write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "seed %v\n", r.Seed)
+	for _, s := range r.Steps {
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "+%v %v\n", s.At, s)
+	}
+	for _, v := range r.Violations {
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "# ! %v\n", v)
+	}
+	return err
+}
+
+// ParseChurnRecord reads one step per line, skipping blank lines and lines
+// starting with #. A step may be prefixed with +<offset>, and a "seed <n>"
+// line sets the seed; a plain script leaves both zero.
+func ParseChurnRecord(r io.Reader) (ChurnRecord, error) {
+	var ret ChurnRecord
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var err error
+		if strings.HasPrefix(text, "seed ") {
+			ret.Seed, err = strconv.ParseInt(strings.TrimSpace(text[len("seed "):]), 10, 64)
+			if err != nil {
+				return ret, fmt.Errorf("line %v: bad seed", line)
+			}
+			continue
+		}
+		var at time.Duration
+		if strings.HasPrefix(text, "+") {
+			fields := strings.SplitN(text, " ", 2)
+			at, err = time.ParseDuration(fields[0][1:])
+			if err != nil || len(fields) < 2 {
+				return ret, fmt.Errorf("line %v: bad step offset", line)
+			}
+			text = fields[1]
+		}
+		s, err := ParseChurnStep(text)
+		if err != nil {
+			return ret, fmt.Errorf("line %v: %v", line, err)
+		}
+		s.At = at
+		ret.Steps = append(ret.Steps, s)
+	}
+	return ret, scanner.Err()
+}
+
+// GenerateChurn writes a random script of the given number of steps after
+// churnInitialNodes joins. Keys come from a small pool so that writes overlap,
+// and at least two nodes are always left in the ring.
+func GenerateChurn(seed int64, steps int) []ChurnStep {
+	r := rand.New(rand.NewSource(seed))
+	var ret []ChurnStep
+	var live []int
+	next := 0
+	for ; next < churnInitialNodes; next++ {
+		ret = append(ret, ChurnStep{Op: ChurnJoin, Node: next})
+		live = append(live, next)
+	}
+	ret = append(ret, ChurnStep{Op: ChurnSettle})
+	key := func() string { return "k" + strconv.Itoa(r.Intn(churnKeys)) }
+	for i := 0; i < steps; i++ {
+		node := live[r.Intn(len(live))]
+		switch p := r.Intn(100); {
+		case p < 30:
+			ret = append(ret, ChurnStep{Op: ChurnPut, Node: node, Key: key(), Value: "v" + strconv.Itoa(i)})
+		case p < 55:
+			ret = append(ret, ChurnStep{Op: ChurnGet, Node: node, Key: key()})
+		case p < 65:
+			ret = append(ret, ChurnStep{Op: ChurnDelete, Node: node, Key: key()})
+		case p < 75 && next < ChurnMaxNodes:
+			ret = append(ret, ChurnStep{Op: ChurnJoin, Node: next})
+			live = append(live, next)
+			next++
+		case p < 91 && p >= 75 && len(live) > 2:
+			op := ChurnQuit
+			if p >= 83 {
+				op = ChurnForceQuit
+			}
+			ret = append(ret, ChurnStep{Op: op, Node: node})
+			for j := range live {
+				if live[j] == node {
+					live = append(live[:j], live[j+1:]...)
+					break
+				}
+			}
+		default:
+			ret = append(ret, ChurnStep{Op: ChurnSettle})
+		}
+	}
+	return ret
+}
+
+const (
+	churnAbsent = iota
+	churnPresent
+	churnUnknown
+)
+
+type churnExpect struct {
+	state int
+	value string
+}
+
+// churnRun plays a script against real nodes on loopback and holds the model
+// the reads are checked against. Keys whose owner and the churnReplicas nodes
+// after it all left since the last settle may be lost, and are not checked
+// again until they are written.
+type churnRun struct {
+	begin      time.Time
+	protocol   string
+	basePort   int
+	nodes      map[int]*NodeWrapper
+	live       []int
+	window     map[int]bool
+	departed   map[int]bool
+	model      map[string]churnExpect
+	violations []string
+}
+
+// RunChurn plays script on nodes of the given protocol listening from
+// basePort up, and records every read that contradicted an acknowledged
+// write. After the last step the ring settles and every key is read once
+// more. All nodes are stopped before it returns.
+//
+// The nodes' own random choices are drawn from seed, and steps are held back
+// to their At, so that playing a record again repeats its schedule as
+// closely as real sockets and timers allow.
+func RunChurn(seed int64, script []ChurnStep, protocol string, basePort int) ChurnRecord {
+	rand.Seed(seed)
+	c := churnRun{
+		begin:    time.Now(),
+		protocol: protocol,
+		basePort: basePort,
+		nodes:    make(map[int]*NodeWrapper),
+		window:   make(map[int]bool),
+		departed: make(map[int]bool),
+		model:    make(map[string]churnExpect),
+	}
+	record := ChurnRecord{Seed: seed, Steps: make([]ChurnStep, len(script))}
+	for i, s := range script {
+		if s.At > 0 {
+			time.Sleep(time.Until(c.begin.Add(s.At)))
+		}
+		s.At = time.Since(c.begin).Truncate(time.Millisecond)
+		record.Steps[i] = s
+		c.step(i, s)
+	}
+	c.settle()
+	keys := make([]string, 0, len(c.model))
+	for k := range c.model {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(c.live) > 0 {
+		for _, k := range keys {
+			c.step(len(script), ChurnStep{Op: ChurnGet, Node: c.live[0], Key: k})
+		}
+	}
+	for _, node := range c.live {
+		c.nodes[node].ForceQuit()
+	}
+	record.Violations = c.violations
+	return record
+}
+
+func (c *churnRun) addr(node int) string {
+	return "127.0.0.1:" + strconv.Itoa(c.basePort+node)
+}
+
+func (c *churnRun) isLive(node int) bool {
+	for _, l := range c.live {
+		if l == node {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *churnRun) fail(i int, s ChurnStep, format string, args ...interface{}) {
+	c.violations = append(c.violations, fmt.Sprintf("step %v [%v]: ", i, s)+fmt.Sprintf(format, args...))
+}
+
+func (c *churnRun) step(i int, s ChurnStep) {
+	if s.Op == ChurnSettle {
+		c.settle()
+		return
+	}
+	if s.Op == ChurnJoin {
+		c.join(s.Node)
+		return
+	}
+	if !c.isLive(s.Node) {
+		return
+	}
+	w := c.nodes[s.Node]
+	switch s.Op {
+	case ChurnQuit, ChurnForceQuit:
+		if len(c.live) == 1 {
+			return
+		}
+		if s.Op == ChurnQuit {
+			w.Quit()
+		} else {
+			w.ForceQuit()
+		}
+		c.leave(s.Node)
+	case ChurnPut:
+		if w.Put(s.Key, s.Value) {
+			c.model[s.Key] = churnExpect{state: churnPresent, value: s.Value}
+		} else {
+			c.model[s.Key] = churnExpect{state: churnUnknown}
+		}
+	case ChurnDelete:
+		if w.Delete(s.Key) {
+			c.model[s.Key] = churnExpect{state: churnAbsent}
+		} else if c.model[s.Key].state == churnPresent {
+			c.model[s.Key] = churnExpect{state: churnUnknown}
+		}
+	case ChurnGet:
+		ok, value := w.Get(s.Key)
+		e := c.model[s.Key]
+		switch {
+		case e.state == churnPresent && !ok:
+			c.fail(i, s, "acknowledged value %v of key %v is gone", e.value, s.Key)
+		case e.state == churnPresent && value != e.value:
+			c.fail(i, s, "key %v reads %v instead of acknowledged %v", s.Key, value, e.value)
+		case e.state == churnAbsent && ok:
+			c.fail(i, s, "absent key %v reads %v", s.Key, value)
+		}
+	}
+}
+
+func (c *churnRun) join(node int) {
+	if _, ok := c.nodes[node]; ok {
+		return
+	}
+	w, err := NewProtocolNode(c.protocol, c.addr(node))
+	if err != nil {
+		return
+	}
+	c.nodes[node] = w
+	w.Run()
+	if len(c.live) == 0 {
+		w.Create()
+	} else if !w.Join(c.addr(c.live[0])) {
+		w.ForceQuit()
+		c.window[node] = true
+		c.leave(node)
+		return
+	}
+	c.live = append(c.live, node)
+	c.window[node] = true
+}
+
+func (c *churnRun) leave(node int) {
+	for j := range c.live {
+		if c.live[j] == node {
+			c.live = append(c.live[:j], c.live[j+1:]...)
+			break
+		}
+	}
+	c.departed[node] = true
+	c.forgetLost()
+}
+
+func (c *churnRun) settle() {
+	ring := make([]*NodeWrapper, 0, len(c.live))
+	for _, node := range c.live {
+		ring = append(ring, c.nodes[node])
+	}
+	awaitRing(ring)
+	c.window = make(map[int]bool)
+	for _, node := range c.live {
+		c.window[node] = true
+	}
+	c.departed = make(map[int]bool)
+}
+
+// forgetLost marks the keys of every node that left together with the
+// churnReplicas nodes after it, in the ring since the last settle.
+func (c *churnRun) forgetLost() {
+	ring := make([]int, 0, len(c.window))
+	ids := make(map[int]*big.Int)
+	for node := range c.window {
+		ring = append(ring, node)
+		ids[node] = NodeId(c.addr(node))
+	}
+	sort.Slice(ring, func(i, j int) bool { return ids[ring[i]].Cmp(ids[ring[j]]) < 0 })
+	lost := func(owner int) bool {
+		for j := 0; j <= churnReplicas && j < len(ring); j++ {
+			if !c.departed[ring[(owner+j)%len(ring)]] {
+				return false
+			}
+		}
+		return true
+	}
+	for k, e := range c.model {
+		if e.state != churnPresent {
+			continue
+		}
+		kId := c.nodes[ring[0]].node.keyId(k)
+		owner := sort.Search(len(ring), func(i int) bool { return ids[ring[i]].Cmp(kId) >= 0 }) % len(ring)
+		if lost(owner) {
+			c.model[k] = churnExpect{state: churnUnknown}
+		}
+	}
+}
+
+// ShrinkChurn removes ever smaller runs of steps from a failing script for as
+// long as fails still holds, calling it at most runs times, and returns the
+// shortest failing script found. The steps kept hold on to their offsets, so
+// a recorded schedule still paces them.
+func ShrinkChurn(script []ChurnStep, fails func([]ChurnStep) bool, runs int) []ChurnStep {
+	for chunk := len(script) / 2; chunk > 0 && runs > 0; {
+		shrunk := false
+		for start := 0; start+chunk <= len(script) && runs > 0; {
+			candidate := append(append([]ChurnStep(nil), script[:start]...), script[start+chunk:]...)
+			runs--
+			if fails(candidate) {
+				script = candidate
+				shrunk = true
+				continue
+			}
+			start += chunk
+		}
+		if !shrunk {
+			chunk /= 2
+		}
+	}
+	return script
+}
@@ -0,0 +1,487 @@
+package chord
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Client reaches a ring from outside it, without being a node: it starts
+// from a few contact addresses, learns more of the ring from their successor
+// lists, and sends each request to the healthiest node it knows, moving on
+// to the next when that one stops answering. An application gives it any
+// handful of addresses and no single one of them has to stay up.
+type Client struct {
+	codec Codec
+	lock  sync.Mutex
+	nodes map[string]*clientNode
+	rtt   rttTable
+	cache clientCache
+	stop  chan struct{}
+	once  sync.Once
+}
+
+type clientNode struct {
+	seed      bool
+	failures  int
+	downUntil time.Time
+}
+
+type ClientNodeStatus struct {
+	Addr     string
+	Seed     bool
+	RTT      time.Duration
+	Failures int
+	Down     bool
+}
+
+// NewClient returns a client of the ring the nodes at addrs are on. It keeps
+// discovering nodes in the background until it is closed.
+func NewClient(codec Codec, addrs ...string) *Client {
+	c := &Client{codec: codec, nodes: make(map[string]*clientNode), stop: make(chan struct{})}
+	for _, addr := range addrs {
+		if addr != NULL {
+			c.nodes[addr] = &clientNode{seed: true}
+		}
+	}
+	go c.discover()
+	go c.follow()
+	return c
+}
+
+func (c *Client) Close() {
+	c.once.Do(func() { close(c.stop) })
+}
+
+func (c *Client) discover() {
+	for {
+		_ = c.Refresh()
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(clientRefreshTime):
+		}
+	}
+}
+
+// Refresh adds the successors of the healthiest node that answers to the
+// nodes the client knows.
+func (c *Client) Refresh() error {
+	var list [SuccessorListLen]string
+	if err := c.call("ChordNode.GetSuccessorList", NULL, &list); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, addr := range list {
+		if _, ok := c.nodes[addr]; addr != NULL && !ok {
+			c.nodes[addr] = &clientNode{}
+		}
+	}
+	return nil
+}
+
+// pick returns the node to try next, leaving out the ones in tried: one that
+// is not down if there is any, the one with the fewest failures in a row
+// among those, and the fastest of these. It returns NULL once every node has
+// been tried.
+func (c *Client) pick(tried map[string]bool) string {
+	c.lock.Lock()
+	now := time.Now()
+	type candidate struct {
+		addr     string
+		down     bool
+		failures int
+	}
+	var candidates []candidate
+	for addr, node := range c.nodes {
+		if !tried[addr] {
+			candidates = append(candidates, candidate{addr, now.Before(node.downUntil), node.failures})
+		}
+	}
+	c.lock.Unlock()
+	if len(candidates) == 0 {
+		return NULL
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.down != b.down {
+			return !a.down
+		}
+		if a.failures != b.failures {
+			return a.failures < b.failures
+		}
+		return c.rtt.faster(a.addr, b.addr)
+	})
+	return candidates[0].addr
+}
+
+func (c *Client) succeeded(addr string, d time.Duration) {
+	c.rtt.observe(addr, d)
+	c.lock.Lock()
+	if node, ok := c.nodes[addr]; ok {
+		node.failures = 0
+		node.downUntil = time.Time{}
+	}
+	c.lock.Unlock()
+}
+
+// failed marks addr down for a while. A node it discovered that keeps
+// failing is forgotten; contact addresses are kept however often they fail.
+func (c *Client) failed(addr string) {
+	c.rtt.forget(addr)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	node, ok := c.nodes[addr]
+	if !ok {
+		return
+	}
+	node.failures++
+	node.downUntil = time.Now().Add(clientDownTime)
+	if !node.seed && node.failures >= clientForgetFailures {
+		delete(c.nodes, addr)
+	}
+}
+
+// clientOnceMethods are the calls a client does not send to another node once
+// the first may have received them. Like a store method missing from
+// idempotentMethods, a second try could fail on, or report, the write the
+// first one already made.
+var clientOnceMethods = map[string]bool{
+	"ChordNode.LeafPutIfAbsent":  true,
+	"ChordNode.LeafDelete":       true,
+	"ChordNode.LeafDeleteIf":     true,
+	"ChordNode.LeafDeletePrefix": true,
+}
+
+// call makes the call on the healthiest node, failing over to the others
+// while the nodes tried cannot be reached or are no longer on the ring.
+// Errors of the call itself come back as they are. One of clientOnceMethods
+// is not failed over once a transport error came after its request was sent,
+// and then fails with ErrUnavailable.
+func (c *Client) call(serviceMethod string, args interface{}, reply interface{}) error {
+	_, err := c.callAt(serviceMethod, args, reply)
+	return err
+}
+
+// callAt is call, and returns the node that answered.
+func (c *Client) callAt(serviceMethod string, args interface{}, reply interface{}) (string, error) {
+	err := ErrUnavailable
+	tried := make(map[string]bool)
+	for addr := c.pick(tried); addr != NULL; addr = c.pick(tried) {
+		tried[addr] = true
+		begin := time.Now()
+		traffic, raw := rpcCallMetered(addr, c.codec, serviceMethod, args, reply)
+		if err = classifyError(raw); !isTransportError(raw) && err != ErrOffline {
+			c.succeeded(addr, time.Since(begin))
+			return addr, err
+		}
+		c.failed(addr)
+		if isTransportError(raw) && traffic.sent > 0 && clientOnceMethods[serviceMethod] {
+			return addr, err
+		}
+	}
+	return NULL, err
+}
+
+func (c *Client) Put(key string, value string) error {
+	var ack AckLevel
+	c.cache.drop([]string{key})
+	return c.call("ChordNode.LeafPut", Pair{First: key, Second: value}, &ack)
+}
+
+// Get returns ErrNotFound for a key that does not exist. With the cache on,
+// it answers from the cache while the value there is fresh.
+func (c *Client) Get(key string) (string, error) {
+	if val, ok := c.cache.get(key); ok {
+		return val, nil
+	}
+	if ttl := c.cache.ttl(); ttl > 0 {
+		var w WatchedValue
+		addr, err := c.callAt("ChordNode.LeafGetWatched", WatchRequest{Key: key, TTL: ttl}, &w)
+		if err == nil {
+			c.cache.put(key, addr, w)
+		}
+		return w.Value, err
+	}
+	var val string
+	err := c.call("ChordNode.LeafGet", key, &val)
+	return val, err
+}
+
+// GetMulti reads keys through one node, which reads each owner's keys with
+// one call. The error is that of reaching the node; keys that could not be
+// read are among the result's failures.
+func (c *Client) GetMulti(keys []string) (MultiGetResult, error) {
+	var ret MultiGetResult
+	err := c.call("ChordNode.LeafGetMulti", keys, &ret)
+	return ret, err
+}
+
+// Stat returns the metadata of key's value, or ErrNotFound for a key that
+// does not exist.
+func (c *Client) Stat(key string) (ValueMeta, error) {
+	var m ValueMeta
+	err := c.call("ChordNode.LeafStat", key, &m)
+	return m, err
+}
+
+// Delete reports whether key existed. A delete is not sent on to another node
+// once one that may have applied it failed, so a second try never reports a
+// key the first one deleted as missing; the delete fails with ErrUnavailable.
+func (c *Client) Delete(key string) (existed bool, err error) {
+	c.cache.drop([]string{key})
+	err = c.call("ChordNode.LeafDelete", key, nil)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// WhereWouldItGo tells where writes of keys would go, without making them.
+func (c *Client) WhereWouldItGo(keys ...string) ([]Placement, error) {
+	var ret []Placement
+	err := c.call("ChordNode.LeafWhereWouldItGo", keys, &ret)
+	return ret, err
+}
+
+func (c *Client) WhoOwns(key string) (Placement, error) {
+	ret, err := c.WhereWouldItGo(key)
+	if err != nil || len(ret) == 0 {
+		return Placement{Key: key}, err
+	}
+	return ret[0], nil
+}
+
+// Nodes returns the nodes the client knows, healthiest first.
+func (c *Client) Nodes() []ClientNodeStatus {
+	c.lock.Lock()
+	now := time.Now()
+	ret := make([]ClientNodeStatus, 0, len(c.nodes))
+	for addr, node := range c.nodes {
+		ret = append(ret, ClientNodeStatus{Addr: addr, Seed: node.seed, Failures: node.failures, Down: now.Before(node.downUntil)})
+	}
+	c.lock.Unlock()
+	for i := range ret {
+		ret[i].RTT, _ = c.rtt.get(ret[i].Addr)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i], ret[j]
+		if a.Down != b.Down {
+			return !a.Down
+		}
+		if a.Failures != b.Failures {
+			return a.Failures < b.Failures
+		}
+		return a.Addr < b.Addr
+	})
+	return ret
+}
+
+// ClientCacheOptions have a client keep the values it reads for up to TTL.
+// The node each value was read through watches the key with its owner, and
+// the client follows that node's invalidation feed, so a value is dropped
+// soon after any write of it. Zero TTL turns the cache off; zero Capacity
+// means clientCacheLen.
+type ClientCacheOptions struct {
+	TTL      time.Duration
+	Capacity int
+}
+
+type ClientCacheStatus struct {
+	Options     ClientCacheOptions
+	Entries     int
+	Hits        uint64
+	Misses      uint64
+	Invalidated uint64
+}
+
+// expiringCache keeps values for a while, up to a number of them, making
+// room for a new key by dropping one at random. It is the store of both the
+// client's cache and the hot key cache, and their locks guard it.
+type expiringCache struct {
+	entries     map[string]expiringEntry
+	invalidated uint64
+}
+
+type expiringEntry struct {
+	value   string
+	node    string
+	expires time.Time
+}
+
+// get returns the entry of key, dropping it and telling so if it has
+// expired.
+func (c *expiringCache) get(key string) (e expiringEntry, ok, expired bool) {
+	e, ok = c.entries[key]
+	if ok && time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return e, false, true
+	}
+	return e, ok, false
+}
+
+func (c *expiringCache) put(key string, e expiringEntry, capacity int) {
+	if c.entries == nil {
+		c.entries = make(map[string]expiringEntry)
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= capacity {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = e
+}
+
+func (c *expiringCache) drop(keys []string) {
+	for _, k := range keys {
+		if _, ok := c.entries[k]; ok {
+			delete(c.entries, k)
+			c.invalidated++
+		}
+	}
+}
+
+func (c *expiringCache) dropNode(node string) {
+	for k, e := range c.entries {
+		if e.node == node {
+			delete(c.entries, k)
+			c.invalidated++
+		}
+	}
+}
+
+func (c *expiringCache) reset() {
+	c.entries = nil
+}
+
+type clientCache struct {
+	lock    sync.Mutex
+	options ClientCacheOptions
+	values  expiringCache
+	feeds   map[string]InvalidationCursor
+	hits    uint64
+	misses  uint64
+}
+
+func (c *clientCache) ttl() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.options.TTL
+}
+
+func (c *clientCache) get(key string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.options.TTL <= 0 {
+		return NULL, false
+	}
+	e, ok, _ := c.values.get(key)
+	if !ok {
+		c.misses++
+		return NULL, false
+	}
+	c.hits++
+	return e.value, true
+}
+
+// put keeps a value read through node, unless the feed followed from node
+// has already gone past where it stood at the read, in which case a write
+// may have been missed.
+func (c *clientCache) put(key, node string, w WatchedValue) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.options.TTL <= 0 {
+		return
+	}
+	if c.feeds == nil {
+		c.feeds = make(map[string]InvalidationCursor)
+	}
+	cur, ok := c.feeds[node]
+	switch {
+	case ok && cur.Epoch != w.Epoch:
+		c.dropNodeLocked(node)
+	case ok && cur.Seq > w.Seq:
+		return
+	}
+	if _, ok := c.feeds[node]; !ok {
+		c.feeds[node] = InvalidationCursor{Epoch: w.Epoch, Seq: w.Seq}
+	}
+	capacity := c.options.Capacity
+	if capacity <= 0 {
+		capacity = clientCacheLen
+	}
+	c.values.put(key, expiringEntry{value: w.Value, node: node, expires: time.Now().Add(c.options.TTL)}, capacity)
+}
+
+func (c *clientCache) drop(keys []string) {
+	c.lock.Lock()
+	c.dropLocked(keys)
+	c.lock.Unlock()
+}
+
+func (c *clientCache) dropLocked(keys []string) {
+	c.values.drop(keys)
+}
+
+func (c *clientCache) dropNodeLocked(node string) {
+	c.values.dropNode(node)
+	delete(c.feeds, node)
+}
+
+// follow polls the invalidation feeds of the nodes the cache read through
+// until the client is closed. A node whose feed cannot be followed takes its
+// values with it.
+func (c *Client) follow() {
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(clientInvalidationPollTime):
+		}
+		c.cache.lock.Lock()
+		feeds := make(map[string]InvalidationCursor, len(c.cache.feeds))
+		for node, cur := range c.cache.feeds {
+			feeds[node] = cur
+		}
+		c.cache.lock.Unlock()
+		for node, cur := range feeds {
+			var feed InvalidationFeed
+			err := RPCCallWithCodec(node, c.codec, "ChordNode.Invalidations", cur, &feed)
+			c.cache.lock.Lock()
+			if now, ok := c.cache.feeds[node]; ok && now == cur {
+				if err != nil || feed.Truncated {
+					c.cache.dropNodeLocked(node)
+				} else {
+					c.cache.dropLocked(feed.Keys)
+					c.cache.feeds[node] = InvalidationCursor{Epoch: feed.Epoch, Seq: feed.Seq}
+				}
+			}
+			c.cache.lock.Unlock()
+		}
+	}
+}
+
+// SetCache turns the client's cache on, or off with zero TTL.
+func (c *Client) SetCache(options ClientCacheOptions) {
+	c.cache.lock.Lock()
+	c.cache.options = options
+	if options.TTL <= 0 {
+		c.cache.values.reset()
+		c.cache.feeds = nil
+	}
+	c.cache.lock.Unlock()
+}
+
+func (c *Client) CacheStatus() ClientCacheStatus {
+	c.cache.lock.Lock()
+	defer c.cache.lock.Unlock()
+	return ClientCacheStatus{
+		Options:     c.cache.options,
+		Entries:     len(c.cache.values.entries),
+		Hits:        c.cache.hits,
+		Misses:      c.cache.misses,
+		Invalidated: c.cache.values.invalidated,
+	}
+}
@@ -0,0 +1,418 @@
+package chord
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/rpc"
+	"reflect"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Codec decides how RPC headers and bodies are put on the wire. Every node of
+// a ring must use the same codec.
+type Codec interface {
+	Name() string
+	NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec
+	NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec
+}
+
+var (
+	defaultCodec Codec = gobCodec{}
+	codecs             = map[string]Codec{
+		"gob":      gobCodec{},
+		"msgpack":  msgpackCodec{},
+		"protobuf": protobufCodec{},
+	}
+)
+
+func LookupCodec(name string) (Codec, bool) {
+	c, ok := codecs[name]
+	return c, ok
+}
+
+type encoder interface {
+	Encode(v interface{}) error
+}
+
+type decoder interface {
+	Decode(v interface{}) error
+}
+
+// streamConn serves both ends of a connection for codecs that provide a
+// streaming encoder/decoder pair, like gob and msgpack.
+type streamConn struct {
+	rwc io.ReadWriteCloser
+	buf *bufio.Writer
+	enc encoder
+	dec decoder
+}
+
+func (c *streamConn) WriteRequest(r *rpc.Request, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.buf.Flush()
+}
+
+func (c *streamConn) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *streamConn) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *streamConn) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *streamConn) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *streamConn) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.buf.Flush()
+}
+
+func (c *streamConn) Close() error {
+	return c.rwc.Close()
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) newConn(conn io.ReadWriteCloser) *streamConn {
+	buf := bufio.NewWriter(conn)
+	return &streamConn{rwc: conn, buf: buf, enc: gob.NewEncoder(buf), dec: gob.NewDecoder(conn)}
+}
+
+func (g gobCodec) NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return g.newConn(conn)
+}
+
+func (g gobCodec) NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return g.newConn(conn)
+}
+
+type msgpackDecoder struct {
+	*msgpack.Decoder
+}
+
+func (d msgpackDecoder) Decode(v interface{}) error {
+	if v == nil {
+		return d.Skip()
+	}
+	return d.Decoder.Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) newConn(conn io.ReadWriteCloser) *streamConn {
+	buf := bufio.NewWriter(conn)
+	return &streamConn{rwc: conn, buf: buf, enc: msgpack.NewEncoder(buf), dec: msgpackDecoder{msgpack.NewDecoder(bufio.NewReader(conn))}}
+}
+
+func (m msgpackCodec) NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return m.newConn(conn)
+}
+
+func (m msgpackCodec) NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return m.newConn(conn)
+}
+
+/* Every protobuf frame is a varint length followed by one message. Headers are
+ *   message Header { string service_method = 1; uint64 seq = 2; string error = 3; }
+ * and bodies use field 1 for the value itself:
+ *   string / big.Int (big-endian bytes)  -> bytes  value = 1;
+ *   Pair                                 -> string first = 1; string second = 2;
+ *   map[string]string                    -> map<string, string> value = 1;
+ *   successor list                       -> repeated string value = 1;
+ * Any other type is carried as JSON in field 15. */
+
+const protobufJSONField = 15
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return &protobufConn{rwc: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+func (protobufCodec) NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return &protobufConn{rwc: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+type protobufConn struct {
+	rwc io.ReadWriteCloser
+	r   *bufio.Reader
+	w   *bufio.Writer
+}
+
+func (c *protobufConn) writeFrame(b []byte) error {
+	_, err := c.w.Write(protowire.AppendVarint(nil, uint64(len(b))))
+	if err != nil {
+		return err
+	}
+	_, err = c.w.Write(b)
+	return err
+}
+
+func (c *protobufConn) readFrame() ([]byte, error) {
+	size, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(c.r, b)
+	return b, err
+}
+
+func (c *protobufConn) write(method string, seq uint64, errMsg string, body interface{}) error {
+	var h []byte
+	h = protowire.AppendTag(h, 1, protowire.BytesType)
+	h = protowire.AppendString(h, method)
+	h = protowire.AppendTag(h, 2, protowire.VarintType)
+	h = protowire.AppendVarint(h, seq)
+	if errMsg != NULL {
+		h = protowire.AppendTag(h, 3, protowire.BytesType)
+		h = protowire.AppendString(h, errMsg)
+	}
+	b, err := marshalProtobuf(body)
+	if err != nil {
+		return err
+	}
+	if err = c.writeFrame(h); err != nil {
+		return err
+	}
+	if err = c.writeFrame(b); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *protobufConn) readHeader() (method string, seq uint64, errMsg string, err error) {
+	b, err := c.readFrame()
+	if err != nil {
+		return
+	}
+	err = consumeProtobufFields(b, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			s, n := protowire.ConsumeString(v)
+			method = s
+			return n, protowire.ParseError(n)
+		case num == 2 && typ == protowire.VarintType:
+			x, n := protowire.ConsumeVarint(v)
+			seq = x
+			return n, protowire.ParseError(n)
+		case num == 3 && typ == protowire.BytesType:
+			s, n := protowire.ConsumeString(v)
+			errMsg = s
+			return n, protowire.ParseError(n)
+		}
+		n := protowire.ConsumeFieldValue(num, typ, v)
+		return n, protowire.ParseError(n)
+	})
+	return
+}
+
+func (c *protobufConn) readBody(body interface{}) error {
+	b, err := c.readFrame()
+	if err != nil || body == nil {
+		return err
+	}
+	return unmarshalProtobuf(b, body)
+}
+
+func (c *protobufConn) WriteRequest(r *rpc.Request, body interface{}) error {
+	return c.write(r.ServiceMethod, r.Seq, NULL, body)
+}
+
+func (c *protobufConn) ReadResponseHeader(r *rpc.Response) (err error) {
+	r.ServiceMethod, r.Seq, r.Error, err = c.readHeader()
+	return
+}
+
+func (c *protobufConn) ReadResponseBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+func (c *protobufConn) ReadRequestHeader(r *rpc.Request) (err error) {
+	r.ServiceMethod, r.Seq, _, err = c.readHeader()
+	return
+}
+
+func (c *protobufConn) ReadRequestBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+func (c *protobufConn) WriteResponse(r *rpc.Response, body interface{}) error {
+	return c.write(r.ServiceMethod, r.Seq, r.Error, body)
+}
+
+func (c *protobufConn) Close() error {
+	return c.rwc.Close()
+}
+
+func appendProtobufString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func marshalProtobuf(body interface{}) ([]byte, error) {
+	var b []byte
+	if x, ok := body.(*big.Int); ok {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		return protowire.AppendBytes(b, x.Bytes()), nil
+	}
+	v := reflect.ValueOf(body)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return b, nil
+	}
+	switch x := v.Interface().(type) {
+	case string:
+		return appendProtobufString(b, 1, x), nil
+	case big.Int:
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		return protowire.AppendBytes(b, x.Bytes()), nil
+	case Pair:
+		b = appendProtobufString(b, 1, x.First)
+		return appendProtobufString(b, 2, x.Second), nil
+	case map[string]string:
+		for k, val := range x {
+			var entry []byte
+			entry = appendProtobufString(entry, 1, k)
+			entry = appendProtobufString(entry, 2, val)
+			b = protowire.AppendTag(b, 1, protowire.BytesType)
+			b = protowire.AppendBytes(b, entry)
+		}
+		return b, nil
+	case [SuccessorListLen]string:
+		for _, s := range x {
+			b = appendProtobufString(b, 1, s)
+		}
+		return b, nil
+	}
+	j, err := json.Marshal(v.Interface())
+	if err != nil {
+		return nil, err
+	}
+	b = protowire.AppendTag(b, protobufJSONField, protowire.BytesType)
+	return protowire.AppendBytes(b, j), nil
+}
+
+func consumeProtobufFields(b []byte, field func(num protowire.Number, typ protowire.Type, v []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := field(num, typ, b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeProtobufBytes(typ protowire.Type, v []byte) ([]byte, int, error) {
+	if typ != protowire.BytesType {
+		return nil, 0, errors.New("unexpected protobuf wire type")
+	}
+	s, n := protowire.ConsumeBytes(v)
+	return s, n, protowire.ParseError(n)
+}
+
+func unmarshalProtobuf(b []byte, body interface{}) error {
+	switch x := body.(type) {
+	case *string:
+		*x = NULL
+	case *big.Int:
+		x.SetInt64(0)
+	case *Pair:
+		*x = Pair{}
+	case *map[string]string:
+		*x = make(map[string]string)
+	case *[SuccessorListLen]string:
+		*x = [SuccessorListLen]string{}
+	}
+	cnt := 0
+	return consumeProtobufFields(b, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		if num == protobufJSONField {
+			s, n, err := consumeProtobufBytes(typ, v)
+			if err != nil {
+				return n, err
+			}
+			return n, json.Unmarshal(s, body)
+		}
+		if num != 1 && num != 2 {
+			n := protowire.ConsumeFieldValue(num, typ, v)
+			return n, protowire.ParseError(n)
+		}
+		s, n, err := consumeProtobufBytes(typ, v)
+		if err != nil {
+			return n, err
+		}
+		switch x := body.(type) {
+		case *string:
+			*x = string(s)
+		case *big.Int:
+			x.SetBytes(s)
+		case *Pair:
+			if num == 1 {
+				x.First = string(s)
+			} else {
+				x.Second = string(s)
+			}
+		case *map[string]string:
+			var k, val string
+			err = consumeProtobufFields(s, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+				e, m, err := consumeProtobufBytes(typ, v)
+				if num == 1 {
+					k = string(e)
+				} else if num == 2 {
+					val = string(e)
+				}
+				return m, err
+			})
+			(*x)[k] = val
+		case *[SuccessorListLen]string:
+			if cnt < SuccessorListLen {
+				x[cnt] = string(s)
+				cnt++
+			}
+		}
+		return n, err
+	})
+}
@@ -0,0 +1,223 @@
+package chord
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errConditionFailed = errors.New("condition does not hold")
+	errKeyExists       = errors.New("key already exists")
+)
+
+type VersionedValue struct {
+	Value   string
+	Version uint64
+}
+
+type DeleteCondition struct {
+	Key       string
+	Value     string
+	Version   uint64
+	ByVersion bool
+}
+
+func (c DeleteCondition) holds(val string, version uint64) bool {
+	if c.ByVersion {
+		return version == c.Version
+	}
+	return val == c.Value
+}
+
+// rawCondition turns a condition on the value readers are shown, which the
+// read hooks make of the stored one, into one on the stored value it was
+// made of, for deleteInStore to check again under the store lock, and tells
+// whether the key is there and the shown value matches. The hooks run
+// without the lock, as they run for any read.
+func (n *ChordNode) rawCondition(c DeleteCondition) (cond *DeleteCondition, existed, holds bool) {
+	n.storeLock.RLock()
+	raw, ok := n.store.Get(c.Key)
+	n.storeLock.RUnlock()
+	if !ok {
+		return nil, false, false
+	}
+	shown, err := n.readValue(c.Key, raw)
+	if err != nil || shown != c.Value {
+		return nil, true, false
+	}
+	return &DeleteCondition{Key: c.Key, Value: raw}, true, true
+}
+
+// Versions are kept in the metadata, only by the owner of a key, and are not
+// moved with it. A key whose version was lost gets a fresh one from the
+// owner's clock on first use, which is larger than any version handed out
+// before, so a stale version never matches after the key changed hands.
+// Callers must hold storeLock for writing.
+func (n *ChordNode) versionLocked(key string) uint64 {
+	return n.metaLocked(key).version
+}
+
+func (n *ChordNode) nextVersionLocked() uint64 {
+	now := uint64(time.Now().UnixNano())
+	if now <= n.versionClock {
+		now = n.versionClock + 1
+	}
+	n.versionClock = now
+	return now
+}
+
+func (n *ChordNode) GetVersionedInStore(key string, ret *VersionedValue) error {
+	n.storageLog().Infof("Get versioned key [%v] in node [%v]'s store.", key, n.addr)
+	if target, ok := n.migratedTo(key); ok {
+		return n.call(target, "ChordNode.GetVersionedInStore", key, ret)
+	}
+	n.hotKeys.hit(key)
+	n.storeLock.Lock()
+	val, ok := n.store.Get(key)
+	if !ok {
+		n.storeLock.Unlock()
+		return errors.New("not found")
+	}
+	ret.Version = n.versionLocked(key)
+	n.accessedLocked(key)
+	n.storeLock.Unlock()
+	var err error
+	ret.Value, err = n.readValue(key, val)
+	return err
+}
+
+func (n *ChordNode) DeleteIfInStore(cond DeleteCondition, _ *string) error {
+	n.storageLog().Infof("Conditionally delete key [%v] in node [%v]'s store.", cond.Key, n.addr)
+	if target, ok := n.migratedTo(cond.Key); ok {
+		return n.call(target, "ChordNode.DeleteIfInStore", cond, nil)
+	}
+	if err := n.keyLeases.admits(cond.Key, nil); err != nil {
+		return err
+	}
+	_, err := n.deleteInStore(cond.Key, &cond)
+	return err
+}
+
+func (n *ChordNode) PutIfAbsentInStore(kv Pair, ack *AckLevel) error {
+	n.storageLog().Infof("Put k-v pair [key:%v][value:%v] to node [%v]'s store if absent.", kv.First, kv.Second, n.addr)
+	if target, ok := n.migratedTo(kv.First); ok {
+		return n.call(target, "ChordNode.PutIfAbsentInStore", kv, ack)
+	}
+	if err := n.keyLeases.admits(kv.First, nil); err != nil {
+		return err
+	}
+	var err error
+	if kv.Second, err = n.acceptWrite(kv.First, kv.Second); err != nil {
+		return err
+	}
+	return n.putInStore(kv, true, ack)
+}
+
+// putIfAbsent reports whether this call wrote the key. Losing to an existing
+// key and failing to reach the owner both return false; only the log tells
+// them apart.
+func (n *ChordNode) putIfAbsent(key string, val string) bool {
+	n.negCache.drop(key)
+	if n.contentAddressed && key != ContentAddress(val) {
+		n.storageLog().Errorf("Trying to put a key that is not the content address of its value.")
+		return false
+	}
+	if n.tier == TierLeaf {
+		return n.leafCall("ChordNode.LeafPutIfAbsent", Pair{First: key, Second: val}, nil) == nil
+	}
+	if !n.isOnline() {
+		n.storageLog().Errorf("Trying to put in an offline node.")
+		return false
+	}
+	t := n.startOp("put", key)
+	var ack AckLevel
+	tar, err := n.ownerCall(t, key, "PutIfAbsentInStore", Pair{First: key, Second: val}, &ack)
+	t.finish(err == nil)
+	if err != nil {
+		if err.Error() == errKeyExists.Error() {
+			n.storageLog().Infof("Key [%v] already exists on node [%v].", key, tar)
+			return false
+		}
+		n.logErrorFunctionCall(tar, "ChordNode.putIfAbsent", "ChordNode.PutIfAbsentInStore", err)
+		return false
+	}
+	return true
+}
+
+func (n *ChordNode) getVersioned(key string) (bool, VersionedValue) {
+	var ret VersionedValue
+	if n.tier == TierLeaf {
+		err := n.leafCall("ChordNode.LeafGetVersioned", key, &ret)
+		return err == nil, ret
+	}
+	if !n.isOnline() {
+		n.storageLog().Errorf("Trying to get in an offline node.")
+		return false, ret
+	}
+	t := n.startOp("get", key)
+	tar, err := n.ownerCall(t, key, "GetVersionedInStore", key, &ret)
+	t.finish(err == nil)
+	if err != nil {
+		n.logErrorFunctionCall(tar, "ChordNode.getVersioned", "ChordNode.GetVersionedInStore", err)
+		return false, ret
+	}
+	return true, ret
+}
+
+func (n *ChordNode) deleteIf(cond DeleteCondition) bool {
+	if n.tier == TierLeaf {
+		return n.leafCall("ChordNode.LeafDeleteIf", cond, nil) == nil
+	}
+	if !n.isOnline() {
+		n.storageLog().Errorf("Trying to delete in an offline node.")
+		return false
+	}
+	t := n.startOp("delete", cond.Key)
+	tar, err := n.ownerCall(t, cond.Key, "DeleteIfInStore", cond, nil)
+	t.finish(err == nil)
+	if err != nil {
+		n.logErrorFunctionCall(tar, "ChordNode.deleteIf", "ChordNode.DeleteIfInStore", err)
+		return false
+	}
+	return true
+}
+
+func (n *ChordNode) LeafGetVersioned(key string, ret *VersionedValue) error {
+	ok, v := n.getVersioned(key)
+	if !ok {
+		return errors.New("not found")
+	}
+	*ret = v
+	return nil
+}
+
+func (n *ChordNode) LeafPutIfAbsent(kv Pair, _ *string) error {
+	if !n.putIfAbsent(kv.First, kv.Second) {
+		return errors.New("put if absent failed")
+	}
+	return nil
+}
+
+func (n *ChordNode) LeafDeleteIf(cond DeleteCondition, _ *string) error {
+	if !n.deleteIf(cond) {
+		return errors.New("conditional delete failed")
+	}
+	return nil
+}
+
+func (w *NodeWrapper) GetWithVersion(key string) (bool, string, uint64) {
+	ok, v := w.node.getVersioned(key)
+	return ok, v.Value, v.Version
+}
+
+func (w *NodeWrapper) DeleteIf(key string, expectedValue string) bool {
+	return w.node.deleteIf(DeleteCondition{Key: key, Value: expectedValue})
+}
+
+func (w *NodeWrapper) DeleteIfVersion(key string, version uint64) bool {
+	return w.node.deleteIf(DeleteCondition{Key: key, Version: version, ByVersion: true})
+}
+
+func (w *NodeWrapper) PutIfAbsent(key string, value string) bool {
+	return w.node.putIfAbsent(key, value)
+}
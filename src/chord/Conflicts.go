@@ -0,0 +1,177 @@
+package chord
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The merges a conflict can come up in, as Conflict.Source names them.
+const (
+	// ConflictPromotion: A backup copy promoted into the store after its
+	// owner failed.
+	ConflictPromotion = "promotion"
+	// ConflictJoin: A copy the successor handed a joining node.
+	ConflictJoin = "join"
+	// ConflictDelta: A copy in the changes a rejoining or standby node
+	// fetched.
+	ConflictDelta = "delta"
+	// ConflictRange: A copy in a migrated range the node adopted.
+	ConflictRange = "range"
+)
+
+// Conflict is two different values of Key meeting on the node that is to own
+// it: Local, the one in its store, and Incoming, the one a merge brought.
+// LocalTime is when this node last wrote Local and IncomingTime when the copy
+// arrived, each zero if the node does not know.
+type Conflict struct {
+	Key          string
+	Source       string
+	Local        string
+	LocalTime    time.Time
+	Incoming     string
+	IncomingTime time.Time
+}
+
+// ConflictResolver returns the value a key keeps when two of its values meet,
+// which may be either of them or a merge of both. It runs on the owning node,
+// under its store lock, so it must not call the node.
+type ConflictResolver func(c Conflict) string
+
+// ResolveIncoming keeps the value the merge brought.
+func ResolveIncoming(c Conflict) string {
+	return c.Incoming
+}
+
+// ResolveLocal keeps the value in the store.
+func ResolveLocal(c Conflict) string {
+	return c.Local
+}
+
+// LastWriterWins keeps the value written last. A value whose time is not
+// known loses to one whose time is, and the incoming one is kept if neither
+// is known.
+func LastWriterWins(c Conflict) string {
+	if !c.LocalTime.IsZero() && (c.IncomingTime.IsZero() || c.LocalTime.After(c.IncomingTime)) {
+		return c.Local
+	}
+	return c.Incoming
+}
+
+// MaxValue keeps the larger value, by number if both are numbers and by
+// bytes otherwise, for counters and high-water marks that only grow.
+func MaxValue(c Conflict) string {
+	a, errA := strconv.ParseFloat(c.Local, 64)
+	b, errB := strconv.ParseFloat(c.Incoming, 64)
+	if errA == nil && errB == nil {
+		if a > b {
+			return c.Local
+		}
+		return c.Incoming
+	}
+	if c.Local > c.Incoming {
+		return c.Local
+	}
+	return c.Incoming
+}
+
+// ConflictStatus counts the conflicts the node resolved, by Source, and
+// which value they kept.
+type ConflictStatus struct {
+	Resolver     string
+	Conflicts    map[string]uint64
+	KeptLocal    uint64
+	KeptIncoming uint64
+	Merged       uint64
+}
+
+type conflictTable struct {
+	lock     sync.Mutex
+	name     string
+	resolver ConflictResolver
+	status   ConflictStatus
+}
+
+// resolveConflictLocked returns the value key keeps when incoming meets the
+// value in the store, through the resolver set or else through fallback,
+// what the merge does by default. Two CRDTs of the same type merge without
+// either. Callers must hold storeLock for writing.
+func (n *ChordNode) resolveConflictLocked(source, key, incoming string, incomingTime time.Time, fallback ConflictResolver) string {
+	local, ok := n.store.Get(key)
+	if !ok || local == incoming {
+		return incoming
+	}
+	if merged, ok := n.mergeCRDT(source, local, incoming); ok {
+		return merged
+	}
+	c := Conflict{Key: key, Source: source, Local: local, Incoming: incoming, IncomingTime: incomingTime}
+	if m, ok := n.meta[key]; ok {
+		c.LocalTime = m.updated
+	}
+	t := &n.conflicts
+	t.lock.Lock()
+	resolve := t.resolver
+	t.lock.Unlock()
+	// A content addressed value cannot merge into another.
+	if resolve == nil || n.contentAddressed {
+		resolve = fallback
+	}
+	ret := resolve(c)
+	t.lock.Lock()
+	if t.status.Conflicts == nil {
+		t.status.Conflicts = make(map[string]uint64)
+	}
+	t.status.Conflicts[source]++
+	switch ret {
+	case local:
+		t.status.KeptLocal++
+	case incoming:
+		t.status.KeptIncoming++
+	default:
+		t.status.Merged++
+	}
+	t.lock.Unlock()
+	n.storageLog().Infof("Node [%v] resolves a %v conflict of key [%v].", n.addr, source, key)
+	return ret
+}
+
+func (t *conflictTable) snapshot() ConflictStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ret := t.status
+	ret.Resolver = t.name
+	ret.Conflicts = make(map[string]uint64, len(t.status.Conflicts))
+	for k, v := range t.status.Conflicts {
+		ret.Conflicts[k] = v
+	}
+	return ret
+}
+
+func (n *ChordNode) serveConflicts(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.conflicts.snapshot())
+}
+
+// SetConflictResolver has the node resolve every conflict with r, named name
+// in its status, in place of what each merge does by default: a promotion,
+// delta or adopted range overwrites the store, and a join keeps the writes
+// that reached the node meanwhile. A nil r goes back to the defaults. Every
+// node of the ring needs the same resolver, as any may come to own a key.
+func (w *NodeWrapper) SetConflictResolver(name string, r ConflictResolver) bool {
+	if r != nil && name == NULL {
+		w.node.log().Errorf("Invalid conflict resolver with no name.")
+		return false
+	}
+	t := &w.node.conflicts
+	t.lock.Lock()
+	t.name, t.resolver = name, r
+	if r == nil {
+		t.name = NULL
+	}
+	t.lock.Unlock()
+	return true
+}
+
+func (w *NodeWrapper) ConflictStatus() ConflictStatus {
+	return w.node.conflicts.snapshot()
+}
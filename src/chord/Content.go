@@ -0,0 +1,58 @@
+package chord
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func ContentAddress(val string) string {
+	sum := sha256.Sum256([]byte(val))
+	return hex.EncodeToString(sum[:])
+}
+
+// PutContentInStore stores a content-addressed pair on its owner. Content
+// that is already there is not written or backed up again, and is only
+// acknowledged as far as the primary.
+func (n *ChordNode) PutContentInStore(kv Pair, ack *AckLevel) error {
+	if kv.First != ContentAddress(kv.Second) {
+		return errors.New("key is not the content address of the value")
+	}
+	n.storeLock.RLock()
+	v, ok := n.store.Get(kv.First)
+	n.storeLock.RUnlock()
+	if ok && v == kv.Second {
+		n.storageLog().Infof("Content [%v] already in node [%v]'s store.", kv.First, n.addr)
+		*ack = AckPrimary
+		return nil
+	}
+	return n.PutInStore(kv, ack)
+}
+
+func (n *ChordNode) putContent(val string, trace *OpTrace) (string, AckLevel) {
+	key := ContentAddress(val)
+	n.negCache.drop(key)
+	if !n.isOnline() {
+		n.storageLog().Errorf("Trying to put in an offline node.")
+		return key, AckNone
+	}
+	t := n.startOp("put", key).tracing(trace)
+	var ack AckLevel
+	_, err := n.ownerCall(t, key, "PutContentInStore", Pair{First: key, Second: val}, &ack)
+	t.finish(err == nil)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.putContent", "ChordNode.PutContentInStore", err)
+		return key, AckNone
+	}
+	return key, ack
+}
+
+func verifyContent(key, val string) bool {
+	if ContentAddress(val) != key {
+		log.Errorf("Value of content address [%v] fails verification.", key)
+		return false
+	}
+	return true
+}
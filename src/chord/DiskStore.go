@@ -0,0 +1,270 @@
+package chord
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	diskRecordPut byte = iota + 1
+	diskRecordDelete
+)
+
+type diskEntry struct {
+	offset int64
+	length int
+}
+
+// DiskStore is an append-only log of puts and deletes with an in-memory
+// index of where each live value sits, so only keys stay resident. Each
+// record is synced before Put or Delete returns, and checksummed; a torn
+// record at the tail, left by a crash, is cut off when the log is reopened.
+// The log is rewritten once the bytes taken by overwritten and deleted
+// records outgrow the live ones.
+type DiskStore struct {
+	path  string
+	file  *os.File
+	size  int64
+	live  int64
+	index map[string]diskEntry
+}
+
+var errDiskStoreCorrupt = errors.New("corrupt disk store record")
+
+func OpenDiskStore(path string) (*DiskStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &DiskStore{path: path, file: file, index: make(map[string]diskEntry)}
+	err = s.replay()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	log.Infof("Open disk store [%v] with %v keys.", path, len(s.index))
+	return s, nil
+}
+
+func (s *DiskStore) replay() error {
+	reader := bufio.NewReader(s.file)
+	var offset int64
+	for {
+		op, key, val, length, err := readDiskRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Errorf("Disk store [%v] cut at offset %v, error message: [%v].", s.path, offset, err)
+			break
+		}
+		s.apply(op, key, offset+int64(length-len(val)-crc32.Size), len(val))
+		offset += int64(length)
+	}
+	s.size = offset
+	return s.file.Truncate(offset)
+}
+
+func readDiskRecord(reader *bufio.Reader) (op byte, key string, val string, length int, err error) {
+	op, err = reader.ReadByte()
+	if err != nil {
+		return
+	}
+	keyLen, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return op, key, val, length, errDiskStoreCorrupt
+	}
+	valLen, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return op, key, val, length, errDiskStoreCorrupt
+	}
+	body := make([]byte, keyLen+valLen+crc32.Size)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return op, key, val, length, errDiskStoreCorrupt
+	}
+	header := diskRecordHeader(op, int(keyLen), int(valLen))
+	payload := body[:keyLen+valLen]
+	sum := crc32.NewIEEE()
+	_, _ = sum.Write(header)
+	_, _ = sum.Write(payload)
+	if sum.Sum32() != binary.BigEndian.Uint32(body[keyLen+valLen:]) {
+		return op, key, val, length, errDiskStoreCorrupt
+	}
+	return op, string(payload[:keyLen]), string(payload[keyLen:]), len(header) + len(body), nil
+}
+
+func diskRecordHeader(op byte, keyLen, valLen int) []byte {
+	header := make([]byte, 1, 1+2*binary.MaxVarintLen64)
+	header[0] = op
+	header = binary.AppendUvarint(header, uint64(keyLen))
+	return binary.AppendUvarint(header, uint64(valLen))
+}
+
+func encodeDiskRecord(op byte, key, val string) []byte {
+	record := diskRecordHeader(op, len(key), len(val))
+	record = append(record, key...)
+	record = append(record, val...)
+	return binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(record))
+}
+
+func (s *DiskStore) apply(op byte, key string, valOffset int64, valLen int) {
+	if old, ok := s.index[key]; ok {
+		s.live -= int64(old.length)
+		delete(s.index, key)
+	}
+	if op == diskRecordPut {
+		s.index[key] = diskEntry{offset: valOffset, length: valLen}
+		s.live += int64(valLen)
+	}
+}
+
+func (s *DiskStore) append(op byte, key, val string) error {
+	record := encodeDiskRecord(op, key, val)
+	_, err := s.file.WriteAt(record, s.size)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	valOffset := s.size + int64(len(record)-len(val)-crc32.Size)
+	s.apply(op, key, valOffset, len(val))
+	s.size += int64(len(record))
+	// The write is on disk already; a failed compaction only leaves the log
+	// longer, to be tried again on the next write.
+	if s.size > diskStoreCompactMinSize && s.size > 2*s.live {
+		if err = s.compact(); err != nil {
+			log.Errorf("Compact disk store [%v] failed, error message: [%v].", s.path, err)
+		}
+	}
+	return nil
+}
+
+func (s *DiskStore) read(e diskEntry) (string, error) {
+	buf := make([]byte, e.length)
+	_, err := s.file.ReadAt(buf, e.offset)
+	return string(buf), err
+}
+
+func (s *DiskStore) rewrite(data map[string]string) error {
+	tmp := s.path + ".compact"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	index := make(map[string]diskEntry, len(data))
+	var offset, live int64
+	for k, v := range data {
+		record := encodeDiskRecord(diskRecordPut, k, v)
+		_, err = writer.Write(record)
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		index[k] = diskEntry{offset: offset + int64(len(record)-len(v)-crc32.Size), length: len(v)}
+		offset += int64(len(record))
+		live += int64(len(v))
+	}
+	if err = writer.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	_ = s.file.Close()
+	s.file, s.size, s.live, s.index = file, offset, live, index
+	return syncDir(filepath.Dir(s.path))
+}
+
+// syncDir makes a rename in dir survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *DiskStore) compact() error {
+	log.Infof("Compact disk store [%v] from %v bytes.", s.path, s.size)
+	return s.rewrite(s.Snapshot())
+}
+
+func (s *DiskStore) Get(key string) (string, bool) {
+	e, ok := s.index[key]
+	if !ok {
+		return NULL, false
+	}
+	val, err := s.read(e)
+	if err != nil {
+		log.Errorf("Read key [%v] from disk store [%v] failed, error message: [%v].", key, s.path, err)
+		return NULL, false
+	}
+	return val, true
+}
+
+func (s *DiskStore) Put(key, val string) error {
+	return s.append(diskRecordPut, key, val)
+}
+
+func (s *DiskStore) Delete(key string) error {
+	if _, ok := s.index[key]; !ok {
+		return nil
+	}
+	return s.append(diskRecordDelete, key, NULL)
+}
+
+func (s *DiskStore) Snapshot() map[string]string {
+	ret := make(map[string]string, len(s.index))
+	s.Iterate(func(key, val string) bool {
+		ret[key] = val
+		return true
+	})
+	return ret
+}
+
+func (s *DiskStore) Iterate(f func(key, val string) bool) {
+	keys := make([]string, 0, len(s.index))
+	for k := range s.index {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		val, ok := s.Get(k)
+		if ok && !f(k, val) {
+			return
+		}
+	}
+}
+
+func (s *DiskStore) Size() int {
+	return len(s.index)
+}
+
+func (s *DiskStore) Reset(data map[string]string) error {
+	return s.rewrite(data)
+}
+
+func (s *DiskStore) Close() error {
+	err := s.file.Sync()
+	if err != nil {
+		return err
+	}
+	return s.file.Close()
+}
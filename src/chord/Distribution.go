@@ -0,0 +1,97 @@
+package chord
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"sort"
+)
+
+// NodeShare is one node's part of the ring. Span is the fraction of the
+// identifier space between its predecessor and it, Sampled the fraction of
+// random identifiers a lookup found it owning, and KeyShare its fraction of
+// the keys stored.
+type NodeShare struct {
+	Addr     string
+	Id       string
+	Span     float64
+	Samples  int
+	Sampled  float64
+	Keys     int
+	KeyShare float64
+}
+
+// DistributionReport tells how evenly a ring spreads its identifiers and
+// keys. Imbalance is the largest span over the mean one, and KeyImbalance the
+// same of keys: with one identifier per node a ring of N nodes has a largest
+// span of about ln N times the mean, and a ratio well above that, or keys
+// far more uneven than spans, calls for virtual nodes or better keys.
+type DistributionReport struct {
+	Nodes        []NodeShare
+	Samples      int
+	Failed       int
+	Keys         int
+	Imbalance    float64
+	KeyImbalance float64
+	Problems     []string
+}
+
+// MeasureDistribution walks the ring from start for its nodes and key counts
+// and has start look up samples random identifiers drawn with seed.
+func MeasureDistribution(start string, codec Codec, seed int64, samples int) DistributionReport {
+	var ret DistributionReport
+	walk := WalkRing(start, codec)
+	ret.Problems = walk.Problems
+	if len(walk.Nodes) == 0 {
+		return ret
+	}
+	index := make(map[string]int, len(walk.Nodes))
+	space := new(big.Float).SetInt(new(big.Int).Lsh(big.NewInt(1), M))
+	for i, info := range walk.Nodes {
+		index[info.Addr] = i
+		ret.Keys += info.Keys
+		pre := walk.Nodes[(i+len(walk.Nodes)-1)%len(walk.Nodes)]
+		span := new(big.Int).Sub(NodeId(info.Addr), NodeId(pre.Addr))
+		if span.Sign() <= 0 {
+			span.Add(span, new(big.Int).Lsh(big.NewInt(1), M))
+		}
+		share, _ := new(big.Float).Quo(new(big.Float).SetInt(span), space).Float64()
+		ret.Nodes = append(ret.Nodes, NodeShare{Addr: info.Addr, Id: info.Id, Span: share, Keys: info.Keys})
+	}
+	r := rand.New(rand.NewSource(seed))
+	limit := new(big.Int).Lsh(big.NewInt(1), M)
+	for i := 0; i < samples; i++ {
+		var owner string
+		err := RPCCallWithCodec(start, codec, "ChordNode.FindSuccessor", new(big.Int).Rand(r, limit), &owner)
+		j, ok := index[owner]
+		if err != nil || !ok {
+			ret.Failed++
+			if err == nil {
+				ret.Problems = append(ret.Problems, fmt.Sprintf("lookup led to [%v], not on the walk", owner))
+			}
+			continue
+		}
+		ret.Nodes[j].Samples++
+		ret.Samples++
+	}
+	var maxSpan, maxKeys float64
+	for i := range ret.Nodes {
+		s := &ret.Nodes[i]
+		if ret.Samples > 0 {
+			s.Sampled = float64(s.Samples) / float64(ret.Samples)
+		}
+		if ret.Keys > 0 {
+			s.KeyShare = float64(s.Keys) / float64(ret.Keys)
+		}
+		if s.Span > maxSpan {
+			maxSpan = s.Span
+		}
+		if s.KeyShare > maxKeys {
+			maxKeys = s.KeyShare
+		}
+	}
+	ret.Imbalance = maxSpan * float64(len(ret.Nodes))
+	ret.KeyImbalance = maxKeys * float64(len(ret.Nodes))
+	sort.Slice(ret.Nodes, func(i, j int) bool { return ret.Nodes[i].Span > ret.Nodes[j].Span })
+	return ret
+}
@@ -0,0 +1,259 @@
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The effects a dry run finds an operation would have on a key.
+const (
+	// EffectWrite: The key would be written on the node.
+	EffectWrite = "write"
+	// EffectBackup: The node would back the written key up.
+	EffectBackup = "backup"
+	// EffectDelete: The key would be deleted from the node's store.
+	EffectDelete = "delete"
+	// EffectDropBackup: The node's pre backup would drop its copy of the key.
+	EffectDropBackup = "drop-backup"
+	// EffectMove: The key would move onto the node.
+	EffectMove = "move"
+	// EffectSkip: The node would leave the key be, as it is leased.
+	EffectSkip = "skip"
+)
+
+type KeyEffect struct {
+	Key    string
+	Node   string
+	Effect string
+}
+
+// DryRunReport is what an operation run dry found it would do: Effects on
+// every key, ordered by key and node, with Nodes the nodes they fall on and
+// Counts how many of each effect there are. Nothing was changed. Problems
+// name the nodes or keys the dry run could not check, which the operation
+// itself would have failed on.
+type DryRunReport struct {
+	Effects  []KeyEffect
+	Nodes    []string
+	Counts   map[string]int
+	Problems []string
+}
+
+func (r *DryRunReport) add(key, node, effect string) {
+	r.Effects = append(r.Effects, KeyEffect{Key: key, Node: node, Effect: effect})
+}
+
+func (r *DryRunReport) merge(o DryRunReport) {
+	r.Effects = append(r.Effects, o.Effects...)
+	r.Problems = append(r.Problems, o.Problems...)
+}
+
+// finish orders the effects and adds them up.
+func (r *DryRunReport) finish() {
+	sort.Slice(r.Effects, func(i, j int) bool {
+		a, b := r.Effects[i], r.Effects[j]
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Node < b.Node
+	})
+	r.Counts = make(map[string]int)
+	nodes := make(map[string]bool)
+	r.Nodes = nil
+	for _, e := range r.Effects {
+		r.Counts[e.Effect]++
+		if !nodes[e.Node] {
+			nodes[e.Node] = true
+			r.Nodes = append(r.Nodes, e.Node)
+		}
+	}
+	sort.Strings(r.Nodes)
+}
+
+func (r DryRunReport) err() error {
+	if len(r.Problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("dry run could not check everything: %v", r.Problems)
+}
+
+// placeKeys adds to report the nodes effect, a write or a delete, of keys
+// through addr would fall on: the holder of each key, and its replicas, which
+// back a write up and drop the copy of a deleted key. Keys are placed
+// dryRunPlaceBatch at a time, to keep each reply small.
+func placeKeys(addr string, codec Codec, keys []string, effect string, report *DryRunReport) error {
+	replicaEffect := EffectBackup
+	if effect == EffectDelete {
+		replicaEffect = EffectDropBackup
+	}
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > dryRunPlaceBatch {
+			batch = batch[:dryRunPlaceBatch]
+		}
+		keys = keys[len(batch):]
+		var placements []Placement
+		if err := RPCCallWithCodec(addr, codec, "ChordNode.LeafWhereWouldItGo", batch, &placements); err != nil {
+			return classifyError(err)
+		}
+		for _, p := range placements {
+			if p.Error != NULL {
+				report.Problems = append(report.Problems, fmt.Sprintf("cannot place [%v]: %v", p.Key, p.Error))
+				continue
+			}
+			report.add(p.Key, p.Holder, effect)
+			for _, r := range p.Replicas {
+				report.add(p.Key, r, replicaEffect)
+			}
+		}
+	}
+	return nil
+}
+
+// DeletePrefixInStoreDryRun reports what DeletePrefixInStore would delete
+// here. A key whose cache source would refuse the delete is reported deleted,
+// as only the delete itself can tell.
+func (n *ChordNode) DeletePrefixInStoreDryRun(prefix string, ret *DryRunReport) error {
+	if prefix == NULL {
+		return errors.New("empty prefix")
+	}
+	var keys []string
+	n.storeLock.RLock()
+	n.store.Iterate(func(k, _ string) bool {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	n.storeLock.RUnlock()
+	for _, k := range keys {
+		if n.keyLeases.admits(k, nil) != nil {
+			ret.add(k, n.addr, EffectSkip)
+		} else {
+			ret.add(k, n.addr, EffectDelete)
+		}
+	}
+	n.preBackupLock.RLock()
+	n.preBackup.Iterate(func(k, _ string) bool {
+		if strings.HasPrefix(k, prefix) {
+			ret.add(k, n.addr, EffectDropBackup)
+		}
+		return true
+	})
+	n.preBackupLock.RUnlock()
+	return nil
+}
+
+// DeletePrefixDryRun reports what DeletePrefix would delete, node by node.
+func DeletePrefixDryRun(addr string, codec Codec, prefix string) (DryRunReport, error) {
+	var report DryRunReport
+	if prefix == NULL {
+		return report, errors.New("empty prefix")
+	}
+	walk := WalkRing(addr, codec)
+	report.Problems = append(report.Problems, walk.Problems...)
+	for _, info := range walk.Nodes {
+		var r DryRunReport
+		if err := RPCCallWithCodec(info.Addr, codec, "ChordNode.DeletePrefixInStoreDryRun", prefix, &r); err != nil {
+			report.Problems = append(report.Problems, fmt.Sprintf("cannot check [%v]: %v", info.Addr, err))
+			continue
+		}
+		report.merge(r)
+	}
+	if !walk.Closed && len(report.Problems) == 0 {
+		report.Problems = append(report.Problems, "the ring walk did not close")
+	}
+	report.finish()
+	return report, report.err()
+}
+
+// RestoreBackupDryRun reports where RestoreBackup would write the keys of
+// the backups.
+func RestoreBackupDryRun(addr string, codec Codec, dest BackupDestination, names ...string) (DryRunReport, error) {
+	var report DryRunReport
+	data, err := readBackups(dest, names)
+	if err != nil {
+		return report, err
+	}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if err = placeKeys(addr, codec, keys, EffectWrite, &report); err != nil {
+		return report, err
+	}
+	report.finish()
+	return report, report.err()
+}
+
+// RestoreRangeAtDryRun reports what RestoreRangeAt would write and delete.
+func RestoreRangeAtDryRun(addr string, codec Codec, dest BackupDestination, r KeyRange, at time.Time) (DryRunReport, error) {
+	var report DryRunReport
+	data, deleted, _, err := planRangeAt(addr, codec, dest, r, at)
+	if err != nil {
+		return report, err
+	}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if err = placeKeys(addr, codec, keys, EffectWrite, &report); err != nil {
+		return report, err
+	}
+	if err = placeKeys(addr, codec, deleted, EffectDelete, &report); err != nil {
+		return report, err
+	}
+	report.finish()
+	return report, report.err()
+}
+
+// MigrateRangeDryRun reports the keys MigrateRange would move, refusing what
+// it would refuse.
+func (n *ChordNode) MigrateRangeDryRun(m Migration, ret *DryRunReport) error {
+	r, err := parseKeyRange(m)
+	if err != nil {
+		return err
+	}
+	if m.Target == n.addr || !n.ping(m.Target) {
+		return errors.New("invalid migration target")
+	}
+	if n.freeze.current().active() {
+		return ErrRingFrozen
+	}
+	for k := range n.rangeData(r) {
+		ret.add(k, m.Target, EffectMove)
+	}
+	ret.finish()
+	return nil
+}
+
+func (w *NodeWrapper) DeletePrefixDryRun(prefix string) (DryRunReport, error) {
+	if !w.node.isOnline() {
+		return DryRunReport{}, ErrOffline
+	}
+	return DeletePrefixDryRun(w.node.addr, w.node.codec, prefix)
+}
+
+func (w *NodeWrapper) RestoreDryRun(dest BackupDestination, names ...string) (DryRunReport, error) {
+	return RestoreBackupDryRun(w.node.addr, w.node.codec, dest, names...)
+}
+
+func (w *NodeWrapper) RestoreRangeAtDryRun(dest BackupDestination, r KeyRange, at time.Time) (DryRunReport, error) {
+	return RestoreRangeAtDryRun(w.node.addr, w.node.codec, dest, r, at)
+}
+
+// MigrateRangeDryRun reports the keys MigrateRange would move onto target.
+func (w *NodeWrapper) MigrateRangeDryRun(target, start, end string) (DryRunReport, bool) {
+	var report DryRunReport
+	err := w.node.MigrateRangeDryRun(Migration{Start: start, End: end, Target: target}, &report)
+	if err != nil {
+		w.node.logErrorFunctionCall(w.node.addr, "NodeWrapper.MigrateRangeDryRun", "ChordNode.MigrateRangeDryRun", err)
+		return report, false
+	}
+	return report, true
+}
@@ -0,0 +1,330 @@
+package chord
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Erasure coded values are stored as a manifest under the key itself, so the
+// manifest is placed and backed up like any other value, while the shards are
+// kept out of the store on the nodes the manifest names, each shard on a
+// node of its own. A value survives as long as any of its data-shard count
+// holders do. A holder hands its shards on when it quits, and to a node that
+// joins in front of it with the manifest, so holders follow the key's owner
+// and its successors. On a ring of fewer nodes than shards the value is
+// stored whole.
+const erasureManifestPrefix = "\x00erasure\x00"
+
+type ErasureManifest struct {
+	Size    int
+	Data    int
+	Parity  int
+	Holders []string
+}
+
+type Shard struct {
+	Key   string
+	Index int
+	Data  []byte
+}
+
+type ShardKey struct {
+	Key   string
+	Index int
+}
+
+// ShardMove has the owner of Key name To the holder of shard Index in place
+// of From.
+type ShardMove struct {
+	Key   string
+	Index int
+	From  string
+	To    string
+}
+
+type shardStore struct {
+	lock   sync.RWMutex
+	shards map[ShardKey][]byte
+}
+
+// errShardMoved: A shard move found the manifest changed since it was read.
+var errShardMoved = errors.New("shard holder changed")
+
+func encodeManifest(m ErasureManifest) string {
+	manifest, _ := json.Marshal(m)
+	return erasureManifestPrefix + string(manifest)
+}
+
+func parseManifest(val string) (ErasureManifest, bool) {
+	var m ErasureManifest
+	if !strings.HasPrefix(val, erasureManifestPrefix) {
+		return m, false
+	}
+	err := json.Unmarshal([]byte(val[len(erasureManifestPrefix):]), &m)
+	return m, err == nil
+}
+
+func (n *ChordNode) PutShard(s Shard, _ *string) error {
+	n.shards.lock.Lock()
+	if n.shards.shards == nil {
+		n.shards.shards = make(map[ShardKey][]byte)
+	}
+	n.shards.shards[ShardKey{Key: s.Key, Index: s.Index}] = s.Data
+	n.shards.lock.Unlock()
+	return nil
+}
+
+func (n *ChordNode) GetShard(k ShardKey, ret *[]byte) error {
+	n.shards.lock.RLock()
+	data, ok := n.shards.shards[k]
+	n.shards.lock.RUnlock()
+	if !ok {
+		return errors.New("shard not found")
+	}
+	*ret = data
+	return nil
+}
+
+func (n *ChordNode) DeleteShard(k ShardKey, _ *string) error {
+	n.shards.lock.Lock()
+	delete(n.shards.shards, k)
+	n.shards.lock.Unlock()
+	return nil
+}
+
+// shardHolders lists the owner and its successors, cnt distinct nodes, or
+// nil when the ring has fewer.
+func (n *ChordNode) shardHolders(owner string, cnt int) ([]string, error) {
+	var sucList [SuccessorListLen]string
+	err := n.call(owner, "ChordNode.GetSuccessorList", NULL, &sucList)
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{owner}
+	seen := map[string]bool{owner: true}
+	for _, s := range sucList {
+		if s != NULL && !seen[s] && len(ret) < cnt {
+			seen[s] = true
+			ret = append(ret, s)
+		}
+	}
+	if len(ret) < cnt {
+		return nil, nil
+	}
+	return ret, nil
+}
+
+// MoveShardInStore rewrites the manifest of mv.Key for shard mv.Index to be
+// held by mv.To, if mv.From holds it still.
+func (n *ChordNode) MoveShardInStore(mv ShardMove, _ *string) error {
+	if target, ok := n.migratedTo(mv.Key); ok {
+		return n.call(target, "ChordNode.MoveShardInStore", mv, nil)
+	}
+	n.storeLock.RLock()
+	old, _ := n.store.Get(mv.Key)
+	n.storeLock.RUnlock()
+	m, isManifest := parseManifest(old)
+	if !isManifest || mv.Index >= len(m.Holders) || m.Holders[mv.Index] != mv.From {
+		return errShardMoved
+	}
+	m.Holders[mv.Index] = mv.To
+	return n.putInStoreIf(Pair{First: mv.Key, Second: encodeManifest(m)}, func(cur string, ok bool) error {
+		if !ok || cur != old {
+			return errShardMoved
+		}
+		return nil
+	}, nil)
+}
+
+// handShardsTo moves to pre, a node that joins in front of this one, the
+// shards this node holds of the manifests in data it hands pre, rewriting
+// them there. A shard of a value pre holds one of already stays.
+func (n *ChordNode) handShardsTo(pre string, data map[string]string) {
+	for k, v := range data {
+		m, isManifest := parseManifest(v)
+		if !isManifest {
+			continue
+		}
+		held := false
+		for _, h := range m.Holders {
+			held = held || h == pre
+		}
+		if held {
+			continue
+		}
+		for i, h := range m.Holders {
+			if h != n.addr || !n.sendShard(pre, ShardKey{Key: k, Index: i}) {
+				continue
+			}
+			m.Holders[i] = pre
+			data[k] = encodeManifest(m)
+			break
+		}
+	}
+}
+
+// handOffShards moves the shards this node holds to its successors, each to
+// the first that holds no other shard of its value, for a quit.
+func (n *ChordNode) handOffShards() {
+	n.shards.lock.RLock()
+	held := make([]ShardKey, 0, len(n.shards.shards))
+	for k := range n.shards.shards {
+		held = append(held, k)
+	}
+	n.shards.lock.RUnlock()
+	if len(held) == 0 {
+		return
+	}
+	n.sucLock.RLock()
+	sucList := n.successorList
+	n.sucLock.RUnlock()
+	moved := 0
+	for _, k := range held {
+		var owner, val string
+		err := n.FindSuccessor(n.keyId(k.Key), &owner)
+		if err == nil && owner == n.addr {
+			err = n.GetInStore(k.Key, &val)
+		} else if err == nil {
+			err = n.call(owner, "ChordNode.GetInStore", k.Key, &val)
+		}
+		m, isManifest := parseManifest(val)
+		if err != nil || !isManifest || k.Index >= len(m.Holders) || m.Holders[k.Index] != n.addr {
+			continue
+		}
+		holders := make(map[string]bool)
+		for _, h := range m.Holders {
+			holders[h] = true
+		}
+		for _, s := range sucList {
+			if s == NULL || holders[s] || !n.sendShard(s, k) {
+				continue
+			}
+			mv := ShardMove{Key: k.Key, Index: k.Index, From: n.addr, To: s}
+			if owner == n.addr {
+				err = n.MoveShardInStore(mv, nil)
+			} else {
+				err = n.call(owner, "ChordNode.MoveShardInStore", mv, nil)
+			}
+			if err == nil {
+				moved++
+			}
+			break
+		}
+	}
+	n.maintenanceLog().Infof("Node [%v] hands off %v of its %v shards.", n.addr, moved, len(held))
+}
+
+// sendShard copies the shard k this node holds to addr and drops it here.
+func (n *ChordNode) sendShard(addr string, k ShardKey) bool {
+	n.shards.lock.RLock()
+	data, ok := n.shards.shards[k]
+	n.shards.lock.RUnlock()
+	if !ok {
+		return false
+	}
+	if err := n.call(addr, "ChordNode.PutShard", Shard{Key: k.Key, Index: k.Index, Data: data}, nil); err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.sendShard", "ChordNode.PutShard", err)
+		return false
+	}
+	_ = n.DeleteShard(k, nil)
+	return true
+}
+
+func (n *ChordNode) putErasure(key string, val string, trace *OpTrace) AckLevel {
+	t := n.startOp("put", key).tracing(trace)
+	tar, err := n.lookup(t, key)
+	if err != nil {
+		t.finish(false)
+		n.logErrorFunctionCall(n.addr, "ChordNode.putErasure", "ChordNode.FindSuccessor", err)
+		return AckNone
+	}
+	rs := reedSolomon{data: n.erasure.data, parity: n.erasure.parity}
+	holders, err := n.shardHolders(tar, rs.data+rs.parity)
+	if err != nil {
+		t.finish(false)
+		n.logErrorFunctionCall(n.addr, "ChordNode.putErasure", "ChordNode.GetSuccessorList", err)
+		return AckNone
+	}
+	stored := val
+	if holders == nil {
+		n.storageLog().Infof("Store key [%v] whole from node [%v], the ring has fewer than %v nodes.", key, n.addr, rs.data+rs.parity)
+	} else {
+		n.storageLog().Infof("Start placing key [%v]'s %v+%v shards from node [%v].", key, rs.data, rs.parity, n.addr)
+		begin := time.Now()
+		for i, shard := range rs.encode([]byte(val)) {
+			err = n.call(holders[i], "ChordNode.PutShard", Shard{Key: key, Index: i, Data: shard}, nil)
+			if err != nil {
+				t.finish(false)
+				n.logErrorFunctionCall(n.addr, "ChordNode.putErasure", "ChordNode.PutShard", err)
+				return AckNone
+			}
+		}
+		t.phase("PutShard", tar, begin)
+		stored = encodeManifest(ErasureManifest{Size: len(val), Data: rs.data, Parity: rs.parity, Holders: holders})
+	}
+	var ack AckLevel
+	begin := time.Now()
+	err = n.call(tar, "ChordNode.PutAcceptedInStore", Pair{First: key, Second: stored}, &ack)
+	t.phase("PutAcceptedInStore", tar, begin)
+	t.finish(err == nil)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.putErasure", "ChordNode.PutInStore", err)
+		return AckNone
+	}
+	return ack
+}
+
+func (n *ChordNode) getErasure(key string, m ErasureManifest) (bool, string) {
+	rs := reedSolomon{data: m.Data, parity: m.Parity}
+	index := make([]int, 0, rs.data)
+	shards := make([][]byte, 0, rs.data)
+	for i, h := range m.Holders {
+		if len(index) == rs.data {
+			break
+		}
+		var shard []byte
+		err := n.call(h, "ChordNode.GetShard", ShardKey{Key: key, Index: i}, &shard)
+		if err != nil {
+			n.storageLog().Infof("Shard %v of key [%v] on [%v] unavailable, error message: [%v].", i, key, h, err)
+			continue
+		}
+		index = append(index, i)
+		shards = append(shards, shard)
+	}
+	if len(index) < rs.data {
+		n.storageLog().Errorf("Only %v of %v shards of key [%v] are available.", len(index), rs.data, key)
+		return false, NULL
+	}
+	val, err := rs.decode(index, shards, m.Size)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.getErasure", "reedSolomon.decode", err)
+		return false, NULL
+	}
+	return true, string(val)
+}
+
+func (n *ChordNode) dropShards(key string, m ErasureManifest) {
+	for i, h := range m.Holders {
+		_ = n.call(h, "ChordNode.DeleteShard", ShardKey{Key: key, Index: i}, nil)
+	}
+}
+
+type erasureConfig struct {
+	data    int
+	parity  int
+	minSize int
+}
+
+// SetErasureCoding makes puts of values of at least minSize bytes store data
+// plus parity shards instead of the value. Zero data shards turns it off.
+func (w *NodeWrapper) SetErasureCoding(data, parity, minSize int) bool {
+	if data < 0 || parity < 0 || data+parity > 255 {
+		w.node.log().Errorf("Invalid erasure coding [%v+%v].", data, parity)
+		return false
+	}
+	w.node.erasure = erasureConfig{data: data, parity: parity, minSize: minSize}
+	return true
+}
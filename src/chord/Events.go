@@ -0,0 +1,105 @@
+package chord
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	EventJoin               = "join"
+	EventLeave              = "leave"
+	EventFailureDetected    = "failure-detected"
+	EventPredecessorChanged = "predecessor-changed"
+	EventSuccessorChanged   = "successor-changed"
+	EventTransferStarted    = "transfer-started"
+	EventTransferFinished   = "transfer-finished"
+	EventBackupPromoted     = "backup-promoted"
+)
+
+type RingEvent struct {
+	Seq    uint64
+	Time   time.Time
+	Node   string
+	Type   string
+	Peer   string
+	Keys   int
+	Detail string
+}
+
+// eventBus fans events out to admin stream subscribers. A subscriber that
+// cannot keep up loses events rather than slowing the node down; the Seq gap
+// tells it so.
+type eventBus struct {
+	lock        sync.Mutex
+	seq         uint64
+	subscribers map[chan RingEvent]struct{}
+}
+
+func (b *eventBus) subscribe() chan RingEvent {
+	ch := make(chan RingEvent, eventSubscriberBufferLen)
+	b.lock.Lock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan RingEvent]struct{})
+	}
+	b.subscribers[ch] = struct{}{}
+	b.lock.Unlock()
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan RingEvent) {
+	b.lock.Lock()
+	delete(b.subscribers, ch)
+	b.lock.Unlock()
+}
+
+func (b *eventBus) publish(e RingEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.seq++
+	e.Seq = b.seq
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (n *ChordNode) publish(eventType, peer string, keys int, detail string) {
+	e := RingEvent{Time: time.Now(), Node: n.addr, Type: eventType, Peer: peer, Keys: keys, Detail: detail}
+	n.noteMembership(e)
+	n.events.publish(e)
+}
+
+func (n *ChordNode) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := n.events.subscribe()
+	defer n.events.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
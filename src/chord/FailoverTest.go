@@ -0,0 +1,112 @@
+//go:build failovertest
+
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const FailoverTestEnabled = true
+
+var failoverAudit struct {
+	lock       sync.Mutex
+	violations []string
+}
+
+// assertPromoted checks that no key a merge promoted into the store is left
+// in the pre backup as well, where a later merge or audit would take it for
+// another node's.
+func (n *ChordNode) assertPromoted(merged []string) {
+	var both []string
+	n.storeLock.RLock()
+	n.preBackupLock.RLock()
+	for _, k := range merged {
+		if _, ok := n.store.Get(k); !ok {
+			continue
+		}
+		if _, ok := n.preBackup.Get(k); ok {
+			both = append(both, k)
+		}
+	}
+	n.preBackupLock.RUnlock()
+	n.storeLock.RUnlock()
+	if len(both) == 0 {
+		return
+	}
+	violation := fmt.Sprintf("node [%v] holds %v promoted keys in both its store and pre backup: %v", n.addr, len(both), both)
+	n.replicationLog().Errorln(violation)
+	failoverAudit.lock.Lock()
+	failoverAudit.violations = append(failoverAudit.violations, violation)
+	failoverAudit.lock.Unlock()
+}
+
+func FailoverViolations() []string {
+	failoverAudit.lock.Lock()
+	defer failoverAudit.lock.Unlock()
+	return append([]string(nil), failoverAudit.violations...)
+}
+
+// FailForTest force quits this node, as a crash would, after the reply.
+func (n *ChordNode) FailForTest(_ string, _ *string) error {
+	go n.forceQuit()
+	return nil
+}
+
+// CheckSuccessorFailover force-fails this node's successor and reads every
+// key of the successor's store back through this node after each of its
+// stabilize rounds, for up to maxRounds of them. It fails unless all of them
+// come back, with their values, and no node of the process caught a
+// promoted key in both its store and pre backup meanwhile.
+func (w *NodeWrapper) CheckSuccessorFailover(maxRounds int) (FailoverCheck, error) {
+	n := w.node
+	var ret FailoverCheck
+	if err := n.FirstAvailableSuccessor(NULL, &ret.Successor); err != nil {
+		return ret, err
+	}
+	if ret.Successor == n.addr {
+		return ret, errors.New("no successor to fail")
+	}
+	data := make(map[string]string)
+	err := n.streamStore(ret.Successor, func(chunk map[string]string) error {
+		for k, v := range chunk {
+			data[k] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return ret, err
+	}
+	ret.Keys = len(data)
+	seen := len(FailoverViolations())
+	if err := n.call(ret.Successor, "ChordNode.FailForTest", NULL, nil); err != nil && !isTransportError(err) {
+		return ret, err
+	}
+	begin := n.pacer.rounds(taskStabilize)
+	for {
+		ret.Unreadable = ret.Unreadable[:0]
+		for k, v := range data {
+			if val, err := n.getValue(k, nil); err != nil || val != v {
+				ret.Unreadable = append(ret.Unreadable, k)
+			}
+		}
+		round := n.pacer.rounds(taskStabilize)
+		ret.Rounds = round - begin
+		if len(ret.Unreadable) == 0 || ret.Rounds >= uint64(maxRounds) {
+			break
+		}
+		for n.pacer.rounds(taskStabilize) == round {
+			time.Sleep(maintainMinPauseTime)
+		}
+	}
+	ret.Violations = FailoverViolations()[seen:]
+	if len(ret.Unreadable) > 0 {
+		return ret, fmt.Errorf("%v of %v keys of [%v] unreadable after %v rounds", len(ret.Unreadable), ret.Keys, ret.Successor, ret.Rounds)
+	}
+	if len(ret.Violations) > 0 {
+		return ret, fmt.Errorf("promotion left keys in both store and pre backup: %v", ret.Violations)
+	}
+	return ret, nil
+}
@@ -0,0 +1,21 @@
+//go:build !failovertest
+
+package chord
+
+import "errors"
+
+// FailoverTestEnabled tells whether the binary was built with the
+// failovertest tag.
+const FailoverTestEnabled = false
+
+// FailoverViolations returns the promotions the failover assertions caught.
+func FailoverViolations() []string {
+	return nil
+}
+
+func (n *ChordNode) assertPromoted(merged []string) {}
+
+// CheckSuccessorFailover needs the failovertest tag to fail a node.
+func (w *NodeWrapper) CheckSuccessorFailover(maxRounds int) (FailoverCheck, error) {
+	return FailoverCheck{}, errors.New("built without the failovertest tag")
+}
@@ -0,0 +1,172 @@
+package chord
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// FailureDetector decides whether a peer counts as up. Report feeds it what
+// calls to the peer saw; Subscribe callbacks run on the goroutine that
+// noticed the change, outside the detector's locks, and must not block.
+type FailureDetector interface {
+	IsAlive(addr string) bool
+	Report(addr string, alive bool)
+	Subscribe(f func(addr string, alive bool))
+}
+
+// Confirmer is implemented by detectors that may answer IsAlive from hearsay;
+// Confirm is asked instead before a peer is removed from the successor list.
+type Confirmer interface {
+	Confirm(addr string) bool
+}
+
+// Gossiper is implemented by detectors whose observations travel on
+// StabilizeExchange.
+type Gossiper interface {
+	Recent() []LivenessObservation
+	Merge(observations []LivenessObservation)
+}
+
+type subscriberList struct {
+	lock      sync.RWMutex
+	callbacks []func(addr string, alive bool)
+}
+
+func (s *subscriberList) add(f func(addr string, alive bool)) {
+	s.lock.Lock()
+	s.callbacks = append(s.callbacks, f)
+	s.lock.Unlock()
+}
+
+func (s *subscriberList) notify(addr string, alive bool) {
+	s.lock.RLock()
+	callbacks := s.callbacks
+	s.lock.RUnlock()
+	for _, f := range callbacks {
+		f(addr, alive)
+	}
+}
+
+// PingDetector dials the peer on every question and remembers nothing but
+// the last answer, to report changes.
+type PingDetector struct {
+	lock        sync.Mutex
+	last        map[string]bool
+	probe       func(addr string) bool
+	subscribers subscriberList
+}
+
+func NewPingDetector(probe func(addr string) bool) *PingDetector {
+	return &PingDetector{last: make(map[string]bool), probe: probe}
+}
+
+func (d *PingDetector) IsAlive(addr string) bool {
+	if addr == NULL {
+		return false
+	}
+	alive := d.probe(addr)
+	d.Report(addr, alive)
+	return alive
+}
+
+func (d *PingDetector) Report(addr string, alive bool) {
+	d.lock.Lock()
+	last, ok := d.last[addr]
+	d.last[addr] = alive
+	d.lock.Unlock()
+	if ok && last != alive || !ok && !alive {
+		d.subscribers.notify(addr, alive)
+	}
+}
+
+func (d *PingDetector) Subscribe(f func(addr string, alive bool)) {
+	d.subscribers.add(f)
+}
+
+// SwimDetector is a CachedDetector whose probes follow SWIM: a peer that
+// does not answer directly is probed again through up to swimIndirectProbes
+// helpers, and only declared dead if none of them reach it either, so a
+// single bad link does not evict a node.
+type SwimDetector struct {
+	*CachedDetector
+	direct   func(addr string) bool
+	helpers  func() []string
+	indirect func(helper, addr string) (bool, error)
+}
+
+func NewSwimDetector(direct func(addr string) bool, helpers func() []string, indirect func(helper, addr string) (bool, error)) *SwimDetector {
+	d := &SwimDetector{direct: direct, helpers: helpers, indirect: indirect}
+	d.CachedDetector = NewCachedDetector(d.probe)
+	return d
+}
+
+func (d *SwimDetector) probe(addr string) bool {
+	if d.direct(addr) {
+		return true
+	}
+	helpers := d.helpers()
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	asked := 0
+	for _, h := range helpers {
+		if asked == swimIndirectProbes {
+			break
+		}
+		if h == NULL || h == addr {
+			continue
+		}
+		alive, err := d.indirect(h, addr)
+		if err != nil {
+			continue
+		}
+		asked++
+		if alive {
+			return true
+		}
+	}
+	return false
+}
+
+// ProbePeer pings addr on behalf of a SWIM detector elsewhere.
+func (n *ChordNode) ProbePeer(addr string, ret *bool) error {
+	*ret = Ping(addr)
+	return nil
+}
+
+func (n *ChordNode) newFailureDetector(name string) (FailureDetector, bool) {
+	switch name {
+	case "ping":
+		return NewPingDetector(Ping), true
+	case "cached":
+		return NewCachedDetector(Ping), true
+	case "swim":
+		return NewSwimDetector(Ping, n.swimHelpers, func(helper, addr string) (bool, error) {
+			var alive bool
+			err := n.countedCall(helper, "ChordNode.ProbePeer", addr, &alive)
+			return alive, err
+		}), true
+	}
+	return nil, false
+}
+
+// useDetector makes d the node's detector. Liveness subscribers belong to the
+// node, not the detector, so the ones added before a swap keep hearing about
+// changes after it.
+func (n *ChordNode) useDetector(d FailureDetector) {
+	d.Subscribe(n.peerSubscribers.notify)
+	n.detector = d
+}
+
+func (n *ChordNode) swimHelpers() []string {
+	n.sucLock.RLock()
+	list := n.successorList
+	n.sucLock.RUnlock()
+	var pre string
+	_ = n.GetPredecessor(NULL, &pre)
+	ret := make([]string, 0, len(list)+1)
+	for _, addr := range append(list[:], pre) {
+		if addr != NULL && addr != n.addr {
+			ret = append(ret, addr)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,31 @@
+package chord
+
+import "testing"
+
+func TestDetectorSwapKeepsSubscribers(t *testing.T) {
+	up := func(addr string) bool { return true }
+	detectors := map[string]func() FailureDetector{
+		"ping":   func() FailureDetector { return NewPingDetector(up) },
+		"cached": func() FailureDetector { return NewCachedDetector(up) },
+		"swim": func() FailureDetector {
+			return NewSwimDetector(up, func() []string { return nil }, func(helper, addr string) (bool, error) { return true, nil })
+		},
+	}
+	for from, newFrom := range detectors {
+		for to, newTo := range detectors {
+			n := new(ChordNode)
+			n.useDetector(newFrom())
+			heard := 0
+			n.peerSubscribers.add(func(addr string, alive bool) {
+				if !alive {
+					heard++
+				}
+			})
+			n.useDetector(newTo())
+			n.detector.Report("node-down", false)
+			if heard != 1 {
+				t.Errorf("death reported after a swap from %v to %v reached the subscriber %v times", from, to, heard)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package chord
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+)
+
+var errLookupOverloaded = errors.New("lookup overloaded, retry later")
+
+type LookupRequest struct {
+	Key    *big.Int
+	Origin string
+}
+
+// lookupLimiter caps the forwarded lookups a node has in flight, in total and
+// per origin, so a single client cannot amplify its traffic through the ring.
+// Lookups entering through FindSuccessor are attributed to the node they
+// entered at.
+type lookupLimiter struct {
+	lock      sync.Mutex
+	total     int
+	perOrigin map[string]int
+}
+
+func (l *lookupLimiter) acquire(origin string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.perOrigin == nil {
+		l.perOrigin = make(map[string]int)
+	}
+	if l.total >= lookupMaxInFlight || l.perOrigin[origin] >= lookupMaxInFlightPerOrigin {
+		return false
+	}
+	l.total++
+	l.perOrigin[origin]++
+	return true
+}
+
+func (l *lookupLimiter) release(origin string) {
+	l.lock.Lock()
+	l.total--
+	l.perOrigin[origin]--
+	if l.perOrigin[origin] == 0 {
+		delete(l.perOrigin, origin)
+	}
+	l.lock.Unlock()
+}
+
+func isOverloaded(err error) bool {
+	return err != nil && err.Error() == errLookupOverloaded.Error()
+}
+
+func (n *ChordNode) ForwardFindSuccessor(req LookupRequest, ret *string) error {
+	return n.findSuccessor(req, ret)
+}
+
+func (n *ChordNode) ForwardFindSuccessorPath(req LookupRequest, ret *LookupPath) error {
+	return n.findSuccessorPath(req, ret)
+}
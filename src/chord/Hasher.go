@@ -0,0 +1,64 @@
+package chord
+
+import (
+	"math/big"
+	"strings"
+)
+
+// KeyHasher maps a key to its identifier on the ring. Node identifiers are
+// always the hash of the address; only keys go through the hasher. Every
+// node of a ring, and every client, has to map keys the same way, or they
+// disagree on who owns what.
+type KeyHasher func(key string) *big.Int
+
+// SaltedKeys hashes salt in front of every key, so that rings sharing their
+// nodes' addresses, or tenants of one ring, spread their keys differently.
+func SaltedKeys(salt string) KeyHasher {
+	return func(key string) *big.Int {
+		return id(salt + key)
+	}
+}
+
+// HashTagKeys hashes only the part of a key between the first { and the }
+// after it, when there is one and it is not empty, so that keys sharing a
+// tag land on the same node.
+func HashTagKeys() KeyHasher {
+	return func(key string) *big.Int {
+		return id(hashTag(key))
+	}
+}
+
+func hashTag(key string) string {
+	open := strings.IndexByte(key, '{')
+	if open < 0 {
+		return key
+	}
+	end := strings.IndexByte(key[open+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[open+1 : open+1+end]
+}
+
+// hashKey maps key with h, or with the default hash when h is nil.
+func hashKey(h KeyHasher, key string) *big.Int {
+	if h == nil {
+		return id(key)
+	}
+	return h(key)
+}
+
+func (n *ChordNode) keyId(key string) *big.Int {
+	return hashKey(n.keyHash, key)
+}
+
+// SetKeyHasher changes how the node maps keys to identifiers. It has to be
+// set before the node creates or joins a ring, the same on every node.
+func (w *NodeWrapper) SetKeyHasher(h KeyHasher) bool {
+	if s := w.node.life.get(); s != StateCreated && s != StateOffline {
+		w.node.log().Errorf("Trying to change the key hasher of an online node.")
+		return false
+	}
+	w.node.keyHash = h
+	return true
+}
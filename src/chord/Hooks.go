@@ -0,0 +1,177 @@
+package chord
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// hookTable keeps the callbacks registered by the embedding application.
+// Callbacks run one at a time on a dedicated goroutine in the order the events
+// happened, so they never run while the node holds one of its own locks.
+// Keys promoted from the local pre backup are reported as transferred in from
+// an empty address. Write and read hooks are the exception: they run on the
+// goroutine of the write or read, which waits for them. A callback that finds
+// hookQueueLen others still waiting is dropped, rather than hold up the node
+// that fired it, and counted in DroppedHookCalls.
+type hookTable struct {
+	lock                 sync.RWMutex
+	predecessorChanged   []func(from, to string)
+	successorChanged     []func(from, to string)
+	keysTransferredIn    []func(from string, keys []string)
+	keysTransferredOut   []func(to string, keys []string)
+	joinComplete         []func(assist string)
+	quit                 []func(force bool)
+	write                []namedHook
+	read                 []namedHook
+	queue                chan func()
+	dispatcherInitialize sync.Once
+	dropped              uint64
+}
+
+// dispatch queues f for the dispatcher, and reports false if the queue is
+// full and f was dropped.
+func (h *hookTable) dispatch(f func()) bool {
+	h.dispatcherInitialize.Do(func() {
+		h.queue = make(chan func(), hookQueueLen)
+		go func() {
+			for f := range h.queue {
+				f()
+			}
+		}()
+	})
+	select {
+	case h.queue <- f:
+		return true
+	default:
+		atomic.AddUint64(&h.dropped, 1)
+		return false
+	}
+}
+
+func (n *ChordNode) dispatchHook(event string, f func()) {
+	if !n.hooks.dispatch(f) {
+		n.log().Errorf("Node [%v]'s hook queue is full, %v callback dropped.", n.addr, event)
+	}
+}
+
+func (n *ChordNode) firePredecessorChanged(from, to string) {
+	if from == to {
+		return
+	}
+	n.publish(EventPredecessorChanged, to, 0, from)
+	n.hooks.lock.RLock()
+	callbacks := n.hooks.predecessorChanged
+	n.hooks.lock.RUnlock()
+	for _, f := range callbacks {
+		f := f
+		n.dispatchHook("predecessor changed", func() { f(from, to) })
+	}
+}
+
+func (n *ChordNode) fireSuccessorChanged(from, to string) {
+	if from == to {
+		return
+	}
+	n.publish(EventSuccessorChanged, to, 0, from)
+	n.hooks.lock.RLock()
+	callbacks := n.hooks.successorChanged
+	n.hooks.lock.RUnlock()
+	for _, f := range callbacks {
+		f := f
+		n.dispatchHook("successor changed", func() { f(from, to) })
+	}
+}
+
+func (n *ChordNode) fireKeysTransferredIn(from string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	n.hooks.lock.RLock()
+	callbacks := n.hooks.keysTransferredIn
+	n.hooks.lock.RUnlock()
+	for _, f := range callbacks {
+		f := f
+		n.dispatchHook("keys transferred in", func() { f(from, keys) })
+	}
+}
+
+func (n *ChordNode) fireKeysTransferredOut(to string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	n.hooks.lock.RLock()
+	callbacks := n.hooks.keysTransferredOut
+	n.hooks.lock.RUnlock()
+	for _, f := range callbacks {
+		f := f
+		n.dispatchHook("keys transferred out", func() { f(to, keys) })
+	}
+}
+
+func (n *ChordNode) fireJoinComplete(assist string) {
+	n.publish(EventJoin, assist, 0, NULL)
+	n.hooks.lock.RLock()
+	callbacks := n.hooks.joinComplete
+	n.hooks.lock.RUnlock()
+	for _, f := range callbacks {
+		f := f
+		n.dispatchHook("join complete", func() { f(assist) })
+	}
+}
+
+func (n *ChordNode) fireQuit(force bool) {
+	if force {
+		n.publish(EventLeave, NULL, 0, "force")
+	} else {
+		n.publish(EventLeave, NULL, 0, NULL)
+	}
+	n.hooks.lock.RLock()
+	callbacks := n.hooks.quit
+	n.hooks.lock.RUnlock()
+	for _, f := range callbacks {
+		f := f
+		n.dispatchHook("quit", func() { f(force) })
+	}
+}
+
+func (w *NodeWrapper) OnPredecessorChanged(f func(from, to string)) {
+	w.node.hooks.lock.Lock()
+	w.node.hooks.predecessorChanged = append(w.node.hooks.predecessorChanged, f)
+	w.node.hooks.lock.Unlock()
+}
+
+func (w *NodeWrapper) OnSuccessorChanged(f func(from, to string)) {
+	w.node.hooks.lock.Lock()
+	w.node.hooks.successorChanged = append(w.node.hooks.successorChanged, f)
+	w.node.hooks.lock.Unlock()
+}
+
+func (w *NodeWrapper) OnKeysTransferredIn(f func(from string, keys []string)) {
+	w.node.hooks.lock.Lock()
+	w.node.hooks.keysTransferredIn = append(w.node.hooks.keysTransferredIn, f)
+	w.node.hooks.lock.Unlock()
+}
+
+func (w *NodeWrapper) OnKeysTransferredOut(f func(to string, keys []string)) {
+	w.node.hooks.lock.Lock()
+	w.node.hooks.keysTransferredOut = append(w.node.hooks.keysTransferredOut, f)
+	w.node.hooks.lock.Unlock()
+}
+
+func (w *NodeWrapper) OnJoinComplete(f func(assist string)) {
+	w.node.hooks.lock.Lock()
+	w.node.hooks.joinComplete = append(w.node.hooks.joinComplete, f)
+	w.node.hooks.lock.Unlock()
+}
+
+func (w *NodeWrapper) OnQuit(f func(force bool)) {
+	w.node.hooks.lock.Lock()
+	w.node.hooks.quit = append(w.node.hooks.quit, f)
+	w.node.hooks.lock.Unlock()
+}
+
+// DroppedHookCalls is the number of callbacks dropped because the hook queue
+// was full when their event happened.
+func (w *NodeWrapper) DroppedHookCalls() uint64 {
+	return atomic.LoadUint64(&w.node.hooks.dropped)
+}
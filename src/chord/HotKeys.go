@@ -0,0 +1,91 @@
+package chord
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type KeyCount struct {
+	Key   string
+	Count uint32
+}
+
+// hotKeyTracker estimates per-key hit counts with a count-min sketch, so its
+// memory does not grow with the number of keys, and keeps a bounded set of
+// the heaviest keys seen so far as candidates for TopKeys.
+type hotKeyTracker struct {
+	lock       sync.Mutex
+	sketch     [hotKeySketchDepth][hotKeySketchWidth]uint32
+	candidates map[string]uint32
+}
+
+// hit counts a hit of key and returns its estimated count.
+func (h *hotKeyTracker) hit(key string) uint32 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(key))
+	sum := f.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var est uint32
+	for i := 0; i < hotKeySketchDepth; i++ {
+		cell := &h.sketch[i][(h1+uint32(i)*h2)%hotKeySketchWidth]
+		*cell++
+		if i == 0 || *cell < est {
+			est = *cell
+		}
+	}
+	if h.candidates == nil {
+		h.candidates = make(map[string]uint32)
+	}
+	if _, ok := h.candidates[key]; ok || len(h.candidates) < hotKeyCandidates {
+		h.candidates[key] = est
+		return est
+	}
+	minKey, minCount := NULL, est
+	for k, c := range h.candidates {
+		if c < minCount {
+			minKey, minCount = k, c
+		}
+	}
+	if minKey != NULL {
+		delete(h.candidates, minKey)
+		h.candidates[key] = est
+	}
+	return est
+}
+
+func (h *hotKeyTracker) top(n int) []KeyCount {
+	h.lock.Lock()
+	ret := make([]KeyCount, 0, len(h.candidates))
+	for k, c := range h.candidates {
+		ret = append(ret, KeyCount{Key: k, Count: c})
+	}
+	h.lock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Key < ret[j].Key
+	})
+	if n >= 0 && n < len(ret) {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+func (n *ChordNode) TopKeys(cnt int, ret *[]KeyCount) error {
+	*ret = n.hotKeys.top(cnt)
+	return nil
+}
+
+func (n *ChordNode) serveTopKeys(w http.ResponseWriter, r *http.Request) {
+	cnt, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil {
+		cnt = hotKeyDefaultTopN
+	}
+	writeJSON(w, n.hotKeys.top(cnt))
+}
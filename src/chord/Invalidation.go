@@ -0,0 +1,430 @@
+package chord
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WatchRequest reads Key and has its owner tell Watcher when it is next
+// written, if that happens within TTL.
+type WatchRequest struct {
+	Key     string
+	Watcher string
+	TTL     time.Duration
+}
+
+// WatchedValue is a value read for a cache. Epoch and Seq are where the
+// invalidation feed of the node that read it stood before the read, so that
+// an invalidation racing the read is not missed.
+type WatchedValue struct {
+	Value string
+	Owner string
+	Epoch int64
+	Seq   uint64
+}
+
+// InvalidationBatch names keys Origin wrote that the receiver watches.
+type InvalidationBatch struct {
+	Origin string
+	Keys   []string
+}
+
+// InvalidationCursor is a position in a node's invalidation feed.
+type InvalidationCursor struct {
+	Epoch int64
+	Seq   uint64
+}
+
+// InvalidationFeed is the keys invalidated after a cursor, up to Seq.
+// Truncated means the feed no longer reaches back to the cursor, or is not
+// the one it was taken from, and whatever was cached off it is suspect.
+type InvalidationFeed struct {
+	Epoch     int64
+	Seq       uint64
+	Keys      []string
+	Truncated bool
+}
+
+// keyWatchers is the owner's side of the invalidation channel: the nodes
+// that cache each key, until their lease runs out, and the keys to tell each
+// of them about. A watcher is told once and watches again on its next read.
+type keyWatchers struct {
+	lock    sync.Mutex
+	until   map[string]map[string]time.Time
+	pending map[string][]string
+}
+
+func (w *keyWatchers) watch(key, watcher string, ttl time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.until == nil {
+		w.until = make(map[string]map[string]time.Time)
+	}
+	if w.until[key] == nil {
+		w.until[key] = make(map[string]time.Time)
+	}
+	w.until[key][watcher] = time.Now().Add(ttl)
+}
+
+// fire queues key for the watchers whose lease is still on.
+func (w *keyWatchers) fire(key string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	watchers, ok := w.until[key]
+	if !ok {
+		return
+	}
+	delete(w.until, key)
+	now := time.Now()
+	for watcher, until := range watchers {
+		if now.After(until) {
+			continue
+		}
+		if w.pending == nil {
+			w.pending = make(map[string][]string)
+		}
+		w.pending[watcher] = append(w.pending[watcher], key)
+	}
+}
+
+func (w *keyWatchers) take() map[string][]string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	ret := w.pending
+	w.pending = nil
+	return ret
+}
+
+// keys returns the watched keys, forgetting the leases that ran out.
+func (w *keyWatchers) keys() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	now := time.Now()
+	ret := make([]string, 0, len(w.until))
+	for k, watchers := range w.until {
+		for watcher, until := range watchers {
+			if now.After(until) {
+				delete(watchers, watcher)
+			}
+		}
+		if len(watchers) == 0 {
+			delete(w.until, k)
+			continue
+		}
+		ret = append(ret, k)
+	}
+	return ret
+}
+
+func (w *keyWatchers) count() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.until)
+}
+
+func (w *keyWatchers) reset() {
+	w.lock.Lock()
+	w.until = nil
+	w.pending = nil
+	w.lock.Unlock()
+}
+
+// invalidationFeed is the watcher's side: the newest invalidationFeedLen keys
+// this node was told were written, numbered in the order they came, for its
+// own cache and for the clients that cache through it. The epoch changes
+// when the node starts over, so a client never follows a feed that restarted
+// numbering.
+type invalidationFeed struct {
+	lock  sync.Mutex
+	epoch int64
+	first uint64
+	keys  []string
+}
+
+func (f *invalidationFeed) cursorLocked() InvalidationCursor {
+	if f.epoch == 0 {
+		f.epoch = time.Now().UnixNano()
+		f.first = 1
+	}
+	return InvalidationCursor{Epoch: f.epoch, Seq: f.first + uint64(len(f.keys)) - 1}
+}
+
+func (f *invalidationFeed) cursor() InvalidationCursor {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.cursorLocked()
+}
+
+func (f *invalidationFeed) add(keys []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.cursorLocked()
+	f.keys = append(f.keys, keys...)
+	if over := len(f.keys) - invalidationFeedLen; over > 0 {
+		f.keys = append([]string(nil), f.keys[over:]...)
+		f.first += uint64(over)
+	}
+}
+
+func (f *invalidationFeed) since(c InvalidationCursor) InvalidationFeed {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	cur := f.cursorLocked()
+	ret := InvalidationFeed{Epoch: cur.Epoch, Seq: cur.Seq}
+	if c.Epoch != cur.Epoch || c.Seq+1 < f.first || c.Seq > cur.Seq {
+		ret.Truncated = true
+		return ret
+	}
+	ret.Keys = append([]string(nil), f.keys[c.Seq+1-f.first:]...)
+	return ret
+}
+
+// heardSince tells whether key was invalidated after c, taking a feed that
+// cannot tell to say it was.
+func (f *invalidationFeed) heardSince(key string, c InvalidationCursor) bool {
+	feed := f.since(c)
+	if feed.Truncated {
+		return true
+	}
+	for _, k := range feed.Keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *invalidationFeed) reset() {
+	f.lock.Lock()
+	f.epoch = 0
+	f.keys = nil
+	f.lock.Unlock()
+}
+
+// HotKeyCacheOptions have a node keep the keys it reads at least MinHits
+// times, counted like TopKeys, for up to TTL, or until their owner says they
+// were written. Zero MinHits turns the cache off. Zero TTL and Capacity mean
+// hotCacheTTL and hotCacheLen.
+type HotKeyCacheOptions struct {
+	MinHits  uint32
+	TTL      time.Duration
+	Capacity int
+}
+
+type HotKeyCacheStatus struct {
+	Options HotKeyCacheOptions
+	Entries int
+	// Watched is the number of this node's keys other nodes cache.
+	Watched     int
+	Hits        uint64
+	Misses      uint64
+	Invalidated uint64
+	Expired     uint64
+}
+
+// hotKeyCache is the read side cache of hot keys. Entries are dropped as
+// soon as the key's owner reports a write, so the TTL only bounds how long a
+// lost invalidation, or an owner that changed, can leave a value stale.
+type hotKeyCache struct {
+	lock    sync.Mutex
+	options HotKeyCacheOptions
+	reads   hotKeyTracker
+	values  expiringCache
+	hits    uint64
+	misses  uint64
+	expired uint64
+}
+
+func (c *hotKeyCache) ttl() time.Duration {
+	if c.options.TTL > 0 {
+		return c.options.TTL
+	}
+	return hotCacheTTL
+}
+
+func (c *hotKeyCache) ttlOf() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ttl()
+}
+
+func (c *hotKeyCache) capacity() int {
+	if c.options.Capacity > 0 {
+		return c.options.Capacity
+	}
+	return hotCacheLen
+}
+
+func (c *hotKeyCache) on() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.options.MinHits > 0
+}
+
+func (c *hotKeyCache) get(key string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok, expired := c.values.get(key)
+	if expired {
+		c.expired++
+	}
+	if !ok {
+		c.misses++
+		return NULL, false
+	}
+	c.hits++
+	return e.value, true
+}
+
+// hot counts a read of key that missed and tells whether it is hot enough to
+// keep.
+func (c *hotKeyCache) hot(key string) bool {
+	c.lock.Lock()
+	min := c.options.MinHits
+	c.lock.Unlock()
+	return c.reads.hit(key) >= min
+}
+
+func (c *hotKeyCache) put(key, value string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values.put(key, expiringEntry{value: value, expires: time.Now().Add(c.ttl())}, c.capacity())
+}
+
+func (c *hotKeyCache) drop(keys []string) {
+	c.lock.Lock()
+	c.values.drop(keys)
+	c.lock.Unlock()
+}
+
+func (c *hotKeyCache) reset() {
+	c.lock.Lock()
+	c.values.reset()
+	c.lock.Unlock()
+}
+
+// GetAndWatch reads key for a cache and has this node, its owner, tell the
+// watcher when it is written. The watch is taken before the read, so no
+// write falls between the two.
+func (n *ChordNode) GetAndWatch(req WatchRequest, ret *WatchedValue) error {
+	if target, ok := n.migratedTo(req.Key); ok {
+		return n.call(target, "ChordNode.GetAndWatch", req, ret)
+	}
+	n.watchers.watch(req.Key, req.Watcher, req.TTL)
+	if err := n.GetInStore(req.Key, &ret.Value); err != nil {
+		return err
+	}
+	ret.Owner = n.addr
+	return nil
+}
+
+// Invalidate drops the keys of batch from this node's cache and passes them
+// on to the clients that cache through it.
+func (n *ChordNode) Invalidate(batch InvalidationBatch, _ *string) error {
+	n.hotCache.drop(batch.Keys)
+	n.invalidations.add(batch.Keys)
+	return nil
+}
+
+// Invalidations returns the keys invalidated since the cursor.
+func (n *ChordNode) Invalidations(c InvalidationCursor, ret *InvalidationFeed) error {
+	*ret = n.invalidations.since(c)
+	return nil
+}
+
+// invalidateWatched tells the watchers about the keys written since the last
+// call. Keys whose range this node no longer owns count as written, since
+// their next writes go to a node that does not know the watchers.
+func (n *ChordNode) invalidateWatched(all bool) {
+	var pre string
+	_ = n.GetPredecessor(NULL, &pre)
+	for _, k := range n.watchers.keys() {
+		_, moved := n.migratedTo(k)
+		if all || moved || pre != NULL && !within(n.keyId(k), NodeId(pre), NodeId(n.addr), true) {
+			n.watchers.fire(k)
+		}
+	}
+	for watcher, keys := range n.watchers.take() {
+		// A watcher that misses this has its TTL to fall back on.
+		if err := n.call(watcher, "ChordNode.Invalidate", InvalidationBatch{Origin: n.addr, Keys: keys}, nil); err != nil {
+			n.logErrorFunctionCall(watcher, "ChordNode.invalidateWatched", "ChordNode.Invalidate", err)
+		}
+	}
+}
+
+// getWatched reads key through its owner, watching it for this node for
+// ttl.
+func (n *ChordNode) getWatched(t *opTimer, key string, ttl time.Duration, ret *WatchedValue) (string, error) {
+	c := n.invalidations.cursor()
+	req := WatchRequest{Key: key, Watcher: n.addr, TTL: ttl}
+	tar, err := n.ownerCall(t, key, "GetAndWatch", req, ret)
+	ret.Epoch, ret.Seq = c.Epoch, c.Seq
+	return tar, err
+}
+
+// LeafGetWatched is a get for a client cache that keeps the value for
+// req.TTL: this node watches the key with its owner for as long, and the
+// client follows this node's invalidation feed from the cursor returned.
+func (n *ChordNode) LeafGetWatched(req WatchRequest, ret *WatchedValue) error {
+	if !n.isOnline() || n.tier == TierLeaf {
+		return ErrOffline
+	}
+	key := req.Key
+	t := n.startOp("get", key)
+	tar, err := n.getWatched(t, key, req.TTL, ret)
+	t.finish(err == nil)
+	if err != nil {
+		n.logErrorFunctionCall(tar, "ChordNode.LeafGetWatched", "ChordNode.GetAndWatch", err)
+		return classifyError(err)
+	}
+	if m, isManifest := parseManifest(ret.Value); isManifest {
+		var ok bool
+		if ok, ret.Value = n.getErasure(key, m); !ok {
+			return ErrUnavailable
+		}
+		var err error
+		ret.Value, err = n.readValue(key, ret.Value)
+		return err
+	}
+	return nil
+}
+
+func (n *ChordNode) hotKeyCacheStatus() HotKeyCacheStatus {
+	c := &n.hotCache
+	c.lock.Lock()
+	ret := HotKeyCacheStatus{
+		Options:     c.options,
+		Entries:     len(c.values.entries),
+		Hits:        c.hits,
+		Misses:      c.misses,
+		Invalidated: c.values.invalidated,
+		Expired:     c.expired,
+	}
+	c.lock.Unlock()
+	ret.Watched = n.watchers.count()
+	return ret
+}
+
+func (n *ChordNode) serveHotKeyCache(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, n.hotKeyCacheStatus())
+}
+
+func (w *NodeWrapper) SetHotKeyCache(options HotKeyCacheOptions) bool {
+	if options.TTL < 0 || options.Capacity < 0 {
+		w.node.log().Errorf("Invalid hot key cache options.")
+		return false
+	}
+	c := &w.node.hotCache
+	c.lock.Lock()
+	c.options = options
+	if options.MinHits == 0 {
+		c.values.reset()
+	}
+	c.lock.Unlock()
+	return true
+}
+
+func (w *NodeWrapper) HotKeyCacheStatus() HotKeyCacheStatus {
+	return w.node.hotKeyCacheStatus()
+}
@@ -0,0 +1,106 @@
+package chord
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errJoinLeaseHeld = errors.New("another join holds the lease")
+
+// JoinLease answers a request for a node's join lease. Holder is whoever has
+// it when it is not granted.
+type JoinLease struct {
+	Granted bool
+	Holder  string
+}
+
+// joinLeaseTable is the lease a node grants on its arc, the ids between its
+// predecessor and itself. Only the holder may join into the arc and take keys
+// from it, so joins landing next to each other run one at a time instead of
+// both taking keys from, and splitting, the same arc. A lease is given up when
+// the join finishes, or runs out after joinLeaseTime if the joiner dies.
+type joinLeaseTable struct {
+	lock    sync.Mutex
+	holder  string
+	expires time.Time
+}
+
+func (t *joinLeaseTable) acquire(joiner string) JoinLease {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.holder != NULL && t.holder != joiner && time.Now().Before(t.expires) {
+		return JoinLease{Holder: t.holder}
+	}
+	t.holder, t.expires = joiner, time.Now().Add(joinLeaseTime)
+	return JoinLease{Granted: true, Holder: joiner}
+}
+
+func (t *joinLeaseTable) release(joiner string) {
+	t.lock.Lock()
+	if t.holder == joiner {
+		t.holder = NULL
+	}
+	t.lock.Unlock()
+}
+
+// heldByOther tells whether a lease other than addr's is in force.
+func (t *joinLeaseTable) heldByOther(addr string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.holder != NULL && t.holder != addr && time.Now().Before(t.expires)
+}
+
+func (n *ChordNode) AcquireJoinLease(joiner string, ret *JoinLease) error {
+	if n.frozen(true) {
+		n.maintenanceLog().Errorf("Node [%v] turns the join of [%v] away, the ring is frozen.", n.addr, joiner)
+		return ErrRingFrozen
+	}
+	*ret = n.joinLease.acquire(joiner)
+	if !ret.Granted {
+		n.maintenanceLog().Infof("Node [%v] holds off join of [%v] while [%v] joins.", n.addr, joiner, ret.Holder)
+	}
+	return nil
+}
+
+func (n *ChordNode) ReleaseJoinLease(joiner string, _ *string) error {
+	n.joinLease.release(joiner)
+	return nil
+}
+
+// leaseJoin takes the join lease of suc, the successor this node found. The
+// join that held it before may have taken the part of the arc this node
+// falls in, so once the lease is held the arc is checked against suc's
+// predecessor, and the lease of that predecessor taken instead if it is now
+// the closer successor. A successor that finds the ring frozen turns the
+// join away with ErrRingFrozen.
+func (n *ChordNode) leaseJoin(suc string) (string, error) {
+	deadline := time.Now().Add(joinLeaseWait)
+	for {
+		var lease JoinLease
+		err := n.call(suc, "ChordNode.AcquireJoinLease", n.addr, &lease)
+		if err != nil {
+			n.logErrorFunctionCall(n.addr, "ChordNode.leaseJoin", "ChordNode.AcquireJoinLease", err)
+			if err = classifyError(err); err != ErrRingFrozen {
+				err = ErrJoinContended
+			}
+			return NULL, err
+		}
+		if lease.Granted {
+			var pre string
+			err = n.call(suc, "ChordNode.GetPredecessor", NULL, &pre)
+			if err != nil || pre == NULL || pre == suc || pre == n.addr || !n.alive(pre) || within(NodeId(n.addr), NodeId(pre), NodeId(suc), true) {
+				return suc, nil
+			}
+			n.maintenanceLog().Infof("Node [%v] joins before [%v], which joined before [%v] meanwhile.", n.addr, pre, suc)
+			_ = n.call(suc, "ChordNode.ReleaseJoinLease", n.addr, nil)
+			suc = pre
+			continue
+		}
+		if time.Now().After(deadline) {
+			n.maintenanceLog().Errorf("Node [%v] gives up waiting for the join lease of [%v] held by [%v].", n.addr, suc, lease.Holder)
+			return NULL, ErrJoinContended
+		}
+		time.Sleep(joinLeasePollTime)
+	}
+}
@@ -0,0 +1,113 @@
+package chord
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// JoinThrottleOptions bound the joins a node assists at once. Joins over
+// MaxConcurrent wait for a slot, up to MaxQueued of them for up to
+// QueueTimeout each, and the rest are turned away with ErrJoinThrottled for
+// the joiner to retry later. A MaxConcurrent of zero takes any number.
+type JoinThrottleOptions struct {
+	MaxConcurrent int
+	MaxQueued     int
+	QueueTimeout  time.Duration
+}
+
+type JoinThrottleStats struct {
+	Active   int
+	Queued   int
+	Served   uint64
+	Rejected uint64
+}
+
+type joinThrottle struct {
+	lock     sync.Mutex
+	options  JoinThrottleOptions
+	slots    chan struct{}
+	queued   int
+	served   uint64
+	rejected uint64
+}
+
+// acquire takes an assist slot, waiting for one if the queue has room, and
+// returns the function that gives it back.
+func (t *joinThrottle) acquire() (func(), error) {
+	t.lock.Lock()
+	slots, options := t.slots, t.options
+	if slots == nil {
+		t.served++
+		t.lock.Unlock()
+		return func() {}, nil
+	}
+	release := func() { <-slots }
+	select {
+	case slots <- struct{}{}:
+		t.served++
+		t.lock.Unlock()
+		return release, nil
+	default:
+	}
+	if t.queued >= options.MaxQueued {
+		t.rejected++
+		t.lock.Unlock()
+		return nil, ErrJoinThrottled
+	}
+	t.queued++
+	t.lock.Unlock()
+	wait := options.QueueTimeout
+	if wait <= 0 {
+		wait = joinThrottleQueueTime
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var err error
+	select {
+	case slots <- struct{}{}:
+	case <-timer.C:
+		err = ErrJoinThrottled
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.queued--
+	if err != nil {
+		t.rejected++
+		return nil, err
+	}
+	t.served++
+	return release, nil
+}
+
+func (t *joinThrottle) stats() JoinThrottleStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return JoinThrottleStats{Active: len(t.slots), Queued: t.queued, Served: t.served, Rejected: t.rejected}
+}
+
+func (n *ChordNode) serveJoins(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.joinThrottle.stats())
+}
+
+// SetJoinThrottle bounds the joins the node assists at once. Assists under
+// way when it is called run out under the old bound.
+func (w *NodeWrapper) SetJoinThrottle(options JoinThrottleOptions) bool {
+	if options.MaxConcurrent < 0 || options.MaxQueued < 0 {
+		w.node.log().Errorf("Invalid join throttle [%+v].", options)
+		return false
+	}
+	t := &w.node.joinThrottle
+	t.lock.Lock()
+	t.options = options
+	t.slots = nil
+	if options.MaxConcurrent > 0 {
+		t.slots = make(chan struct{}, options.MaxConcurrent)
+	}
+	t.lock.Unlock()
+	return true
+}
+
+func (w *NodeWrapper) JoinThrottleStats() JoinThrottleStats {
+	return w.node.joinThrottle.stats()
+}
@@ -0,0 +1,354 @@
+package chord
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrNoKeyFilter: The node keeps no filter of its keys, or has keys
+// migrated out of it that its filter would miss.
+var ErrNoKeyFilter = errors.New("no key filter")
+
+// KeyFilterOptions have a node keep a Bloom filter of the keys it stores,
+// sized for FalsePositiveRate, and fetch those of its neighbours, every
+// RefreshTime. Zero FalsePositiveRate turns filters off, and zero
+// RefreshTime means keyFilterRefreshTime. With SkipInMultiGet, GetMulti
+// does not ask an owner for the keys its filter rules out; a key written to
+// it since the filter was fetched, up to RefreshTime ago, then reads as
+// missing.
+type KeyFilterOptions struct {
+	FalsePositiveRate float64
+	RefreshTime       time.Duration
+	SkipInMultiGet    bool
+}
+
+// KeyFilter is a Bloom filter of the keys Owner stored when it was Built, and
+// of those written to it after. A key it does not contain was not there; one
+// it contains may not be.
+type KeyFilter struct {
+	Owner  string
+	Bits   []uint64
+	Hashes int
+	Keys   int
+	Built  time.Time
+}
+
+func filterHashes(key string) (uint64, uint64) {
+	a := fnv.New64a()
+	_, _ = a.Write([]byte(key))
+	b := fnv.New64()
+	_, _ = b.Write([]byte(key))
+	return a.Sum64(), b.Sum64() | 1
+}
+
+func (f *KeyFilter) add(key string) {
+	m := uint64(len(f.Bits)) * 64
+	h1, h2 := filterHashes(key)
+	for i := 0; i < f.Hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		f.Bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.Keys++
+}
+
+func (f KeyFilter) MayContain(key string) bool {
+	if len(f.Bits) == 0 {
+		return true
+	}
+	m := uint64(len(f.Bits)) * 64
+	h1, h2 := filterHashes(key)
+	for i := 0; i < f.Hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		if f.Bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// FalsePositiveRate estimates the chance of the filter containing a key that
+// is not there, from the keys added.
+func (f KeyFilter) FalsePositiveRate() float64 {
+	m := float64(len(f.Bits) * 64)
+	if m == 0 {
+		return 1
+	}
+	return math.Pow(1-math.Exp(-float64(f.Hashes)*float64(f.Keys)/m), float64(f.Hashes))
+}
+
+// newKeyFilter sizes a filter for keys at rate, leaving room for as many
+// writes again before the next rebuild.
+func newKeyFilter(owner string, keys int, rate float64) KeyFilter {
+	expected := float64(2*keys + keyFilterMinKeys)
+	bits := math.Ceil(-expected * math.Log(rate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Max(1, math.Round(bits/expected*math.Ln2)))
+	return KeyFilter{Owner: owner, Bits: make([]uint64, int(bits+63)/64), Hashes: hashes, Built: time.Now()}
+}
+
+type KeyFilterStatus struct {
+	Options KeyFilterOptions
+	Own     KeyFilterSummary
+	// Peers are the filters fetched from other nodes, and Skipped counts the
+	// keys GetMulti did not ask their owners for.
+	Peers   []KeyFilterSummary
+	Skipped uint64
+}
+
+type KeyFilterSummary struct {
+	Owner             string
+	Keys              int
+	Bytes             int
+	Hashes            int
+	FalsePositiveRate float64
+	Built             time.Time
+	Fetched           time.Time
+}
+
+type fetchedFilter struct {
+	filter KeyFilter
+	at     time.Time
+}
+
+type keyFilters struct {
+	lock    sync.Mutex
+	options KeyFilterOptions
+	own     KeyFilter
+	peers   map[string]fetchedFilter
+	skipped uint64
+}
+
+func (f *keyFilters) on() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.options.FalsePositiveRate > 0
+}
+
+func (f *keyFilters) refreshTime() time.Duration {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.options.RefreshTime > 0 {
+		return f.options.RefreshTime
+	}
+	return keyFilterRefreshTime
+}
+
+// add notes a key written to the store in the filter, so that it never
+// misses a key until the next rebuild.
+func (f *keyFilters) add(key string) {
+	f.lock.Lock()
+	if len(f.own.Bits) > 0 {
+		f.own.add(key)
+	}
+	f.lock.Unlock()
+}
+
+// peer returns the filter fetched from addr, if it is no older than the
+// refresh time.
+func (f *keyFilters) peer(addr string) (KeyFilter, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	p, ok := f.peers[addr]
+	max := f.options.RefreshTime
+	if max <= 0 {
+		max = keyFilterRefreshTime
+	}
+	if !ok || time.Since(p.at) > max {
+		return KeyFilter{}, false
+	}
+	return p.filter, true
+}
+
+func (f *keyFilters) fetched(filter KeyFilter) {
+	f.lock.Lock()
+	if f.peers == nil {
+		f.peers = make(map[string]fetchedFilter)
+	}
+	f.peers[filter.Owner] = fetchedFilter{filter: filter, at: time.Now()}
+	f.lock.Unlock()
+}
+
+func (f *keyFilters) reset() {
+	f.lock.Lock()
+	f.own = KeyFilter{}
+	f.peers = nil
+	f.lock.Unlock()
+}
+
+func summarize(filter KeyFilter, fetched time.Time) KeyFilterSummary {
+	return KeyFilterSummary{
+		Owner:             filter.Owner,
+		Keys:              filter.Keys,
+		Bytes:             8 * len(filter.Bits),
+		Hashes:            filter.Hashes,
+		FalsePositiveRate: filter.FalsePositiveRate(),
+		Built:             filter.Built,
+		Fetched:           fetched,
+	}
+}
+
+func (f *keyFilters) status() KeyFilterStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ret := KeyFilterStatus{Options: f.options, Own: summarize(f.own, time.Time{}), Skipped: f.skipped}
+	for _, p := range f.peers {
+		ret.Peers = append(ret.Peers, summarize(p.filter, p.at))
+	}
+	return ret
+}
+
+// rebuildKeyFilter makes the filter anew from the store, dropping the keys
+// deleted since the last rebuild. Writes add their keys to the filter under
+// the store lock, so swapping it in before the lock is let go misses none.
+func (n *ChordNode) rebuildKeyFilter() {
+	n.filters.lock.Lock()
+	rate := n.filters.options.FalsePositiveRate
+	n.filters.lock.Unlock()
+	n.storeLock.RLock()
+	defer n.storeLock.RUnlock()
+	filter := newKeyFilter(n.addr, n.store.Size(), rate)
+	n.store.Iterate(func(k, _ string) bool {
+		filter.add(k)
+		return true
+	})
+	n.filters.lock.Lock()
+	n.filters.own = filter
+	n.filters.lock.Unlock()
+}
+
+// refreshKeyFilters rebuilds this node's filter and fetches its neighbours'.
+func (n *ChordNode) refreshKeyFilters() {
+	n.rebuildKeyFilter()
+	var suc, pre string
+	_ = n.FirstAvailableSuccessor(NULL, &suc)
+	_ = n.GetPredecessor(NULL, &pre)
+	for _, addr := range []string{suc, pre} {
+		if addr != NULL && addr != n.addr {
+			_, _ = n.fetchKeyFilter(addr)
+		}
+	}
+}
+
+func (n *ChordNode) fetchKeyFilter(addr string) (KeyFilter, error) {
+	if f, ok := n.filters.peer(addr); ok {
+		return f, nil
+	}
+	var f KeyFilter
+	if addr == n.addr {
+		err := n.KeyFilter(NULL, &f)
+		return f, err
+	}
+	if err := n.call(addr, "ChordNode.KeyFilter", NULL, &f); err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.fetchKeyFilter", "ChordNode.KeyFilter", err)
+		return f, err
+	}
+	n.filters.fetched(f)
+	return f, nil
+}
+
+// KeyFilter returns this node's filter of its keys.
+func (n *ChordNode) KeyFilter(_ string, ret *KeyFilter) error {
+	migrating := n.migrating()
+	n.filters.lock.Lock()
+	defer n.filters.lock.Unlock()
+	if len(n.filters.own.Bits) == 0 || migrating {
+		return ErrNoKeyFilter
+	}
+	*ret = n.filters.own
+	ret.Bits = append([]uint64(nil), n.filters.own.Bits...)
+	return nil
+}
+
+// filterMultiGet drops from keys those the filter of their owner tar rules
+// out, if GetMulti may skip them, and returns them apart.
+func (n *ChordNode) filterMultiGet(tar string, keys []string) (asked, skipped []string) {
+	n.filters.lock.Lock()
+	skip := n.filters.options.FalsePositiveRate > 0 && n.filters.options.SkipInMultiGet
+	n.filters.lock.Unlock()
+	if !skip {
+		return keys, nil
+	}
+	f, err := n.fetchKeyFilter(tar)
+	if err != nil {
+		return keys, nil
+	}
+	for _, k := range keys {
+		if f.MayContain(k) {
+			asked = append(asked, k)
+		} else {
+			skipped = append(skipped, k)
+		}
+	}
+	n.filters.lock.Lock()
+	n.filters.skipped += uint64(len(skipped))
+	n.filters.lock.Unlock()
+	return asked, skipped
+}
+
+// mayContain tells whether key may be stored, from the filter of its owner:
+// false means it is not, as of the filter's fetch. An owner without one
+// answers ErrNoKeyFilter.
+func (n *ChordNode) mayContain(key string) (bool, error) {
+	if !n.isOnline() {
+		return false, ErrOffline
+	}
+	t := n.startOp("lookup", key)
+	owner, err := n.lookup(t, key)
+	t.finish(err == nil)
+	if err != nil {
+		return false, classifyError(err)
+	}
+	f, err := n.fetchKeyFilter(owner)
+	if err != nil {
+		return false, classifyError(err)
+	}
+	return f.MayContain(key), nil
+}
+
+func (n *ChordNode) setKeyFilter(options KeyFilterOptions) bool {
+	if options.FalsePositiveRate < 0 || options.FalsePositiveRate >= 1 || options.RefreshTime < 0 {
+		n.log().Errorf("Invalid key filter options [%+v].", options)
+		return false
+	}
+	n.filters.lock.Lock()
+	n.filters.options = options
+	if options.FalsePositiveRate == 0 {
+		n.filters.own = KeyFilter{}
+		n.filters.peers = nil
+	}
+	n.filters.lock.Unlock()
+	if options.FalsePositiveRate > 0 && n.isOnline() {
+		n.rebuildKeyFilter()
+	}
+	return true
+}
+
+func (n *ChordNode) serveKeyFilter(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.filters.status())
+}
+
+// SetKeyFilter has the node keep a filter of its keys. Every node of the ring
+// needs filters on for the others to use them.
+func (w *NodeWrapper) SetKeyFilter(options KeyFilterOptions) bool {
+	return w.node.setKeyFilter(options)
+}
+
+func (w *NodeWrapper) KeyFilterStatus() KeyFilterStatus {
+	return w.node.filters.status()
+}
+
+// MayContain checks key against its owner's filter, without reading it.
+func (w *NodeWrapper) MayContain(key string) (bool, error) {
+	return w.node.mayContain(key)
+}
+
+// KeyFilter fetches the filter of the node at addr, for a client to check keys
+// against before asking for them.
+func (c *Client) KeyFilter(addr string) (KeyFilter, error) {
+	var f KeyFilter
+	err := classifyError(RPCCallWithCodec(addr, c.codec, "ChordNode.KeyFilter", NULL, &f))
+	return f, err
+}
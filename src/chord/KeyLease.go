@@ -0,0 +1,214 @@
+package chord
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrKeyLeased: A write without the key's lease, or a lease claim, found
+	// the key leased to another holder.
+	ErrKeyLeased = errors.New("key is leased to another holder")
+	// ErrLeaseLost: A write under a lease came after the lease expired, was
+	// released, or was claimed by another holder.
+	ErrLeaseLost = errors.New("lease expired or lost")
+)
+
+// KeyLease is a holder's claim on exclusive write access to Key until
+// Expires, by the owner's clock. Token grows with every new grant on Owner,
+// the node that granted it, and starts from the clock, so writes carrying
+// another token, from a holder that lost its lease and does not know yet,
+// are turned away, even by a new owner of the key or the same node started
+// again.
+type KeyLease struct {
+	Key     string
+	Holder  string
+	Owner   string
+	Token   uint64
+	Expires time.Time
+}
+
+type LeaseRequest struct {
+	Key    string
+	Holder string
+	TTL    time.Duration
+}
+
+type LeasedWrite struct {
+	Lease  KeyLease
+	Value  string
+	Delete bool
+}
+
+// keyLeaseTable holds the leases granted on keys this node owns. Leases live
+// on the owner only: a new owner, after a join, a quit or a failure, starts
+// with none.
+type keyLeaseTable struct {
+	lock   sync.Mutex
+	leases map[string]KeyLease
+	token  uint64
+}
+
+// grant leases req.Key to req.Holder, renewing the holder's own lease, unless
+// another holder's lease is in force, which it returns.
+func (t *keyLeaseTable) grant(owner string, req LeaseRequest) (KeyLease, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.leases == nil {
+		t.leases = make(map[string]KeyLease)
+	}
+	now := time.Now()
+	cur, ok := t.leases[req.Key]
+	if ok && now.Before(cur.Expires) && cur.Holder != req.Holder {
+		return cur, false
+	}
+	if !ok || !now.Before(cur.Expires) {
+		if t.token == 0 {
+			t.token = uint64(now.UnixNano())
+		}
+		t.token++
+		cur = KeyLease{Key: req.Key, Holder: req.Holder, Owner: owner, Token: t.token}
+	}
+	cur.Expires = now.Add(req.TTL)
+	t.leases[req.Key] = cur
+	if len(t.leases)%keyLeaseSweepEvery == 0 {
+		for k, l := range t.leases {
+			if !now.Before(l.Expires) {
+				delete(t.leases, k)
+			}
+		}
+	}
+	return cur, true
+}
+
+func (t *keyLeaseTable) release(lease KeyLease) {
+	t.lock.Lock()
+	if cur, ok := t.leases[lease.Key]; ok && cur.sameGrant(lease) {
+		delete(t.leases, lease.Key)
+	}
+	t.lock.Unlock()
+}
+
+// admits tells whether a write to key carrying lease, nil for a plain write,
+// may go ahead.
+func (t *keyLeaseTable) admits(key string, lease *KeyLease) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	cur, ok := t.leases[key]
+	held := ok && time.Now().Before(cur.Expires)
+	switch {
+	case lease == nil && held:
+		return ErrKeyLeased
+	case lease != nil && (!held || !cur.sameGrant(*lease)):
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (l KeyLease) sameGrant(o KeyLease) bool {
+	return l.Owner == o.Owner && l.Token == o.Token
+}
+
+func (n *ChordNode) AcquireKeyLeaseInStore(req LeaseRequest, ret *KeyLease) error {
+	if target, ok := n.migratedTo(req.Key); ok {
+		return n.call(target, "ChordNode.AcquireKeyLeaseInStore", req, ret)
+	}
+	lease, ok := n.keyLeases.grant(n.addr, req)
+	*ret = lease
+	if !ok {
+		return ErrKeyLeased
+	}
+	return nil
+}
+
+func (n *ChordNode) ReleaseKeyLeaseInStore(lease KeyLease, _ *string) error {
+	if target, ok := n.migratedTo(lease.Key); ok {
+		return n.call(target, "ChordNode.ReleaseKeyLeaseInStore", lease, nil)
+	}
+	n.keyLeases.release(lease)
+	return nil
+}
+
+func (n *ChordNode) LeasedWriteInStore(w LeasedWrite, ack *AckLevel) error {
+	if target, ok := n.migratedTo(w.Lease.Key); ok {
+		return n.call(target, "ChordNode.LeasedWriteInStore", w, ack)
+	}
+	if err := n.keyLeases.admits(w.Lease.Key, &w.Lease); err != nil {
+		return err
+	}
+	if w.Delete {
+		if err := n.cache.write(cacheWrite{key: w.Lease.Key, delete: true}); err != nil {
+			n.logErrorFunctionCall(n.addr, "ChordNode.LeasedWriteInStore", "CacheSource.Delete", err)
+			return err
+		}
+		_, err := n.deleteInStore(w.Lease.Key, nil)
+		return err
+	}
+	val, err := n.acceptWrite(w.Lease.Key, w.Value)
+	if err != nil {
+		return err
+	}
+	return n.putAccepted(Pair{First: w.Lease.Key, Second: val}, ack)
+}
+
+func leaseError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err.Error() == ErrKeyLeased.Error():
+		return ErrKeyLeased
+	case err.Error() == ErrLeaseLost.Error():
+		return ErrLeaseLost
+	}
+	return err
+}
+
+func (n *ChordNode) leaseCall(key, serviceMethod string, args interface{}, reply interface{}) error {
+	if n.tier == TierLeaf || !n.isOnline() {
+		n.storageLog().Errorf("Trying to use key leases from a leaf or an offline node.")
+		return ErrUnavailable
+	}
+	t := n.startOp("lease", key)
+	tar, err := n.ownerCall(t, key, serviceMethod, args, reply)
+	t.finish(err == nil)
+	if err != nil {
+		n.logErrorFunctionCall(tar, "ChordNode.leaseCall", "ChordNode."+serviceMethod, err)
+	}
+	return leaseError(err)
+}
+
+// AcquireLease claims exclusive write access to key for holder, for ttl, or
+// renews holder's lease. Until the lease ends only PutLeased and DeleteLeased
+// with it write the key; plain writes fail with ErrKeyLeased. A ttl of zero
+// or over a minute is taken as a minute.
+func (w *NodeWrapper) AcquireLease(key, holder string, ttl time.Duration) (KeyLease, error) {
+	if ttl <= 0 || ttl > keyLeaseMaxTTL {
+		ttl = keyLeaseMaxTTL
+	}
+	var lease KeyLease
+	err := w.node.leaseCall(key, "AcquireKeyLeaseInStore", LeaseRequest{Key: key, Holder: holder, TTL: ttl}, &lease)
+	return lease, err
+}
+
+func (w *NodeWrapper) ReleaseLease(lease KeyLease) error {
+	return w.node.leaseCall(lease.Key, "ReleaseKeyLeaseInStore", lease, nil)
+}
+
+func (w *NodeWrapper) PutLeased(lease KeyLease, value string) error {
+	var ack AckLevel
+	err := w.node.leaseCall(lease.Key, "LeasedWriteInStore", LeasedWrite{Lease: lease, Value: value}, &ack)
+	if err == nil {
+		w.node.hotCache.drop([]string{lease.Key})
+		w.node.negCache.drop(lease.Key)
+	}
+	return err
+}
+
+func (w *NodeWrapper) DeleteLeased(lease KeyLease) error {
+	err := w.node.leaseCall(lease.Key, "LeasedWriteInStore", LeasedWrite{Lease: lease, Delete: true}, nil)
+	if err == nil {
+		w.node.hotCache.drop([]string{lease.Key})
+	}
+	return err
+}
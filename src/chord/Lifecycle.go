@@ -0,0 +1,91 @@
+package chord
+
+import "sync/atomic"
+
+// LifecycleState is where a ring node is between Initialize and quitting. A
+// node only serves and maintains the ring while Online; leaves of a super
+// peer stay Created and track attachment separately.
+type LifecycleState int32
+
+const (
+	// StateCreated: Initialized, not yet part of a ring.
+	StateCreated LifecycleState = iota
+	// StateJoining: Creating a ring or joining one, and taking over its keys.
+	StateJoining
+	// StateOnline: Part of the ring.
+	StateOnline
+	// StateDraining: Quitting, handing its keys to the successor.
+	StateDraining
+	// StateOffline: Quit or force quit. The node may join again.
+	StateOffline
+	// StateStandby: Keeping a warm copy of what it would own, off the ring,
+	// until promoted.
+	StateStandby
+)
+
+var lifecycleNames = [...]string{"created", "joining", "online", "draining", "offline", "standby"}
+
+func (s LifecycleState) String() string {
+	if s < 0 || int(s) >= len(lifecycleNames) {
+		return "unknown"
+	}
+	return lifecycleNames[s]
+}
+
+// lifecycleMoves lists the states each state may move to. A failed join goes
+// back to where it started from, a force quit skips draining, and a standby
+// joins when promoted.
+var lifecycleMoves = map[LifecycleState][]LifecycleState{
+	StateCreated:  {StateJoining, StateStandby},
+	StateJoining:  {StateOnline, StateCreated, StateOffline, StateStandby},
+	StateOnline:   {StateDraining, StateOffline},
+	StateDraining: {StateOffline},
+	StateOffline:  {StateJoining, StateStandby},
+	StateStandby:  {StateJoining, StateOffline},
+}
+
+type lifecycle struct {
+	state int32
+}
+
+func (l *lifecycle) get() LifecycleState {
+	return LifecycleState(atomic.LoadInt32(&l.state))
+}
+
+// move takes the node from one of from to to, and reports the state it left.
+// It fails, leaving the state alone, if the node is in none of from or to is
+// not a legal move from where it is.
+func (l *lifecycle) move(to LifecycleState, from ...LifecycleState) (LifecycleState, bool) {
+	for _, f := range from {
+		if !lifecycleAllows(f, to) {
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&l.state, int32(f), int32(to)) {
+			return f, true
+		}
+	}
+	return l.get(), false
+}
+
+func lifecycleAllows(from, to LifecycleState) bool {
+	for _, s := range lifecycleMoves[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *ChordNode) isOnline() bool {
+	return n.life.get() == StateOnline
+}
+
+// enter moves the node to to from one of from, and logs what was tried
+// otherwise.
+func (n *ChordNode) enter(to LifecycleState, from ...LifecycleState) (LifecycleState, bool) {
+	was, ok := n.life.move(to, from...)
+	if !ok {
+		n.maintenanceLog().Errorf("Node [%v] cannot become %v while %v.", n.addr, to, was)
+	}
+	return was, ok
+}
@@ -0,0 +1,206 @@
+package chord
+
+import (
+	"net/http"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LivenessObservation is what a node last saw of a peer, Age before it was
+// sent. Ages rather than timestamps travel, so clocks need not agree.
+type LivenessObservation struct {
+	Addr  string
+	Alive bool
+	Age   time.Duration
+}
+
+type livenessEntry struct {
+	alive     bool
+	at        time.Time
+	firsthand bool
+}
+
+// CachedDetector merges this node's own pings and calls with the
+// observations its neighbours piggyback on StabilizeExchange. A fresh
+// observation answers IsAlive without a probe; a peer reported dead by
+// someone else is still probed before Confirm gives it up.
+type CachedDetector struct {
+	lock        sync.Mutex
+	entries     map[string]livenessEntry
+	probe       func(addr string) bool
+	pings       uint64
+	saved       uint64
+	subscribers subscriberList
+}
+
+type LivenessStats struct {
+	Pings        uint64
+	SavedPings   uint64
+	Observations []LivenessObservation
+}
+
+func NewCachedDetector(probe func(addr string) bool) *CachedDetector {
+	return &CachedDetector{entries: make(map[string]livenessEntry), probe: probe}
+}
+
+func (d *CachedDetector) observe(addr string, alive bool, at time.Time, firsthand bool) {
+	if addr == NULL {
+		return
+	}
+	d.lock.Lock()
+	e, ok := d.entries[addr]
+	if ok && e.at.After(at) {
+		d.lock.Unlock()
+		return
+	}
+	d.entries[addr] = livenessEntry{alive: alive, at: at, firsthand: firsthand}
+	d.lock.Unlock()
+	if ok && e.alive != alive || !ok && !alive {
+		d.subscribers.notify(addr, alive)
+	}
+}
+
+func (d *CachedDetector) fresh(addr string) (livenessEntry, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	e, ok := d.entries[addr]
+	if !ok || time.Since(e.at) > livenessFreshness {
+		return e, false
+	}
+	d.saved++
+	return e, true
+}
+
+func (d *CachedDetector) run(addr string) bool {
+	d.lock.Lock()
+	d.pings++
+	d.lock.Unlock()
+	alive := d.probe(addr)
+	d.observe(addr, alive, time.Now(), true)
+	return alive
+}
+
+func (d *CachedDetector) IsAlive(addr string) bool {
+	if addr == NULL {
+		return false
+	}
+	if e, ok := d.fresh(addr); ok {
+		return e.alive
+	}
+	return d.run(addr)
+}
+
+// Confirm trusts a fresh report of life from anyone but only this node's own
+// report of death.
+func (d *CachedDetector) Confirm(addr string) bool {
+	if addr == NULL {
+		return false
+	}
+	if e, ok := d.fresh(addr); ok && (e.alive || e.firsthand) {
+		return e.alive
+	}
+	return d.run(addr)
+}
+
+func (d *CachedDetector) Report(addr string, alive bool) {
+	d.observe(addr, alive, time.Now(), true)
+}
+
+func (d *CachedDetector) Subscribe(f func(addr string, alive bool)) {
+	d.subscribers.add(f)
+}
+
+func (d *CachedDetector) Merge(observations []LivenessObservation) {
+	now := time.Now()
+	for _, o := range observations {
+		if o.Age < livenessFreshness {
+			d.observe(o.Addr, o.Alive, now.Add(-o.Age), false)
+		}
+	}
+}
+
+// Recent returns the freshest observations, at most livenessGossipLen, for a
+// neighbour to merge.
+func (d *CachedDetector) Recent() []LivenessObservation {
+	now := time.Now()
+	d.lock.Lock()
+	ret := make([]LivenessObservation, 0, len(d.entries))
+	for addr, e := range d.entries {
+		age := now.Sub(e.at)
+		if age > livenessFreshness {
+			delete(d.entries, addr)
+			continue
+		}
+		ret = append(ret, LivenessObservation{Addr: addr, Alive: e.alive, Age: age})
+	}
+	d.lock.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Age < ret[j].Age })
+	if len(ret) > livenessGossipLen {
+		ret = ret[:livenessGossipLen]
+	}
+	return ret
+}
+
+func (d *CachedDetector) Stats() LivenessStats {
+	observations := d.Recent()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return LivenessStats{Pings: d.pings, SavedPings: d.saved, Observations: observations}
+}
+
+func (n *ChordNode) ping(addr string) bool {
+	alive := Ping(addr)
+	n.detector.Report(addr, alive)
+	return alive
+}
+
+func (n *ChordNode) alive(addr string) bool {
+	return n.detector.IsAlive(addr)
+}
+
+func (n *ChordNode) confirmedAlive(addr string) bool {
+	if c, ok := n.detector.(Confirmer); ok {
+		return c.Confirm(addr)
+	}
+	return n.detector.IsAlive(addr)
+}
+
+// isTransportError tells a peer that could not be reached from one that
+// answered with an error.
+func isTransportError(err error) bool {
+	_, isServerError := err.(rpc.ServerError)
+	return err != nil && !isServerError
+}
+
+func (n *ChordNode) observeCall(addr string, err error) {
+	n.detector.Report(addr, !isTransportError(err))
+	if isTransportError(err) {
+		n.repairAfterFailure(addr)
+	}
+}
+
+func (n *ChordNode) recentLiveness() []LivenessObservation {
+	if g, ok := n.detector.(Gossiper); ok {
+		return g.Recent()
+	}
+	return nil
+}
+
+func (n *ChordNode) mergeLiveness(observations []LivenessObservation) {
+	if g, ok := n.detector.(Gossiper); ok {
+		g.Merge(observations)
+	}
+}
+
+func (n *ChordNode) livenessStats() LivenessStats {
+	if s, ok := n.detector.(interface{ Stats() LivenessStats }); ok {
+		return s.Stats()
+	}
+	return LivenessStats{}
+}
+
+func (n *ChordNode) serveLiveness(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.livenessStats())
+}
@@ -0,0 +1,22 @@
+package chord
+
+import "sync"
+
+// nodeLock is the lock type of the node's routing state, store and pre
+// backup. Built with the lockorder tag, every acquisition is recorded per
+// goroutine: a lock taken while another is held adds an edge between their
+// classes, and an edge closing a cycle, a lock taken twice, or any of them
+// held across a remote call is reported with both stacks. Without the tag
+// it is a plain sync.RWMutex.
+type nodeLock struct {
+	sync.RWMutex
+	class string
+}
+
+func (n *ChordNode) nameLocks() {
+	n.preLock.class = "preLock"
+	n.sucLock.class = "sucLock"
+	n.fingerLock.class = "fingerLock"
+	n.storeLock.class = "storeLock"
+	n.preBackupLock.class = "preBackupLock"
+}
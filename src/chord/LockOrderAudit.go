@@ -0,0 +1,162 @@
+//go:build lockorder
+
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const LockAuditEnabled = true
+
+type heldLock struct {
+	lock  *nodeLock
+	stack string
+}
+
+var lockAudit = struct {
+	lock     sync.Mutex
+	held     map[uint64][]heldLock
+	edges    map[string]map[string]string
+	reported map[string]bool
+	reports  []string
+}{
+	held:     make(map[uint64][]heldLock),
+	edges:    make(map[string]map[string]string),
+	reported: make(map[string]bool),
+}
+
+func LockAuditReports() []string {
+	lockAudit.lock.Lock()
+	defer lockAudit.lock.Unlock()
+	return append([]string(nil), lockAudit.reports...)
+}
+
+func goroutineId() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	ret, _ := strconv.ParseUint(string(b[:bytes.IndexByte(b, ' ')]), 10, 64)
+	return ret
+}
+
+// site names the calling frames without their arguments, to report each
+// offending code path once.
+func site() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	var b bytes.Buffer
+	for {
+		f, more := frames.Next()
+		fmt.Fprintf(&b, "%v:%v ", f.Function, f.Line)
+		if !more {
+			return b.String()
+		}
+	}
+}
+
+func stack() string {
+	buf := make([]byte, 8192)
+	return string(buf[:runtime.Stack(buf, false)])
+}
+
+// report records a finding once per key. The audit lock is held.
+func report(key string, format string, args ...interface{}) {
+	if lockAudit.reported[key] {
+		return
+	}
+	lockAudit.reported[key] = true
+	msg := fmt.Sprintf(format, args...)
+	lockAudit.reports = append(lockAudit.reports, msg)
+	log.Errorf("Lock audit: %v", msg)
+}
+
+// leadsTo tells whether the lock graph leads from one class to another.
+func leadsTo(from, to string, seen map[string]bool) bool {
+	if from == to {
+		return true
+	}
+	seen[from] = true
+	for next := range lockAudit.edges[from] {
+		if !seen[next] && leadsTo(next, to, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *nodeLock) acquire() {
+	g, s, where := goroutineId(), stack(), site()
+	lockAudit.lock.Lock()
+	defer lockAudit.lock.Unlock()
+	for _, h := range lockAudit.held[g] {
+		if h.lock == l {
+			report("again "+l.class+where, "%v taken again while held\nfirst:\n%v\nagain:\n%v", l.class, h.stack, s)
+			continue
+		}
+		from, to := h.lock.class, l.class
+		if _, ok := lockAudit.edges[from][to]; ok || from == to {
+			continue
+		}
+		if leadsTo(to, from, make(map[string]bool)) {
+			report("cycle "+from+" "+to, "%v taken while holding %v closes a cycle in the lock order\nholding:\n%v\ntaking:\n%v", to, from, h.stack, s)
+		}
+		if lockAudit.edges[from] == nil {
+			lockAudit.edges[from] = make(map[string]string)
+		}
+		lockAudit.edges[from][to] = s
+	}
+	lockAudit.held[g] = append(lockAudit.held[g], heldLock{lock: l, stack: s})
+}
+
+func (l *nodeLock) release() {
+	g := goroutineId()
+	lockAudit.lock.Lock()
+	defer lockAudit.lock.Unlock()
+	held := lockAudit.held[g]
+	for i := len(held) - 1; i >= 0; i-- {
+		if held[i].lock == l {
+			held = append(held[:i], held[i+1:]...)
+			break
+		}
+	}
+	if len(held) == 0 {
+		delete(lockAudit.held, g)
+	} else {
+		lockAudit.held[g] = held
+	}
+}
+
+func (l *nodeLock) Lock() {
+	l.acquire()
+	l.RWMutex.Lock()
+}
+
+func (l *nodeLock) Unlock() {
+	l.release()
+	l.RWMutex.Unlock()
+}
+
+func (l *nodeLock) RLock() {
+	l.acquire()
+	l.RWMutex.RLock()
+}
+
+func (l *nodeLock) RUnlock() {
+	l.release()
+	l.RWMutex.RUnlock()
+}
+
+func auditRemoteCall(addr string, serviceMethod string) {
+	g, where := goroutineId(), site()
+	lockAudit.lock.Lock()
+	defer lockAudit.lock.Unlock()
+	for _, h := range lockAudit.held[g] {
+		report("call "+h.lock.class+" "+serviceMethod+" "+where, "%v held across %v to [%v]\nheld since:\n%v\ncalling:\n%v", h.lock.class, serviceMethod, addr, h.stack, stack())
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !lockorder
+
+package chord
+
+// LockAuditEnabled tells whether the binary was built with the lockorder tag.
+const LockAuditEnabled = false
+
+// LockAuditReports returns what the lock-order audit found so far.
+func LockAuditReports() []string {
+	return nil
+}
+
+func auditRemoteCall(addr string, serviceMethod string) {}
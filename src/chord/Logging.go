@@ -0,0 +1,210 @@
+package chord
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Subsystems tag a node's log entries in the subsystem field, so that each can
+// be leveled on its own. Entries outside them carry no subsystem.
+const (
+	SubsystemRouting     = "routing"
+	SubsystemStorage     = "storage"
+	SubsystemReplication = "replication"
+	SubsystemMaintenance = "maintenance"
+)
+
+type LogOptions struct {
+	// Path is the node's own log file, appended to. Empty keeps the standard
+	// logger's output.
+	Path string
+	// MaxSize rotates the file once it would grow past this many bytes, to
+	// Path.1, Path.2 and so on up to MaxFiles; older files are dropped. Zero
+	// never rotates.
+	MaxSize  int64
+	MaxFiles int
+	JSON     bool
+	// Level applies to entries of subsystems missing from Levels and to
+	// entries of none. Zero takes the standard logger's level.
+	Level  log.Level
+	Levels map[string]log.Level
+}
+
+// nodeLogs are the entries a node logs through. A new logger replaces them
+// all at once, so that a node logging while SetLogger or SetLogging runs sees
+// either the old set or the new one.
+type nodeLogs struct {
+	node        *log.Entry
+	routing     *log.Entry
+	storage     *log.Entry
+	replication *log.Entry
+	maintenance *log.Entry
+}
+
+func (n *ChordNode) setLogger(logger *log.Logger) {
+	entry := logger.WithField("node", n.addr)
+	n.logs.Store(&nodeLogs{
+		node:        entry,
+		routing:     entry.WithField("subsystem", SubsystemRouting),
+		storage:     entry.WithField("subsystem", SubsystemStorage),
+		replication: entry.WithField("subsystem", SubsystemReplication),
+		maintenance: entry.WithField("subsystem", SubsystemMaintenance),
+	})
+}
+
+func (n *ChordNode) log() *log.Entry {
+	return n.logs.Load().(*nodeLogs).node
+}
+
+func (n *ChordNode) routingLog() *log.Entry {
+	return n.logs.Load().(*nodeLogs).routing
+}
+
+func (n *ChordNode) storageLog() *log.Entry {
+	return n.logs.Load().(*nodeLogs).storage
+}
+
+func (n *ChordNode) replicationLog() *log.Entry {
+	return n.logs.Load().(*nodeLogs).replication
+}
+
+func (n *ChordNode) maintenanceLog() *log.Entry {
+	return n.logs.Load().(*nodeLogs).maintenance
+}
+
+// levelFormatter drops entries above their subsystem's level. The logger runs
+// at the most verbose of the levels, so only entries some subsystem wants
+// reach it.
+type levelFormatter struct {
+	next   log.Formatter
+	level  log.Level
+	levels map[string]log.Level
+}
+
+func (f levelFormatter) Format(entry *log.Entry) ([]byte, error) {
+	level := f.level
+	if sub, ok := entry.Data["subsystem"].(string); ok {
+		if l, ok := f.levels[sub]; ok {
+			level = l
+		}
+	}
+	if entry.Level > level {
+		return nil, nil
+	}
+	return f.next.Format(entry)
+}
+
+// rotatingFile appends to a file and, once it reaches maxSize, shifts it and
+// its older copies down by one suffix.
+type rotatingFile struct {
+	lock     sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.maxFiles <= 0 {
+		_ = os.Remove(f.path)
+	} else {
+		_ = os.Remove(fmt.Sprintf("%v.%v", f.path, f.maxFiles))
+		for i := f.maxFiles - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%v.%v", f.path, i), fmt.Sprintf("%v.%v", f.path, i+1))
+		}
+		_ = os.Rename(f.path, f.path+".1")
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	written, err := f.file.Write(p)
+	f.size += int64(written)
+	return written, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.file.Close()
+}
+
+// SetLogging gives the node a logger of its own built from options: its own
+// file with rotation, text or JSON entries, and a level per subsystem. The
+// file of an earlier call is closed.
+func (w *NodeWrapper) SetLogging(options LogOptions) error {
+	n := w.node
+	var out io.Writer = log.StandardLogger().Out
+	var file *rotatingFile
+	if options.Path != NULL {
+		var err error
+		file, err = openRotatingFile(options.Path, options.MaxSize, options.MaxFiles)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+	level := options.Level
+	if level == log.PanicLevel {
+		level = log.GetLevel()
+	}
+	loggerLevel := level
+	for _, l := range options.Levels {
+		if l > loggerLevel {
+			loggerLevel = l
+		}
+	}
+	var next log.Formatter = &log.TextFormatter{}
+	if options.JSON {
+		next = &log.JSONFormatter{}
+	}
+	logger := log.New()
+	logger.SetOutput(out)
+	logger.SetLevel(loggerLevel)
+	logger.SetFormatter(levelFormatter{next: next, level: level, levels: options.Levels})
+	n.logLock.Lock()
+	defer n.logLock.Unlock()
+	n.setLogger(logger)
+	if n.logFile != nil {
+		_ = n.logFile.Close()
+	}
+	n.logFile = file
+	return nil
+}
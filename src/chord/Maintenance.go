@@ -0,0 +1,116 @@
+package chord
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	taskStabilize        = "stabilize"
+	taskFixFinger        = "fixFinger"
+	taskCheckPredecessor = "checkPredecessor"
+)
+
+// Rough number of rpc calls and pings one round of each task costs, used to
+// keep the rounds within the maintenance budget.
+var maintenanceRoundCost = map[string]int64{
+	taskStabilize:        SuccessorListLen + 3,
+	taskFixFinger:        1,
+	taskCheckPredecessor: 2,
+}
+
+type MaintenanceInterval struct {
+	Task     string
+	Interval time.Duration
+	Quiet    int
+	Rounds   uint64
+}
+
+type pacedTask struct {
+	interval time.Duration
+	quiet    int
+	rounds   uint64
+}
+
+// maintenancePacer stretches a task's interval after maintainStableRounds
+// rounds in a row changed nothing and snaps every task back to the shortest
+// interval as soon as churn shows up. A budget in rpc calls per second,
+// shared evenly among the tasks, puts a floor under every interval.
+type maintenancePacer struct {
+	lock   sync.Mutex
+	budget int64
+	tasks  map[string]*pacedTask
+}
+
+func (p *maintenancePacer) task(name string) *pacedTask {
+	if p.tasks == nil {
+		p.tasks = make(map[string]*pacedTask)
+	}
+	t, ok := p.tasks[name]
+	if !ok {
+		t = &pacedTask{interval: maintainPauseTime}
+		p.tasks[name] = t
+	}
+	return t
+}
+
+func (p *maintenancePacer) next(name string, changed bool) time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	t := p.task(name)
+	t.rounds++
+	if changed {
+		t.interval = maintainMinPauseTime
+		t.quiet = 0
+	} else if t.quiet++; t.quiet >= maintainStableRounds {
+		t.quiet = 0
+		t.interval *= 2
+		if t.interval > maintainMaxPauseTime {
+			t.interval = maintainMaxPauseTime
+		}
+	}
+	interval := t.interval
+	if p.budget > 0 {
+		share := p.budget / int64(len(maintenanceRoundCost))
+		if share < 1 {
+			share = 1
+		}
+		floor := time.Duration(maintenanceRoundCost[name]) * time.Second / time.Duration(share)
+		if interval < floor {
+			interval = floor
+		}
+	}
+	return interval
+}
+
+func (p *maintenancePacer) churn() {
+	p.lock.Lock()
+	for name := range maintenanceRoundCost {
+		t := p.task(name)
+		t.interval = maintainMinPauseTime
+		t.quiet = 0
+	}
+	p.lock.Unlock()
+}
+
+func (p *maintenancePacer) intervals() []MaintenanceInterval {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ret := make([]MaintenanceInterval, 0, len(p.tasks))
+	for name, t := range p.tasks {
+		ret = append(ret, MaintenanceInterval{Task: name, Interval: t.interval, Quiet: t.quiet, Rounds: t.rounds})
+	}
+	return ret
+}
+
+// rounds is the number of rounds of a task run so far.
+func (p *maintenancePacer) rounds(name string) uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.task(name).rounds
+}
+
+func (n *ChordNode) serveMaintenance(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.pacer.intervals())
+}
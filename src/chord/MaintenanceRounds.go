@@ -0,0 +1,172 @@
+package chord
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaintenanceRound is what one round of stabilize, fixFinger or
+// checkPredecessor changed. Failed rounds could not reach the peer they
+// needed and count as changed, as the pacer takes them. Finger is the index a
+// fixFinger round looked up, and -1 for the other tasks.
+type MaintenanceRound struct {
+	Seq     uint64
+	Time    time.Time
+	Task    string
+	Changed bool
+	Failed  bool
+	// OldSuccessor and NewSuccessor are the first successor before and after
+	// a stabilize round.
+	OldSuccessor string
+	NewSuccessor string
+	Finger       int
+	OldFinger    string
+	NewFinger    string
+	// ClearedPredecessor is the predecessor a checkPredecessor round found
+	// dead and dropped.
+	ClearedPredecessor string
+}
+
+// roundLog keeps the last maintenanceRoundsLen rounds, and how many rounds
+// in a row of each task changed nothing. Waiters block on wake, which the
+// pacer's count of every round closes.
+type roundLog struct {
+	lock   sync.Mutex
+	seq    uint64
+	rounds []MaintenanceRound
+	quiet  map[string]int
+	wake   chan struct{}
+}
+
+func (l *roundLog) record(r MaintenanceRound) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.seq++
+	r.Seq, r.Time = l.seq, time.Now()
+	l.rounds = append(l.rounds, r)
+	if len(l.rounds) > maintenanceRoundsLen {
+		l.rounds = l.rounds[len(l.rounds)-maintenanceRoundsLen:]
+	}
+	if l.quiet == nil {
+		l.quiet = make(map[string]int)
+	}
+	if r.Changed {
+		l.quiet[r.Task] = 0
+	} else {
+		l.quiet[r.Task]++
+	}
+}
+
+// counted wakes the waiters once the pacer has counted a round.
+func (l *roundLog) counted() {
+	l.lock.Lock()
+	if l.wake != nil {
+		close(l.wake)
+		l.wake = nil
+	}
+	l.lock.Unlock()
+}
+
+// since returns the rounds kept after seq. Rounds missing between seq and
+// the first one returned were dropped from the log.
+func (l *roundLog) since(seq uint64) []MaintenanceRound {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var ret []MaintenanceRound
+	for _, r := range l.rounds {
+		if r.Seq > seq {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// settledLocked tells whether quiet rounds in a row of stabilize and
+// checkPredecessor, and of fixFinger unless a router replaces it, changed
+// nothing since the counts of the pacer p in start.
+func (l *roundLog) settledLocked(p *maintenancePacer, quiet int, start map[string]uint64) bool {
+	for _, task := range []string{taskStabilize, taskCheckPredecessor, taskFixFinger} {
+		count := p.rounds(task)
+		if task == taskFixFinger && count == 0 {
+			continue
+		}
+		if l.quiet[task] < quiet || count-start[task] < uint64(quiet) {
+			return false
+		}
+	}
+	return true
+}
+
+// await waits until the node settles, as settledLocked, on rounds run after
+// the call, and returns how many stabilize rounds that took. It gives up
+// after maxRounds of them, or after timeout.
+func (l *roundLog) await(p *maintenancePacer, quiet, maxRounds int, timeout time.Duration) (int, bool) {
+	deadline := time.After(timeout)
+	l.lock.Lock()
+	start := make(map[string]uint64, len(maintenanceRoundCost))
+	for task := range maintenanceRoundCost {
+		start[task] = p.rounds(task)
+	}
+	for {
+		rounds := int(p.rounds(taskStabilize) - start[taskStabilize])
+		if l.settledLocked(p, quiet, start) {
+			l.lock.Unlock()
+			return rounds, true
+		}
+		if rounds >= maxRounds {
+			l.lock.Unlock()
+			return rounds, false
+		}
+		if l.wake == nil {
+			l.wake = make(chan struct{})
+		}
+		wake := l.wake
+		l.lock.Unlock()
+		select {
+		case <-wake:
+		case <-deadline:
+			return int(p.rounds(taskStabilize) - start[taskStabilize]), false
+		}
+		l.lock.Lock()
+	}
+}
+
+// serveMaintenanceRounds returns the rounds after since=, all kept by
+// default.
+func (n *ChordNode) serveMaintenanceRounds(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, n.rounds.since(since))
+}
+
+// MaintenanceRounds returns the recorded maintenance rounds with a Seq after
+// since, oldest first.
+func (w *NodeWrapper) MaintenanceRounds(since uint64) []MaintenanceRound {
+	return w.node.rounds.since(since)
+}
+
+// AwaitStable blocks until quiet rounds in a row of every maintenance task of
+// the node, all run after the call, changed nothing, and returns how many
+// stabilize rounds it waited; false if that took more than maxRounds rounds
+// or timeout. A ring has converged when every node is stable at once.
+func (w *NodeWrapper) AwaitStable(quiet, maxRounds int, timeout time.Duration) (int, bool) {
+	return w.node.rounds.await(&w.node.pacer, quiet, maxRounds, timeout)
+}
+
+// awaitRing waits for each online node of ring in turn to be stable, as
+// AwaitStable, or to give up.
+func awaitRing(ring []*NodeWrapper) {
+	for _, w := range ring {
+		if w.State() == StateOnline {
+			w.AwaitStable(churnStableRounds, churnSettleRounds, churnSettleTime)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package chord
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	MemberJoined = "joined"
+	MemberLeft   = "left"
+	MemberFailed = "failed"
+)
+
+// MembershipEvent is a change of the ring's membership: Member joined, left,
+// or was found failed by Observer.
+type MembershipEvent struct {
+	Time     time.Time
+	Kind     string
+	Member   string
+	Observer string
+}
+
+func (e MembershipEvent) id() string {
+	return fmt.Sprintf("%v|%v|%v|%v", e.Time.UnixNano(), e.Kind, e.Member, e.Observer)
+}
+
+// membershipJournal keeps the newest membershipJournalLen membership events
+// this node saw or heard of, oldest first. Nodes swap journals with a random
+// peer every membershipGossipTime, so that each converges on the ring's
+// history; an event reads the same everywhere, so merging is a union.
+type membershipJournal struct {
+	lock   sync.Mutex
+	events []MembershipEvent
+	known  map[string]bool
+}
+
+// note records what this node saw, unless it saw Member in that state last.
+func (j *membershipJournal) note(e MembershipEvent) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for i := len(j.events) - 1; i >= 0; i-- {
+		if last := j.events[i]; last.Member == e.Member && last.Observer == e.Observer {
+			if last.Kind == e.Kind {
+				return
+			}
+			break
+		}
+	}
+	j.addLocked([]MembershipEvent{e})
+}
+
+func (j *membershipJournal) merge(events []MembershipEvent) {
+	j.lock.Lock()
+	j.addLocked(events)
+	j.lock.Unlock()
+}
+
+func (j *membershipJournal) addLocked(events []MembershipEvent) {
+	if j.known == nil {
+		j.known = make(map[string]bool)
+	}
+	added := false
+	for _, e := range events {
+		if id := e.id(); !j.known[id] {
+			j.known[id] = true
+			j.events = append(j.events, e)
+			added = true
+		}
+	}
+	if !added {
+		return
+	}
+	sort.SliceStable(j.events, func(a, b int) bool {
+		return j.events[a].Time.Before(j.events[b].Time)
+	})
+	if over := len(j.events) - membershipJournalLen; over > 0 {
+		for _, e := range j.events[:over] {
+			delete(j.known, e.id())
+		}
+		j.events = append([]MembershipEvent(nil), j.events[over:]...)
+	}
+}
+
+func (j *membershipJournal) get() []MembershipEvent {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return append([]MembershipEvent(nil), j.events...)
+}
+
+// membersAt replays events up to at: the members that had joined by then
+// and had not left or been found failed since.
+func membersAt(events []MembershipEvent, at time.Time) []string {
+	in := make(map[string]bool)
+	for _, e := range events {
+		if e.Time.After(at) {
+			break
+		}
+		in[e.Member] = e.Kind == MemberJoined
+	}
+	var ret []string
+	for member, ok := range in {
+		if ok {
+			ret = append(ret, member)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// noteMembership records the membership changes among the events this node
+// publishes. Leaving is recorded by quit, which still has the ring to tell.
+func (n *ChordNode) noteMembership(e RingEvent) {
+	switch {
+	case e.Type == EventJoin && n.tier != TierLeaf:
+		n.memberJournal.note(MembershipEvent{Time: e.Time, Kind: MemberJoined, Member: n.addr, Observer: n.addr})
+	case e.Type == EventFailureDetected:
+		n.memberJournal.note(MembershipEvent{Time: e.Time, Kind: MemberFailed, Member: e.Peer, Observer: n.addr})
+	}
+}
+
+// announceLeave records that this node leaves and hands the journal to the
+// successor, for the ring to keep.
+func (n *ChordNode) announceLeave() {
+	n.memberJournal.note(MembershipEvent{Time: time.Now(), Kind: MemberLeft, Member: n.addr, Observer: n.addr})
+	var theirs []MembershipEvent
+	if _, err := n.callSuccessor("ChordNode.GossipMembership", n.memberJournal.get(), &theirs); err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.announceLeave", "ChordNode.GossipMembership", err)
+	}
+}
+
+// gossipMembership swaps journals with a random peer.
+func (n *ChordNode) gossipMembership() {
+	peer := n.gossipPeer()
+	if peer == NULL {
+		return
+	}
+	var theirs []MembershipEvent
+	if err := n.call(peer, "ChordNode.GossipMembership", n.memberJournal.get(), &theirs); err != nil {
+		n.logErrorFunctionCall(peer, "ChordNode.gossipMembership", "ChordNode.GossipMembership", err)
+		return
+	}
+	n.memberJournal.merge(theirs)
+}
+
+// GossipMembership merges a peer's journal and returns this node's.
+func (n *ChordNode) GossipMembership(events []MembershipEvent, ret *[]MembershipEvent) error {
+	n.memberJournal.merge(events)
+	*ret = n.memberJournal.get()
+	return nil
+}
+
+type RingMembers struct {
+	At      time.Time
+	Members []string
+}
+
+// serveMembershipJournal returns the journal, of one member with member=
+// and from since= on, or with at= the members the journal puts in the ring
+// at that time. Times are RFC 3339.
+func (n *ChordNode) serveMembershipJournal(w http.ResponseWriter, r *http.Request) {
+	events := n.memberJournal.get()
+	q := r.URL.Query()
+	if at := q.Get("at"); at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, RingMembers{At: t, Members: membersAt(events, t)})
+		return
+	}
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	member := q.Get("member")
+	ret := make([]MembershipEvent, 0, len(events))
+	for _, e := range events {
+		if (member == "" || e.Member == member) && !e.Time.Before(since) {
+			ret = append(ret, e)
+		}
+	}
+	writeJSON(w, ret)
+}
+
+// MembershipJournal returns the membership events this node knows of, oldest
+// first.
+func (w *NodeWrapper) MembershipJournal() []MembershipEvent {
+	return w.node.memberJournal.get()
+}
+
+// MembersAt returns the members the journal puts in the ring at t.
+func (w *NodeWrapper) MembersAt(t time.Time) []string {
+	return membersAt(w.node.memberJournal.get(), t)
+}
@@ -0,0 +1,286 @@
+package chord
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrMessageTooLarge: A request was larger than the server's message
+	// size limit.
+	ErrMessageTooLarge = errors.New("message exceeds the size limit")
+	// ErrValueTooLarge: A key and value do not fit in one message.
+	ErrValueTooLarge = errors.New("value exceeds the message size limit")
+)
+
+// MessageLimitStatus tells how the node kept its messages within
+// MaxMessageSize: Refused counts the requests it answered with
+// ErrMessageTooLarge, TooLarge the writes refused with ErrValueTooLarge, and
+// Chunked the transfers and backups it split.
+type MessageLimitStatus struct {
+	MaxMessageSize int
+	Refused        uint64
+	TooLarge       uint64
+	Chunked        uint64
+}
+
+type messageLimit struct {
+	max      int64
+	refused  uint64
+	tooLarge uint64
+	chunked  uint64
+}
+
+func (l *messageLimit) size() int {
+	if max := atomic.LoadInt64(&l.max); max > 0 {
+		return int(max)
+	}
+	return rpcMaxMessageSize
+}
+
+// chunkSize is what the pairs of one chunk may add up to. It leaves half the
+// limit for encoding, since a codec may carry a batch as escaped JSON.
+func (l *messageLimit) chunkSize() int {
+	return l.size() / 2
+}
+
+func pairSize(k, v string) int {
+	return len(k) + len(v) + messagePairOverhead
+}
+
+func (l *messageLimit) fits(k, v string) bool {
+	return pairSize(k, v) <= l.chunkSize()
+}
+
+// chunks splits data into maps within the chunk size. A pair too large for
+// one goes alone, for the receiver to refuse.
+func (l *messageLimit) chunks(data map[string]string) []map[string]string {
+	max := l.chunkSize()
+	var ret []map[string]string
+	cur, size := make(map[string]string), 0
+	for k, v := range data {
+		s := pairSize(k, v)
+		if size+s > max && len(cur) > 0 {
+			ret = append(ret, cur)
+			cur, size = make(map[string]string), 0
+		}
+		cur[k] = v
+		size += s
+	}
+	if len(cur) > 0 || len(ret) == 0 {
+		ret = append(ret, cur)
+	}
+	if len(ret) > 1 {
+		atomic.AddUint64(&l.chunked, 1)
+	}
+	return ret
+}
+
+// splitReply splits a transfer reply within the chunk size, the removed keys
+// going with the last part.
+func (l *messageLimit) splitReply(reply TransferReply) []TransferReply {
+	parts := l.chunks(reply.Changed)
+	ret := make([]TransferReply, len(parts))
+	for i, p := range parts {
+		ret[i].Changed = p
+	}
+	max := l.chunkSize()
+	last := &ret[len(ret)-1]
+	size := 0
+	for k, v := range last.Changed {
+		size += pairSize(k, v)
+	}
+	for _, k := range reply.Removed {
+		if size += pairSize(k, NULL); size > max && (len(last.Changed) > 0 || len(last.Removed) > 0) {
+			ret = append(ret, TransferReply{})
+			last, size = &ret[len(ret)-1], pairSize(k, NULL)
+		}
+		last.Removed = append(last.Removed, k)
+	}
+	return ret
+}
+
+func (l *messageLimit) status() MessageLimitStatus {
+	return MessageLimitStatus{
+		MaxMessageSize: l.size(),
+		Refused:        atomic.LoadUint64(&l.refused),
+		TooLarge:       atomic.LoadUint64(&l.tooLarge),
+		Chunked:        atomic.LoadUint64(&l.chunked),
+	}
+}
+
+// acceptSize refuses a write whose key and value would not fit in a message.
+func (n *ChordNode) acceptSize(key, value string) error {
+	if n.msgLimit.fits(key, value) {
+		return nil
+	}
+	atomic.AddUint64(&n.msgLimit.tooLarge, 1)
+	n.storageLog().Errorf("Refuse key [%v] with a value of %v bytes over the message size limit.", key, len(value))
+	return ErrValueTooLarge
+}
+
+// meteredConn counts the bytes read from and written to a connection, for a
+// server codec to tell how large a request was and a caller what a call
+// cost. A decoder reads ahead, so a request on a connection carrying several
+// at once may be charged some of the next. With a limit set, reads stop at
+// limit bytes since read was last reset and fail from then on, so a request
+// over the limit is never taken in whole; the connection cannot be read
+// further.
+type meteredConn struct {
+	net.Conn
+	read    int64
+	written int64
+	limit   int64
+	over    int32
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	if max := atomic.LoadInt64(&c.limit); max > 0 {
+		left := max - atomic.LoadInt64(&c.read)
+		if left <= 0 || atomic.LoadInt32(&c.over) != 0 {
+			atomic.StoreInt32(&c.over, 1)
+			return 0, ErrMessageTooLarge
+		}
+		if int64(len(b)) > left {
+			b = b[:left]
+		}
+	}
+	cnt, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(cnt))
+	return cnt, err
+}
+
+func (c *meteredConn) overLimit() bool {
+	return atomic.LoadInt32(&c.over) != 0
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	cnt, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(cnt))
+	return cnt, err
+}
+
+// TransferChunk is a further part of a transfer too large for one message.
+type TransferChunk struct {
+	Changed map[string]string
+	Removed []string
+	More    bool
+}
+
+type stagedTransfer struct {
+	parts []TransferReply
+	at    time.Time
+}
+
+// transferOutbox holds the parts of the transfers to each node that did not
+// go with the first message, until it fetches them with NextTransferChunk.
+// The keys moved are in this node's pre backup meanwhile, so a transfer left
+// unfetched for transferOutboxTTL is dropped.
+type transferOutbox struct {
+	lock    sync.Mutex
+	pending map[string]*stagedTransfer
+}
+
+func (o *transferOutbox) sweepLocked() {
+	for pre, s := range o.pending {
+		if time.Since(s.at) > transferOutboxTTL {
+			delete(o.pending, pre)
+		}
+	}
+}
+
+// stage returns the first part of reply for pre and keeps the rest.
+func (o *transferOutbox) stage(pre string, parts []TransferReply) TransferReply {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.sweepLocked()
+	delete(o.pending, pre)
+	if len(parts) > 1 {
+		if o.pending == nil {
+			o.pending = make(map[string]*stagedTransfer)
+		}
+		o.pending[pre] = &stagedTransfer{parts: parts[1:], at: time.Now()}
+	}
+	return parts[0]
+}
+
+func (o *transferOutbox) next(pre string) TransferChunk {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.sweepLocked()
+	s, ok := o.pending[pre]
+	if !ok {
+		return TransferChunk{}
+	}
+	part := s.parts[0]
+	s.parts = s.parts[1:]
+	s.at = time.Now()
+	if len(s.parts) == 0 {
+		delete(o.pending, pre)
+	}
+	return TransferChunk{Changed: part.Changed, Removed: part.Removed, More: len(s.parts) > 0}
+}
+
+// NextTransferChunk returns the next part of the transfer to pre, and
+// whether more follow.
+func (n *ChordNode) NextTransferChunk(pre string, ret *TransferChunk) error {
+	*ret = n.outbox.next(pre)
+	return nil
+}
+
+// transferRest fetches from suc the parts of a transfer after the first,
+// reply, and adds them to it.
+func (n *ChordNode) transferRest(suc string, reply *TransferReply) error {
+	for {
+		var chunk TransferChunk
+		if err := n.call(suc, "ChordNode.NextTransferChunk", n.addr, &chunk); err != nil {
+			n.logErrorFunctionCall(n.addr, "ChordNode.transferRest", "ChordNode.NextTransferChunk", err)
+			return err
+		}
+		if reply.Changed == nil {
+			reply.Changed = make(map[string]string, len(chunk.Changed))
+		}
+		for k, v := range chunk.Changed {
+			reply.Changed[k] = v
+		}
+		reply.Removed = append(reply.Removed, chunk.Removed...)
+		if !chunk.More {
+			return nil
+		}
+	}
+}
+
+// appendPreBackup sends batch to the pre backup of addr in parts within the
+// message size limit.
+func (n *ChordNode) appendPreBackup(addr string, batch *BackupBatch) error {
+	for _, part := range n.msgLimit.chunks(batch.Data) {
+		if err := n.call(addr, "ChordNode.AppendPreBackup", &BackupBatch{Owner: batch.Owner, Data: part}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *ChordNode) serveMessageLimit(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.msgLimit.status())
+}
+
+// SetMaxMessageSize sets the largest request in bytes the node serves and
+// the size its transfers and backups are split to fit; zero means
+// rpcMaxMessageSize. Every node of a ring should use the same.
+func (w *NodeWrapper) SetMaxMessageSize(max int) bool {
+	if max < 0 {
+		w.node.log().Errorf("Invalid message size limit [%v].", max)
+		return false
+	}
+	atomic.StoreInt64(&w.node.msgLimit.max, int64(max))
+	return true
+}
+
+func (w *NodeWrapper) MessageLimitStatus() MessageLimitStatus {
+	return w.node.msgLimit.status()
+}
@@ -0,0 +1,133 @@
+package chord
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ValueMeta describes a stored value as its owner knows it. Metadata, the
+// version with it, is kept only by the owner and not moved with the key: a
+// key that arrived by a join, transfer, migration or failover starts over
+// with fresh metadata when it is first used, its Created then being when
+// this owner got it. Accessed is the last read served from the owner's
+// store, zero for none since.
+type ValueMeta struct {
+	Key      string
+	Size     int
+	Created  time.Time
+	Updated  time.Time
+	Accessed time.Time
+	Version  uint64
+	Owner    string
+}
+
+// valueMeta is the metadata the owner keeps for each key, under storeLock.
+// accessed is in Unix nanoseconds and set atomically, since reads hold
+// storeLock only for reading. expires is when a caching node's entry
+// outlives its TTL, zero until it is set.
+type valueMeta struct {
+	size     int
+	created  time.Time
+	updated  time.Time
+	accessed int64
+	version  uint64
+	expires  time.Time
+}
+
+// metaLocked returns key's metadata, making it fresh if it was lost. Callers
+// must hold storeLock for writing.
+func (n *ChordNode) metaLocked(key string) *valueMeta {
+	if m, ok := n.meta[key]; ok {
+		return m
+	}
+	now := time.Now()
+	m := &valueMeta{created: now, updated: now, version: n.nextVersionLocked()}
+	if val, ok := n.store.Get(key); ok {
+		m.size = len(val)
+	}
+	n.meta[key] = m
+	return m
+}
+
+// wroteLocked updates key's metadata for a write of val. Callers must hold
+// storeLock for writing.
+func (n *ChordNode) wroteLocked(key, val string) {
+	m, ok := n.meta[key]
+	now := time.Now()
+	if !ok {
+		m = &valueMeta{created: now}
+		n.meta[key] = m
+	}
+	m.size = len(val)
+	m.updated = now
+	m.version = n.nextVersionLocked()
+}
+
+// accessedLocked notes a read of key. Callers must hold storeLock.
+func (n *ChordNode) accessedLocked(key string) {
+	if m, ok := n.meta[key]; ok {
+		atomic.StoreInt64(&m.accessed, time.Now().UnixNano())
+	}
+}
+
+func (n *ChordNode) StatInStore(key string, ret *ValueMeta) error {
+	n.storageLog().Infof("Stat key [%v] in node [%v]'s store.", key, n.addr)
+	if target, ok := n.migratedTo(key); ok {
+		return n.call(target, "ChordNode.StatInStore", key, ret)
+	}
+	n.storeLock.Lock()
+	defer n.storeLock.Unlock()
+	if _, ok := n.store.Get(key); !ok {
+		return ErrNotFound
+	}
+	m := n.metaLocked(key)
+	*ret = ValueMeta{
+		Key:     key,
+		Size:    m.size,
+		Created: m.created,
+		Updated: m.updated,
+		Version: m.version,
+		Owner:   n.addr,
+	}
+	if at := atomic.LoadInt64(&m.accessed); at != 0 {
+		ret.Accessed = time.Unix(0, at)
+	}
+	return nil
+}
+
+// stat tells a key that does not exist, ErrNotFound, from one whose owner
+// could not be reached, as getValue does.
+func (n *ChordNode) stat(key string) (ret ValueMeta, err error) {
+	if n.tier == TierLeaf {
+		err = classifyError(n.leafCall("ChordNode.LeafStat", key, &ret))
+		return ret, err
+	}
+	if !n.isOnline() {
+		n.storageLog().Errorf("Trying to stat in an offline node.")
+		return ret, ErrOffline
+	}
+	t := n.startOp("get", key)
+	tar, err := n.ownerCall(t, key, "StatInStore", key, &ret)
+	err = classifyError(err)
+	t.finish(err == nil || err == ErrNotFound)
+	if err != nil && err != ErrNotFound {
+		n.logErrorFunctionCall(tar, "ChordNode.stat", "ChordNode.StatInStore", err)
+	}
+	return ret, err
+}
+
+func (n *ChordNode) LeafStat(key string, ret *ValueMeta) error {
+	m, err := n.stat(key)
+	if err != nil {
+		return err
+	}
+	*ret = m
+	return nil
+}
+
+// Stat returns the metadata of key's value, and false if the key is not
+// stored or its owner could not be reached.
+func (w *NodeWrapper) Stat(key string) (bool, ValueMeta) {
+	m, err := w.node.stat(key)
+	return err == nil, m
+}
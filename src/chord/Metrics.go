@@ -0,0 +1,104 @@
+package chord
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rpcLatencyBuckets are the upper bounds of the latency histograms. Calls
+// slower than the last fall in one more bucket.
+var rpcLatencyBuckets = []time.Duration{
+	100 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second,
+}
+
+// RPCMetric counts the calls of one method, or to one peer. Latency[i] is the
+// number of calls that took at most Buckets[i] and more than the bucket
+// before; the last entry counts the slower ones.
+type RPCMetric struct {
+	Calls     uint64
+	Errors    uint64
+	TotalTime time.Duration
+	Latency   []uint64
+}
+
+// RPCMetrics cover every RPCCall the process made since it started, so the
+// nodes sharing a process share them, like the profiles.
+type RPCMetrics struct {
+	Buckets  []time.Duration
+	ByMethod map[string]RPCMetric
+	ByPeer   map[string]RPCMetric
+}
+
+type rpcMetricTable struct {
+	lock     sync.Mutex
+	byMethod map[string]*RPCMetric
+	byPeer   map[string]*RPCMetric
+}
+
+var rpcMetrics rpcMetricTable
+
+func (m *RPCMetric) observe(d time.Duration, err error) {
+	if m.Latency == nil {
+		m.Latency = make([]uint64, len(rpcLatencyBuckets)+1)
+	}
+	m.Calls++
+	if err != nil {
+		m.Errors++
+	}
+	m.TotalTime += d
+	i := 0
+	for i < len(rpcLatencyBuckets) && d > rpcLatencyBuckets[i] {
+		i++
+	}
+	m.Latency[i]++
+}
+
+func (t *rpcMetricTable) observe(addr string, serviceMethod string, d time.Duration, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.byMethod == nil {
+		t.byMethod = make(map[string]*RPCMetric)
+		t.byPeer = make(map[string]*RPCMetric)
+	}
+	for _, entry := range []struct {
+		table map[string]*RPCMetric
+		key   string
+	}{{t.byMethod, serviceMethod}, {t.byPeer, addr}} {
+		m, ok := entry.table[entry.key]
+		if !ok {
+			m = new(RPCMetric)
+			entry.table[entry.key] = m
+		}
+		m.observe(d, err)
+	}
+}
+
+// RPCCallMetrics returns a copy of the process's RPC metrics.
+func RPCCallMetrics() RPCMetrics {
+	t := &rpcMetrics
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ret := RPCMetrics{
+		Buckets:  rpcLatencyBuckets,
+		ByMethod: make(map[string]RPCMetric, len(t.byMethod)),
+		ByPeer:   make(map[string]RPCMetric, len(t.byPeer)),
+	}
+	for k, m := range t.byMethod {
+		c := *m
+		c.Latency = append([]uint64(nil), m.Latency...)
+		ret.ByMethod[k] = c
+	}
+	for k, m := range t.byPeer {
+		c := *m
+		c.Latency = append([]uint64(nil), m.Latency...)
+		ret.ByPeer[k] = c
+	}
+	return ret
+}
+
+func (n *ChordNode) serveRPCMetrics(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, RPCCallMetrics())
+}
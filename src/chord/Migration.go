@@ -0,0 +1,345 @@
+package chord
+
+import (
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A migration moves the keys whose ids fall in (Start, End] off their owner
+// onto Target. The owner keeps answering lookups for the range and forwards
+// store operations to Target, which backs the keys up and keeps them through
+// its own transfers. Migrations live only as long as both nodes stay in the
+// ring and are not applied to bulk loads.
+type Migration struct {
+	Start  string
+	End    string
+	Target string
+}
+
+// RangeTransfer carries the keys of a migrated range to Target: all of them
+// at first, then those written since, and Removed, those deleted since.
+type RangeTransfer struct {
+	Migration Migration
+	Source    string
+	Data      map[string]string
+	Removed   []string
+}
+
+type keyRange struct {
+	start *big.Int
+	end   *big.Int
+}
+
+func (r keyRange) contains(kId *big.Int) bool {
+	return within(kId, r.start, r.end, true)
+}
+
+// key names r by the values of its bounds, for the maps of migrations.
+func (r keyRange) key() string {
+	return r.start.Text(16) + ":" + r.end.Text(16)
+}
+
+type outgoingRange struct {
+	r      keyRange
+	target string
+}
+
+type migrationTable struct {
+	lock     sync.RWMutex
+	outgoing map[string]outgoingRange
+	hosted   map[string]keyRange
+}
+
+func parseKeyRange(m Migration) (keyRange, error) {
+	start, ok := new(big.Int).SetString(m.Start, 16)
+	if !ok {
+		return keyRange{}, errors.New("invalid range start")
+	}
+	end, ok := new(big.Int).SetString(m.End, 16)
+	if !ok {
+		return keyRange{}, errors.New("invalid range end")
+	}
+	return keyRange{start: start, end: end}, nil
+}
+
+func (n *ChordNode) migratedTo(key string) (string, bool) {
+	n.migrations.lock.RLock()
+	defer n.migrations.lock.RUnlock()
+	for _, o := range n.migrations.outgoing {
+		if o.r.contains(n.keyId(key)) {
+			return o.target, true
+		}
+	}
+	return NULL, false
+}
+
+// migrating tells whether a key range is migrated out of this node.
+func (n *ChordNode) migrating() bool {
+	n.migrations.lock.RLock()
+	defer n.migrations.lock.RUnlock()
+	return len(n.migrations.outgoing) > 0
+}
+
+func (n *ChordNode) hosts(key string) bool {
+	n.migrations.lock.RLock()
+	defer n.migrations.lock.RUnlock()
+	for _, r := range n.migrations.hosted {
+		if r.contains(n.keyId(key)) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostedRanges returns the ranges migrated onto this node.
+func (n *ChordNode) HostedRanges(_ string, ret *[]Migration) error {
+	n.migrations.lock.RLock()
+	defer n.migrations.lock.RUnlock()
+	*ret = make([]Migration, 0, len(n.migrations.hosted))
+	for _, h := range n.migrations.hosted {
+		*ret = append(*ret, Migration{Start: h.start.Text(16), End: h.end.Text(16), Target: n.addr})
+	}
+	return nil
+}
+
+func (n *ChordNode) MigrateRange(m Migration, moved *int) error {
+	r, err := parseKeyRange(m)
+	if err != nil {
+		return err
+	}
+	if m.Target == n.addr || !n.ping(m.Target) {
+		return errors.New("invalid migration target")
+	}
+	if n.frozen(false) {
+		return ErrRingFrozen
+	}
+	n.replicationLog().Infof("Start migrating range (%v, %v] from node [%v] to [%v].", m.Start, m.End, n.addr, m.Target)
+	n.migrations.lock.Lock()
+	if n.migrations.outgoing == nil {
+		n.migrations.outgoing = make(map[string]outgoingRange)
+	}
+	n.migrations.outgoing[r.key()] = outgoingRange{r: r, target: m.Target}
+	n.migrations.lock.Unlock()
+	data := n.rangeData(r)
+	err = n.call(m.Target, "ChordNode.AdoptRange", RangeTransfer{Migration: m, Source: n.addr, Data: data}, nil)
+	if err == nil {
+		err = n.finishMigration(m, r, data)
+	}
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.MigrateRange", "ChordNode.AdoptRange", err)
+		n.abandonMigration(m, r)
+		return err
+	}
+	n.fireKeysTransferredOut(m.Target, keysOf(data))
+	_ = n.replicator.OnTopologyChange(TopologyChange{Kind: TopologyRangeMigrated, Peer: m.Target, Keys: data})
+	*moved = len(data)
+	n.replicationLog().Infof("Migrated %v keys from node [%v] to [%v].", len(data), n.addr, m.Target)
+	return nil
+}
+
+// finishMigration sends Target what writes already past the forwarding check
+// while the range was copied changed here since sent, the values Target
+// holds, until nothing did, and only then drops the range from the store.
+// Each pass is acknowledged before the next is taken, so a failed one loses
+// nothing.
+func (n *ChordNode) finishMigration(m Migration, r keyRange, sent map[string]string) error {
+	for {
+		n.storeLock.RLock()
+		late, removed := n.lateChangesLocked(r, sent)
+		n.storeLock.RUnlock()
+		if len(late) == 0 && len(removed) == 0 {
+			n.storeLock.Lock()
+			if late, removed = n.lateChangesLocked(r, sent); len(late) == 0 && len(removed) == 0 {
+				for k := range sent {
+					n.storeDelete(n.store, k, "ChordNode.MigrateRange")
+					delete(n.meta, k)
+				}
+				n.storeLock.Unlock()
+				return nil
+			}
+			n.storeLock.Unlock()
+		}
+		t := RangeTransfer{Migration: m, Source: n.addr, Data: late, Removed: removed}
+		if err := n.call(m.Target, "ChordNode.AdoptRange", t, nil); err != nil {
+			return err
+		}
+		for k, v := range late {
+			sent[k] = v
+		}
+		for _, k := range removed {
+			delete(sent, k)
+		}
+	}
+}
+
+// lateChangesLocked returns the keys of r whose value in the store is not
+// the one in sent, and those of sent no longer there. The store lock is
+// held.
+func (n *ChordNode) lateChangesLocked(r keyRange, sent map[string]string) (map[string]string, []string) {
+	late := make(map[string]string)
+	n.store.Iterate(func(k, v string) bool {
+		if r.contains(n.keyId(k)) {
+			if old, ok := sent[k]; !ok || old != v {
+				late[k] = v
+			}
+		}
+		return true
+	})
+	var removed []string
+	for k := range sent {
+		if _, ok := n.store.Get(k); !ok {
+			removed = append(removed, k)
+		}
+	}
+	return late, removed
+}
+
+// abandonMigration undoes a migration that failed: Target, which may have
+// adopted the range before it failed, as when its backup could not be
+// written, gives it up along with the writes forwarded to it meanwhile, and
+// this node serves the range again.
+func (n *ChordNode) abandonMigration(m Migration, r keyRange) {
+	var taken map[string]string
+	if err := n.call(m.Target, "ChordNode.AbandonRange", m, &taken); err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.abandonMigration", "ChordNode.AbandonRange", err)
+	}
+	n.storeLock.Lock()
+	for k, v := range taken {
+		n.storePut(n.store, k, v, "ChordNode.abandonMigration")
+		n.tombstones.clear(k)
+	}
+	n.storeLock.Unlock()
+	n.migrations.lock.Lock()
+	delete(n.migrations.outgoing, r.key())
+	n.migrations.lock.Unlock()
+	if len(taken) > 0 {
+		_ = n.replicateBatch(taken)
+	}
+}
+
+func keysOf(data map[string]string) []string {
+	ret := make([]string, 0, len(data))
+	for k := range data {
+		ret = append(ret, k)
+	}
+	return ret
+}
+
+func (n *ChordNode) rangeData(r keyRange) map[string]string {
+	n.storeLock.RLock()
+	defer n.storeLock.RUnlock()
+	data := make(map[string]string)
+	n.store.Iterate(func(k, v string) bool {
+		if r.contains(n.keyId(k)) {
+			data[k] = v
+		}
+		return true
+	})
+	return data
+}
+
+func (n *ChordNode) AdoptRange(t RangeTransfer, _ *string) error {
+	r, err := parseKeyRange(t.Migration)
+	if err != nil {
+		return err
+	}
+	n.migrations.lock.Lock()
+	if n.migrations.hosted == nil {
+		n.migrations.hosted = make(map[string]keyRange)
+	}
+	n.migrations.hosted[r.key()] = r
+	n.migrations.lock.Unlock()
+	n.storeLock.Lock()
+	received := make([]string, 0, len(t.Data))
+	for k, v := range t.Data {
+		v = n.resolveConflictLocked(ConflictRange, k, v, time.Time{}, ResolveIncoming)
+		t.Data[k] = v
+		n.storePut(n.store, k, v, "ChordNode.AdoptRange")
+		delete(n.meta, k)
+		received = append(received, k)
+	}
+	for _, k := range t.Removed {
+		n.storeDelete(n.store, k, "ChordNode.AdoptRange")
+		delete(n.meta, k)
+		n.tombstones.add(k)
+	}
+	n.storeLock.Unlock()
+	n.fireKeysTransferredIn(t.Source, received)
+	err = n.replicateBatch(t.Data)
+	for _, k := range t.Removed {
+		if e := n.replicator.OnDelete(k); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// AbandonRange undoes AdoptRange for a migration its source gave up on: the
+// range is no longer hosted, and the keys adopted in it are dropped and
+// returned, for the source to keep.
+func (n *ChordNode) AbandonRange(m Migration, ret *map[string]string) error {
+	r, err := parseKeyRange(m)
+	if err != nil {
+		return err
+	}
+	n.migrations.lock.Lock()
+	_, hosted := n.migrations.hosted[r.key()]
+	delete(n.migrations.hosted, r.key())
+	n.migrations.lock.Unlock()
+	if !hosted {
+		return nil
+	}
+	n.replicationLog().Infof("Abandon range (%v, %v] migrated onto node [%v].", m.Start, m.End, n.addr)
+	dropped := n.rangeData(r)
+	n.storeLock.Lock()
+	for k := range dropped {
+		n.storeDelete(n.store, k, "ChordNode.AbandonRange")
+		delete(n.meta, k)
+	}
+	n.storeLock.Unlock()
+	for k := range dropped {
+		_ = n.replicator.OnDelete(k)
+	}
+	*ret = dropped
+	return nil
+}
+
+func (n *ChordNode) serveMigrate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "migrate needs POST", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	if dry, _ := strconv.ParseBool(q.Get("dry_run")); dry {
+		var report DryRunReport
+		if err := n.MigrateRangeDryRun(Migration{Start: q.Get("start"), End: q.Get("end"), Target: q.Get("target")}, &report); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, report)
+		return
+	}
+	var moved int
+	err := n.MigrateRange(Migration{Start: q.Get("start"), End: q.Get("end"), Target: q.Get("target")}, &moved)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]int{"Moved": moved})
+}
+
+// MigrateRange moves the keys this node owns with ids in (start, end], given
+// as hex, onto target.
+func (w *NodeWrapper) MigrateRange(target, start, end string) (int, bool) {
+	var moved int
+	err := w.node.MigrateRange(Migration{Start: start, End: end, Target: target}, &moved)
+	if err != nil {
+		w.node.logErrorFunctionCall(w.node.addr, "NodeWrapper.MigrateRange", "ChordNode.MigrateRange", err)
+		return 0, false
+	}
+	return moved, true
+}
@@ -0,0 +1,186 @@
+package chord
+
+import (
+	"fmt"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// KeyFailure is why one key of a GetMulti was not read. Owner is the node it
+// was asked of, empty when its owner could not be found.
+type KeyFailure struct {
+	Key   string
+	Owner string
+	Cause string
+}
+
+// Err is the cause as an error, ErrNotFound for a key that does not exist
+// and ErrUnavailable for one that could not be read.
+func (f KeyFailure) Err() error {
+	return classifyError(rpc.ServerError(f.Cause))
+}
+
+// MultiGetResult holds the values of the keys read, and a failure for each
+// of the others.
+type MultiGetResult struct {
+	Values   map[string]string
+	Failures []KeyFailure
+}
+
+func (r *MultiGetResult) fail(key, owner string, err error) {
+	r.Failures = append(r.Failures, KeyFailure{Key: key, Owner: owner, Cause: err.Error()})
+}
+
+// GetManyInStore reads keys from this node's store as GetInStore does.
+func (n *ChordNode) GetManyInStore(keys []string, ret *MultiGetResult) error {
+	n.storageLog().Infof("Get %v keys in node [%v]'s store.", len(keys), n.addr)
+	*ret = MultiGetResult{Values: make(map[string]string, len(keys))}
+	for _, k := range keys {
+		var val string
+		if err := n.GetInStore(k, &val); err != nil {
+			ret.fail(k, n.addr, err)
+			continue
+		}
+		ret.Values[k] = val
+	}
+	return nil
+}
+
+// getMulti resolves the owners of keys with partitionByOwner and reads each
+// owner's keys with one call, all owners at once. The keys whose owner could
+// not be found or reached are read one by one with getEach.
+func (n *ChordNode) getMulti(keys []string) MultiGetResult {
+	n.storageLog().Infof("Start get %v keys from node [%v].", len(keys), n.addr)
+	ret := MultiGetResult{Values: make(map[string]string, len(keys))}
+	if n.tier == TierLeaf {
+		if err := n.leafCall("ChordNode.LeafGetMulti", keys, &ret); err != nil {
+			ret = MultiGetResult{Values: make(map[string]string)}
+			for _, k := range keys {
+				ret.fail(k, NULL, classifyError(err))
+			}
+		}
+		return ret
+	}
+	if !n.isOnline() {
+		n.storageLog().Errorf("Trying to get in an offline node.")
+		for _, k := range keys {
+			ret.fail(k, NULL, ErrOffline)
+		}
+		return ret
+	}
+	owners, unresolved := n.partitionByOwner(keys)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	gather := func(part MultiGetResult) {
+		lock.Lock()
+		for k, v := range part.Values {
+			ret.Values[k] = v
+		}
+		ret.Failures = append(ret.Failures, part.Failures...)
+		lock.Unlock()
+	}
+	for tar, ks := range owners {
+		wg.Add(1)
+		go func(tar string, ks []string) {
+			defer wg.Done()
+			gather(n.getFrom(tar, ks))
+		}(tar, ks)
+	}
+	if len(unresolved) > 0 {
+		ks := make([]string, 0, len(unresolved))
+		for k := range unresolved {
+			ks = append(ks, k)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gather(n.getEach(ks))
+		}()
+	}
+	wg.Wait()
+	return ret
+}
+
+// getEach reads keys one by one with getValue, which looks their owners up
+// again and tries the replica of one that does not answer.
+func (n *ChordNode) getEach(keys []string) MultiGetResult {
+	ret := MultiGetResult{Values: make(map[string]string, len(keys))}
+	for _, k := range keys {
+		var tr OpTrace
+		if val, err := n.getValue(k, &tr); err != nil {
+			ret.fail(k, tr.Owner, err)
+		} else {
+			ret.Values[k] = val
+		}
+	}
+	return ret
+}
+
+// getFrom reads keys of owner tar. Keys that tar's filter rules out fail
+// without asking it.
+func (n *ChordNode) getFrom(tar string, keys []string) MultiGetResult {
+	keys, skipped := n.filterMultiGet(tar, keys)
+	ret := MultiGetResult{Values: make(map[string]string)}
+	if len(keys) > 0 {
+		ret = n.readFrom(tar, keys)
+	}
+	for _, k := range skipped {
+		ret.fail(k, tar, ErrNotFound)
+	}
+	return ret
+}
+
+// readFrom reads keys from tar's store, and decodes the erasure coded ones.
+func (n *ChordNode) readFrom(tar string, keys []string) MultiGetResult {
+	var ret MultiGetResult
+	t := n.startOp("get", fmt.Sprintf("%v keys", len(keys)))
+	begin := time.Now()
+	err := n.call(tar, "ChordNode.GetManyInStore", keys, &ret)
+	t.phase("GetManyInStore", tar, begin)
+	t.finish(err == nil)
+	if err != nil {
+		n.logErrorFunctionCall(tar, "ChordNode.getMulti", "ChordNode.GetManyInStore", err)
+		return n.getEach(keys)
+	}
+	if ret.Values == nil {
+		ret.Values = make(map[string]string)
+	}
+	for k, val := range ret.Values {
+		m, isManifest := parseManifest(val)
+		if isManifest {
+			var ok bool
+			if ok, val = n.getErasure(k, m); !ok {
+				delete(ret.Values, k)
+				ret.fail(k, tar, ErrUnavailable)
+				continue
+			}
+			if val, err = n.readValue(k, val); err != nil {
+				delete(ret.Values, k)
+				ret.fail(k, tar, err)
+				continue
+			}
+		}
+		if n.contentAddressed && !verifyContent(k, val) {
+			delete(ret.Values, k)
+			ret.fail(k, tar, errContentMismatch)
+			continue
+		}
+		ret.Values[k] = val
+	}
+	return ret
+}
+
+func (n *ChordNode) LeafGetMulti(keys []string, ret *MultiGetResult) error {
+	if !n.isOnline() {
+		return ErrOffline
+	}
+	*ret = n.getMulti(keys)
+	return nil
+}
+
+// GetMulti reads keys with one call to each of their owners and returns the
+// values found, and for every other key why it was not.
+func (w *NodeWrapper) GetMulti(keys []string) MultiGetResult {
+	return w.node.getMulti(keys)
+}
@@ -0,0 +1,170 @@
+package chord
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NegativeCacheOptions have a node remember for TTL the keys its gets found
+// missing, and answer further gets of them without a lookup. Zero TTL turns
+// the cache off; a second or less keeps a key written through another node
+// from reading as missing here for long. Zero Capacity means
+// negativeCacheLen.
+type NegativeCacheOptions struct {
+	TTL      time.Duration
+	Capacity int
+}
+
+type NegativeCacheStatus struct {
+	Options     NegativeCacheOptions
+	Entries     int
+	Hits        uint64
+	Misses      uint64
+	Invalidated uint64
+	Expired     uint64
+}
+
+// negativeCache holds the keys found missing by this node's gets. A write
+// made through this node drops its key. drops counts them, so that a get
+// that was under way during a write does not cache its stale miss.
+type negativeCache struct {
+	lock        sync.Mutex
+	options     NegativeCacheOptions
+	expires     map[string]time.Time
+	drops       uint64
+	hits        uint64
+	misses      uint64
+	invalidated uint64
+	expired     uint64
+}
+
+func (c *negativeCache) capacity() int {
+	if c.options.Capacity > 0 {
+		return c.options.Capacity
+	}
+	return negativeCacheLen
+}
+
+// missing tells whether key is cached as missing, and otherwise returns the
+// drop count for add.
+func (c *negativeCache) missing(key string) (bool, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.options.TTL == 0 {
+		return false, c.drops
+	}
+	at, ok := c.expires[key]
+	if ok && time.Now().After(at) {
+		delete(c.expires, key)
+		c.expired++
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return false, c.drops
+	}
+	c.hits++
+	return true, c.drops
+}
+
+// add caches key as missing, unless a write was dropped since drops.
+func (c *negativeCache) add(key string, drops uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.options.TTL == 0 || c.drops != drops {
+		return
+	}
+	if c.expires == nil {
+		c.expires = make(map[string]time.Time)
+	}
+	if _, ok := c.expires[key]; !ok && len(c.expires) >= c.capacity() {
+		for k := range c.expires {
+			delete(c.expires, k)
+			break
+		}
+	}
+	c.expires[key] = time.Now().Add(c.options.TTL)
+}
+
+func (c *negativeCache) drop(keys ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.drops++
+	for _, k := range keys {
+		if _, ok := c.expires[k]; ok {
+			delete(c.expires, k)
+			c.invalidated++
+		}
+	}
+}
+
+func (c *negativeCache) reset() {
+	c.lock.Lock()
+	c.drops++
+	c.expires = nil
+	c.lock.Unlock()
+}
+
+func (c *negativeCache) status() NegativeCacheStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return NegativeCacheStatus{
+		Options:     c.options,
+		Entries:     len(c.expires),
+		Hits:        c.hits,
+		Misses:      c.misses,
+		Invalidated: c.invalidated,
+		Expired:     c.expired,
+	}
+}
+
+func (n *ChordNode) setNegativeCache(options NegativeCacheOptions) bool {
+	if options.TTL < 0 || options.Capacity < 0 {
+		n.log().Errorf("Invalid negative cache options [%+v].", options)
+		return false
+	}
+	c := &n.negCache
+	c.lock.Lock()
+	c.options = options
+	if options.TTL == 0 {
+		c.expires = nil
+	}
+	c.lock.Unlock()
+	return true
+}
+
+// serveNegativeCache returns the cache's status, and with POST sets its ttl=
+// and capacity= first.
+func (n *ChordNode) serveNegativeCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var options NegativeCacheOptions
+		var err error
+		if t := r.URL.Query().Get("ttl"); t != "" {
+			if options.TTL, err = time.ParseDuration(t); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if c := r.URL.Query().Get("capacity"); c != "" {
+			if options.Capacity, err = strconv.Atoi(c); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if !n.setNegativeCache(options) {
+			http.Error(w, "ttl and capacity must not be negative", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, n.negCache.status())
+}
+
+func (w *NodeWrapper) SetNegativeCache(options NegativeCacheOptions) bool {
+	return w.node.setNegativeCache(options)
+}
+
+func (w *NodeWrapper) NegativeCacheStatus() NegativeCacheStatus {
+	return w.node.negCache.status()
+}
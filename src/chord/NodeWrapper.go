@@ -1,5 +1,12 @@
 package chord
 
+import (
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
 type NodeWrapper struct {
 	node *ChordNode
 }
@@ -9,6 +16,101 @@ func (w *NodeWrapper) Initialize(addr string) {
 	w.node.initialize(addr)
 }
 
+// SetLogger sends the node's logs to logger instead of the standard logger,
+// so that nodes sharing a process can be logged, filtered and leveled one by
+// one. Entries carry the node's address in the node field either way, and
+// their subsystem, if any, in the subsystem field.
+func (w *NodeWrapper) SetLogger(logger *log.Logger) {
+	w.node.setLogger(logger)
+}
+
+// Logger is the node's log, for protocols and services built on it.
+func (w *NodeWrapper) Logger() *log.Entry {
+	return w.node.log()
+}
+
+func (w *NodeWrapper) SetCodec(name string) bool {
+	codec, ok := LookupCodec(name)
+	if !ok {
+		return false
+	}
+	w.node.codec = codec
+	return true
+}
+
+func (w *NodeWrapper) SetAdmin(options AdminOptions) {
+	w.node.admin.options = options
+}
+
+func (w *NodeWrapper) SetTier(tier int) {
+	w.node.tier = tier
+}
+
+func (w *NodeWrapper) SetRoutingBudget(rpcPerSecond int64) {
+	w.node.accordion.lock.Lock()
+	w.node.accordion.budget = rpcPerSecond
+	w.node.accordion.lock.Unlock()
+}
+
+// SetStorage swaps the engines behind the store and the pre backup of a node
+// that is not in the ring. Whoever opened the engines closes them after Quit.
+func (w *NodeWrapper) SetStorage(store, preBackup KVStore) bool {
+	return w.node.setStorage(store, preBackup)
+}
+
+// SetReplicator replaces the default strategy of one copy in the successor's
+// pre backup. Set it on every node of the ring before any of them joins.
+func (w *NodeWrapper) SetReplicator(r Replicator) {
+	w.node.replicator = r
+}
+
+func (w *NodeWrapper) RepairReplicas() bool {
+	return w.node.replicator.Repair() == nil
+}
+
+// SetFailureDetector picks how peers are judged up: "ping" dials on every
+// check, "cached" (the default) reuses fresh and gossiped observations, and
+// "swim" adds indirect probes through neighbours before declaring a peer dead.
+// It has to be set before the node creates or joins a ring.
+func (w *NodeWrapper) SetFailureDetector(name string) bool {
+	if s := w.node.life.get(); s != StateCreated && s != StateOffline {
+		w.node.log().Errorf("Trying to change the failure detector of an online node.")
+		return false
+	}
+	d, ok := w.node.newFailureDetector(name)
+	if !ok {
+		return false
+	}
+	w.node.useDetector(d)
+	return true
+}
+
+func (w *NodeWrapper) OnPeerLivenessChanged(f func(addr string, alive bool)) {
+	w.node.peerSubscribers.add(f)
+}
+
+func (w *NodeWrapper) SetContentAddressed(on bool) {
+	w.node.contentAddressed = on
+}
+
+// SetAudit runs the misplaced and orphaned key audit, and the comparison of
+// the node's range with the successor's backup of it, every interval in the
+// background. Zero turns it off; Audit still runs it on demand.
+func (w *NodeWrapper) SetAudit(interval time.Duration, repair bool) {
+	w.node.auditor.lock.Lock()
+	w.node.auditor.interval = interval
+	w.node.auditor.repair = repair
+	w.node.auditor.lock.Unlock()
+}
+
+// SetMaintenanceBudget bounds stabilize, fixFinger and checkPredecessor to
+// about rpcPerSecond calls a second together. Zero means no bound.
+func (w *NodeWrapper) SetMaintenanceBudget(rpcPerSecond int64) {
+	w.node.pacer.lock.Lock()
+	w.node.pacer.budget = rpcPerSecond
+	w.node.pacer.lock.Unlock()
+}
+
 func (w *NodeWrapper) Run() {
 	w.node.run()
 }
@@ -29,6 +131,16 @@ func (w *NodeWrapper) ForceQuit() {
 	w.node.forceQuit()
 }
 
+// State reports where the node is in its lifecycle.
+func (w *NodeWrapper) State() LifecycleState {
+	return w.node.life.get()
+}
+
+// Online reports whether the node is part of a ring and serving it.
+func (w *NodeWrapper) Online() bool {
+	return w.node.isOnline()
+}
+
 func (w *NodeWrapper) Ping(addr string) bool {
 	return w.node.ping(addr)
 }
@@ -41,6 +153,93 @@ func (w *NodeWrapper) Get(key string) (bool, string) {
 	return w.node.get(key)
 }
 
+// GetValue is Get that tells a missing key, ErrNotFound, from one that could
+// not be reached, ErrUnavailable, and from a node that is offline, ErrOffline.
+func (w *NodeWrapper) GetValue(key string) (string, error) {
+	return w.node.getValue(key, nil)
+}
+
+// Lookup finds the owner of key and the nodes the lookup was forwarded
+// through on the way, each with the latency seen by the node before it.
+func (w *NodeWrapper) Lookup(key string) (LookupPath, error) {
+	var path LookupPath
+	err := w.node.FindSuccessorPath(w.node.keyId(key), &path)
+	return path, err
+}
+
+// GetTraced is GetValue that also reports the lookup path and per-peer
+// timings of the read.
+func (w *NodeWrapper) GetTraced(key string) (string, OpTrace, error) {
+	var trace OpTrace
+	val, err := w.node.getValue(key, &trace)
+	return val, trace, err
+}
+
+// PutTraced is Put that also reports the lookup path and per-peer timings of
+// the write.
+func (w *NodeWrapper) PutTraced(key string, value string) (bool, OpTrace) {
+	var trace OpTrace
+	ack := w.node.putWithAck(key, value, &trace)
+	return ack != AckNone, trace
+}
+
 func (w *NodeWrapper) Delete(key string) bool {
 	return w.node.delete(key)
 }
+
+// ForEachLocal calls f on every pair in the node's own store, in no order,
+// until f returns false. It sees the store as it was when the call began,
+// and holds no lock while f runs, so f may use the node. Pre backup copies of
+// the predecessor's keys are not included, nor are erasure coded values,
+// which no node holds whole.
+func (w *NodeWrapper) ForEachLocal(f func(k, v string) bool) {
+	n := w.node
+	n.storeLock.RLock()
+	data := n.store.Snapshot()
+	n.storeLock.RUnlock()
+	for k, v := range data {
+		if _, isManifest := parseManifest(v); isManifest {
+			continue
+		}
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func (w *NodeWrapper) Export(addr string, out io.Writer) error {
+	return w.node.export(addr, out)
+}
+
+func (w *NodeWrapper) SetSlowOpThreshold(op string, d time.Duration) {
+	w.node.slowOps.setThreshold(op, d)
+}
+
+func (w *NodeWrapper) SlowOps(op string, min time.Duration, limit int) []SlowOp {
+	return w.node.slowOps.query(op, min, limit)
+}
+
+func (w *NodeWrapper) TopKeys(n int) []KeyCount {
+	return w.node.hotKeys.top(n)
+}
+
+func (w *NodeWrapper) PutContent(value string) (string, bool) {
+	key, ack := w.node.putContent(value, nil)
+	return key, ack != AckNone
+}
+
+func (w *NodeWrapper) ReplicationStats() ReplicationStats {
+	return w.node.replicationStats()
+}
+
+func (w *NodeWrapper) Audit(repair bool) AuditReport {
+	return w.node.audit(repair)
+}
+
+func (w *NodeWrapper) PeerScores() []PeerScore {
+	return w.node.peers.scores()
+}
+
+func (w *NodeWrapper) Liveness() LivenessStats {
+	return w.node.livenessStats()
+}
@@ -0,0 +1,155 @@
+package chord
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverloadOptions say when a node counts as overloaded: when more than
+// MaxInFlight requests are waiting on its server, or its puts, gets and
+// deletes take MaxLatency on average. While it is, and for HoldTime after,
+// maintenance rounds come Stretch times further apart, and audits and
+// scheduled backups wait, so that the client traffic gets the node. Backups
+// of single writes are not deferred. Zero limits turn detection off.
+type OverloadOptions struct {
+	MaxInFlight int64
+	MaxLatency  time.Duration
+	Stretch     int
+	HoldTime    time.Duration
+}
+
+type OverloadStatus struct {
+	Overloaded bool
+	InFlight   int64
+	Latency    time.Duration
+	// Episodes counts the times the node became overloaded, Stretched the
+	// maintenance rounds put off, and Deferred the audits and backups.
+	Episodes  uint64
+	Stretched uint64
+	Deferred  uint64
+}
+
+type overloadDetector struct {
+	lock      sync.Mutex
+	options   OverloadOptions
+	latency   time.Duration
+	sampled   time.Time
+	until     time.Time
+	episodes  uint64
+	stretched uint64
+	deferred  uint64
+}
+
+func isClientOp(op string) bool {
+	return op == "put" || op == "get" || op == "delete"
+}
+
+func (o *overloadDetector) observe(d time.Duration) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.options.MaxLatency <= 0 {
+		return
+	}
+	if time.Since(o.sampled) > o.hold() {
+		o.latency = d
+	} else {
+		o.latency += (d - o.latency) / rttSmoothing
+	}
+	o.sampled = time.Now()
+}
+
+func (o *overloadDetector) hold() time.Duration {
+	if o.options.HoldTime > 0 {
+		return o.options.HoldTime
+	}
+	return overloadHoldTime
+}
+
+// overloaded tells whether the node is overloaded now, or was within the
+// hold time. A latency not sampled for that long is out of date.
+func (n *ChordNode) overloaded() bool {
+	o := &n.overload
+	inFlight := atomic.LoadInt64(&n.conns.inFlight)
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	now := time.Now()
+	busy := o.options.MaxInFlight > 0 && inFlight > o.options.MaxInFlight ||
+		o.options.MaxLatency > 0 && now.Sub(o.sampled) <= o.hold() && o.latency > o.options.MaxLatency
+	if busy {
+		if !now.Before(o.until) {
+			o.episodes++
+			n.maintenanceLog().Errorf("Node [%v] is overloaded with %v requests in flight and %v latency; shedding maintenance.", n.addr, inFlight, o.latency)
+		}
+		o.until = now.Add(o.hold())
+	}
+	return now.Before(o.until)
+}
+
+// pause is the pacer's interval before the next round of task, stretched
+// while the node is overloaded.
+func (n *ChordNode) pause(task string, changed bool) time.Duration {
+	interval := n.pacer.next(task, changed)
+	n.rounds.counted()
+	if !n.overloaded() {
+		return interval
+	}
+	o := &n.overload
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.stretched++
+	stretch := o.options.Stretch
+	if stretch <= 0 {
+		stretch = overloadStretch
+	}
+	return interval * time.Duration(stretch)
+}
+
+// deferring tells whether work that can wait should wait, and counts it.
+func (n *ChordNode) deferring() bool {
+	if !n.overloaded() {
+		return false
+	}
+	n.overload.lock.Lock()
+	n.overload.deferred++
+	n.overload.lock.Unlock()
+	return true
+}
+
+func (n *ChordNode) overloadStatus() OverloadStatus {
+	overloaded := n.overloaded()
+	o := &n.overload
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	ret := OverloadStatus{
+		Overloaded: overloaded,
+		InFlight:   atomic.LoadInt64(&n.conns.inFlight),
+		Episodes:   o.episodes,
+		Stretched:  o.stretched,
+		Deferred:   o.deferred,
+	}
+	if time.Since(o.sampled) <= o.hold() {
+		ret.Latency = o.latency
+	}
+	return ret
+}
+
+func (n *ChordNode) serveOverload(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.overloadStatus())
+}
+
+func (w *NodeWrapper) SetOverload(options OverloadOptions) bool {
+	if options.MaxInFlight < 0 || options.MaxLatency < 0 || options.Stretch < 0 || options.HoldTime < 0 {
+		w.node.log().Errorf("Invalid overload options [%+v].", options)
+		return false
+	}
+	w.node.overload.lock.Lock()
+	w.node.overload.options = options
+	w.node.overload.lock.Unlock()
+	return true
+}
+
+func (w *NodeWrapper) OverloadStatus() OverloadStatus {
+	return w.node.overloadStatus()
+}
@@ -0,0 +1,261 @@
+package chord
+
+import (
+	"chord/ring"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// FingerExact: Finger i is the successor of start(i), as Chord has it.
+	FingerExact = iota
+	// FingerProximity: Finger i is whichever node of the successor of
+	// start(i) and those after it up to start(i+1) has answered this node
+	// fastest. Any of them routes as well, in fewer milliseconds. The first
+	// finger stays the successor.
+	FingerProximity
+)
+
+// PeerRTT is the round trip time this node has measured to a peer: RTT
+// smoothed over the samples, Deviation the smoothed distance of a sample from
+// it, and Min the fastest seen. Probes counts the samples taken by probing,
+// the rest coming from the calls the node made anyway.
+type PeerRTT struct {
+	Addr      string
+	RTT       time.Duration
+	Deviation time.Duration
+	Min       time.Duration
+	Samples   uint64
+	Probes    uint64
+	Updated   time.Time
+}
+
+type rttEntry struct {
+	rtt       time.Duration
+	deviation time.Duration
+	min       time.Duration
+	samples   uint64
+	probes    uint64
+	updated   time.Time
+}
+
+// rttTable keeps a smoothed round trip time per peer, from the calls this
+// node makes anyway and the probes of the peers it has not called lately.
+type rttTable struct {
+	lock  sync.Mutex
+	peers map[string]*rttEntry
+}
+
+func (r *rttTable) observe(addr string, d time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.peers == nil {
+		r.peers = make(map[string]*rttEntry)
+	}
+	e, ok := r.peers[addr]
+	if !ok {
+		r.peers[addr] = &rttEntry{rtt: d, deviation: d / 2, min: d, samples: 1, updated: time.Now()}
+		return
+	}
+	diff := d - e.rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	e.deviation += (diff - e.deviation) / rttDeviationSmoothing
+	e.rtt += (d - e.rtt) / rttSmoothing
+	if d < e.min {
+		e.min = d
+	}
+	e.samples++
+	e.updated = time.Now()
+}
+
+func (r *rttTable) probed(addr string) {
+	r.lock.Lock()
+	if e, ok := r.peers[addr]; ok {
+		e.probes++
+	}
+	r.lock.Unlock()
+}
+
+func (r *rttTable) get(addr string) (time.Duration, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	e, ok := r.peers[addr]
+	if !ok {
+		return 0, false
+	}
+	return e.rtt, true
+}
+
+// fresh tells whether addr has a sample younger than age.
+func (r *rttTable) fresh(addr string, age time.Duration) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	e, ok := r.peers[addr]
+	return ok && time.Since(e.updated) < age
+}
+
+func (r *rttTable) forget(addr string) {
+	r.lock.Lock()
+	delete(r.peers, addr)
+	r.lock.Unlock()
+}
+
+// expire forgets the peers with no sample for age.
+func (r *rttTable) expire(age time.Duration) {
+	r.lock.Lock()
+	for addr, e := range r.peers {
+		if time.Since(e.updated) > age {
+			delete(r.peers, addr)
+		}
+	}
+	r.lock.Unlock()
+}
+
+// faster tells whether a has been measured faster than b. A peer not
+// measured yet is not taken to be faster.
+func (r *rttTable) faster(a, b string) bool {
+	da, ok := r.get(a)
+	if !ok {
+		return false
+	}
+	db, ok := r.get(b)
+	return !ok || da < db
+}
+
+func (r *rttTable) snapshot() []PeerRTT {
+	r.lock.Lock()
+	ret := make([]PeerRTT, 0, len(r.peers))
+	for addr, e := range r.peers {
+		ret = append(ret, PeerRTT{Addr: addr, RTT: e.rtt, Deviation: e.deviation, Min: e.min, Samples: e.samples, Probes: e.probes, Updated: e.updated})
+	}
+	r.lock.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Addr < ret[j].Addr })
+	return ret
+}
+
+// probeRTT measures addr with the cheapest call there is.
+func (n *ChordNode) probeRTT(addr string) bool {
+	var pre string
+	if n.call(addr, "ChordNode.GetPredecessor", NULL, &pre) != nil {
+		return false
+	}
+	n.rtt.probed(addr)
+	return true
+}
+
+// probeTargets are the peers whose round trip times this node has use for:
+// its fingers, successors and predecessor, and the replicas it may read from.
+func (n *ChordNode) probeTargets() []string {
+	seen := map[string]bool{NULL: true, n.addr: true}
+	var ret []string
+	add := func(addr string) {
+		if !seen[addr] {
+			seen[addr] = true
+			ret = append(ret, addr)
+		}
+	}
+	n.sucLock.RLock()
+	for _, s := range n.successorList {
+		add(s)
+	}
+	n.sucLock.RUnlock()
+	var pre string
+	_ = n.GetPredecessor(NULL, &pre)
+	add(pre)
+	n.fingerLock.RLock()
+	for _, f := range n.fingerTable {
+		add(f)
+	}
+	n.fingerLock.RUnlock()
+	n.readRouter.lock.Lock()
+	for _, e := range n.readRouter.replicas {
+		add(e.addr)
+	}
+	n.readRouter.lock.Unlock()
+	return ret
+}
+
+// probePeers probes up to rttProbeBatch of the targets not sampled for
+// rttProbeStale, and forgets the peers not sampled for rttExpireTime.
+func (n *ChordNode) probePeers() {
+	n.rtt.expire(rttExpireTime)
+	probes := 0
+	for _, addr := range n.probeTargets() {
+		if probes == rttProbeBatch {
+			break
+		}
+		if n.rtt.fresh(addr, rttProbeStale) {
+			continue
+		}
+		n.probeRTT(addr)
+		probes++
+	}
+}
+
+// proximateFinger picks finger i, for which the lookup of start(i) found suc,
+// as FingerProximity has it. Peers not measured yet are probed first.
+func (n *ChordNode) proximateFinger(i int, suc string) string {
+	nId := NodeId(n.addr)
+	lo := start(nId, i)
+	span := ring.Distance(lo, start(nId, i+1))
+	inside := func(addr string) bool {
+		return ring.Distance(lo, NodeId(addr)).Cmp(span) < 0
+	}
+	if suc == n.addr || !inside(suc) {
+		return suc
+	}
+	var list [SuccessorListLen]string
+	if err := n.call(suc, "ChordNode.GetSuccessorList", NULL, &list); err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.proximateFinger", "ChordNode.GetSuccessorList", err)
+		return suc
+	}
+	candidates := []string{suc}
+	for _, s := range list {
+		if s == NULL || s == n.addr || s == suc || !inside(s) {
+			break
+		}
+		if !n.peers.blacklisted(s) {
+			candidates = append(candidates, s)
+		}
+	}
+	best := suc
+	for _, c := range candidates {
+		if !n.rtt.fresh(c, rttProbeStale) && !n.probeRTT(c) {
+			continue
+		}
+		if n.rtt.faster(c, best) {
+			best = c
+		}
+	}
+	return best
+}
+
+func (n *ChordNode) servePeerRTTs(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.rtt.snapshot())
+}
+
+// SetFingerSelection picks how fixFinger fills the finger table, FingerExact
+// by default.
+func (w *NodeWrapper) SetFingerSelection(mode int) bool {
+	if mode != FingerExact && mode != FingerProximity {
+		w.node.log().Errorf("Invalid finger selection [%v].", mode)
+		return false
+	}
+	atomic.StoreInt32(&w.node.fingerSelection, int32(mode))
+	return true
+}
+
+// PeerRTTs returns the round trip times the node has measured, by address.
+func (w *NodeWrapper) PeerRTTs() []PeerRTT {
+	return w.node.rtt.snapshot()
+}
+
+// PeerRTT returns the smoothed round trip time to addr, if measured.
+func (w *NodeWrapper) PeerRTT(addr string) (time.Duration, bool) {
+	return w.node.rtt.get(addr)
+}
@@ -0,0 +1,119 @@
+package chord
+
+import (
+	"math"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OffenceBogusRouting      = "bogus-routing"
+	OffenceFailedTransfer    = "failed-transfer"
+	OffenceProtocolViolation = "protocol-violation"
+)
+
+var offenceWeight = map[string]float64{
+	OffenceBogusRouting:      1,
+	OffenceFailedTransfer:    2,
+	OffenceProtocolViolation: 3,
+}
+
+type PeerScore struct {
+	Addr        string
+	Score       float64
+	Offences    map[string]int
+	Blacklisted bool
+	Until       time.Time
+}
+
+type peerRecord struct {
+	score    float64
+	updated  time.Time
+	offences map[string]int
+	until    time.Time
+}
+
+// peerScoreTable scores misbehaving peers. Scores halve every
+// peerScoreHalfLife, and a peer whose score reaches peerBlacklistScore is kept
+// out of fingers, learned routes and the backup entries of the successor list
+// for peerBlacklistTime. The immediate successor found by stabilize is never
+// refused, so a wrongly blacklisted peer cannot cut the ring.
+type peerScoreTable struct {
+	lock  sync.Mutex
+	peers map[string]*peerRecord
+}
+
+func (r *peerRecord) decay(now time.Time) {
+	r.score *= math.Pow(0.5, float64(now.Sub(r.updated))/float64(peerScoreHalfLife))
+	r.updated = now
+}
+
+func (t *peerScoreTable) penalize(addr, offence string) bool {
+	if addr == NULL {
+		return false
+	}
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.peers == nil {
+		t.peers = make(map[string]*peerRecord)
+	}
+	r, ok := t.peers[addr]
+	if !ok {
+		r = &peerRecord{updated: now, offences: make(map[string]int)}
+		t.peers[addr] = r
+	}
+	r.decay(now)
+	r.score += offenceWeight[offence]
+	r.offences[offence]++
+	if r.score >= peerBlacklistScore && now.After(r.until) {
+		r.until = now.Add(peerBlacklistTime)
+		return true
+	}
+	return false
+}
+
+func (t *peerScoreTable) blacklisted(addr string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	r, ok := t.peers[addr]
+	return ok && time.Now().Before(r.until)
+}
+
+func (t *peerScoreTable) scores() []PeerScore {
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ret := make([]PeerScore, 0, len(t.peers))
+	for addr, r := range t.peers {
+		r.decay(now)
+		offences := make(map[string]int, len(r.offences))
+		for k, v := range r.offences {
+			offences[k] = v
+		}
+		ret = append(ret, PeerScore{Addr: addr, Score: r.score, Offences: offences, Blacklisted: now.Before(r.until), Until: r.until})
+	}
+	return ret
+}
+
+func (n *ChordNode) penalize(addr, offence string) {
+	if n.peers.penalize(addr, offence) {
+		n.maintenanceLog().Errorf("Node [%v] blacklists peer [%v] for %v after [%v].", n.addr, addr, peerBlacklistTime, offence)
+		n.accordion.forget(addr)
+	}
+}
+
+// checkCallError blames a peer that answers with an error only a peer not
+// speaking this protocol would give.
+func (n *ChordNode) checkCallError(addr string, err error) {
+	if serverErr, ok := err.(rpc.ServerError); ok && strings.HasPrefix(string(serverErr), "rpc: ") {
+		n.penalize(addr, OffenceProtocolViolation)
+	}
+}
+
+func (n *ChordNode) servePeers(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.peers.scores())
+}
@@ -0,0 +1,80 @@
+package chord
+
+// Placement is where a write of Key would go. Owner is the node whose range
+// the key falls in, Holder the node that would store it, which differs when
+// a migration moved the key's range, and Replicas the nodes that would keep
+// its backups. Values large enough to be erasure coded are stored as shards
+// on further nodes, which depend on the value and are not named.
+type Placement struct {
+	Key      string
+	Id       string
+	Owner    string
+	Holder   string
+	Replicas []string
+	Error    string
+}
+
+// DescribePlacement tells where this node would store key and back it up.
+func (n *ChordNode) DescribePlacement(key string, ret *Placement) error {
+	if target, ok := n.migratedTo(key); ok {
+		if err := n.call(target, "ChordNode.DescribePlacement", key, ret); err != nil {
+			return err
+		}
+		ret.Owner = n.addr
+		return nil
+	}
+	*ret = Placement{Key: key, Id: n.keyId(key).Text(16), Owner: n.addr, Holder: n.addr}
+	if _, ok := n.replicator.(successorReplicator); ok {
+		var suc string
+		if err := n.FirstAvailableSuccessor(NULL, &suc); err == nil && suc != n.addr {
+			ret.Replicas = []string{suc}
+		}
+	}
+	return nil
+}
+
+func (n *ChordNode) placement(key string) Placement {
+	t := n.startOp("placement", key)
+	owner, err := n.lookup(t, key)
+	t.finish(err == nil)
+	var ret Placement
+	if err == nil {
+		err = n.call(owner, "ChordNode.DescribePlacement", key, &ret)
+	}
+	if err != nil {
+		ret = Placement{Key: key, Id: n.keyId(key).Text(16), Owner: owner, Error: err.Error()}
+	}
+	return ret
+}
+
+// LeafWhereWouldItGo looks up where writes of keys would go without making
+// them. A key that cannot be placed carries the error in its placement.
+func (n *ChordNode) LeafWhereWouldItGo(keys []string, ret *[]Placement) error {
+	if !n.isOnline() {
+		return ErrOffline
+	}
+	*ret = make([]Placement, 0, len(keys))
+	for _, k := range keys {
+		*ret = append(*ret, n.placement(k))
+	}
+	return nil
+}
+
+func (w *NodeWrapper) WhereWouldItGo(keys ...string) ([]Placement, error) {
+	var ret []Placement
+	var err error
+	if w.node.tier == TierLeaf {
+		err = w.node.leafCall("ChordNode.LeafWhereWouldItGo", keys, &ret)
+	} else {
+		err = w.node.LeafWhereWouldItGo(keys, &ret)
+	}
+	return ret, err
+}
+
+func (w *NodeWrapper) WhoOwns(key string) (Placement, error) {
+	ret, err := w.WhereWouldItGo(key)
+	if err != nil || len(ret) == 0 {
+		return Placement{Key: key}, err
+	}
+	return ret[0], nil
+}
@@ -0,0 +1,305 @@
+package chord
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// JournalRecord is one write a node took as the key's owner.
+type JournalRecord struct {
+	Time   int64
+	Key    string
+	Value  string
+	Delete bool
+}
+
+// KeyRange is the keys from From up to, not including, To, in byte order.
+// An empty To has no upper bound.
+type KeyRange struct {
+	From string
+	To   string
+}
+
+func (r KeyRange) contains(key string) bool {
+	return key >= r.From && (r.To == "" || key < r.To)
+}
+
+type PointInTimeReport struct {
+	At        time.Time
+	Snapshots int
+	Records   int
+	Written   int
+	Deleted   int
+}
+
+// journal takes down a write for shipping with the backups. at is read
+// under the store lock, so writes of one key are journaled in order.
+func (n *ChordNode) journal(at time.Time, key, val string, del bool) {
+	if atomic.LoadInt32(&n.backups.journaling) == 0 {
+		return
+	}
+	b := &n.backups
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.journal) >= journalMaxPending {
+		n.storageLog().Errorf("Node [%v] drops a journal record of key [%v]; its backup destination is behind.", n.addr, b.journal[0].Key)
+		b.journal = b.journal[1:]
+	}
+	b.journal = append(b.journal, JournalRecord{Time: at.UnixNano(), Key: key, Value: val, Delete: del})
+}
+
+func journalName(addr string, from, to int64) string {
+	return backupDir(addr) + "journal/" + time.Unix(0, from).UTC().Format(backupTimeLayout) + "-" + time.Unix(0, to).UTC().Format(backupTimeLayout) + ".jsonl"
+}
+
+// journalSpan is the time span a journal segment covers, to the
+// millisecond its name carries.
+func journalSpan(name string) (from, to time.Time, ok bool) {
+	if path.Base(path.Dir(name)) != "journal" {
+		return from, to, false
+	}
+	parts := strings.Split(strings.TrimSuffix(path.Base(name), ".jsonl"), "-")
+	if len(parts) != 2 {
+		return from, to, false
+	}
+	from, err := time.Parse(backupTimeLayout, parts[0])
+	if err == nil {
+		to, err = time.Parse(backupTimeLayout, parts[1])
+	}
+	return from, to.Add(time.Millisecond), err == nil
+}
+
+// shipJournal sends the journal records taken since the last call to the
+// backup destination as one segment. Records that fail to go out are kept
+// for the next call.
+func (n *ChordNode) shipJournal() {
+	b := &n.backups
+	b.lock.Lock()
+	records, dest := b.journal, b.options.Destination
+	b.journal = nil
+	b.shipped = time.Now()
+	b.lock.Unlock()
+	if len(records) == 0 || dest == nil {
+		return
+	}
+	r, w := io.Pipe()
+	go func() {
+		enc := json.NewEncoder(w)
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		_ = w.Close()
+	}()
+	err := dest.Put(journalName(n.addr, records[0].Time, records[len(records)-1].Time), r)
+	_ = r.Close()
+	if err == nil {
+		return
+	}
+	n.logErrorFunctionCall(n.addr, "ChordNode.shipJournal", "BackupDestination.Put", err)
+	b.lock.Lock()
+	b.journal = append(records, b.journal...)
+	b.lock.Unlock()
+}
+
+func (n *ChordNode) shipJournalIfDue() {
+	n.backups.lock.Lock()
+	due := time.Since(n.backups.shipped) >= journalShipTime
+	n.backups.lock.Unlock()
+	if due {
+		n.shipJournal()
+	}
+}
+
+type pitEvent struct {
+	time    int64
+	value   string
+	deleted bool
+}
+
+// rangeAt rebuilds r as of at from the newest backup of every node taken
+// by then, and every journal record up to then: each key takes the newest of
+// the values the backups and the records give it.
+func rangeAt(dest BackupDestination, r KeyRange, at time.Time) (map[string]pitEvent, PointInTimeReport, error) {
+	report := PointInTimeReport{At: at}
+	names, err := dest.List("node-")
+	if err != nil {
+		return nil, report, err
+	}
+	snapshots := make(map[string]string)
+	var oldest time.Time
+	for _, name := range names {
+		t, ok := backupTime(name)
+		if !ok || t.After(at) {
+			continue
+		}
+		if dir := path.Dir(name); name > snapshots[dir] {
+			snapshots[dir] = name
+		}
+	}
+	events := make(map[string]pitEvent)
+	read := func(name string, f func(dec *json.Decoder) error) error {
+		file, err := dest.Get(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		dec := json.NewDecoder(bufio.NewReader(file))
+		for {
+			if err = f(dec); err != nil {
+				break
+			}
+		}
+		if err != io.EOF {
+			return fmt.Errorf("read backup %v: %v", name, err)
+		}
+		return nil
+	}
+	for _, name := range snapshots {
+		t, _ := backupTime(name)
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+		err = read(name, func(dec *json.Decoder) error {
+			var kv Pair
+			if err := dec.Decode(&kv); err != nil {
+				return err
+			}
+			if e, ok := events[kv.First]; r.contains(kv.First) && (!ok || e.time < t.UnixNano()) {
+				events[kv.First] = pitEvent{time: t.UnixNano(), value: kv.Second}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, report, err
+		}
+		report.Snapshots++
+	}
+	for _, name := range names {
+		from, to, ok := journalSpan(name)
+		if !ok || from.After(at) || to.Before(oldest) {
+			continue
+		}
+		err = read(name, func(dec *json.Decoder) error {
+			var rec JournalRecord
+			if err := dec.Decode(&rec); err != nil {
+				return err
+			}
+			if !r.contains(rec.Key) || rec.Time > at.UnixNano() {
+				return nil
+			}
+			// A record as new as a backup came after the backup read the key.
+			if e, ok := events[rec.Key]; !ok || e.time <= rec.Time {
+				events[rec.Key] = pitEvent{time: rec.Time, value: rec.Value, deleted: rec.Delete}
+			}
+			report.Records++
+			return nil
+		})
+		if err != nil {
+			return nil, report, err
+		}
+	}
+	if report.Snapshots == 0 && report.Records == 0 {
+		return nil, report, ErrNoBackup
+	}
+	return events, report, nil
+}
+
+// rangeNow returns what the ring addr is on holds in r, node by node.
+func rangeNow(addr string, codec Codec, r KeyRange) (map[string]string, error) {
+	walk := WalkRing(addr, codec)
+	if !walk.Closed || len(walk.Problems) > 0 {
+		return nil, fmt.Errorf("ring of %v is inconsistent: %v", addr, walk.Problems)
+	}
+	ret := make(map[string]string)
+	for _, info := range walk.Nodes {
+		var sid uint64
+		if err := RPCCallWithCodec(info.Addr, codec, "ChordNode.OpenSnapshot", NULL, &sid); err != nil {
+			return nil, err
+		}
+		for {
+			var chunk SnapshotChunk
+			if err := RPCCallWithCodec(info.Addr, codec, "ChordNode.NextSnapshotChunk", sid, &chunk); err != nil {
+				_ = RPCCallWithCodec(info.Addr, codec, "ChordNode.CloseSnapshot", sid, nil)
+				return nil, err
+			}
+			for k, v := range chunk.Data {
+				if r.contains(k) {
+					ret[k] = v
+				}
+			}
+			if chunk.Done {
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// planRangeAt returns the keys RestoreRangeAt would write, with their values,
+// and those it would delete, in order.
+func planRangeAt(addr string, codec Codec, dest BackupDestination, r KeyRange, at time.Time) (map[string]string, []string, PointInTimeReport, error) {
+	events, report, err := rangeAt(dest, r, at)
+	if err != nil {
+		return nil, nil, report, err
+	}
+	current, err := rangeNow(addr, codec, r)
+	if err != nil {
+		return nil, nil, report, err
+	}
+	data := make(map[string]string)
+	for k, e := range events {
+		if v, ok := current[k]; !e.deleted && (!ok || v != e.value) {
+			data[k] = e.value
+		}
+	}
+	keys := make([]string, 0, len(current))
+	for k := range current {
+		if e, ok := events[k]; !ok || e.deleted {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return data, keys, report, nil
+}
+
+// RestoreRangeAt puts r back the way it was at at, in the ring addr is on,
+// from the backups and journals in dest: keys of r that held a value then
+// get it back, and keys of r that did not exist then are deleted. Everything
+// else is left alone. Journals come from nodes backed up with Journal on; a
+// write to a node without one is only known to a restore once a backup of
+// that node has seen it.
+func RestoreRangeAt(addr string, codec Codec, dest BackupDestination, r KeyRange, at time.Time) (PointInTimeReport, error) {
+	data, keys, report, err := planRangeAt(addr, codec, dest, r, at)
+	if err != nil {
+		return report, err
+	}
+	if len(data) > 0 {
+		if err = RPCCallWithCodec(addr, codec, "ChordNode.LeafBulkLoad", &data, nil); err != nil {
+			return report, err
+		}
+	}
+	report.Written = len(data)
+	for _, k := range keys {
+		err = RPCCallWithCodec(addr, codec, "ChordNode.LeafDelete", k, nil)
+		if err != nil && err.Error() != ErrNotFound.Error() {
+			return report, err
+		}
+		report.Deleted++
+	}
+	return report, nil
+}
+
+// RestoreRangeAt is RestoreRangeAt through this node.
+func (w *NodeWrapper) RestoreRangeAt(dest BackupDestination, r KeyRange, at time.Time) (PointInTimeReport, error) {
+	return RestoreRangeAt(w.node.addr, w.node.codec, dest, r, at)
+}
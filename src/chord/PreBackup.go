@@ -0,0 +1,275 @@
+package chord
+
+import (
+	"math/big"
+	"time"
+)
+
+// BackupPair is a backup write of one pair, made on behalf of Owner, the node
+// whose store it copies.
+type BackupPair struct {
+	Owner string
+	Pair  Pair
+}
+
+// BackupBatch is a backup write of many pairs of Owner's store.
+type BackupBatch struct {
+	Owner string
+	Data  map[string]string
+}
+
+// BackupRange names the keys Owner backed up whose ids fall in (Start, End],
+// in hex like a migration's range, other than those of Owner's hosted ranges.
+type BackupRange struct {
+	Owner  string
+	Start  string
+	End    string
+	Hosted []Migration
+}
+
+// backupOwners files every key of the pre backup under its owner, so that a
+// merge promotes the keys of the owners that are gone and nothing else, and
+// a range that left its owner is dropped without listing its keys. Keys of a
+// pre backup given to SetStorage, or from a writer that did not say, have no
+// owner and are promoted by any merge. at is when each key last arrived,
+// for a conflict on promotion to weigh. The pre backup lock guards it.
+type backupOwners struct {
+	owner map[string]string
+	keys  map[string]map[string]bool
+	at    map[string]time.Time
+}
+
+func (o *backupOwners) set(key, owner string) {
+	o.remove(key)
+	if o.at == nil {
+		o.at = make(map[string]time.Time)
+	}
+	o.at[key] = time.Now()
+	if owner == NULL {
+		return
+	}
+	if o.owner == nil {
+		o.owner = make(map[string]string)
+		o.keys = make(map[string]map[string]bool)
+	}
+	o.owner[key] = owner
+	if o.keys[owner] == nil {
+		o.keys[owner] = make(map[string]bool)
+	}
+	o.keys[owner][key] = true
+}
+
+func (o *backupOwners) remove(key string) {
+	delete(o.at, key)
+	owner, ok := o.owner[key]
+	if !ok {
+		return
+	}
+	delete(o.owner, key)
+	delete(o.keys[owner], key)
+	if len(o.keys[owner]) == 0 {
+		delete(o.keys, owner)
+	}
+}
+
+func (o *backupOwners) reset() {
+	o.owner = nil
+	o.keys = nil
+	o.at = nil
+}
+
+func (o *backupOwners) of(owner string) []string {
+	ret := make([]string, 0, len(o.keys[owner]))
+	for k := range o.keys[owner] {
+		ret = append(ret, k)
+	}
+	return ret
+}
+
+func (o *backupOwners) counts() map[string]int {
+	ret := make(map[string]int, len(o.keys))
+	for owner, keys := range o.keys {
+		ret[owner] = len(keys)
+	}
+	return ret
+}
+
+// backupPut, backupDelete and backupReset write the pre backup and keep the
+// owners in step. The pre backup lock is held. backupPut merges a CRDT into
+// the copy there, and returns the value stored.
+func (n *ChordNode) backupPut(key, val, owner string, fromFunc string) (string, error) {
+	if cur, ok := n.preBackup.Get(key); ok {
+		val, _ = n.mergeCRDT(crdtMergeBackup, cur, val)
+	}
+	err := n.preBackup.Put(key, val)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, fromFunc, "KVStore.Put", err)
+		return val, err
+	}
+	n.backupOwners.set(key, owner)
+	return val, nil
+}
+
+func (n *ChordNode) backupDelete(key string, fromFunc string) {
+	n.storeDelete(n.preBackup, key, fromFunc)
+	n.backupOwners.remove(key)
+}
+
+func (n *ChordNode) backupReset(data map[string]string, owner string, fromFunc string) {
+	n.storeReset(n.preBackup, data, fromFunc)
+	n.backupOwners.reset()
+	for k := range data {
+		n.backupOwners.set(k, owner)
+	}
+}
+
+// mergeOwners picks the owners a merge promotes the keys of: failed, and any
+// other owner in the pre backup that does not answer. This node's own keys
+// are in its store already.
+func (n *ChordNode) mergeOwners(failed string) map[string]bool {
+	n.preBackupLock.RLock()
+	owners := make([]string, 0, len(n.backupOwners.keys))
+	for owner := range n.backupOwners.keys {
+		owners = append(owners, owner)
+	}
+	n.preBackupLock.RUnlock()
+	ret := make(map[string]bool)
+	for _, owner := range owners {
+		if owner == failed || owner != n.addr && !n.ping(owner) {
+			ret[owner] = true
+		}
+	}
+	return ret
+}
+
+// merging tells whether a merge of owners promotes key. The pre backup lock
+// is held.
+func (n *ChordNode) merging(key string, owners map[string]bool) bool {
+	owner, ok := n.backupOwners.owner[key]
+	return !ok || owners[owner]
+}
+
+// TrimPreBackup drops the keys of r from the pre backup.
+func (n *ChordNode) TrimPreBackup(r BackupRange, _ *string) error {
+	dropped, err := parseKeyRange(Migration{Start: r.Start, End: r.End})
+	if err != nil {
+		return err
+	}
+	var hosted []keyRange
+	for _, m := range r.Hosted {
+		h, err := parseKeyRange(m)
+		if err != nil {
+			return err
+		}
+		hosted = append(hosted, h)
+	}
+	n.preBackupLock.Lock()
+	cnt := 0
+	for _, k := range n.backupOwners.of(r.Owner) {
+		kId := n.keyId(k)
+		if !dropped.contains(kId) || inRanges(kId, hosted) {
+			continue
+		}
+		n.backupDelete(k, "ChordNode.TrimPreBackup")
+		n.seeding.note(k, nil)
+		cnt++
+	}
+	n.preBackupLock.Unlock()
+	n.replication.backupUpdated()
+	n.replicationLog().Infof("Drop %v keys of [%v]'s range (%v, %v] from node [%v]'s pre backup.", cnt, r.Owner, r.Start, r.End, n.addr)
+	return nil
+}
+
+func inRanges(kId *big.Int, ranges []keyRange) bool {
+	for _, r := range ranges {
+		if r.contains(kId) {
+			return true
+		}
+	}
+	return false
+}
+
+// handedOffRange names the keys of this node that went to pre, a joining
+// predecessor: those outside (pre, n] and the hosted ranges.
+func (n *ChordNode) handedOffRange(pre string) BackupRange {
+	ret := BackupRange{Owner: n.addr, Start: NodeId(n.addr).Text(16), End: NodeId(pre).Text(16)}
+	_ = n.HostedRanges(NULL, &ret.Hosted)
+	return ret
+}
+
+// reclaimPreBackup drops the keys of the pre backup the predecessor no longer
+// owns: those outside (its predecessor, it] and its hosted ranges. Keys
+// backed up for an owner that is gone are left for a merge to promote. It
+// needs no word from the node its range went to, so a lost trim, or a node
+// joining behind the predecessor, leaves no copies behind.
+func (n *ChordNode) reclaimPreBackup() int {
+	var pre, prePre string
+	_ = n.GetPredecessor(NULL, &pre)
+	if pre == NULL || pre == n.addr {
+		return 0
+	}
+	if seeding, _ := n.seeding.inProgress(); seeding != NULL {
+		return 0
+	}
+	var hosted []Migration
+	if n.call(pre, "ChordNode.GetPredecessor", NULL, &prePre) != nil || prePre == NULL ||
+		n.call(pre, "ChordNode.HostedRanges", NULL, &hosted) != nil {
+		return 0
+	}
+	var ranges []keyRange
+	for _, m := range hosted {
+		if r, err := parseKeyRange(m); err == nil {
+			ranges = append(ranges, r)
+		}
+	}
+	stale := func(k string) bool {
+		kId := n.keyId(k)
+		return !within(kId, NodeId(prePre), NodeId(pre), true) && !inRanges(kId, ranges)
+	}
+	var keys []string
+	owners := make(map[string]bool)
+	n.preBackupLock.RLock()
+	n.preBackup.Iterate(func(k, _ string) bool {
+		if stale(k) {
+			keys = append(keys, k)
+			if owner, ok := n.backupOwners.owner[k]; ok && owner != pre {
+				owners[owner] = true
+			}
+		}
+		return true
+	})
+	n.preBackupLock.RUnlock()
+	if len(keys) == 0 {
+		return 0
+	}
+	gone := make(map[string]bool)
+	for owner := range owners {
+		gone[owner] = owner != n.addr && !n.ping(owner)
+	}
+	// A predecessor, or a predecessor of it, that changed meanwhile moved
+	// the range the keys were judged by, and is the next pass's to judge.
+	var now, nowPre string
+	_ = n.GetPredecessor(NULL, &now)
+	if now != pre || n.call(pre, "ChordNode.GetPredecessor", NULL, &nowPre) != nil || nowPre != prePre {
+		return 0
+	}
+	cnt := 0
+	n.preBackupLock.Lock()
+	for _, k := range keys {
+		if owner, ok := n.backupOwners.owner[k]; ok && gone[owner] {
+			continue
+		}
+		if _, ok := n.preBackup.Get(k); !ok {
+			continue
+		}
+		n.backupDelete(k, "ChordNode.reclaimPreBackup")
+		n.seeding.note(k, nil)
+		cnt++
+	}
+	n.preBackupLock.Unlock()
+	if cnt > 0 {
+		n.replication.backupReclaimed(cnt)
+		n.replicationLog().Infof("Reclaim %v keys predecessor [%v] no longer owns from node [%v]'s pre backup.", cnt, pre, n.addr)
+	}
+	return cnt
+}
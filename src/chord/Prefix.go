@@ -0,0 +1,148 @@
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeletePrefixReport adds up what a prefix deletion removed from the nodes
+// it reached.
+type DeletePrefixReport struct {
+	Nodes   int
+	Deleted int
+	// Backups is the number of copies dropped from pre backups.
+	Backups int
+	// Skipped keys are leased, or their cache source refused the delete.
+	Skipped  []string
+	Problems []string
+}
+
+// DeletePrefixInStore deletes the keys starting with prefix from this node's
+// store and pre backup, tombstoning each, so that neither a backup replay nor
+// a promotion brings them back.
+func (n *ChordNode) DeletePrefixInStore(prefix string, ret *DeletePrefixReport) error {
+	if prefix == NULL {
+		return errors.New("empty prefix")
+	}
+	n.storageLog().Infof("Delete keys with prefix [%v] in node [%v]'s store and pre backup.", prefix, n.addr)
+	var keys []string
+	n.storeLock.RLock()
+	n.store.Iterate(func(k, _ string) bool {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	n.storeLock.RUnlock()
+	for _, k := range keys {
+		if n.keyLeases.admits(k, nil) != nil || n.cache.write(cacheWrite{key: k, delete: true}) != nil {
+			ret.Skipped = append(ret.Skipped, k)
+			continue
+		}
+		n.storeLock.Lock()
+		val, ok := n.store.Get(k)
+		if ok {
+			n.storeDelete(n.store, k, "ChordNode.DeletePrefixInStore")
+			delete(n.meta, k)
+		}
+		n.tombstones.add(k)
+		at := time.Now()
+		n.storeLock.Unlock()
+		if !ok {
+			continue
+		}
+		ret.Deleted++
+		n.journal(at, k, NULL, true)
+		n.watchers.fire(k)
+		if m, isManifest := parseManifest(val); isManifest {
+			go n.dropShards(k, m)
+		}
+	}
+	n.preBackupLock.Lock()
+	n.preBackup.Iterate(func(k, _ string) bool {
+		if strings.HasPrefix(k, prefix) {
+			n.backupDelete(k, "ChordNode.DeletePrefixInStore")
+			n.seeding.note(k, nil)
+			n.tombstones.add(k)
+			ret.Backups++
+		}
+		return true
+	})
+	n.preBackupLock.Unlock()
+	n.replication.backupUpdated()
+	ret.Nodes = 1
+	return nil
+}
+
+// DeletePrefix deletes every key starting with prefix from the ring addr is
+// on, and every backup of them, by walking the ring and having each node
+// clear its own store and pre backup. Nodes the walk cannot reach are named
+// in the report's problems, and an error is returned with it.
+func DeletePrefix(addr string, codec Codec, prefix string) (DeletePrefixReport, error) {
+	var report DeletePrefixReport
+	if prefix == NULL {
+		return report, errors.New("empty prefix")
+	}
+	walk := WalkRing(addr, codec)
+	report.Problems = append(report.Problems, walk.Problems...)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, info := range walk.Nodes {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			var r DeletePrefixReport
+			err := RPCCallWithCodec(addr, codec, "ChordNode.DeletePrefixInStore", prefix, &r)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("cannot delete on [%v]: %v", addr, err))
+				return
+			}
+			report.Nodes += r.Nodes
+			report.Deleted += r.Deleted
+			report.Backups += r.Backups
+			report.Skipped = append(report.Skipped, r.Skipped...)
+		}(info.Addr)
+	}
+	wg.Wait()
+	if !walk.Closed && len(report.Problems) == 0 {
+		report.Problems = append(report.Problems, "the ring walk did not close")
+	}
+	return report, report.err(prefix)
+}
+
+func (r DeletePrefixReport) err(prefix string) error {
+	if len(r.Problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("prefix [%v] may survive on nodes not reached: %v", prefix, r.Problems)
+}
+
+// LeafDeletePrefix is DeletePrefix through this super peer. Nodes it did not
+// reach are left to the report, which an error would not carry back.
+func (n *ChordNode) LeafDeletePrefix(prefix string, ret *DeletePrefixReport) error {
+	if prefix == NULL {
+		return errors.New("empty prefix")
+	}
+	*ret, _ = DeletePrefix(n.addr, n.codec, prefix)
+	return nil
+}
+
+func (w *NodeWrapper) DeletePrefix(prefix string) (DeletePrefixReport, error) {
+	n := w.node
+	if n.tier == TierLeaf {
+		var report DeletePrefixReport
+		if err := n.leafCall("ChordNode.LeafDeletePrefix", prefix, &report); err != nil {
+			return report, err
+		}
+		return report, report.err(prefix)
+	}
+	if !n.isOnline() {
+		return DeletePrefixReport{}, ErrOffline
+	}
+	return DeletePrefix(n.addr, n.codec, prefix)
+}
@@ -0,0 +1,84 @@
+package chord
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+)
+
+// Router replaces the finger-table routing of a node. The node still keeps
+// its successor list, predecessor, store and pre backup itself, so a router
+// only has to resolve keys to successors and maintain its own pointers.
+type Router interface {
+	FindSuccessor(kId *big.Int) (string, error)
+	Maintain()
+}
+
+type service struct {
+	name string
+	rcvr interface{}
+}
+
+var (
+	protocolLock sync.RWMutex
+	protocols    = map[string]func(w *NodeWrapper){
+		"chord": func(*NodeWrapper) {},
+	}
+)
+
+// RegisterProtocol makes a routing protocol available to NewProtocolNode.
+// setup is called on a freshly initialized node before it runs.
+func RegisterProtocol(name string, setup func(w *NodeWrapper)) {
+	protocolLock.Lock()
+	protocols[name] = setup
+	protocolLock.Unlock()
+}
+
+func NewProtocolNode(protocol string, addr string) (*NodeWrapper, error) {
+	protocolLock.RLock()
+	setup, ok := protocols[protocol]
+	protocolLock.RUnlock()
+	if !ok {
+		return nil, errors.New("unknown protocol " + protocol)
+	}
+	w := new(NodeWrapper)
+	w.Initialize(addr)
+	setup(w)
+	return w, nil
+}
+
+func (w *NodeWrapper) SetRouter(r Router) {
+	w.node.router = r
+}
+
+// RegisterService publishes rcvr's methods on the node's RPC server under
+// name, next to the ChordNode service. It must be called before Run.
+func (w *NodeWrapper) RegisterService(name string, rcvr interface{}) {
+	w.node.services = append(w.node.services, service{name: name, rcvr: rcvr})
+}
+
+func (w *NodeWrapper) Addr() string {
+	return w.node.addr
+}
+
+func (w *NodeWrapper) Successor() (string, error) {
+	var suc string
+	err := w.node.FirstAvailableSuccessor(NULL, &suc)
+	return suc, err
+}
+
+func (w *NodeWrapper) SuccessorList() [SuccessorListLen]string {
+	var list [SuccessorListLen]string
+	_ = w.node.GetSuccessorList(NULL, &list)
+	return list
+}
+
+func (w *NodeWrapper) PredecessorList() [PredecessorListLen]string {
+	var list [PredecessorListLen]string
+	_ = w.node.GetPredecessorList(NULL, &list)
+	return list
+}
+
+func (w *NodeWrapper) Call(addr string, serviceMethod string, args interface{}, reply interface{}) error {
+	return w.node.call(addr, serviceMethod, args, reply)
+}
@@ -0,0 +1,329 @@
+package chord
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBusy: The node's server had no room for the request's class within the
+// wait allowed.
+var ErrBusy = errors.New("server busy")
+
+// RPCClass is the priority a node's server gives a request, highest first.
+type RPCClass int
+
+const (
+	RPCClassClient RPCClass = iota
+	RPCClassRouting
+	RPCClassMaintenance
+	RPCClassBulk
+	rpcClassCount
+)
+
+func (c RPCClass) String() string {
+	switch c {
+	case RPCClassClient:
+		return "client"
+	case RPCClassRouting:
+		return "routing"
+	case RPCClassMaintenance:
+		return "maintenance"
+	case RPCClassBulk:
+		return "bulk"
+	}
+	return "unknown"
+}
+
+// rpcClasses puts the ChordNode methods in a class other than maintenance.
+// The writes a put copies to its successor are client requests, since the
+// put waits on them.
+var rpcClasses = map[string]RPCClass{
+	"GetInStore":             RPCClassClient,
+	"GetVersionedInStore":    RPCClassClient,
+	"GetManyInStore":         RPCClassClient,
+	"GetInReplica":           RPCClassClient,
+	"GetRawInReplica":        RPCClassBulk,
+	"GetAndWatch":            RPCClassClient,
+	"StatInStore":            RPCClassClient,
+	"PutInStore":             RPCClassClient,
+	"PutIfAbsentInStore":     RPCClassClient,
+	"PutManyInStore":         RPCClassClient,
+	"PutContentInStore":      RPCClassClient,
+	"PutAcceptedInStore":     RPCClassClient,
+	"UpdateCRDTInStore":      RPCClassClient,
+	"LeasedWriteInStore":     RPCClassClient,
+	"DeleteInStore":          RPCClassClient,
+	"DeleteIfInStore":        RPCClassClient,
+	"DeletePrefixInStore":    RPCClassClient,
+	"AcquireKeyLeaseInStore": RPCClassClient,
+	"ReleaseKeyLeaseInStore": RPCClassClient,
+	"PutInPreBackup":         RPCClassClient,
+	"DeleteInPreBackup":      RPCClassClient,
+	"GetShard":               RPCClassClient,
+	"PutShard":               RPCClassClient,
+	"DeleteShard":            RPCClassClient,
+	"MoveShardInStore":       RPCClassClient,
+	"DescribePlacement":      RPCClassClient,
+	"LeafPut":                RPCClassClient,
+	"LeafPutIfAbsent":        RPCClassClient,
+	"LeafGet":                RPCClassClient,
+	"LeafGetMulti":           RPCClassClient,
+	"LeafGetVersioned":       RPCClassClient,
+	"LeafGetWatched":         RPCClassClient,
+	"LeafStat":               RPCClassClient,
+	"LeafDelete":             RPCClassClient,
+	"LeafDeleteIf":           RPCClassClient,
+	"LeafDeletePrefix":       RPCClassClient,
+	"LeafWhereWouldItGo":     RPCClassClient,
+	"KeyFilter":              RPCClassClient,
+
+	"FindSuccessor":            RPCClassRouting,
+	"FindSuccessorPath":        RPCClassRouting,
+	"ForwardFindSuccessor":     RPCClassRouting,
+	"ForwardFindSuccessorPath": RPCClassRouting,
+	"FirstAvailableSuccessor":  RPCClassRouting,
+
+	"TransferData":            RPCClassBulk,
+	"TransferDelta":           RPCClassBulk,
+	"NextTransferChunk":       RPCClassBulk,
+	"BulkPutInStore":          RPCClassBulk,
+	"BulkPutAcceptedInStore":  RPCClassBulk,
+	"LeafBulkLoad":            RPCClassBulk,
+	"FinishBulkLoad":          RPCClassBulk,
+	"AppendPreBackup":         RPCClassBulk,
+	"TrimPreBackup":           RPCClassBulk,
+	"EraseRedundantPreBackup": RPCClassBulk,
+	"DeleteManyInPreBackup":   RPCClassBulk,
+	"CompareBackup":           RPCClassBulk,
+	"MissingInStore":          RPCClassBulk,
+	"OpenSnapshot":            RPCClassBulk,
+	"NextSnapshotChunk":       RPCClassBulk,
+	"CloseSnapshot":           RPCClassBulk,
+	"MigrateRange":            RPCClassBulk,
+	"AdoptRange":              RPCClassBulk,
+	"AbandonRange":            RPCClassBulk,
+}
+
+// RPCClassOptions cap the requests a node's server runs at once: Limits for
+// each class, and Total for all of them together, zero for no cap. A slot
+// freed goes to the highest class waiting with room under its own cap. A
+// request waiting longer than MaxWait, zero meaning rpcClassWaitTime, is
+// refused with ErrBusy, which a lookup retries; a cap on client or routing
+// requests, which nodes forward to each other, should leave room for the
+// requests forwarded on.
+type RPCClassOptions struct {
+	Limits  map[RPCClass]int
+	Total   int
+	MaxWait time.Duration
+}
+
+type RPCClassStatus struct {
+	Class    string
+	Limit    int
+	Running  int
+	Waiting  int
+	Admitted uint64
+	Refused  uint64
+	// AvgWait is the mean time the admitted requests of the class waited.
+	AvgWait time.Duration
+}
+
+type rpcWaiter struct {
+	class   RPCClass
+	ready   chan struct{}
+	granted bool
+}
+
+type rpcScheduler struct {
+	lock      sync.Mutex
+	options   RPCClassOptions
+	overrides map[string]RPCClass
+	running   [rpcClassCount]int
+	total     int
+	queues    [rpcClassCount][]*rpcWaiter
+	admitted  [rpcClassCount]uint64
+	refused   [rpcClassCount]uint64
+	waited    [rpcClassCount]time.Duration
+}
+
+// class is the class of serviceMethod: a method classified with ClassifyRPC,
+// one of rpcClasses, or maintenance.
+func (s *rpcScheduler) class(serviceMethod string) RPCClass {
+	s.lock.Lock()
+	c, ok := s.overrides[serviceMethod]
+	s.lock.Unlock()
+	if ok {
+		return c
+	}
+	if name := strings.TrimPrefix(serviceMethod, "ChordNode."); name != serviceMethod {
+		if c, ok := rpcClasses[name]; ok {
+			return c
+		}
+	}
+	return RPCClassMaintenance
+}
+
+func (s *rpcScheduler) roomLocked(c RPCClass) bool {
+	limit := s.options.Limits[c]
+	return (limit <= 0 || s.running[c] < limit) && (s.options.Total <= 0 || s.total < s.options.Total)
+}
+
+// aheadLocked tells whether a request waits that a slot should go to before
+// one of class c: one of c itself, or with a total cap, of a higher class.
+func (s *rpcScheduler) aheadLocked(c RPCClass) bool {
+	if len(s.queues[c]) > 0 {
+		return true
+	}
+	if s.options.Total <= 0 {
+		return false
+	}
+	for h := RPCClass(0); h < c; h++ {
+		if len(s.queues[h]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *rpcScheduler) startLocked(c RPCClass) {
+	s.running[c]++
+	s.total++
+	s.admitted[c]++
+}
+
+func (s *rpcScheduler) maxWait() time.Duration {
+	if s.options.MaxWait > 0 {
+		return s.options.MaxWait
+	}
+	return rpcClassWaitTime
+}
+
+// acquire takes a slot for a request of class c, waiting for one if the
+// class or the server is full.
+func (s *rpcScheduler) acquire(c RPCClass) error {
+	s.lock.Lock()
+	if s.roomLocked(c) && !s.aheadLocked(c) {
+		s.startLocked(c)
+		s.lock.Unlock()
+		return nil
+	}
+	w := &rpcWaiter{class: c, ready: make(chan struct{})}
+	s.queues[c] = append(s.queues[c], w)
+	wait := s.maxWait()
+	s.lock.Unlock()
+	begin := time.Now()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+	case <-timer.C:
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if w.granted {
+		s.waited[c] += time.Since(begin)
+		return nil
+	}
+	q := s.queues[c]
+	for i := range q {
+		if q[i] == w {
+			s.queues[c] = append(q[:i:i], q[i+1:]...)
+			break
+		}
+	}
+	s.refused[c]++
+	return ErrBusy
+}
+
+func (s *rpcScheduler) release(c RPCClass) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.running[c]--
+	s.total--
+	s.dispatchLocked()
+}
+
+// dispatchLocked hands the free slots to the waiting requests, highest class
+// first.
+func (s *rpcScheduler) dispatchLocked() {
+	for c := RPCClass(0); c < rpcClassCount; c++ {
+		for len(s.queues[c]) > 0 && s.roomLocked(c) {
+			w := s.queues[c][0]
+			s.queues[c] = s.queues[c][1:]
+			s.startLocked(c)
+			w.granted = true
+			close(w.ready)
+		}
+	}
+}
+
+func (s *rpcScheduler) status() []RPCClassStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := make([]RPCClassStatus, 0, rpcClassCount)
+	for c := RPCClass(0); c < rpcClassCount; c++ {
+		st := RPCClassStatus{
+			Class:    c.String(),
+			Limit:    s.options.Limits[c],
+			Running:  s.running[c],
+			Waiting:  len(s.queues[c]),
+			Admitted: s.admitted[c],
+			Refused:  s.refused[c],
+		}
+		if s.admitted[c] > 0 {
+			st.AvgWait = s.waited[c] / time.Duration(s.admitted[c])
+		}
+		ret = append(ret, st)
+	}
+	return ret
+}
+
+func (n *ChordNode) setRPCClasses(options RPCClassOptions) bool {
+	if options.Total < 0 || options.MaxWait < 0 {
+		n.log().Errorf("Invalid rpc class options [%+v].", options)
+		return false
+	}
+	limits := make(map[RPCClass]int, len(options.Limits))
+	for c, limit := range options.Limits {
+		if c < 0 || c >= rpcClassCount || limit < 0 {
+			n.log().Errorf("Invalid rpc class options [%+v].", options)
+			return false
+		}
+		limits[c] = limit
+	}
+	options.Limits = limits
+	s := &n.rpcSched
+	s.lock.Lock()
+	s.options = options
+	// Requests held back by the old caps may fit the new ones.
+	s.dispatchLocked()
+	s.lock.Unlock()
+	return true
+}
+
+func (n *ChordNode) serveRPCClasses(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.rpcSched.status())
+}
+
+func (w *NodeWrapper) SetRPCClasses(options RPCClassOptions) bool {
+	return w.node.setRPCClasses(options)
+}
+
+func (w *NodeWrapper) RPCClassStatus() []RPCClassStatus {
+	return w.node.rpcSched.status()
+}
+
+// ClassifyRPC puts serviceMethod, such as a method of a service added with
+// RegisterService, in class.
+func (w *NodeWrapper) ClassifyRPC(serviceMethod string, class RPCClass) {
+	s := &w.node.rpcSched
+	s.lock.Lock()
+	if s.overrides == nil {
+		s.overrides = make(map[string]RPCClass)
+	}
+	s.overrides[serviceMethod] = class
+	s.lock.Unlock()
+}
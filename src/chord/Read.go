@@ -0,0 +1,90 @@
+package chord
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound: The node responsible for the key answered that it holds no
+	// such key.
+	ErrNotFound = errors.New("not found")
+	// ErrUnavailable: The peers an operation needed could not be reached. For
+	// a key, neither its owner nor the replica after it answered, so whether
+	// the key exists is unknown.
+	ErrUnavailable = errors.New("unavailable")
+
+	errContentMismatch = errors.New("value does not match its content address")
+)
+
+// getFromReplica reads key from the node after owner, which holds the copy
+// of owner's store until it notices owner is gone and merges it in.
+func (n *ChordNode) getFromReplica(t *opTimer, key, owner string) (string, error) {
+	var val string
+	replica, err := n.nodeAfter(owner)
+	if err != nil || replica == owner || replica == NULL {
+		return NULL, ErrUnavailable
+	}
+	n.storageLog().Infof("Owner [%v] of key [%v] is unreachable, reading replica [%v].", owner, key, replica)
+	begin := time.Now()
+	err = n.call(replica, "ChordNode.GetInReplica", key, &val)
+	t.phase("GetInReplica", replica, begin)
+	if err != nil {
+		n.logErrorFunctionCall(replica, "ChordNode.getFromReplica", "ChordNode.GetInReplica", err)
+		return NULL, classifyError(err)
+	}
+	return val, nil
+}
+
+// nodeAfter finds the node that follows addr. A lookup past addr is
+// answered by addr itself while it is still this node's successor, so the
+// successor list is tried first, and a node that has not yet noticed addr
+// is gone may forward to it, so the lookup is retried.
+func (n *ChordNode) nodeAfter(addr string) (string, error) {
+	n.sucLock.RLock()
+	list := n.successorList
+	n.sucLock.RUnlock()
+	for i := 0; i+1 < len(list); i++ {
+		if list[i] == addr {
+			return list[i+1], nil
+		}
+	}
+	var ret string
+	err := n.FindSuccessor(start(NodeId(addr), 0), &ret)
+	for i := 1; err != nil && i < attempt; i++ {
+		time.Sleep(time.Duration(i) * lookupRetryPauseTime)
+		err = n.FindSuccessor(start(NodeId(addr), 0), &ret)
+	}
+	return ret, err
+}
+
+// GetInReplica answers for a predecessor that could not be reached, from the
+// store if the backup has already been merged and from the pre backup
+// otherwise.
+func (n *ChordNode) GetInReplica(key string, val *string) error {
+	if err := n.GetRawInReplica(key, val); err != nil {
+		return err
+	}
+	var err error
+	*val, err = n.readValue(key, *val)
+	return err
+}
+
+// GetRawInReplica is GetInReplica for nodes copying or merging the value,
+// which they need as stored, before the read hooks.
+func (n *ChordNode) GetRawInReplica(key string, val *string) error {
+	var ok bool
+	n.storeLock.RLock()
+	*val, ok = n.store.Get(key)
+	n.storeLock.RUnlock()
+	if !ok {
+		n.preBackupLock.RLock()
+		*val, ok = n.preBackup.Get(key)
+		n.preBackupLock.RUnlock()
+	}
+	if !ok {
+		*val = NULL
+		return ErrNotFound
+	}
+	return nil
+}
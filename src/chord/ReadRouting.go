@@ -0,0 +1,106 @@
+package chord
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ReadPrimary: Gets read the key's owner.
+	ReadPrimary = iota
+	// ReadNearest: Gets read whichever of the owner and the replica after it
+	// has answered this node faster, falling back to the owner if the replica
+	// does not have the key. Writes still go to the owner.
+	ReadNearest
+)
+
+type replicaEntry struct {
+	addr string
+	at   time.Time
+}
+
+// readRouter remembers which node holds the replica of each owner read from,
+// so that picking the nearer of the two costs no lookup on the read path.
+type readRouter struct {
+	mode     int32
+	lock     sync.Mutex
+	replicas map[string]replicaEntry
+	probes   repairTable
+}
+
+func (r *readRouter) replicaOf(owner string) (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	e, ok := r.replicas[owner]
+	if !ok || time.Since(e.at) > replicaCacheTime {
+		return NULL, false
+	}
+	return e.addr, true
+}
+
+// learnReplica finds the replica of owner off the read path and measures
+// it once, so the next read of owner's keys has both to choose from.
+func (n *ChordNode) learnReplica(owner string) {
+	r := &n.readRouter
+	if !r.probes.begin(owner) {
+		return
+	}
+	go func() {
+		defer r.probes.end(owner)
+		replica, err := n.nodeAfter(owner)
+		if err != nil || replica == NULL || replica == owner {
+			return
+		}
+		var pre string
+		if n.call(replica, "ChordNode.GetPredecessor", NULL, &pre) != nil {
+			return
+		}
+		r.lock.Lock()
+		if r.replicas == nil {
+			r.replicas = make(map[string]replicaEntry)
+		}
+		r.replicas[owner] = replicaEntry{addr: replica, at: time.Now()}
+		r.lock.Unlock()
+	}()
+}
+
+// readNearest reads key from the nearer of its owner and the owner's
+// replica. It returns the owner.
+func (n *ChordNode) readNearest(t *opTimer, key string, val *string) (string, error) {
+	owner, err := n.lookup(t, key)
+	if err != nil {
+		return owner, err
+	}
+	replica, known := n.readRouter.replicaOf(owner)
+	if !known {
+		n.learnReplica(owner)
+	}
+	if known && n.rtt.faster(replica, owner) {
+		begin := time.Now()
+		err = n.call(replica, "ChordNode.GetInReplica", key, val)
+		t.phase("GetInReplica", replica, begin)
+		if err == nil {
+			return owner, nil
+		}
+		// The replica may lag behind the owner, or have moved on.
+	}
+	begin := time.Now()
+	err = n.call(owner, "ChordNode.GetInStore", key, val)
+	t.phase("GetInStore", owner, begin)
+	if isTransportError(err) {
+		t.retries++
+		return n.ownerCall(t, key, "GetInStore", key, val)
+	}
+	return owner, err
+}
+
+// SetReadRouting picks where gets read from, ReadPrimary by default.
+func (w *NodeWrapper) SetReadRouting(mode int) bool {
+	if mode != ReadPrimary && mode != ReadNearest {
+		w.node.log().Errorf("Invalid read routing [%v].", mode)
+		return false
+	}
+	atomic.StoreInt32(&w.node.readRouter.mode, int32(mode))
+	return true
+}
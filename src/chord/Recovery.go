@@ -0,0 +1,133 @@
+package chord
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// RecoveryReport is how long a local ring took to recover from one force
+// quit: until a walk of the ring closed cleanly without the victim, and until
+// every key written before was readable again. A zero duration means it did
+// not happen within recoveryMaxWait.
+type RecoveryReport struct {
+	Nodes        int
+	Keys         int
+	Victim       string
+	RingRepaired time.Duration
+	KeysReadable time.Duration
+	Unreadable   int
+}
+
+// Within tells whether both the ring and the keys recovered within bound.
+func (r RecoveryReport) Within(bound time.Duration) bool {
+	return r.RingRepaired > 0 && r.RingRepaired <= bound && r.KeysReadable > 0 && r.KeysReadable <= bound
+}
+
+// FailoverCheck is what CheckSuccessorFailover found. Rounds counts this
+// node's stabilize rounds from the failure until every key read back, or
+// until the check gave up.
+type FailoverCheck struct {
+	Successor  string
+	Keys       int
+	Rounds     uint64
+	Unreadable []string
+	Violations []string
+}
+
+// CheckFailover starts a ring of nodes of the given protocol listening from
+// basePort up, writes keys, lets it settle and has the first node check the
+// failover of its successor, as CheckSuccessorFailover. All nodes are stopped
+// before it returns.
+func CheckFailover(protocol string, basePort int, nodes int, keys int, maxRounds int) (FailoverCheck, error) {
+	var ring []*NodeWrapper
+	defer func() {
+		for _, w := range ring {
+			if w.node.isOnline() {
+				w.ForceQuit()
+			}
+		}
+	}()
+	for i := 0; i < nodes; i++ {
+		w, err := NewProtocolNode(protocol, "127.0.0.1:"+strconv.Itoa(basePort+i))
+		if err != nil {
+			return FailoverCheck{}, err
+		}
+		w.Run()
+		if i == 0 {
+			w.Create()
+		} else if !w.Join(ring[0].Addr()) {
+			w.ForceQuit()
+			continue
+		}
+		ring = append(ring, w)
+	}
+	awaitRing(ring)
+	for i := 0; i < keys; i++ {
+		ring[i%len(ring)].Put("failover-"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	awaitRing(ring)
+	return ring[0].CheckSuccessorFailover(maxRounds)
+}
+
+// MeasureRecovery starts a ring of nodes of the given protocol listening
+// from basePort up, writes keys, lets it settle, force quits a node picked
+// from seed and times the recovery. All nodes are stopped before it returns.
+func MeasureRecovery(seed int64, protocol string, basePort int, nodes int, keys int) (RecoveryReport, error) {
+	r := rand.New(rand.NewSource(seed))
+	ret := RecoveryReport{Nodes: nodes, Keys: keys}
+	var ring []*NodeWrapper
+	defer func() {
+		for _, w := range ring {
+			if w.node.isOnline() {
+				w.ForceQuit()
+			}
+		}
+	}()
+	for i := 0; i < nodes; i++ {
+		w, err := NewProtocolNode(protocol, "127.0.0.1:"+strconv.Itoa(basePort+i))
+		if err != nil {
+			return ret, err
+		}
+		w.Run()
+		if i == 0 {
+			w.Create()
+		} else if !w.Join(ring[0].Addr()) {
+			w.ForceQuit()
+			continue
+		}
+		ring = append(ring, w)
+	}
+	awaitRing(ring)
+	for i := 0; i < keys; i++ {
+		ring[i%len(ring)].Put("recovery-"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	// Long enough for maintenance to slow to its idle pace.
+	time.Sleep(recoverySettleTime)
+	victim := 1 + r.Intn(len(ring)-1)
+	ret.Victim = ring[victim].Addr()
+	ring[victim].ForceQuit()
+	ring = append(ring[:victim], ring[victim+1:]...)
+	begin := time.Now()
+	for time.Since(begin) < recoveryMaxWait && (ret.RingRepaired == 0 || ret.KeysReadable == 0) {
+		if ret.RingRepaired == 0 {
+			walk := WalkRing(ring[0].Addr(), ring[0].node.codec)
+			if walk.Closed && len(walk.Problems) == 0 && len(walk.Nodes) == len(ring) {
+				ret.RingRepaired = time.Since(begin)
+			}
+		}
+		if ret.KeysReadable == 0 {
+			ret.Unreadable = 0
+			for i := 0; i < keys; i++ {
+				if ok, _ := ring[i%len(ring)].Get("recovery-" + strconv.Itoa(i)); !ok {
+					ret.Unreadable++
+				}
+			}
+			if ret.Unreadable == 0 {
+				ret.KeysReadable = time.Since(begin)
+			}
+		}
+		time.Sleep(recoveryPollTime)
+	}
+	return ret, nil
+}
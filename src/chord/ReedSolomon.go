@@ -0,0 +1,149 @@
+package chord
+
+import "errors"
+
+// Arithmetic over GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1.
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// reedSolomon is a systematic code: the first data shards are the value
+// itself and the parity rows form a Cauchy matrix, so any data rows of the
+// encoding matrix are invertible and any data shards rebuild the value.
+type reedSolomon struct {
+	data   int
+	parity int
+}
+
+func (rs reedSolomon) row(r int) []byte {
+	ret := make([]byte, rs.data)
+	if r < rs.data {
+		ret[r] = 1
+		return ret
+	}
+	for j := range ret {
+		ret[j] = gfInv(byte(r) ^ byte(j))
+	}
+	return ret
+}
+
+func (rs reedSolomon) encode(val []byte) [][]byte {
+	size := (len(val) + rs.data - 1) / rs.data
+	if size == 0 {
+		size = 1
+	}
+	padded := make([]byte, size*rs.data)
+	copy(padded, val)
+	shards := make([][]byte, rs.data+rs.parity)
+	for i := 0; i < rs.data; i++ {
+		shards[i] = padded[i*size : (i+1)*size]
+	}
+	for i := rs.data; i < len(shards); i++ {
+		shards[i] = make([]byte, size)
+		coef := rs.row(i)
+		for j := 0; j < rs.data; j++ {
+			for b := 0; b < size; b++ {
+				shards[i][b] ^= gfMul(coef[j], shards[j][b])
+			}
+		}
+	}
+	return shards
+}
+
+// decode rebuilds the data shards from exactly rs.data shards whose rows in
+// the encoding matrix are given by index.
+func (rs reedSolomon) decode(index []int, shards [][]byte, size int) ([]byte, error) {
+	if len(index) != rs.data || len(shards) != rs.data {
+		return nil, errors.New("wrong number of shards")
+	}
+	mat := make([][]byte, rs.data)
+	for i, r := range index {
+		mat[i] = rs.row(r)
+	}
+	inv, err := gfInvert(mat)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, rs.data*len(shards[0]))
+	for j := 0; j < rs.data; j++ {
+		out := ret[j*len(shards[0]) : (j+1)*len(shards[0])]
+		for l := 0; l < rs.data; l++ {
+			c := inv[j][l]
+			for b := range out {
+				out[b] ^= gfMul(c, shards[l][b])
+			}
+		}
+	}
+	if size > len(ret) {
+		return nil, errors.New("shards are shorter than the value")
+	}
+	return ret[:size], nil
+}
+
+func gfInvert(mat [][]byte) ([][]byte, error) {
+	k := len(mat)
+	work := make([][]byte, k)
+	for i := range mat {
+		work[i] = make([]byte, 2*k)
+		copy(work[i], mat[i])
+		work[i][k+i] = 1
+	}
+	for col := 0; col < k; col++ {
+		pivot := -1
+		for r := col; r < k; r++ {
+			if work[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, errors.New("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		scale := gfInv(work[col][col])
+		for c := range work[col] {
+			work[col][c] = gfMul(work[col][c], scale)
+		}
+		for r := 0; r < k; r++ {
+			if r == col || work[r][col] == 0 {
+				continue
+			}
+			f := work[r][col]
+			for c := range work[r] {
+				work[r][c] ^= gfMul(f, work[col][c])
+			}
+		}
+	}
+	ret := make([][]byte, k)
+	for i := range work {
+		ret[i] = work[i][k:]
+	}
+	return ret, nil
+}
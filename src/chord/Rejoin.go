@@ -0,0 +1,101 @@
+package chord
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
+)
+
+// RejoinReport is what cycling node objects of a local ring through quits
+// and joins again did. Goroutines is the number running after each cycle,
+// which stays level unless a lifecycle leaves something behind.
+type RejoinReport struct {
+	Nodes      int
+	Keys       int
+	Cycles     int
+	Goroutines []int
+	Problems   []string
+}
+
+func (r *RejoinReport) problem(cycle int, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf("cycle %v: ", cycle)+fmt.Sprintf(format, args...))
+}
+
+// CycleRejoin starts a ring of nodes of the given protocol listening from
+// basePort up, writes keys and then, cycles times, quits or force quits a
+// node picked from seed and joins the same node object again, checking that
+// its maintenance stopped and started over, that the ring closes with it
+// and that every key reads back. All nodes are stopped before it returns.
+func CycleRejoin(seed int64, protocol string, basePort int, nodes int, keys int, cycles int) (RejoinReport, error) {
+	r := rand.New(rand.NewSource(seed))
+	ret := RejoinReport{Nodes: nodes, Keys: keys, Cycles: cycles}
+	var ring []*NodeWrapper
+	defer func() {
+		for _, w := range ring {
+			if w.node.isOnline() {
+				w.ForceQuit()
+			}
+		}
+	}()
+	for i := 0; i < nodes; i++ {
+		w, err := NewProtocolNode(protocol, "127.0.0.1:"+strconv.Itoa(basePort+i))
+		if err != nil {
+			return ret, err
+		}
+		w.Run()
+		if i == 0 {
+			w.Create()
+		} else if !w.Join(ring[0].Addr()) {
+			w.ForceQuit()
+			return ret, fmt.Errorf("node [%v] cannot join", w.Addr())
+		}
+		ring = append(ring, w)
+	}
+	awaitRing(ring)
+	for i := 0; i < keys; i++ {
+		ring[i%len(ring)].Put("rejoin-"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	for c := 0; c < cycles; c++ {
+		w := ring[1+r.Intn(len(ring)-1)]
+		if r.Intn(2) == 0 {
+			w.Quit()
+		} else {
+			w.ForceQuit()
+		}
+		if s := w.State(); s != StateOffline {
+			ret.problem(c, "[%v] is %v after quitting", w.Addr(), s)
+		}
+		if names := w.Workers(); len(names) > 0 {
+			ret.problem(c, "[%v] still runs %v after quitting", w.Addr(), names)
+		}
+		awaitRing(ring)
+		if !w.Join(ring[0].Addr()) {
+			ret.problem(c, "[%v] cannot join again", w.Addr())
+			continue
+		}
+		if len(w.Workers()) == 0 {
+			ret.problem(c, "[%v] joined without maintenance", w.Addr())
+		}
+		awaitRing(ring)
+		walk := WalkRing(ring[0].Addr(), ring[0].node.codec)
+		if !walk.Closed || len(walk.Nodes) != len(ring) {
+			ret.problem(c, "the ring walk found %v of %v nodes, closed %v", len(walk.Nodes), len(ring), walk.Closed)
+		}
+		unreadable := 0
+		for i := 0; i < keys; i++ {
+			if ok, v := w.Get("rejoin-" + strconv.Itoa(i)); !ok || v != strconv.Itoa(i) {
+				unreadable++
+			}
+		}
+		if unreadable > 0 {
+			ret.problem(c, "%v keys unreadable through [%v]", unreadable, w.Addr())
+		}
+		runtime.GC()
+		ret.Goroutines = append(ret.Goroutines, runtime.NumGoroutine())
+	}
+	if g := ret.Goroutines; len(g) > 1 && g[len(g)-1]-g[0] > rejoinGoroutineSlack {
+		ret.problem(cycles-1, "goroutines grew from %v to %v", g[0], g[len(g)-1])
+	}
+	return ret, nil
+}
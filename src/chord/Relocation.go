@@ -0,0 +1,211 @@
+package chord
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A node that moves to a new host keeps its identity: it listens on the new
+// address and publishes it as host:port#identity, where identity is the
+// address it first joined at. Identifiers hash the identity, so the node
+// comes back at the same place on the ring, in charge of the same keys.
+
+const identitySeparator = "#"
+
+var (
+	// ErrIdentityMismatch: A relocation was asked of a node whose address
+	// does not carry the identity of the address it moves from.
+	ErrIdentityMismatch = errors.New("address does not carry the old address's identity")
+	// ErrStillRunning: A relocation was asked while a node still answers
+	// at the old address.
+	ErrStillRunning = errors.New("a node still answers at the old address")
+)
+
+// Relocated is the address of a node with identity listening on addr.
+func Relocated(addr, identity string) string {
+	if identity == NULL || identity == addr {
+		return addr
+	}
+	return addr + identitySeparator + identity
+}
+
+// Identity is the name the identifier of the node at addr hashes.
+func Identity(addr string) string {
+	if i := strings.Index(addr, identitySeparator); i >= 0 {
+		return addr[i+len(identitySeparator):]
+	}
+	return addr
+}
+
+// NetAddr is the address the node at addr listens on.
+func NetAddr(addr string) string {
+	if i := strings.Index(addr, identitySeparator); i >= 0 {
+		return addr[:i]
+	}
+	return addr
+}
+
+// LoadIdentity reads the identity kept at path, or keeps identity addr there
+// if there is none yet, so that a node started again from the same disk on
+// another host finds the identity it had.
+func LoadIdentity(path, addr string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return NULL, err
+	}
+	identity := Identity(addr)
+	return identity, ioutil.WriteFile(path, []byte(identity+"\n"), 0644)
+}
+
+type AddressChange struct {
+	Old string
+	New string
+}
+
+type relocationState struct {
+	lock sync.Mutex
+	// from is the old address of a relocation under way on this node.
+	from string
+	// seen holds the changes announced to this node, so each is passed on
+	// once.
+	seen map[string]string
+}
+
+func (r *relocationState) relocating() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.from != NULL
+}
+
+// replaceAddr puts addr in the place of old in the routing tables.
+func (n *ChordNode) replaceAddr(old, addr string) {
+	n.sucLock.Lock()
+	oldSuc := n.successorList[0]
+	for i := range n.successorList {
+		if n.successorList[i] == old {
+			n.successorList[i] = addr
+		}
+	}
+	suc := n.successorList[0]
+	n.sucLock.Unlock()
+	n.fireSuccessorChanged(oldSuc, suc)
+	n.preLock.Lock()
+	pre := n.predecessor
+	for i := range n.predecessorList {
+		if n.predecessorList[i] == old {
+			n.predecessorList[i] = addr
+		}
+	}
+	n.preLock.Unlock()
+	if pre == old {
+		_ = n.SetPredecessor(addr, nil)
+	}
+	n.fingerLock.Lock()
+	for i := range n.fingerTable {
+		if n.fingerTable[i] == old {
+			n.fingerTable[i] = addr
+		}
+	}
+	n.fingerLock.Unlock()
+	n.accordion.forget(old)
+	n.accordion.learn(addr)
+	n.rtt.forget(old)
+}
+
+// announceAddress passes c on to every node in the routing tables.
+func (n *ChordNode) announceAddress(c AddressChange) {
+	n.sucLock.RLock()
+	list := n.successorList
+	n.sucLock.RUnlock()
+	n.preLock.RLock()
+	pre, preList := n.predecessor, n.predecessorList
+	n.preLock.RUnlock()
+	n.fingerLock.RLock()
+	fingers := n.fingerTable
+	n.fingerLock.RUnlock()
+	peers := append(append(append([]string{pre}, list[:]...), preList[:]...), fingers[:]...)
+	seen := map[string]bool{NULL: true, n.addr: true, c.Old: true, c.New: true}
+	for _, addr := range peers {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		go func(addr string) {
+			if err := n.call(addr, "ChordNode.AnnounceAddress", c, nil); err != nil {
+				n.logErrorFunctionCall(n.addr, "ChordNode.announceAddress", "ChordNode.AnnounceAddress", err)
+			}
+		}(addr)
+	}
+}
+
+// AnnounceAddress takes note that the node at c.Old moved to c.New, and
+// tells the nodes this one knows, so the change goes round the ring instead
+// of the old address being found dead and the new one taken for a stranger.
+func (n *ChordNode) AnnounceAddress(c AddressChange, _ *struct{}) error {
+	if Identity(c.Old) != Identity(c.New) || c.Old == c.New {
+		return ErrIdentityMismatch
+	}
+	if !n.admits(c.New) {
+		return ErrNotAdmitted
+	}
+	r := &n.relocation
+	r.lock.Lock()
+	if r.seen == nil {
+		r.seen = make(map[string]string)
+	}
+	if r.seen[c.Old] == c.New {
+		r.lock.Unlock()
+		return nil
+	}
+	r.seen[c.Old] = c.New
+	r.lock.Unlock()
+	n.maintenanceLog().Infof("Node [%v] learns that [%v] moved to [%v].", n.addr, c.Old, c.New)
+	n.replaceAddr(c.Old, c.New)
+	n.announceAddress(c)
+	return nil
+}
+
+// relocate joins the ring addr is on in the place of the node that was at
+// old, keeping what the store has kept of its keys: only what changed
+// while it was away is transferred.
+func (n *ChordNode) relocate(assist, old string) error {
+	if n.router != nil {
+		n.maintenanceLog().Errorf("Trying to relocate a node of another routing protocol.")
+		return ErrIdentityMismatch
+	}
+	if old == n.addr || Identity(old) != Identity(n.addr) {
+		n.maintenanceLog().Errorf("Node [%v] cannot take the place of [%v].", n.addr, old)
+		return ErrIdentityMismatch
+	}
+	if n.ping(old) {
+		return ErrStillRunning
+	}
+	r := &n.relocation
+	r.lock.Lock()
+	r.from = old
+	r.lock.Unlock()
+	defer func() {
+		r.lock.Lock()
+		r.from = NULL
+		r.lock.Unlock()
+	}()
+	if _, err := n.joinRing(assist); err != nil {
+		return err
+	}
+	n.maintenanceLog().Infof("Node [%v] moved from [%v].", n.addr, old)
+	n.announceAddress(AddressChange{Old: old, New: n.addr})
+	return nil
+}
+
+// Relocate joins the ring assist is on as the node that was at old, which
+// must have stopped. The node's address carries old's identity, as
+// Relocated gives it, and its storage what it kept from old.
+func (w *NodeWrapper) Relocate(assist, old string) error {
+	return w.node.relocate(assist, old)
+}
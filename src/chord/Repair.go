@@ -0,0 +1,66 @@
+package chord
+
+import "sync"
+
+// repairTable keeps one reactive repair per peer in flight, however many
+// calls to it fail meanwhile.
+type repairTable struct {
+	lock     sync.Mutex
+	inFlight map[string]bool
+}
+
+func (r *repairTable) begin(addr string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.inFlight[addr] {
+		return false
+	}
+	if r.inFlight == nil {
+		r.inFlight = make(map[string]bool)
+	}
+	r.inFlight[addr] = true
+	return true
+}
+
+func (r *repairTable) end(addr string) {
+	r.lock.Lock()
+	delete(r.inFlight, addr)
+	r.lock.Unlock()
+}
+
+// repairAfterFailure runs when a call to addr could not reach it. If addr is
+// the predecessor or in the successor list, the round that would have
+// noticed on its next tick runs now: the predecessor check promotes the
+// backup, and stabilize drops the successor and refills the list.
+func (n *ChordNode) repairAfterFailure(addr string) {
+	if !n.isOnline() || addr == NULL || addr == n.addr {
+		return
+	}
+	var pre string
+	_ = n.GetPredecessor(NULL, &pre)
+	isPre := addr == pre
+	isSuc := false
+	n.sucLock.RLock()
+	for _, s := range n.successorList {
+		isSuc = isSuc || s == addr
+	}
+	n.sucLock.RUnlock()
+	if !isPre && !isSuc || !n.repairs.begin(addr) {
+		return
+	}
+	go func() {
+		defer n.repairs.end(addr)
+		if n.confirmedAlive(addr) {
+			return
+		}
+		n.maintenanceLog().Infof("Node [%v] repairs around unreachable [%v] without waiting for maintenance.", n.addr, addr)
+		n.publish(EventFailureDetected, addr, 0, "reactive")
+		if isPre {
+			n.checkPredecessor()
+		}
+		if isSuc {
+			n.stabilize()
+		}
+		n.pacer.churn()
+	}()
+}
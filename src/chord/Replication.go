@@ -0,0 +1,201 @@
+package chord
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+type ReplicationStats struct {
+	Successor          string
+	PendingBackups     int
+	OldestPending      time.Duration
+	LastSync           time.Time
+	FailedBackups      uint64
+	UnreplicatedWrites int
+	PreBackupKeys      int
+	PreBackupUpdated   time.Time
+	Seeding            string
+	SeedingFor         time.Duration
+	// PreBackupOwners counts the keys of the pre backup by owner; keys that
+	// have none are not counted.
+	PreBackupOwners map[string]int
+	// BackupDivergence is the number of keys the last audit found the
+	// successor's copy of this node's range to differ in, and
+	// DivergentBackupKeys the sum over all audits.
+	BackupDivergence    int
+	BackupAudited       time.Time
+	DivergentBackupKeys uint64
+	// ReclaimedBackupKeys counts the keys dropped from the pre backup
+	// because the predecessor no longer owned them.
+	ReclaimedBackupKeys uint64
+	// Queue holds the backup writes waiting for the successor.
+	Queue ReplicationQueueStatus
+}
+
+// replicationTracker measures the window in which a write on this node exists
+// only in its own store. Writes whose backup failed stay counted as
+// unreplicated until the whole store is pushed to the successor again.
+type replicationTracker struct {
+	lock             sync.Mutex
+	nextId           uint64
+	pending          map[uint64]time.Time
+	lastSync         time.Time
+	failed           uint64
+	unreplicated     int
+	preBackupUpdated time.Time
+	diverged         int
+	audited          time.Time
+	divergedTotal    uint64
+	reclaimed        uint64
+}
+
+func (r *replicationTracker) begin() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.pending == nil {
+		r.pending = make(map[uint64]time.Time)
+	}
+	r.nextId++
+	r.pending[r.nextId] = time.Now()
+	return r.nextId
+}
+
+func (r *replicationTracker) end(backupId uint64, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.pending, backupId)
+	if err != nil {
+		r.failed++
+		r.unreplicated++
+		return
+	}
+	r.lastSync = time.Now()
+}
+
+func (r *replicationTracker) fullSync() {
+	r.lock.Lock()
+	r.lastSync = time.Now()
+	r.unreplicated = 0
+	r.lock.Unlock()
+}
+
+// queued counts a write queued without being tried.
+func (r *replicationTracker) queued() {
+	r.lock.Lock()
+	r.unreplicated++
+	r.lock.Unlock()
+}
+
+// recovered counts writes the replication queue delivered.
+func (r *replicationTracker) recovered(writes int) {
+	r.lock.Lock()
+	r.lastSync = time.Now()
+	if r.unreplicated -= writes; r.unreplicated < 0 {
+		r.unreplicated = 0
+	}
+	r.lock.Unlock()
+}
+
+func (r *replicationTracker) backupReclaimed(keys int) {
+	r.lock.Lock()
+	r.reclaimed += uint64(keys)
+	r.preBackupUpdated = time.Now()
+	r.lock.Unlock()
+}
+
+func (r *replicationTracker) backupUpdated() {
+	r.lock.Lock()
+	r.preBackupUpdated = time.Now()
+	r.lock.Unlock()
+}
+
+func (r *replicationTracker) backupAudited(diverged int) {
+	r.lock.Lock()
+	r.diverged = diverged
+	r.audited = time.Now()
+	r.divergedTotal += uint64(diverged)
+	r.lock.Unlock()
+}
+
+func (n *ChordNode) replicationStats() ReplicationStats {
+	var suc string
+	_ = n.FirstAvailableSuccessor(NULL, &suc)
+	n.preBackupLock.RLock()
+	preBackupKeys := n.preBackup.Size()
+	preBackupOwners := n.backupOwners.counts()
+	n.preBackupLock.RUnlock()
+	seeding, seedingFor := n.seeding.inProgress()
+	queue := n.replQueue.status()
+	r := &n.replication
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ret := ReplicationStats{
+		Successor:          suc,
+		PendingBackups:     len(r.pending),
+		LastSync:           r.lastSync,
+		FailedBackups:      r.failed,
+		UnreplicatedWrites: r.unreplicated,
+		PreBackupKeys:      preBackupKeys,
+		PreBackupUpdated:   r.preBackupUpdated,
+		Seeding:            seeding,
+		SeedingFor:         seedingFor,
+		PreBackupOwners:    preBackupOwners,
+
+		BackupDivergence:    r.diverged,
+		BackupAudited:       r.audited,
+		DivergentBackupKeys: r.divergedTotal,
+		ReclaimedBackupKeys: r.reclaimed,
+		Queue:               queue,
+	}
+	for _, begin := range r.pending {
+		if d := time.Since(begin); d > ret.OldestPending {
+			ret.OldestPending = d
+		}
+	}
+	return ret
+}
+
+func (n *ChordNode) serveReplication(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.replicationStats())
+}
+
+func (n *ChordNode) serveSeeding(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		mode := -1
+		for m, name := range seedModes {
+			if name == r.URL.Query().Get("mode") {
+				mode = m
+			}
+		}
+		if mode < 0 {
+			http.Error(w, "mode must be async or sync", http.StatusBadRequest)
+			return
+		}
+		n.setSeedMode(mode)
+	}
+	writeJSON(w, n.seeding.status())
+}
+
+func (n *ChordNode) setSeedMode(mode int) {
+	n.seeding.lock.Lock()
+	n.seeding.mode = mode
+	n.seeding.lock.Unlock()
+	n.replicationLog().Infof("Node [%v] seeds its pre backup in %v mode.", n.addr, seedModes[mode])
+}
+
+// SetSeedMode chooses whether Notify waits for the pre backup to hold a copy
+// of the new predecessor's store, SeedSync, or seeds it in the background,
+// SeedAsync.
+func (w *NodeWrapper) SetSeedMode(mode int) bool {
+	if mode != SeedAsync && mode != SeedSync {
+		w.node.log().Errorf("Invalid seed mode [%v].", mode)
+		return false
+	}
+	w.node.setSeedMode(mode)
+	return true
+}
+
+func (w *NodeWrapper) SeedStatus() SeedStatus {
+	return w.node.seeding.status()
+}
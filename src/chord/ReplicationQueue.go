@@ -0,0 +1,354 @@
+package chord
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// OverflowDropOldest: a full queue drops its oldest write to take the new
+	// one.
+	OverflowDropOldest = iota
+	// OverflowDropNewest: a full queue drops the new write.
+	OverflowDropNewest
+	// OverflowBlock: the writer waits up to replicationQueueBlockTime for
+	// room, and the write is dropped if none frees up.
+	OverflowBlock
+)
+
+var overflowPolicies = []string{OverflowDropOldest: "drop-oldest", OverflowDropNewest: "drop-newest", OverflowBlock: "block"}
+
+// errBackupQueued: The backup write was queued for the successor rather than
+// made, so the write is acked by the primary only.
+var errBackupQueued = errors.New("backup write queued")
+
+// ReplicationQueueOptions bound the queue of backup writes waiting for the
+// successor. Zero capacity means replicationQueueLen.
+type ReplicationQueueOptions struct {
+	Capacity int
+	Policy   int
+}
+
+type ReplicationQueueStatus struct {
+	Successor string
+	Policy    string
+	Capacity  int
+	// Depth is the number of keys waiting, and Oldest how long the first of
+	// them has.
+	Depth  int
+	Oldest time.Duration
+	// Enqueued, Delivered and Dropped count writes, Retries the batches
+	// sent again after failing, and Blocked the writers that waited for
+	// room.
+	Enqueued  uint64
+	Delivered uint64
+	Dropped   uint64
+	Retries   uint64
+	Blocked   uint64
+	LastError string
+}
+
+type queuedWrite struct {
+	value  *string
+	seq    uint64
+	writes int
+	at     time.Time
+}
+
+// replicationQueue holds the backup writes the successor did not take, one
+// per key with the latest value, and sends them on in batches, backing off
+// while the successor keeps failing. Once anything is queued, later writes
+// queue behind it, so that a retried value never overtakes a newer one.
+type replicationQueue struct {
+	lock      sync.Mutex
+	options   ReplicationQueueOptions
+	order     []string
+	entries   map[string]*queuedWrite
+	seq       uint64
+	space     chan struct{}
+	successor string
+	backoff   time.Duration
+	next      time.Time
+	enqueued  uint64
+	delivered uint64
+	dropped   uint64
+	retries   uint64
+	blocked   uint64
+	err       error
+}
+
+func (q *replicationQueue) capacity() int {
+	if q.options.Capacity > 0 {
+		return q.options.Capacity
+	}
+	return replicationQueueLen
+}
+
+func (q *replicationQueue) busy() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.entries) > 0
+}
+
+// add queues a write of key, value nil for a delete, and tells whether it
+// was queued.
+func (q *replicationQueue) add(key string, value *string) bool {
+	deadline := time.Now().Add(replicationQueueBlockTime)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.entries == nil {
+		q.entries = make(map[string]*queuedWrite)
+	}
+	blocked := false
+	for {
+		if e, ok := q.entries[key]; ok {
+			q.seq++
+			e.value, e.seq = value, q.seq
+			e.writes++
+			q.enqueued++
+			return true
+		}
+		if len(q.order) < q.capacity() {
+			break
+		}
+		switch q.options.Policy {
+		case OverflowDropOldest:
+			q.dropLocked(q.order[0])
+			continue
+		case OverflowBlock:
+			if wait := time.Until(deadline); wait > 0 {
+				if !blocked {
+					blocked = true
+					q.blocked++
+				}
+				if q.space == nil {
+					q.space = make(chan struct{})
+				}
+				space := q.space
+				q.lock.Unlock()
+				select {
+				case <-space:
+				case <-time.After(wait):
+				}
+				q.lock.Lock()
+				continue
+			}
+		}
+		q.dropped++
+		return false
+	}
+	q.seq++
+	q.entries[key] = &queuedWrite{value: value, seq: q.seq, writes: 1, at: time.Now()}
+	q.order = append(q.order, key)
+	q.enqueued++
+	return true
+}
+
+func (q *replicationQueue) dropLocked(key string) {
+	q.dropped += uint64(q.entries[key].writes)
+	delete(q.entries, key)
+	for i, k := range q.order {
+		if k == key {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// head returns up to max of the oldest writes, and whether a batch is due.
+func (q *replicationQueue) head(max int) (map[string]queuedWrite, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.order) == 0 || time.Now().Before(q.next) {
+		return nil, false
+	}
+	ret := make(map[string]queuedWrite)
+	for _, k := range q.order {
+		if len(ret) == max {
+			break
+		}
+		ret[k] = *q.entries[k]
+	}
+	return ret, true
+}
+
+// done takes the writes of a batch the successor took out of the queue,
+// unless the key was written again meanwhile, and returns how many writes
+// they were.
+func (q *replicationQueue) done(suc string, batch map[string]queuedWrite) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	writes := 0
+	kept := q.order[:0]
+	for _, k := range q.order {
+		e := q.entries[k]
+		b, ok := batch[k]
+		if ok && b.seq == e.seq {
+			writes += e.writes
+			delete(q.entries, k)
+			continue
+		}
+		if ok {
+			e.writes -= b.writes
+			writes += b.writes
+		}
+		kept = append(kept, k)
+	}
+	q.order = kept
+	q.successor = suc
+	q.delivered += uint64(writes)
+	q.backoff = 0
+	q.next = time.Time{}
+	q.err = nil
+	if q.space != nil {
+		close(q.space)
+		q.space = nil
+	}
+	return writes
+}
+
+func (q *replicationQueue) failed(suc string, err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.successor = suc
+	q.retries++
+	q.err = err
+	if q.backoff == 0 {
+		q.backoff = replicationQueuePollTime
+	} else if q.backoff *= 2; q.backoff > replicationQueueMaxBackoff {
+		q.backoff = replicationQueueMaxBackoff
+	}
+	q.next = time.Now().Add(q.backoff)
+}
+
+func (q *replicationQueue) reset() {
+	q.lock.Lock()
+	for _, e := range q.entries {
+		q.dropped += uint64(e.writes)
+	}
+	q.order = nil
+	q.entries = nil
+	q.backoff = 0
+	q.next = time.Time{}
+	q.lock.Unlock()
+}
+
+func (q *replicationQueue) status() ReplicationQueueStatus {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	ret := ReplicationQueueStatus{
+		Successor: q.successor,
+		Policy:    overflowPolicies[q.options.Policy],
+		Capacity:  q.capacity(),
+		Depth:     len(q.order),
+		Enqueued:  q.enqueued,
+		Delivered: q.delivered,
+		Dropped:   q.dropped,
+		Retries:   q.retries,
+		Blocked:   q.blocked,
+	}
+	if len(q.order) > 0 {
+		ret.Oldest = time.Since(q.entries[q.order[0]].at)
+	}
+	if q.err != nil {
+		ret.LastError = q.err.Error()
+	}
+	return ret
+}
+
+// queueBackup queues a backup write for drainReplicationQueue to make.
+func (n *ChordNode) queueBackup(key string, value *string) {
+	if !n.replQueue.add(key, value) {
+		n.replicationLog().Errorf("Node [%v]'s replication queue is full, backup write of key [%v] dropped.", n.addr, key)
+	}
+}
+
+// drainReplicationQueue sends the successor the oldest batch of queued
+// writes, if one is due.
+func (n *ChordNode) drainReplicationQueue() {
+	batch, due := n.replQueue.head(replicationQueueBatch)
+	if !due {
+		return
+	}
+	var suc string
+	if err := n.FirstAvailableSuccessor(NULL, &suc); err != nil {
+		n.replQueue.failed(NULL, err)
+		return
+	}
+	if suc == n.addr {
+		// Alone on the ring, there is nobody to back up to.
+		n.replQueue.done(suc, batch)
+		return
+	}
+	puts := BackupBatch{Owner: n.addr, Data: make(map[string]string)}
+	var deletes []string
+	for k, e := range batch {
+		if e.value == nil {
+			deletes = append(deletes, k)
+		} else {
+			puts.Data[k] = *e.value
+		}
+	}
+	var err error
+	method := "ChordNode.AppendPreBackup"
+	if len(puts.Data) > 0 {
+		err = n.appendPreBackup(suc, &puts)
+	}
+	if err == nil && len(deletes) > 0 {
+		method = "ChordNode.DeleteManyInPreBackup"
+		err = n.call(suc, method, deletes, nil)
+	}
+	if err != nil {
+		n.logErrorFunctionCall(suc, "ChordNode.drainReplicationQueue", method, err)
+		n.replQueue.failed(suc, err)
+		return
+	}
+	n.replication.recovered(n.replQueue.done(suc, batch))
+}
+
+// serveReplicationQueue returns the queue's status, and with POST sets its
+// policy= and capacity= first.
+func (n *ChordNode) serveReplicationQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		options := ReplicationQueueOptions{Policy: -1}
+		for p, name := range overflowPolicies {
+			if name == r.URL.Query().Get("policy") {
+				options.Policy = p
+			}
+		}
+		if c := r.URL.Query().Get("capacity"); c != "" {
+			var err error
+			if options.Capacity, err = strconv.Atoi(c); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if !n.setReplicationQueue(options) {
+			http.Error(w, "policy must be drop-oldest, drop-newest or block, and capacity not negative", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, n.replQueue.status())
+}
+
+func (n *ChordNode) setReplicationQueue(options ReplicationQueueOptions) bool {
+	if options.Policy < 0 || options.Policy >= len(overflowPolicies) || options.Capacity < 0 {
+		n.log().Errorf("Invalid replication queue options [%+v].", options)
+		return false
+	}
+	n.replQueue.lock.Lock()
+	n.replQueue.options = options
+	n.replQueue.lock.Unlock()
+	return true
+}
+
+func (w *NodeWrapper) SetReplicationQueue(options ReplicationQueueOptions) bool {
+	return w.node.setReplicationQueue(options)
+}
+
+func (w *NodeWrapper) ReplicationQueueStatus() ReplicationQueueStatus {
+	return w.node.replQueue.status()
+}
@@ -0,0 +1,407 @@
+package chord
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// TopologyPredecessorJoined: Peer notified as a closer predecessor.
+	TopologyPredecessorJoined = iota
+	// TopologyPredecessorFailed: Peer, the predecessor, stopped answering.
+	TopologyPredecessorFailed
+	// TopologyPredecessorAdopted: Peer was taken from the predecessor list
+	// after the predecessor failed.
+	TopologyPredecessorAdopted
+	// TopologyKeysHandedOff: Keys moved from the store to Peer, a joining
+	// predecessor.
+	TopologyKeysHandedOff
+	// TopologyRangeMigrated: Keys moved from the store to Peer by an operator
+	// migration.
+	TopologyRangeMigrated
+)
+
+type TopologyChange struct {
+	Kind int
+	Peer string
+	Keys map[string]string
+}
+
+// Replicator decides where the copies of this node's keys live. The node calls
+// it after every local write and on every change of its range, and never from
+// routing, so a strategy can be swapped without touching lookups.
+type Replicator interface {
+	OnPut(kv Pair) error
+	OnDelete(key string) error
+	OnTopologyChange(change TopologyChange) error
+	// Repair re-sends whatever this node should have replicated.
+	Repair() error
+}
+
+// BatchReplicator is implemented by replicators that back up many keys in one
+// go. Bulk loads and adopted ranges fall back to OnPut per key otherwise.
+type BatchReplicator interface {
+	OnPutBatch(data map[string]string) error
+}
+
+// successorReplicator keeps one copy of the store in the successor's pre
+// backup, and holds the copy of the predecessor's store in its own.
+type successorReplicator struct {
+	n *ChordNode
+}
+
+func (r successorReplicator) successor(fromFunc string) (string, error) {
+	var suc string
+	err := r.n.FirstAvailableSuccessor(NULL, &suc)
+	if err != nil {
+		r.n.logErrorFunctionCall(r.n.addr, fromFunc, "ChordNode.FirstAvailableSuccessor", err)
+	}
+	return suc, err
+}
+
+// backUp sends a backup write to the successor, and queues the writes of
+// keys it fails for. While writes are queued, it queues the new ones behind
+// them instead of sending them.
+func (r successorReplicator) backUp(writes map[string]*string, send func() error) error {
+	n := r.n
+	if n.replQueue.busy() {
+		for k, v := range writes {
+			n.replication.queued()
+			n.queueBackup(k, v)
+		}
+		return errBackupQueued
+	}
+	backupId := n.replication.begin()
+	err := send()
+	n.replication.end(backupId, err)
+	if err != nil {
+		for k, v := range writes {
+			n.queueBackup(k, v)
+		}
+	}
+	return err
+}
+
+func (r successorReplicator) OnPut(kv Pair) error {
+	n := r.n
+	return r.backUp(map[string]*string{kv.First: &kv.Second}, func() error {
+		_, err := n.callSuccessor("ChordNode.PutInPreBackup", BackupPair{Owner: n.addr, Pair: kv}, nil)
+		if err != nil {
+			n.logErrorFunctionCall(n.addr, "successorReplicator.OnPut", "ChordNode.PutInPreBackup", err)
+		}
+		return err
+	})
+}
+
+func (r successorReplicator) OnPutBatch(data map[string]string) error {
+	n := r.n
+	n.replicationLog().Infof("Start backing up %v keys of node [%v].", len(data), n.addr)
+	writes := make(map[string]*string, len(data))
+	for k, v := range data {
+		v := v
+		writes[k] = &v
+	}
+	return r.backUp(writes, func() error {
+		for _, part := range n.msgLimit.chunks(data) {
+			_, err := n.callSuccessor("ChordNode.AppendPreBackup", &BackupBatch{Owner: n.addr, Data: part}, nil)
+			if err != nil {
+				n.logErrorFunctionCall(n.addr, "successorReplicator.OnPutBatch", "ChordNode.AppendPreBackup", err)
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r successorReplicator) OnDelete(key string) error {
+	n := r.n
+	return r.backUp(map[string]*string{key: nil}, func() error {
+		suc, err := n.callSuccessor("ChordNode.DeleteInPreBackup", key, nil)
+		if err != nil {
+			n.logErrorFunctionCall(suc, "successorReplicator.OnDelete", "ChordNode.DeleteInPreBackup", err)
+		}
+		return err
+	})
+}
+
+func (r successorReplicator) OnTopologyChange(change TopologyChange) error {
+	n := r.n
+	switch change.Kind {
+	case TopologyPredecessorJoined:
+		r.seed(change.Peer, func() { n.promoteBackup(NULL) })
+	case TopologyPredecessorFailed:
+		n.promoteBackup(change.Peer)
+	case TopologyPredecessorAdopted:
+		r.seed(change.Peer, nil)
+	case TopologyKeysHandedOff:
+		n.preBackupLock.Lock()
+		n.backupReset(change.Keys, change.Peer, "successorReplicator.OnTopologyChange")
+		n.preBackupLock.Unlock()
+		n.replication.backupUpdated()
+		n.replicationLog().Infof("Reset node [%v]'s pre backup to the keys handed to [%v].", n.addr, change.Peer)
+		r.trimHandedOff(change.Peer)
+	case TopologyRangeMigrated:
+		r.eraseRedundant(change)
+	}
+	return nil
+}
+
+// seed replaces the pre backup with a copy of the predecessor's store, after
+// running first. In SeedAsync mode it does so off the caller's goroutine: the
+// copy can be large, and the caller is often an RPC handler the
+// predecessor's stabilize is waiting on.
+func (r successorReplicator) seed(pre string, first func()) {
+	n := r.n
+	gen := n.seeding.start(pre)
+	run := func() {
+		n.seeding.serial.Lock()
+		defer n.seeding.serial.Unlock()
+		if !n.seeding.current(gen) {
+			return
+		}
+		if first != nil {
+			first()
+		}
+		t := n.startOp("transfer", NULL)
+		begin := time.Now()
+		backup := make(map[string]string)
+		err := n.streamStore(pre, func(chunk map[string]string) error {
+			for k, v := range chunk {
+				backup[k] = v
+			}
+			n.seeding.progress(gen, len(chunk))
+			return nil
+		})
+		t.phase("streamStore", pre, begin)
+		t.finish(err == nil)
+		if err != nil {
+			n.logErrorFunctionCall(n.addr, "successorReplicator.seed", "ChordNode.streamStore", err)
+			n.penalize(pre, OffenceFailedTransfer)
+		}
+		n.preBackupLock.Lock()
+		if n.seeding.current(gen) {
+			n.seeding.apply(backup)
+			n.backupReset(backup, pre, "successorReplicator.seed")
+		}
+		n.preBackupLock.Unlock()
+		n.replication.backupUpdated()
+		n.seeding.finish(gen, err)
+	}
+	if n.seeding.synchronous() {
+		run()
+		return
+	}
+	go run()
+}
+
+const (
+	// SeedAsync: Notify returns at once and the pre backup is seeded in the
+	// background, which the seed status follows.
+	SeedAsync = iota
+	// SeedSync: Notify returns once the pre backup holds the new
+	// predecessor's store, so a node that got through stabilize is backed up.
+	SeedSync
+)
+
+var seedModes = []string{SeedAsync: "async", SeedSync: "sync"}
+
+type SeedStatus struct {
+	Mode    string
+	Peer    string
+	Running bool
+	Began   time.Time
+	// Keys copied so far, or by the last seed when none is running.
+	Keys     int
+	Duration time.Duration
+	Error    string
+}
+
+// seedTracker follows the seed of the pre backup. Backup writes that arrive
+// while the predecessor's store is being fetched are noted, under the pre
+// backup lock, and laid over the fetched copy so the reset does not undo
+// them.
+type seedTracker struct {
+	serial   sync.Mutex
+	lock     sync.Mutex
+	mode     int
+	gen      uint64
+	peer     string
+	running  bool
+	began    time.Time
+	copied   int
+	duration time.Duration
+	err      error
+	changes  map[string]*string
+	seeded   map[string]bool
+}
+
+func (s *seedTracker) start(peer string) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.gen++
+	s.peer = peer
+	s.running = true
+	s.began = time.Now()
+	s.copied = 0
+	s.err = nil
+	s.changes = make(map[string]*string)
+	return s.gen
+}
+
+func (s *seedTracker) synchronous() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.mode == SeedSync
+}
+
+func (s *seedTracker) progress(gen uint64, keys int) {
+	s.lock.Lock()
+	if gen == s.gen {
+		s.copied += keys
+	}
+	s.lock.Unlock()
+}
+
+func (s *seedTracker) current(gen uint64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return gen == s.gen
+}
+
+func (s *seedTracker) finish(gen uint64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if gen != s.gen {
+		return
+	}
+	s.running = false
+	s.duration = time.Since(s.began)
+	s.err = err
+	s.changes = nil
+	if err == nil {
+		if s.seeded == nil {
+			s.seeded = make(map[string]bool)
+		}
+		s.seeded[s.peer] = true
+	}
+}
+
+// note records a pre backup write. The pre backup lock is held.
+func (s *seedTracker) note(key string, value *string) {
+	s.lock.Lock()
+	if s.running {
+		s.changes[key] = value
+	}
+	s.lock.Unlock()
+}
+
+// apply lays the noted writes over a fetched copy. The pre backup lock is
+// held.
+func (s *seedTracker) apply(backup map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, v := range s.changes {
+		if v == nil {
+			delete(backup, k)
+		} else {
+			backup[k] = *v
+		}
+	}
+}
+
+// report tells peer, once, that its store has been copied, or that the copy
+// is still under way.
+func (s *seedTracker) report(peer string) (seeded, seeding bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	seeded = s.seeded[peer]
+	delete(s.seeded, peer)
+	return seeded, s.running && s.peer == peer
+}
+
+func (s *seedTracker) status() SeedStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := SeedStatus{Mode: seedModes[s.mode], Peer: s.peer, Running: s.running, Began: s.began, Keys: s.copied, Duration: s.duration}
+	if s.running {
+		ret.Duration = time.Since(s.began)
+	}
+	if s.err != nil {
+		ret.Error = s.err.Error()
+	}
+	return ret
+}
+
+func (s *seedTracker) inProgress() (string, time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.running {
+		return NULL, 0
+	}
+	return s.peer, time.Since(s.began)
+}
+
+// trimHandedOff drops the range pre took over from the successor's pre
+// backup, unless the successor is pre.
+func (r successorReplicator) trimHandedOff(pre string) {
+	n := r.n
+	suc, err := r.successor("successorReplicator.trimHandedOff")
+	if err != nil || suc == pre || suc == n.addr {
+		return
+	}
+	n.replicationLog().Infof("Start trimming the range handed to [%v] from node [%v]'s pre backup.", pre, suc)
+	_ = n.call(suc, "ChordNode.TrimPreBackup", n.handedOffRange(pre), nil)
+}
+
+// eraseRedundant drops keys that left this node from the successor's pre
+// backup, unless the successor is where they went. A migrated range is not
+// a contiguous part of the node's range, so its keys are listed.
+func (r successorReplicator) eraseRedundant(change TopologyChange) {
+	n := r.n
+	suc, err := r.successor("successorReplicator.eraseRedundant")
+	if err != nil || suc == change.Peer {
+		return
+	}
+	n.replicationLog().Infof("Start erasing redundant data in node [%v]'s pre backup.", suc)
+	_ = n.call(suc, "ChordNode.EraseRedundantPreBackup", &change.Keys, nil)
+}
+
+func (r successorReplicator) Repair() error {
+	n := r.n
+	suc, err := r.successor("successorReplicator.Repair")
+	if err != nil || suc == n.addr {
+		return err
+	}
+	n.storeLock.RLock()
+	data := n.store.Snapshot()
+	n.storeLock.RUnlock()
+	err = n.appendPreBackup(suc, &BackupBatch{Owner: n.addr, Data: data})
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "successorReplicator.Repair", "ChordNode.AppendPreBackup", err)
+		return err
+	}
+	// A failed OnDelete leaves the key in the backup; resending recent
+	// tombstones lets the replay converge.
+	if keys := n.tombstones.recent(); len(keys) > 0 {
+		err = n.call(suc, "ChordNode.DeleteManyInPreBackup", keys, nil)
+		if err != nil {
+			n.logErrorFunctionCall(n.addr, "successorReplicator.Repair", "ChordNode.DeleteManyInPreBackup", err)
+			return err
+		}
+	}
+	n.replication.fullSync()
+	return nil
+}
+
+func (n *ChordNode) replicateBatch(data map[string]string) error {
+	if b, ok := n.replicator.(BatchReplicator); ok {
+		return b.OnPutBatch(data)
+	}
+	var ret error
+	for k, v := range data {
+		if err := n.replicator.OnPut(Pair{First: k, Second: v}); err != nil {
+			ret = err
+		}
+	}
+	return ret
+}
@@ -0,0 +1,106 @@
+package chord
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrOffline: The node the operation was called on is not online.
+	ErrOffline = errors.New("node is offline")
+	// ErrNotContentAddress: A content addressed node was asked to put a key
+	// that is not the content address of its value.
+	ErrNotContentAddress = errors.New("key is not the content address of its value")
+	// ErrAlreadyJoined: Join was called on a node already on a ring, or a leaf
+	// already attached.
+	ErrAlreadyJoined = errors.New("node already joined")
+	// ErrJoinContended: The successor stayed leased to other joins for longer
+	// than the join was willing to wait.
+	ErrJoinContended = errors.New("successor busy with other joins")
+	// ErrJoinThrottled: The assisting node kept turning the join away, busy
+	// with as many joins as it takes at once and as many waiting as it queues.
+	ErrJoinThrottled = errors.New("assisting node busy with other joins")
+)
+
+// causes are the errors a result may name. They reach a remote caller as
+// text only, and classifyError turns the text back into the value.
+var causes = []error{
+	ErrNotFound, ErrUnavailable, ErrOffline, ErrNotContentAddress, ErrKeyLeased, ErrLeaseLost,
+	ErrNotAdmitted, ErrAlreadyJoined, ErrJoinContended, ErrJoinThrottled, errContentMismatch,
+	ErrNoKeyFilter, ErrBusy, ErrMessageTooLarge, ErrValueTooLarge, ErrRingFrozen,
+	ErrCRDTType,
+}
+
+// classifyError maps an error from a remote call onto one of the causes: a
+// peer that could not be reached is ErrUnavailable.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if isTransportError(err) {
+		return ErrUnavailable
+	}
+	if r, ok := parseRejected(err.Error()); ok {
+		return r
+	}
+	for _, c := range causes {
+		if err.Error() == c.Error() {
+			return c
+		}
+	}
+	return err
+}
+
+// Result is what an operation came to, for callers that need to know why it
+// failed and not just that it did.
+type Result struct {
+	// Err is nil on success, or its cause: ErrOffline, ErrUnavailable,
+	// ErrNotFound, ErrKeyLeased, ErrNotContentAddress, ErrNotAdmitted,
+	// ErrAlreadyJoined, ErrJoinContended, ErrJoinThrottled, a *RejectedError,
+	// or an error the owner returned.
+	Err error
+	// Owner is the node the key was found to belong to, or the successor a
+	// join went in front of.
+	Owner    string
+	Hops     int
+	Retries  int
+	Duration time.Duration
+	// Ack is how far a put was replicated.
+	Ack AckLevel
+}
+
+func (r Result) Ok() bool {
+	return r.Err == nil
+}
+
+func resultOf(trace OpTrace, err error) Result {
+	return Result{Err: err, Owner: trace.Owner, Hops: len(trace.Hops), Retries: trace.Retries, Duration: trace.Duration}
+}
+
+func (w *NodeWrapper) PutResult(key string, value string) Result {
+	var trace OpTrace
+	ack, err := w.node.putValue(key, value, &trace)
+	ret := resultOf(trace, err)
+	ret.Ack = ack
+	return ret
+}
+
+func (w *NodeWrapper) GetResult(key string) (string, Result) {
+	var trace OpTrace
+	val, err := w.node.getValue(key, &trace)
+	return val, resultOf(trace, err)
+}
+
+// DeleteResult succeeds whether or not the key existed, and existed tells
+// which.
+func (w *NodeWrapper) DeleteResult(key string) (existed bool, ret Result) {
+	var trace OpTrace
+	existed, err := w.node.deleteValue(key, &trace)
+	return existed, resultOf(trace, err)
+}
+
+func (w *NodeWrapper) JoinResult(addr string) Result {
+	begin := time.Now()
+	suc, err := w.node.joinRing(addr)
+	return Result{Err: err, Owner: suc, Duration: time.Since(begin)}
+}
@@ -0,0 +1,101 @@
+package chord
+
+import "fmt"
+
+type NodeInfo struct {
+	Addr          string
+	Id            string
+	Predecessor   string
+	SuccessorList [SuccessorListLen]string
+	Keys          int
+	PreBackupKeys int
+}
+
+type RingWalk struct {
+	Nodes []NodeInfo
+	// Problems lists every break, loop and predecessor mismatch met on the
+	// way, in walk order. An empty list means the ring closed cleanly.
+	Problems []string
+	Closed   bool
+}
+
+func (n *ChordNode) NodeInfo(_ string, ret *NodeInfo) error {
+	ret.Addr = n.addr
+	ret.Id = fmt.Sprintf("%040x", NodeId(n.addr))
+	_ = n.GetPredecessor(NULL, &ret.Predecessor)
+	_ = n.GetSuccessorList(NULL, &ret.SuccessorList)
+	n.storeLock.RLock()
+	ret.Keys = n.store.Size()
+	n.storeLock.RUnlock()
+	n.preBackupLock.RLock()
+	ret.PreBackupKeys = n.preBackup.Size()
+	n.preBackupLock.RUnlock()
+	return nil
+}
+
+// WalkRing follows successor pointers from start until it comes back. A dead
+// successor is reported as a break and skipped using the rest of the list; a
+// node reached twice before getting back to start is reported as a loop.
+func WalkRing(start string, codec Codec) RingWalk {
+	var ret RingWalk
+	visited := make(map[string]int)
+	cur := start
+	for cur != NULL {
+		var info NodeInfo
+		err := RPCCallWithCodec(cur, codec, "ChordNode.NodeInfo", NULL, &info)
+		if err != nil {
+			ret.Problems = append(ret.Problems, fmt.Sprintf("cannot reach [%v]: %v", cur, err))
+			return ret
+		}
+		visited[cur] = len(ret.Nodes)
+		if len(ret.Nodes) > 0 {
+			prev := ret.Nodes[len(ret.Nodes)-1].Addr
+			if info.Predecessor != prev {
+				ret.Problems = append(ret.Problems, fmt.Sprintf("[%v] follows [%v] but its predecessor is [%v]", cur, prev, info.Predecessor))
+			}
+		}
+		ret.Nodes = append(ret.Nodes, info)
+		next := NULL
+		for i, s := range info.SuccessorList {
+			if s == NULL {
+				continue
+			}
+			if Ping(s) {
+				next = s
+				break
+			}
+			ret.Problems = append(ret.Problems, fmt.Sprintf("break: [%v]'s successor %v [%v] is unreachable", cur, i, s))
+		}
+		if next == NULL {
+			ret.Problems = append(ret.Problems, fmt.Sprintf("break: [%v] has no reachable successor", cur))
+			return ret
+		}
+		if next == start {
+			ret.Closed = true
+			if len(ret.Nodes) > 0 && ret.Nodes[0].Predecessor != cur {
+				ret.Problems = append(ret.Problems, fmt.Sprintf("[%v] follows [%v] but its predecessor is [%v]", start, cur, ret.Nodes[0].Predecessor))
+			}
+			return ret
+		}
+		if i, ok := visited[next]; ok {
+			ret.Problems = append(ret.Problems, fmt.Sprintf("loop: [%v] leads back to [%v], node %v of the walk", cur, next, i))
+			return ret
+		}
+		cur = next
+	}
+	return ret
+}
+
+func (w *NodeWrapper) WalkRing() RingWalk {
+	w.node.routingLog().Infof("Start walking the ring from node [%v].", w.node.addr)
+	return WalkRing(w.node.addr, w.node.codec)
+}
+
+// LookupFrom has the node at addr look key up, and returns the owner and the
+// hops the lookup took from there. The key is hashed with hasher, which has to
+// be the ring's own, nil for the default.
+func LookupFrom(addr, key string, hasher KeyHasher, codec Codec) (LookupPath, error) {
+	var path LookupPath
+	err := RPCCallWithCodec(addr, codec, "ChordNode.FindSuccessorPath", hashKey(hasher, key), &path)
+	return path, err
+}
@@ -0,0 +1,232 @@
+package chord
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrRingFrozen: The ring is frozen for maintenance and takes no joins or
+// migrations until it thaws.
+var ErrRingFrozen = errors.New("ring frozen")
+
+// RingFreeze is a freeze of the whole ring, or the thaw ending one. While
+// frozen, until Until, nodes turn joins and migrations away and defer the
+// reclaiming of their pre backups; reads and writes go on, and nodes that
+// fail or quit are still replaced by their neighbours. The freeze or thaw
+// with the highest Seq wins, so the last one asked for holds however the two
+// spread.
+type RingFreeze struct {
+	Seq    uint64
+	Frozen bool
+	Until  time.Time
+	Reason string
+	// By is the node the freeze or thaw was asked of.
+	By string
+}
+
+func (f RingFreeze) active() bool {
+	return f.Frozen && time.Now().Before(f.Until)
+}
+
+func (f RingFreeze) newer(than RingFreeze) bool {
+	return f.Seq > than.Seq || f.Seq == than.Seq && f.By > than.By
+}
+
+type RingFreezeRequest struct {
+	Freeze   bool
+	Duration time.Duration
+	Reason   string
+}
+
+// RingFreezeStatus tells whether the ring is frozen as this node knows it,
+// with the joins it turned away and the work it deferred meanwhile.
+type RingFreezeStatus struct {
+	Freeze   RingFreeze
+	Active   bool
+	Refused  uint64
+	Deferred uint64
+}
+
+type freezeState struct {
+	lock     sync.Mutex
+	cur      RingFreeze
+	refused  uint64
+	deferred uint64
+}
+
+// merge takes f over if it is newer than the freeze known.
+func (s *freezeState) merge(f RingFreeze) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !f.newer(s.cur) {
+		return false
+	}
+	s.cur = f
+	return true
+}
+
+func (s *freezeState) current() RingFreeze {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.cur
+}
+
+func (s *freezeState) status() RingFreezeStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return RingFreezeStatus{Freeze: s.cur, Active: s.cur.active(), Refused: s.refused, Deferred: s.deferred}
+}
+
+// frozen tells whether the ring is frozen, counting a join turned away in
+// refused or deferred work otherwise.
+func (n *ChordNode) frozen(join bool) bool {
+	s := &n.freeze
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.cur.active() {
+		return false
+	}
+	if join {
+		s.refused++
+	} else {
+		s.deferred++
+	}
+	return true
+}
+
+// spreadRingFreeze passes f on to every node in the routing tables. Nodes
+// it misses learn f from their neighbours on stabilize.
+func (n *ChordNode) spreadRingFreeze(f RingFreeze) {
+	seen := map[string]bool{NULL: true, n.addr: true}
+	for _, addr := range n.probeTargets() {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		go func(addr string) {
+			if err := n.call(addr, "ChordNode.SpreadRingFreeze", f, nil); err != nil {
+				n.logErrorFunctionCall(n.addr, "ChordNode.spreadRingFreeze", "ChordNode.SpreadRingFreeze", err)
+			}
+		}(addr)
+	}
+}
+
+// learnRingFreeze takes f over if it is newer, and logs the change.
+func (n *ChordNode) learnRingFreeze(f RingFreeze) bool {
+	if !n.freeze.merge(f) {
+		return false
+	}
+	if f.Frozen {
+		n.maintenanceLog().Infof("Node [%v] learns the ring is frozen by [%v] until %v: %v.", n.addr, f.By, f.Until, f.Reason)
+	} else {
+		n.maintenanceLog().Infof("Node [%v] learns the ring was thawed by [%v].", n.addr, f.By)
+	}
+	return true
+}
+
+// SpreadRingFreeze takes f over if it is newer than the freeze this node
+// knows, and passes it on.
+func (n *ChordNode) SpreadRingFreeze(f RingFreeze, _ *struct{}) error {
+	if n.learnRingFreeze(f) {
+		n.spreadRingFreeze(f)
+	}
+	return nil
+}
+
+// RequestRingFreeze freezes the ring for req.Duration, ringFreezeTime if
+// zero, or thaws it, and spreads the change from this node.
+func (n *ChordNode) RequestRingFreeze(req RingFreezeRequest, ret *RingFreeze) error {
+	if req.Duration < 0 {
+		return errors.New("invalid freeze duration")
+	}
+	if req.Duration == 0 {
+		req.Duration = ringFreezeTime
+	}
+	now := time.Now()
+	f := RingFreeze{Seq: uint64(now.UnixNano()), Frozen: req.Freeze, Reason: req.Reason, By: n.addr}
+	if cur := n.freeze.current(); f.Seq <= cur.Seq {
+		f.Seq = cur.Seq + 1
+	}
+	if f.Frozen {
+		f.Until = now.Add(req.Duration)
+	}
+	n.learnRingFreeze(f)
+	n.spreadRingFreeze(f)
+	*ret = f
+	return nil
+}
+
+func (n *ChordNode) GetRingFreeze(_ string, ret *RingFreezeStatus) error {
+	*ret = n.freeze.status()
+	return nil
+}
+
+// serveRingFreeze returns the freeze this node knows, and on POST freezes the
+// ring for for=, a duration, with reason=.
+func (n *ChordNode) serveRingFreeze(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, n.freeze.status())
+		return
+	}
+	req := RingFreezeRequest{Freeze: true, Reason: r.URL.Query().Get("reason")}
+	if s := r.URL.Query().Get("for"); s != "" {
+		var err error
+		if req.Duration, err = time.ParseDuration(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var f RingFreeze
+	if err := n.RequestRingFreeze(req, &f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, f)
+}
+
+func (n *ChordNode) serveRingThaw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "thaw needs POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var f RingFreeze
+	_ = n.RequestRingFreeze(RingFreezeRequest{Reason: r.URL.Query().Get("reason")}, &f)
+	writeJSON(w, f)
+}
+
+// FreezeRing freezes the ring of the node for d, ringFreezeTime if zero.
+func (w *NodeWrapper) FreezeRing(reason string, d time.Duration) (RingFreeze, bool) {
+	var f RingFreeze
+	if err := w.node.RequestRingFreeze(RingFreezeRequest{Freeze: true, Duration: d, Reason: reason}, &f); err != nil {
+		w.node.log().Errorf("Invalid ring freeze [%v].", d)
+		return f, false
+	}
+	return f, true
+}
+
+func (w *NodeWrapper) ThawRing() RingFreeze {
+	var f RingFreeze
+	_ = w.node.RequestRingFreeze(RingFreezeRequest{}, &f)
+	return f
+}
+
+func (w *NodeWrapper) RingFreezeStatus() RingFreezeStatus {
+	return w.node.freeze.status()
+}
+
+// FreezeRing freezes the ring of the node at addr for d, ringFreezeTime if
+// zero, from that node.
+func FreezeRing(addr string, codec Codec, reason string, d time.Duration) (RingFreeze, error) {
+	var f RingFreeze
+	err := RPCCallWithCodec(addr, codec, "ChordNode.RequestRingFreeze", RingFreezeRequest{Freeze: true, Duration: d, Reason: reason}, &f)
+	return f, classifyError(err)
+}
+
+// ThawRing thaws the ring of the node at addr, from that node.
+func ThawRing(addr string, codec Codec, reason string) (RingFreeze, error) {
+	var f RingFreeze
+	err := RPCCallWithCodec(addr, codec, "ChordNode.RequestRingFreeze", RingFreezeRequest{Reason: reason}, &f)
+	return f, classifyError(err)
+}
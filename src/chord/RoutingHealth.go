@@ -0,0 +1,209 @@
+package chord
+
+import (
+	"math"
+	"math/big"
+	"net/http"
+	"sync"
+)
+
+// RoutingReport tells how well this node's finger table routes. Hop counts
+// are of the lookups this node started; a protocol with its own router does
+// not report its hops, so they count as none.
+type RoutingReport struct {
+	Lookups uint64
+	Failed  uint64
+	AvgHops float64
+	MaxHops int
+	// HopCounts[i] is the number of lookups that took i hops, the last
+	// bucket taking the longer ones too.
+	HopCounts []uint64
+	// Nodes is the ring size as the successor list tells it, and
+	// ExpectedHops half its log2, what a Chord lookup takes on average with
+	// every finger right. Efficiency is ExpectedHops over AvgHops: well below
+	// one, lookups take hops that fixFinger should have saved.
+	Nodes        int64
+	ExpectedHops float64
+	Efficiency   float64
+	// FingerUse counts the hops this node forwarded through each finger, by
+	// index, and LearnedHops and SuccessorHops the ones that went through a
+	// learned entry or the successor instead.
+	FingerUse     map[int]uint64
+	LearnedHops   uint64
+	SuccessorHops uint64
+	// DeadSkipped counts the times routing passed over a dead finger.
+	DeadSkipped uint64
+	// Fingers is the number of distinct fingers, and DeadFingers how many of
+	// them the failure detector takes for dead now.
+	Fingers        int
+	DeadFingers    int
+	DeadFingerRate float64
+	// FingerFixes counts fixFinger rounds and FingerChanges the ones that
+	// found a finger wrong. Many changes and a high dead finger rate mean
+	// fixFinger is not keeping up with churn.
+	FingerFixes   uint64
+	FingerChanges uint64
+}
+
+// routingHealth counts what RoutingReport adds up.
+type routingHealth struct {
+	lock          sync.Mutex
+	lookups       uint64
+	failed        uint64
+	hops          [routingHopBuckets]uint64
+	totalHops     uint64
+	maxHops       int
+	fingerUse     map[int]uint64
+	learnedHops   uint64
+	successorHops uint64
+	deadSkipped   uint64
+	fingerFixes   uint64
+	fingerChanges uint64
+}
+
+func (r *routingHealth) lookup(hops int, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lookups++
+	if !ok {
+		r.failed++
+		return
+	}
+	r.hops[int(math.Min(float64(hops), routingHopBuckets-1))]++
+	r.totalHops += uint64(hops)
+	if hops > r.maxHops {
+		r.maxHops = hops
+	}
+}
+
+// forwarded counts a hop through finger i, or through a learned entry, or
+// the successor with i negative.
+func (r *routingHealth) forwarded(i int, learned bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch {
+	case learned:
+		r.learnedHops++
+	case i < 0:
+		r.successorHops++
+	default:
+		if r.fingerUse == nil {
+			r.fingerUse = make(map[int]uint64)
+		}
+		r.fingerUse[i]++
+	}
+}
+
+func (r *routingHealth) skippedDead() {
+	r.lock.Lock()
+	r.deadSkipped++
+	r.lock.Unlock()
+}
+
+func (r *routingHealth) fixed(changed bool) {
+	r.lock.Lock()
+	r.fingerFixes++
+	if changed {
+		r.fingerChanges++
+	}
+	r.lock.Unlock()
+}
+
+// ringSizeEstimate is the ring size the spacing of the successor list
+// implies, exact when the list wraps around the ring, or else the gossiped
+// node count, which lags behind joins.
+func (n *ChordNode) ringSizeEstimate() int64 {
+	n.sucLock.RLock()
+	list := n.successorList
+	n.sucLock.RUnlock()
+	seen := make(map[string]bool)
+	last, wrapped := NULL, false
+	for _, s := range list {
+		switch {
+		case s == NULL:
+		case s == n.addr || seen[s]:
+			wrapped = true
+		default:
+			seen[s] = true
+			last = s
+		}
+	}
+	if len(seen) == 0 {
+		if a := n.aggregator.get(); a.Epoch != 0 && a.Nodes > 0 {
+			return a.Nodes
+		}
+		return 1
+	}
+	if wrapped {
+		return int64(len(seen)) + 1
+	}
+	span := new(big.Int).Sub(NodeId(last), NodeId(n.addr))
+	if span.Sign() <= 0 {
+		span.Add(span, new(big.Int).Lsh(big.NewInt(1), M))
+	}
+	ring := new(big.Float).SetInt(new(big.Int).Lsh(big.NewInt(int64(len(seen))), M))
+	size, _ := ring.Quo(ring, new(big.Float).SetInt(span)).Int64()
+	if size <= int64(len(seen)) {
+		return int64(len(seen)) + 1
+	}
+	return size
+}
+
+func (n *ChordNode) routingReport() RoutingReport {
+	r := &n.routingHealth
+	r.lock.Lock()
+	ret := RoutingReport{
+		Lookups:       r.lookups,
+		Failed:        r.failed,
+		MaxHops:       r.maxHops,
+		HopCounts:     append([]uint64(nil), r.hops[:]...),
+		FingerUse:     make(map[int]uint64, len(r.fingerUse)),
+		LearnedHops:   r.learnedHops,
+		SuccessorHops: r.successorHops,
+		DeadSkipped:   r.deadSkipped,
+		FingerFixes:   r.fingerFixes,
+		FingerChanges: r.fingerChanges,
+	}
+	for i, c := range r.fingerUse {
+		ret.FingerUse[i] = c
+	}
+	if done := r.lookups - r.failed; done > 0 {
+		ret.AvgHops = float64(r.totalHops) / float64(done)
+	}
+	r.lock.Unlock()
+	ret.Nodes = n.ringSizeEstimate()
+	if ret.Nodes > 1 {
+		ret.ExpectedHops = math.Log2(float64(ret.Nodes)) / 2
+	}
+	if ret.AvgHops > 0 {
+		ret.Efficiency = ret.ExpectedHops / ret.AvgHops
+	} else if ret.Lookups > ret.Failed {
+		ret.Efficiency = 1
+	}
+	n.fingerLock.RLock()
+	fingers := n.fingerTable
+	n.fingerLock.RUnlock()
+	seen := make(map[string]bool)
+	for _, f := range fingers {
+		if f == NULL || f == n.addr || seen[f] {
+			continue
+		}
+		seen[f] = true
+		ret.Fingers++
+		if !n.alive(f) {
+			ret.DeadFingers++
+		}
+	}
+	if ret.Fingers > 0 {
+		ret.DeadFingerRate = float64(ret.DeadFingers) / float64(ret.Fingers)
+	}
+	return ret
+}
+
+func (n *ChordNode) serveRoutingReport(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.routingReport())
+}
+
+func (w *NodeWrapper) RoutingReport() RoutingReport {
+	return w.node.routingReport()
+}
@@ -0,0 +1,180 @@
+package chord
+
+import (
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connTable tracks the connections Accept serves and the requests in flight
+// on them, so that quitting stops taking connections, lets the requests it
+// already took finish, and only then cuts what is left.
+type connTable struct {
+	lock     sync.Mutex
+	conns    map[net.Conn]bool
+	closed   bool
+	inFlight int64
+}
+
+func (t *connTable) open() {
+	t.lock.Lock()
+	t.conns = make(map[net.Conn]bool)
+	t.closed = false
+	t.lock.Unlock()
+}
+
+func (t *connTable) add(conn net.Conn) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = true
+	return true
+}
+
+func (t *connTable) remove(conn net.Conn) {
+	t.lock.Lock()
+	delete(t.conns, conn)
+	t.lock.Unlock()
+}
+
+func (t *connTable) isClosed() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closed
+}
+
+// close stops new connections. The caller closes the listener after it.
+func (t *connTable) close() {
+	t.lock.Lock()
+	t.closed = true
+	t.lock.Unlock()
+}
+
+// drain waits up to timeout for the requests in flight to be answered, then
+// closes every connection still open, and reports how many requests it cut.
+func (t *connTable) drain(timeout time.Duration) int64 {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&t.inFlight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollTime)
+	}
+	t.lock.Lock()
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+	t.conns = make(map[net.Conn]bool)
+	t.lock.Unlock()
+	return atomic.LoadInt64(&t.inFlight)
+}
+
+// trackedCodec counts a request from the moment its header is read until its
+// response is written. net/rpc writes a response for every header it reads,
+// errors included. Once a request's body is read it waits for a slot of its
+// class, which the response frees; a request refused one is answered with
+// ErrBusy in place of running, and one over the message size limit, which is
+// read no further than the limit, with ErrMessageTooLarge.
+type trackedCodec struct {
+	rpc.ServerCodec
+	inFlight *int64
+	sched    *rpcScheduler
+	conn     *meteredConn
+	limit    *messageLimit
+	lock     sync.Mutex
+	method   string
+	seq      uint64
+	classes  map[uint64]RPCClass
+}
+
+func (c *trackedCodec) ReadRequestHeader(r *rpc.Request) error {
+	atomic.StoreInt64(&c.conn.read, 0)
+	atomic.StoreInt64(&c.conn.limit, int64(c.limit.size()))
+	err := c.ServerCodec.ReadRequestHeader(r)
+	if err == nil {
+		atomic.AddInt64(c.inFlight, 1)
+		c.method, c.seq = r.ServiceMethod, r.Seq
+	}
+	return err
+}
+
+func (c *trackedCodec) ReadRequestBody(body interface{}) error {
+	if err := c.ServerCodec.ReadRequestBody(body); err != nil || body == nil {
+		if c.conn.overLimit() {
+			atomic.AddUint64(&c.limit.refused, 1)
+			return ErrMessageTooLarge
+		}
+		return err
+	}
+	class := c.sched.class(c.method)
+	if err := c.sched.acquire(class); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.classes[c.seq] = class
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *trackedCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	defer atomic.AddInt64(c.inFlight, -1)
+	c.lock.Lock()
+	class, ok := c.classes[r.Seq]
+	delete(c.classes, r.Seq)
+	c.lock.Unlock()
+	if ok {
+		defer c.sched.release(class)
+	}
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+func (n *ChordNode) serveConn(server *rpc.Server, conn net.Conn) {
+	if !n.conns.add(conn) {
+		_ = conn.Close()
+		return
+	}
+	metered := &meteredConn{Conn: conn}
+	server.ServeCodec(&trackedCodec{
+		ServerCodec: n.codec.NewServerCodec(metered),
+		inFlight:    &n.conns.inFlight,
+		sched:       &n.rpcSched,
+		conn:        metered,
+		limit:       &n.msgLimit,
+		classes:     make(map[uint64]RPCClass),
+	})
+	n.conns.remove(conn)
+}
+
+// serve brings up the RPC server and the admin api unless they are up: run
+// does it first, and a join or stand by after quitting again, on a fresh
+// listener.
+func (n *ChordNode) serve() {
+	if n.listener != nil {
+		return
+	}
+	n.initializeServer()
+	n.startAdmin()
+}
+
+// shutDownServer stops taking connections. Unless drain is false, as for a
+// force quit, requests already taken are given drainTimeout to finish.
+func (n *ChordNode) shutDownServer(drain bool) {
+	n.stopAdmin()
+	n.conns.close()
+	if n.listener == nil {
+		return
+	}
+	err := n.listener.Close()
+	if err != nil {
+		n.maintenanceLog().Errorf("close listener failed in force quit, error message: [%v]", err)
+	}
+	n.listener = nil
+	timeout := drainTimeout
+	if !drain {
+		timeout = 0
+	}
+	if cut := n.conns.drain(timeout); cut > 0 {
+		n.maintenanceLog().Errorf("Node [%v] cut %v requests in flight on shutting down.", n.addr, cut)
+	}
+}
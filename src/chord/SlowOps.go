@@ -0,0 +1,147 @@
+package chord
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Hop struct {
+	Addr    string
+	Latency time.Duration
+}
+
+type LookupPath struct {
+	Successor string
+	Hops      []Hop
+}
+
+// OpTrace is what one get or put went through: the owner its lookup found,
+// the hops of that lookup with their latencies, the time spent on each peer,
+// and how many lookups or owner calls were retried.
+type OpTrace struct {
+	Owner    string
+	Hops     []Hop
+	Peers    []PeerTiming
+	Retries  int
+	Duration time.Duration
+	Ok       bool
+}
+
+type PeerTiming struct {
+	Phase    string
+	Peer     string
+	Duration time.Duration
+}
+
+type SlowOp struct {
+	Time     time.Time
+	Op       string
+	Key      string
+	Duration time.Duration
+	Ok       bool
+	Hops     []Hop
+	Peers    []PeerTiming
+}
+
+type slowOpLog struct {
+	lock       sync.RWMutex
+	thresholds map[string]time.Duration
+	buf        [slowOpLogLen]SlowOp
+	next       int
+	cnt        int
+}
+
+func (l *slowOpLog) threshold(op string) time.Duration {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if d, ok := l.thresholds[op]; ok {
+		return d
+	}
+	return slowOpDefaultThreshold
+}
+
+func (l *slowOpLog) setThreshold(op string, d time.Duration) {
+	l.lock.Lock()
+	if l.thresholds == nil {
+		l.thresholds = make(map[string]time.Duration)
+	}
+	l.thresholds[op] = d
+	l.lock.Unlock()
+}
+
+func (l *slowOpLog) record(op SlowOp) {
+	l.lock.Lock()
+	l.buf[l.next] = op
+	l.next = (l.next + 1) % slowOpLogLen
+	if l.cnt < slowOpLogLen {
+		l.cnt++
+	}
+	l.lock.Unlock()
+}
+
+// query returns the recorded operations newest first, keeping only those of
+// the given kind (any kind if empty) that took at least min.
+func (l *slowOpLog) query(op string, min time.Duration, limit int) []SlowOp {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	ret := make([]SlowOp, 0, l.cnt)
+	for i := 1; i <= l.cnt; i++ {
+		e := l.buf[(l.next-i+slowOpLogLen)%slowOpLogLen]
+		if (op == NULL || e.Op == op) && e.Duration >= min {
+			ret = append(ret, e)
+			if limit > 0 && len(ret) == limit {
+				break
+			}
+		}
+	}
+	return ret
+}
+
+type opTimer struct {
+	n       *ChordNode
+	op      string
+	key     string
+	start   time.Time
+	owner   string
+	hops    []Hop
+	peers   []PeerTiming
+	retries int
+	trace   *OpTrace
+}
+
+func (n *ChordNode) startOp(op, key string) *opTimer {
+	return &opTimer{n: n, op: op, key: key, start: time.Now()}
+}
+
+func (t *opTimer) phase(phase, peer string, begin time.Time) {
+	t.peers = append(t.peers, PeerTiming{Phase: phase, Peer: peer, Duration: time.Since(begin)})
+}
+
+// tracing has finish fill trace, if it is not nil, for the caller.
+func (t *opTimer) tracing(trace *OpTrace) *opTimer {
+	t.trace = trace
+	return t
+}
+
+func (t *opTimer) finish(ok bool) {
+	d := time.Since(t.start)
+	if isClientOp(t.op) {
+		t.n.overload.observe(d)
+	}
+	if t.trace != nil {
+		*t.trace = OpTrace{Owner: t.owner, Hops: t.hops, Peers: t.peers, Retries: t.retries, Duration: d, Ok: ok}
+	}
+	if d < t.n.slowOps.threshold(t.op) {
+		return
+	}
+	t.n.slowOps.record(SlowOp{Time: t.start, Op: t.op, Key: t.key, Duration: d, Ok: ok, Hops: t.hops, Peers: t.peers})
+}
+
+func (n *ChordNode) serveSlowOps(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	min, _ := time.ParseDuration(q.Get("min"))
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	writeJSON(w, n.slowOps.query(q.Get("op"), min, limit))
+}
@@ -0,0 +1,146 @@
+package chord
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+type SnapshotChunk struct {
+	Data map[string]string
+	Done bool
+}
+
+type snapshotSession struct {
+	keys     []string
+	pos      int
+	lastUsed time.Time
+}
+
+type snapshotTable struct {
+	lock     sync.Mutex
+	nextId   uint64
+	sessions map[uint64]*snapshotSession
+}
+
+func (t *snapshotTable) open(keys []string) uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.sessions == nil {
+		t.sessions = make(map[uint64]*snapshotSession)
+	}
+	now := time.Now()
+	for sid, s := range t.sessions {
+		if now.Sub(s.lastUsed) > snapshotSessionTimeout {
+			delete(t.sessions, sid)
+		}
+	}
+	t.nextId++
+	t.sessions[t.nextId] = &snapshotSession{keys: keys, lastUsed: now}
+	return t.nextId
+}
+
+func (t *snapshotTable) next(sid uint64, size int) ([]string, bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s, ok := t.sessions[sid]
+	if !ok {
+		return nil, false, errors.New("unknown or expired snapshot")
+	}
+	end := s.pos + size
+	if end > len(s.keys) {
+		end = len(s.keys)
+	}
+	keys := s.keys[s.pos:end]
+	s.pos = end
+	s.lastUsed = time.Now()
+	done := s.pos == len(s.keys)
+	if done {
+		delete(t.sessions, sid)
+	}
+	return keys, done, nil
+}
+
+func (t *snapshotTable) close(sid uint64) {
+	t.lock.Lock()
+	delete(t.sessions, sid)
+	t.lock.Unlock()
+}
+
+// OpenSnapshot only records the key set; values are read chunk by chunk, so a
+// key written after opening is returned with its newest value and a key
+// deleted meanwhile is skipped.
+func (n *ChordNode) OpenSnapshot(_ string, ret *uint64) error {
+	n.storeLock.RLock()
+	keys := make([]string, 0, n.store.Size())
+	n.store.Iterate(func(k, _ string) bool {
+		keys = append(keys, k)
+		return true
+	})
+	n.storeLock.RUnlock()
+	*ret = n.snapshots.open(keys)
+	n.storageLog().Infof("Open snapshot [%v] of node [%v]'s store with %v keys.", *ret, n.addr, len(keys))
+	return nil
+}
+
+func (n *ChordNode) NextSnapshotChunk(sid uint64, ret *SnapshotChunk) error {
+	keys, done, err := n.snapshots.next(sid, snapshotChunkSize)
+	if err != nil {
+		return err
+	}
+	ret.Data = make(map[string]string, len(keys))
+	ret.Done = done
+	n.storeLock.RLock()
+	for _, k := range keys {
+		if v, ok := n.store.Get(k); ok {
+			ret.Data[k] = v
+		}
+	}
+	n.storeLock.RUnlock()
+	return nil
+}
+
+func (n *ChordNode) CloseSnapshot(sid uint64, _ *string) error {
+	n.snapshots.close(sid)
+	return nil
+}
+
+func (n *ChordNode) streamStore(addr string, handle func(chunk map[string]string) error) error {
+	var sid uint64
+	err := n.call(addr, "ChordNode.OpenSnapshot", NULL, &sid)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.streamStore", "ChordNode.OpenSnapshot", err)
+		return err
+	}
+	for {
+		var chunk SnapshotChunk
+		err = n.call(addr, "ChordNode.NextSnapshotChunk", sid, &chunk)
+		if err != nil {
+			n.logErrorFunctionCall(n.addr, "ChordNode.streamStore", "ChordNode.NextSnapshotChunk", err)
+			_ = n.call(addr, "ChordNode.CloseSnapshot", sid, nil)
+			return err
+		}
+		if err = handle(chunk.Data); err != nil {
+			_ = n.call(addr, "ChordNode.CloseSnapshot", sid, nil)
+			return err
+		}
+		if chunk.Done {
+			return nil
+		}
+	}
+}
+
+func (n *ChordNode) export(addr string, w io.Writer) error {
+	n.storageLog().Infof("Start exporting node [%v]'s store.", addr)
+	enc := json.NewEncoder(w)
+	return n.streamStore(addr, func(chunk map[string]string) error {
+		for k, v := range chunk {
+			if err := enc.Encode(Pair{First: k, Second: v}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
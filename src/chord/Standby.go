@@ -0,0 +1,293 @@
+package chord
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TransferRequest asks for the keys Pre would take over, leaving out those
+// whose digest Pre already has.
+type TransferRequest struct {
+	Pre  string
+	Have map[string]uint64
+	// Copy leaves the keys where they are, for a standby keeping its copy
+	// warm; otherwise they move as in TransferData.
+	Copy bool
+	// Relocated counts the pre backup's copies of the keys Pre has as
+	// taken over too, for a node back at a new address whose keys suc may
+	// not have promoted yet, unless they were deleted since.
+	Relocated bool
+}
+
+// TransferReply holds the keys that differ from the caller's copy, and the
+// keys of the copy that are not to be taken over at all.
+type TransferReply struct {
+	Changed map[string]string
+	Removed []string
+}
+
+type StandbyStatus struct {
+	Standby   bool
+	Successor string
+	Keys      int
+	Synced    time.Time
+	Error     string
+}
+
+// standbyState is a warm standby's link to the ring. A standby takes no
+// place on the ring: it keeps the routing tables and a copy of the keys it
+// would own were it to join in front of its would-be successor, so that
+// promoting it only moves what changed since the last sync.
+type standbyState struct {
+	lock   sync.Mutex
+	gen    uint64
+	assist string
+	status StandbyStatus
+}
+
+func digest(val string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(val))
+	return h.Sum64()
+}
+
+func (n *ChordNode) digests() map[string]uint64 {
+	n.storeLock.RLock()
+	defer n.storeLock.RUnlock()
+	ret := make(map[string]uint64, n.store.Size())
+	n.store.Iterate(func(k, v string) bool {
+		ret[k] = digest(v)
+		return true
+	})
+	return ret
+}
+
+func delta(data map[string]string, have map[string]uint64) TransferReply {
+	ret := TransferReply{Changed: make(map[string]string)}
+	for k, v := range data {
+		if d, ok := have[k]; !ok || d != digest(v) {
+			ret.Changed[k] = v
+		}
+	}
+	for k := range have {
+		if _, ok := data[k]; !ok {
+			ret.Removed = append(ret.Removed, k)
+		}
+	}
+	return ret
+}
+
+// TransferDelta is TransferData, or a copy of what it would move, that only
+// sends what the caller's copy lacks.
+func (n *ChordNode) TransferDelta(req TransferRequest, ret *TransferReply) error {
+	if !req.Copy {
+		var data map[string]string
+		if err := n.transferData(req.Pre, &data); err != nil {
+			return err
+		}
+		if req.Relocated {
+			nId := NodeId(req.Pre)
+			thisId := NodeId(n.addr)
+			n.preBackupLock.RLock()
+			n.preBackup.Iterate(func(k, v string) bool {
+				_, moved := data[k]
+				if _, kept := req.Have[k]; kept && !moved && !n.tombstones.has(k) && !within(n.keyId(k), nId, thisId, true) {
+					data[k] = v
+				}
+				return true
+			})
+			n.preBackupLock.RUnlock()
+		}
+		*ret = n.outbox.stage(req.Pre, n.msgLimit.splitReply(delta(data, req.Have)))
+		return nil
+	}
+	if !n.admits(req.Pre) {
+		n.maintenanceLog().Errorf("Node [%v] refuses to copy data to unadmitted [%v].", n.addr, req.Pre)
+		return ErrNotAdmitted
+	}
+	nId := NodeId(req.Pre)
+	thisId := NodeId(n.addr)
+	data := make(map[string]string)
+	n.storeLock.RLock()
+	n.store.Iterate(func(k, v string) bool {
+		if !within(n.keyId(k), nId, thisId, true) && !n.hosts(k) {
+			data[k] = v
+		}
+		return true
+	})
+	n.storeLock.RUnlock()
+	*ret = n.outbox.stage(req.Pre, n.msgLimit.splitReply(delta(data, req.Have)))
+	return nil
+}
+
+// applyDeltaLocked brings the store in line with a delta against it. The store
+// lock is held.
+func (n *ChordNode) applyDeltaLocked(d TransferReply, fromFunc string) {
+	for _, k := range d.Removed {
+		n.storeDelete(n.store, k, fromFunc)
+	}
+	for k, v := range d.Changed {
+		v = n.resolveConflictLocked(ConflictDelta, k, v, time.Time{}, ResolveIncoming)
+		n.storePut(n.store, k, v, fromFunc)
+	}
+}
+
+func (n *ChordNode) standby(addr string) bool {
+	if n.tier == TierLeaf {
+		n.maintenanceLog().Errorf("Trying to put a leaf on standby.")
+		return false
+	}
+	if _, err := n.requestAdmission(addr); err != nil {
+		return false
+	}
+	if _, ok := n.enter(StateStandby, StateCreated, StateOffline); !ok {
+		return false
+	}
+	n.serve()
+	n.maintain()
+	s := &n.standbyState
+	s.lock.Lock()
+	s.gen++
+	gen := s.gen
+	s.assist = addr
+	s.status = StandbyStatus{Standby: true}
+	s.lock.Unlock()
+	n.maintenanceLog().Infof("Node [%v] stands by for the ring of [%v].", n.addr, addr)
+	go func() {
+		for {
+			s.lock.Lock()
+			current := s.gen == gen
+			s.lock.Unlock()
+			state := n.life.get()
+			if !current || state != StateStandby && state != StateJoining {
+				return
+			}
+			if state == StateStandby {
+				n.syncStandby()
+			}
+			time.Sleep(standbySyncTime)
+		}
+	}()
+	return true
+}
+
+// syncStandby refreshes the routing tables and the copy from the would-be
+// successor.
+func (n *ChordNode) syncStandby() {
+	s := &n.standbyState
+	s.lock.Lock()
+	assist := s.assist
+	s.lock.Unlock()
+	var suc string
+	err := n.call(assist, "ChordNode.FindSuccessor", NodeId(n.addr), &suc)
+	var reply TransferReply
+	if err == nil {
+		n.presentTicket(suc)
+		err = n.call(suc, "ChordNode.TransferDelta", TransferRequest{Pre: n.addr, Have: n.digests(), Copy: true}, &reply)
+	}
+	if err == nil {
+		err = n.transferRest(suc, &reply)
+	}
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.syncStandby", "ChordNode.TransferDelta", err)
+		s.lock.Lock()
+		s.status.Error = err.Error()
+		s.lock.Unlock()
+		return
+	}
+	n.storeLock.Lock()
+	n.applyDeltaLocked(reply, "ChordNode.syncStandby")
+	keys := n.store.Size()
+	n.storeLock.Unlock()
+	n.sucLock.Lock()
+	n.successorList = [SuccessorListLen]string{suc}
+	n.sucLock.Unlock()
+	n.refillSuccessors(suc)
+	n.fingerLock.Lock()
+	n.fingerTable[0] = suc
+	n.fingerLock.Unlock()
+	n.deriveFingerTable(suc)
+	s.lock.Lock()
+	s.status = StandbyStatus{Standby: true, Successor: suc, Keys: keys, Synced: time.Now()}
+	s.lock.Unlock()
+}
+
+// transferDelta takes over the keys of suc for a standby being promoted or a
+// relocated node, sending only what the store lacks, and returns them all.
+// The store is left empty for join to fill, whether or not the transfer went
+// through.
+func (n *ChordNode) transferDelta(suc string, relocated bool) (map[string]string, error) {
+	var reply TransferReply
+	err := n.call(suc, "ChordNode.TransferDelta", TransferRequest{Pre: n.addr, Have: n.digests(), Relocated: relocated}, &reply)
+	if err == nil {
+		err = n.transferRest(suc, &reply)
+	}
+	n.storeLock.Lock()
+	defer n.storeLock.Unlock()
+	if err != nil {
+		// The copy stays with suc, which is still its owner.
+		n.storeReset(n.store, nil, "ChordNode.transferDelta")
+		return nil, err
+	}
+	n.applyDeltaLocked(reply, "ChordNode.transferDelta")
+	data := n.store.Snapshot()
+	n.storeReset(n.store, nil, "ChordNode.transferDelta")
+	n.maintenanceLog().Infof("Node [%v] takes over %v keys, %v of them changed or new to it.", n.addr, len(data), len(reply.Changed))
+	return data, nil
+}
+
+func (n *ChordNode) promote() bool {
+	if n.life.get() != StateStandby {
+		n.maintenanceLog().Errorf("Trying to promote a node that is not on standby.")
+		return false
+	}
+	s := &n.standbyState
+	s.lock.Lock()
+	assist := s.assist
+	s.lock.Unlock()
+	_, err := n.joinRing(assist)
+	if err != nil {
+		return false
+	}
+	s.lock.Lock()
+	s.status = StandbyStatus{}
+	s.lock.Unlock()
+	return true
+}
+
+func (n *ChordNode) standbyStatus() StandbyStatus {
+	s := &n.standbyState
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.status
+}
+
+func (n *ChordNode) servePromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "promote needs POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !n.promote() {
+		http.Error(w, "promotion failed", http.StatusConflict)
+		return
+	}
+	writeJSON(w, n.standbyStatus())
+}
+
+// Standby puts the node on warm standby for the ring addr is on, instead of
+// joining it: the node owns no keys and serves no reads or writes, but keeps
+// its routing tables and a copy of the keys it would own up to date, until
+// Promote joins it.
+func (w *NodeWrapper) Standby(addr string) bool {
+	return w.node.standby(addr)
+}
+
+func (w *NodeWrapper) Promote() bool {
+	return w.node.promote()
+}
+
+func (w *NodeWrapper) StandbyStatus() StandbyStatus {
+	return w.node.standbyStatus()
+}
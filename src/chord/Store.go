@@ -0,0 +1,162 @@
+package chord
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// KVStore holds a node's store or its pre backup. Implementations need not
+// be safe for concurrent use: the node serialises access under storeLock and
+// preBackupLock. Deleting the current key from inside Iterate is allowed.
+type KVStore interface {
+	Get(key string) (string, bool)
+	Put(key, val string) error
+	Delete(key string) error
+	// Snapshot returns a copy the caller may keep and modify.
+	Snapshot() map[string]string
+	// Iterate visits every pair until f returns false.
+	Iterate(f func(key, val string) bool)
+	Size() int
+	// Reset replaces the whole content with data, which may be nil.
+	Reset(data map[string]string) error
+}
+
+type memoryStore struct {
+	data map[string]string
+}
+
+func NewMemoryStore() KVStore {
+	return &memoryStore{data: make(map[string]string)}
+}
+
+func (s *memoryStore) Get(key string) (string, bool) {
+	val, ok := s.data[key]
+	return val, ok
+}
+
+func (s *memoryStore) Put(key, val string) error {
+	s.data[key] = val
+	return nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	delete(s.data, key)
+	return nil
+}
+
+func (s *memoryStore) Snapshot() map[string]string {
+	ret := make(map[string]string, len(s.data))
+	for k, v := range s.data {
+		ret[k] = v
+	}
+	return ret
+}
+
+func (s *memoryStore) Iterate(f func(key, val string) bool) {
+	for k, v := range s.data {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func (s *memoryStore) Size() int {
+	return len(s.data)
+}
+
+func (s *memoryStore) Reset(data map[string]string) error {
+	s.data = make(map[string]string, len(data))
+	for k, v := range data {
+		s.data[k] = v
+	}
+	return nil
+}
+
+// storeWatch notes the keys written to the store while transfers run, for
+// their last pass.
+type storeWatch struct {
+	lock    sync.Mutex
+	running int32
+	written map[string]bool
+}
+
+func (w *storeWatch) start() {
+	w.lock.Lock()
+	if w.running == 0 {
+		w.written = make(map[string]bool)
+	}
+	atomic.AddInt32(&w.running, 1)
+	w.lock.Unlock()
+}
+
+func (w *storeWatch) note(key string) {
+	if atomic.LoadInt32(&w.running) == 0 {
+		return
+	}
+	w.lock.Lock()
+	if w.written != nil {
+		w.written[key] = true
+	}
+	w.lock.Unlock()
+}
+
+// stop returns the keys written since the first of the transfers running
+// started.
+func (w *storeWatch) stop() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	keys := make([]string, 0, len(w.written))
+	for k := range w.written {
+		keys = append(keys, k)
+	}
+	if atomic.AddInt32(&w.running, -1) == 0 {
+		w.written = nil
+	}
+	return keys
+}
+
+func (n *ChordNode) storePut(s KVStore, key, val string, fromFunc string) {
+	err := s.Put(key, val)
+	if s == n.store {
+		n.transfers.note(key)
+		n.filters.add(key)
+	}
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, fromFunc, "KVStore.Put", err)
+	}
+}
+
+func (n *ChordNode) storeDelete(s KVStore, key string, fromFunc string) {
+	err := s.Delete(key)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, fromFunc, "KVStore.Delete", err)
+	}
+}
+
+func (n *ChordNode) storeReset(s KVStore, data map[string]string, fromFunc string) {
+	err := s.Reset(data)
+	if s == n.store {
+		for k := range data {
+			n.filters.add(k)
+		}
+	}
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, fromFunc, "KVStore.Reset", err)
+	}
+}
+
+func (n *ChordNode) setStorage(store, preBackup KVStore) bool {
+	if s := n.life.get(); s != StateCreated && s != StateOffline {
+		n.log().Errorf("Trying to swap the storage of an online node.")
+		return false
+	}
+	n.storeLock.Lock()
+	n.store = store
+	n.meta = make(map[string]*valueMeta)
+	n.storeLock.Unlock()
+	n.preBackupLock.Lock()
+	n.preBackup = preBackup
+	n.backupOwners.reset()
+	n.preBackupLock.Unlock()
+	return true
+}
@@ -0,0 +1,201 @@
+package chord
+
+import (
+	"chord/ring"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The invariants of the successor list, as checkSuccessorList names them.
+const (
+	// InvariantFirstAlive: The first entry is the first live successor.
+	InvariantFirstAlive = "first-alive"
+	// InvariantRingOrder: Up to this node itself, the entries go clockwise
+	// around the ring.
+	InvariantRingOrder = "ring-order"
+	// InvariantNoDuplicates: No node comes twice before this node itself.
+	InvariantNoDuplicates = "no-duplicates"
+	// InvariantNoGaps: No entry follows an empty one.
+	InvariantNoGaps = "no-gaps"
+	// InvariantWrap: A list that reaches this node itself, in a ring smaller
+	// than the list, goes on around the ring again.
+	InvariantWrap = "wrap"
+)
+
+// SuccessorViolation is an invariant found broken, with the list it broke in.
+type SuccessorViolation struct {
+	Time      time.Time
+	Invariant string
+	Detail    string
+	List      [SuccessorListLen]string
+}
+
+type SuccessorCheckStatus struct {
+	Checks     uint64
+	Violations map[string]uint64
+	// Repairs counts the lists rewritten, and Raced those found changed by
+	// maintenance before the repair could be written, to check again.
+	Repairs uint64
+	Raced   uint64
+	Recent  []SuccessorViolation
+}
+
+type successorCheck struct {
+	lock       sync.Mutex
+	checks     uint64
+	violations map[string]uint64
+	repairs    uint64
+	raced      uint64
+	recent     []SuccessorViolation
+}
+
+func (c *successorCheck) record(found []SuccessorViolation, repaired, raced bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.checks++
+	if c.violations == nil {
+		c.violations = make(map[string]uint64)
+	}
+	for _, v := range found {
+		c.violations[v.Invariant]++
+	}
+	c.recent = append(c.recent, found...)
+	if len(c.recent) > successorViolationsLen {
+		c.recent = c.recent[len(c.recent)-successorViolationsLen:]
+	}
+	if repaired {
+		c.repairs++
+	}
+	if raced {
+		c.raced++
+	}
+}
+
+func (c *successorCheck) status() SuccessorCheckStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ret := SuccessorCheckStatus{Checks: c.checks, Violations: make(map[string]uint64), Repairs: c.repairs, Raced: c.raced}
+	for k, v := range c.violations {
+		ret.Violations[k] = v
+	}
+	ret.Recent = append(ret.Recent, c.recent...)
+	return ret
+}
+
+// verifySuccessors checks list, the successor list of self, and returns it
+// repaired along with the invariants it broke. Gaps are closed, entries out
+// of order or repeated dropped, a wrap that does not go around again cut off,
+// and dead entries in front of the first live one skipped; the list shortened
+// is left for refillSuccessors to grow back.
+func verifySuccessors(self string, list [SuccessorListLen]string, alive func(addr string) bool) (ret [SuccessorListLen]string, found []SuccessorViolation) {
+	fail := func(invariant, format string, args ...interface{}) {
+		found = append(found, SuccessorViolation{Time: time.Now(), Invariant: invariant, Detail: fmt.Sprintf(format, args...), List: list})
+	}
+	var entries []string
+	gap := false
+	for i, s := range list {
+		if s == NULL {
+			gap = true
+			continue
+		}
+		if gap {
+			fail(InvariantNoGaps, "entry %v [%v] follows an empty one", i, s)
+			gap = false
+		}
+		entries = append(entries, s)
+	}
+	// The entries before this node itself, each further round than the last.
+	selfId := NodeId(self)
+	var ahead []string
+	last := big.NewInt(0)
+	wrap := len(entries)
+	for i, s := range entries {
+		if s == self {
+			wrap = i
+			break
+		}
+		d := ring.Distance(selfId, NodeId(s))
+		switch d.Cmp(last) {
+		case 0:
+			fail(InvariantNoDuplicates, "[%v] comes again", s)
+			continue
+		case -1:
+			fail(InvariantRingOrder, "[%v] comes after a node further round the ring", s)
+			continue
+		}
+		ahead = append(ahead, s)
+		last = d
+	}
+	kept := append([]string(nil), ahead...)
+	if wrap < len(entries) {
+		cycle := append(append([]string(nil), ahead...), self)
+		for i, s := range entries[wrap:] {
+			if want := cycle[(len(ahead)+i)%len(cycle)]; s != want {
+				fail(InvariantWrap, "[%v] is where [%v] would come again", s, want)
+				break
+			}
+			kept = append(kept, s)
+		}
+	}
+	first := 0
+	for first < len(kept) && kept[first] != self && !alive(kept[first]) {
+		first++
+	}
+	if first == len(kept) {
+		// Nothing alive to put first: stabilize will have to find a successor.
+		first = 0
+	} else if first > 0 {
+		fail(InvariantFirstAlive, "%v dead entries ahead of [%v]", first, kept[first])
+	}
+	copy(ret[:], kept[first:])
+	return ret, found
+}
+
+// checkSuccessorList verifies the successor list and writes back its repair,
+// unless maintenance changed the list meanwhile.
+func (n *ChordNode) checkSuccessorList() {
+	n.sucLock.RLock()
+	list := n.successorList
+	n.sucLock.RUnlock()
+	if list[0] == NULL {
+		return
+	}
+	repaired, found := verifySuccessors(n.addr, list, n.alive)
+	if len(found) == 0 {
+		n.sucCheck.record(nil, false, false)
+		return
+	}
+	for _, v := range found {
+		n.maintenanceLog().Errorf("Successor list of [%v] breaks invariant %v: %v, in %v.", n.addr, v.Invariant, v.Detail, v.List)
+	}
+	n.sucLock.Lock()
+	raced := n.successorList != list
+	if !raced {
+		n.successorList = repaired
+	}
+	n.sucLock.Unlock()
+	n.sucCheck.record(found, !raced, raced)
+	if raced {
+		return
+	}
+	n.maintenanceLog().Infof("Repair successor list of [%v] to %v.", n.addr, repaired)
+	if repaired[0] != list[0] {
+		n.fireSuccessorChanged(list[0], repaired[0])
+		n.adoptSuccessor(repaired[0])
+	} else if repaired[0] != n.addr {
+		n.refillSuccessors(repaired[0])
+	}
+}
+
+func (n *ChordNode) serveSuccessorCheck(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.sucCheck.status())
+}
+
+// SuccessorCheckStatus returns what the background checks of the successor
+// list found and repaired.
+func (w *NodeWrapper) SuccessorCheckStatus() SuccessorCheckStatus {
+	return w.node.sucCheck.status()
+}
@@ -0,0 +1,198 @@
+package chord
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	TierSuperPeer = iota
+	TierLeaf
+)
+
+type LeafInfo struct {
+	Addr     string
+	LastSeen time.Time
+}
+
+// Leaves are nodes that never enter the ring. They attach to a super peer,
+// which routes their requests, and fail over to one of that super peer's
+// successors when it goes away, so churn among leaves never touches the ring.
+type leafState struct {
+	lock       sync.RWMutex
+	super      string
+	candidates [SuccessorListLen]string
+	attached   bool
+	stop       chan bool
+}
+
+type leafTable struct {
+	lock   sync.Mutex
+	leaves map[string]time.Time
+}
+
+func (n *ChordNode) AttachLeaf(leaf string, ret *[SuccessorListLen]string) error {
+	if n.tier != TierSuperPeer || !n.isOnline() {
+		return errors.New("not a super peer in the ring")
+	}
+	n.leaves.lock.Lock()
+	if n.leaves.leaves == nil {
+		n.leaves.leaves = make(map[string]time.Time)
+	}
+	if _, ok := n.leaves.leaves[leaf]; !ok {
+		n.maintenanceLog().Infof("Super peer [%v] accepts leaf [%v].", n.addr, leaf)
+	}
+	n.leaves.leaves[leaf] = time.Now()
+	n.leaves.lock.Unlock()
+	return n.GetSuccessorList(NULL, ret)
+}
+
+func (n *ChordNode) DetachLeaf(leaf string, _ *string) error {
+	n.leaves.lock.Lock()
+	delete(n.leaves.leaves, leaf)
+	n.leaves.lock.Unlock()
+	n.maintenanceLog().Infof("Leaf [%v] detached from super peer [%v].", leaf, n.addr)
+	return nil
+}
+
+func (n *ChordNode) leafList() []LeafInfo {
+	n.leaves.lock.Lock()
+	defer n.leaves.lock.Unlock()
+	ret := make([]LeafInfo, 0, len(n.leaves.leaves))
+	for addr, seen := range n.leaves.leaves {
+		if time.Since(seen) > leafTimeout {
+			delete(n.leaves.leaves, addr)
+			continue
+		}
+		ret = append(ret, LeafInfo{Addr: addr, LastSeen: seen})
+	}
+	return ret
+}
+
+func (n *ChordNode) LeafPut(kv Pair, ack *AckLevel) error {
+	var err error
+	*ack, err = n.putValue(kv.First, kv.Second, nil)
+	return err
+}
+
+func (n *ChordNode) LeafGet(key string, ret *string) error {
+	val, err := n.getValue(key, nil)
+	if err != nil {
+		return err
+	}
+	*ret = val
+	return nil
+}
+
+func (n *ChordNode) LeafDelete(key string, _ *string) error {
+	existed, err := n.deleteValue(key, nil)
+	if err == nil && !existed {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (n *ChordNode) attach(addr string) error {
+	n.leaf.lock.RLock()
+	attached := n.leaf.attached
+	n.leaf.lock.RUnlock()
+	if attached {
+		n.maintenanceLog().Errorf("Trying to attach an attached leaf.")
+		return ErrAlreadyJoined
+	}
+	if !n.attachTo(addr) {
+		return ErrUnavailable
+	}
+	n.leaf.lock.Lock()
+	n.leaf.attached = true
+	n.leaf.stop = make(chan bool, 1)
+	stop := n.leaf.stop
+	n.leaf.lock.Unlock()
+	n.maintenanceLog().Infof("Leaf [%v] attached to super peer [%v].", n.addr, addr)
+	go n.leafHeartbeat(stop)
+	n.fireJoinComplete(addr)
+	return nil
+}
+
+func (n *ChordNode) attachTo(addr string) bool {
+	var candidates [SuccessorListLen]string
+	err := n.call(addr, "ChordNode.AttachLeaf", n.addr, &candidates)
+	if err != nil {
+		n.logErrorFunctionCall(n.addr, "ChordNode.attachTo", "ChordNode.AttachLeaf", err)
+		return false
+	}
+	n.leaf.lock.Lock()
+	n.leaf.super = addr
+	n.leaf.candidates = candidates
+	n.leaf.lock.Unlock()
+	return true
+}
+
+func (n *ChordNode) leafHeartbeat(stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(leafHeartbeatTime):
+		}
+		n.leaf.lock.RLock()
+		super := n.leaf.super
+		n.leaf.lock.RUnlock()
+		if !n.attachTo(super) {
+			n.failover(super)
+		}
+	}
+}
+
+func (n *ChordNode) failover(failed string) bool {
+	n.leaf.lock.RLock()
+	candidates := n.leaf.candidates
+	n.leaf.lock.RUnlock()
+	for _, c := range candidates {
+		if c != NULL && c != failed && n.attachTo(c) {
+			n.maintenanceLog().Infof("Leaf [%v] failed over from [%v] to [%v].", n.addr, failed, c)
+			return true
+		}
+	}
+	n.maintenanceLog().Errorf("Leaf [%v] found no super peer to fail over to.", n.addr)
+	return false
+}
+
+// leafCall forwards a request to the super peer, failing over once if the
+// super peer cannot be reached at all.
+func (n *ChordNode) leafCall(serviceMethod string, args interface{}, reply interface{}) error {
+	n.leaf.lock.RLock()
+	super, attached := n.leaf.super, n.leaf.attached
+	n.leaf.lock.RUnlock()
+	if !attached {
+		return errors.New("leaf is not attached")
+	}
+	err := n.call(super, serviceMethod, args, reply)
+	if !isTransportError(err) {
+		return err
+	}
+	if !n.failover(super) {
+		return err
+	}
+	n.leaf.lock.RLock()
+	super = n.leaf.super
+	n.leaf.lock.RUnlock()
+	return n.call(super, serviceMethod, args, reply)
+}
+
+func (n *ChordNode) detach() {
+	n.leaf.lock.Lock()
+	super, attached := n.leaf.super, n.leaf.attached
+	n.leaf.attached = false
+	if attached {
+		n.leaf.stop <- true
+	}
+	n.leaf.lock.Unlock()
+	if !attached {
+		n.maintenanceLog().Errorf("Trying to detach a leaf that is not attached.")
+		return
+	}
+	_ = n.call(super, "ChordNode.DetachLeaf", n.addr, nil)
+	n.maintenanceLog().Infof("Leaf [%v] detached from super peer [%v].", n.addr, super)
+}
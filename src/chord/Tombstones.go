@@ -0,0 +1,88 @@
+package chord
+
+import (
+	"sync"
+	"time"
+)
+
+// tombstoneTable remembers keys deleted in the last tombstoneTTL, in the
+// store or the pre backup, so that copies replayed from elsewhere (a backup
+// append, a promotion, a quit handoff) do not bring them back. A new write
+// of the key clears its tombstone.
+type tombstoneTable struct {
+	lock sync.Mutex
+	at   map[string]time.Time
+}
+
+func (t *tombstoneTable) add(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.at == nil {
+		t.at = make(map[string]time.Time)
+	}
+	now := time.Now()
+	t.at[key] = now
+	if len(t.at)%tombstoneSweepEvery == 0 {
+		for k, at := range t.at {
+			if now.Sub(at) > tombstoneTTL {
+				delete(t.at, k)
+			}
+		}
+	}
+}
+
+func (t *tombstoneTable) clear(key string) {
+	t.lock.Lock()
+	delete(t.at, key)
+	t.lock.Unlock()
+}
+
+func (t *tombstoneTable) reset() {
+	t.lock.Lock()
+	t.at = nil
+	t.lock.Unlock()
+}
+
+func (t *tombstoneTable) has(key string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	at, ok := t.at[key]
+	return ok && time.Since(at) <= tombstoneTTL
+}
+
+// filter drops tombstoned keys from data in place.
+func (t *tombstoneTable) filter(data map[string]string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for k := range data {
+		if at, ok := t.at[k]; ok && time.Since(at) <= tombstoneTTL {
+			delete(data, k)
+		}
+	}
+}
+
+func (t *tombstoneTable) recent() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ret := make([]string, 0, len(t.at))
+	for k, at := range t.at {
+		if time.Since(at) <= tombstoneTTL {
+			ret = append(ret, k)
+		}
+	}
+	return ret
+}
+
+// DeleteManyInPreBackup applies tombstones to the pre backup. Keys it does
+// not hold are tombstoned all the same.
+func (n *ChordNode) DeleteManyInPreBackup(keys []string, _ *string) error {
+	n.preBackupLock.Lock()
+	for _, k := range keys {
+		n.backupDelete(k, "ChordNode.DeleteManyInPreBackup")
+		n.seeding.note(k, nil)
+		n.tombstones.add(k)
+	}
+	n.preBackupLock.Unlock()
+	n.replication.backupUpdated()
+	return nil
+}
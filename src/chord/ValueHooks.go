@@ -0,0 +1,162 @@
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrRejected: A write or read hook on the key's owner turned the value down.
+// The error is a *RejectedError naming the hook and why, and errors.Is
+// matches it with ErrRejected.
+var ErrRejected = errors.New("value rejected")
+
+// RejectedError is the ErrRejected of one hook. It reaches a remote caller as
+// text, which classifyError parses back.
+type RejectedError struct {
+	Hook   string
+	Reason string
+}
+
+const rejectedPrefix = "value rejected by hook "
+
+func (e *RejectedError) Error() string {
+	return rejectedPrefix + e.Hook + ": " + e.Reason
+}
+
+func (e *RejectedError) Is(target error) bool {
+	return target == ErrRejected
+}
+
+func parseRejected(text string) (*RejectedError, bool) {
+	if !strings.HasPrefix(text, rejectedPrefix) {
+		return nil, false
+	}
+	hook, reason, ok := strings.Cut(strings.TrimPrefix(text, rejectedPrefix), ": ")
+	if !ok {
+		return nil, false
+	}
+	return &RejectedError{Hook: hook, Reason: reason}, true
+}
+
+// WriteHook checks a value written to key and returns the value to store in
+// its place, which may be the same, or an error saying why it is refused.
+type WriteHook func(key, value string) (string, error)
+
+// ReadHook turns a stored value of key into the value read, or refuses the
+// read with an error. ErrNotFound reads as the key not being there, for a
+// value a freshness check finds too old.
+type ReadHook func(key, value string) (string, error)
+
+type namedHook struct {
+	name string
+	hook func(key, value string) (string, error)
+}
+
+// runHooks runs hooks over a value of key, in the order they were added,
+// each taking the value the one before returned. A content addressed value
+// must come out as it went in.
+func (n *ChordNode) runHooks(kind string, hooks []namedHook, key, value string) (string, error) {
+	for _, h := range hooks {
+		out, err := h.hook(key, value)
+		if err == ErrNotFound && kind == "Read" {
+			return NULL, err
+		}
+		if err == nil && n.contentAddressed && out != value {
+			err = errors.New("changed a content addressed value")
+		}
+		if err != nil {
+			n.storageLog().Infof("%v hook [%v] of node [%v] rejects key [%v]: %v.", kind, h.name, n.addr, key, err)
+			return NULL, &RejectedError{Hook: h.name, Reason: err.Error()}
+		}
+		value = out
+	}
+	return value, nil
+}
+
+// acceptWrite runs the write hooks over a value written to key. A value
+// moving between nodes was accepted when it was written and does not pass
+// them again.
+func (n *ChordNode) acceptWrite(key, value string) (string, error) {
+	n.hooks.lock.RLock()
+	hooks := n.hooks.write
+	n.hooks.lock.RUnlock()
+	value, err := n.runHooks("Write", hooks, key, value)
+	if err == nil {
+		err = n.acceptSize(key, value)
+	}
+	return value, err
+}
+
+// readValue runs the read hooks over a stored value of key. An erasure
+// coding manifest is left alone, for the node decoding the value to pass
+// the value through them instead.
+func (n *ChordNode) readValue(key, value string) (string, error) {
+	n.hooks.lock.RLock()
+	hooks := n.hooks.read
+	n.hooks.lock.RUnlock()
+	if len(hooks) == 0 {
+		return value, nil
+	}
+	if _, isManifest := parseManifest(value); isManifest {
+		return value, nil
+	}
+	return n.runHooks("Read", hooks, key, value)
+}
+
+// acceptBatch runs the write hooks over every pair of batch, and turns the
+// whole batch down if any pair is.
+func (n *ChordNode) acceptBatch(batch map[string]string) (map[string]string, error) {
+	n.hooks.lock.RLock()
+	none := len(n.hooks.write) == 0
+	n.hooks.lock.RUnlock()
+	if none {
+		for k, v := range batch {
+			if err := n.acceptSize(k, v); err != nil {
+				return nil, err
+			}
+		}
+		return batch, nil
+	}
+	ret := make(map[string]string, len(batch))
+	for k, v := range batch {
+		out, err := n.acceptWrite(k, v)
+		if err != nil {
+			return nil, err
+		}
+		ret[k] = out
+	}
+	return ret, nil
+}
+
+// AddWriteHook has the node run h over every value written to a key it owns
+// before taking it. Hooks run on the write's goroutine, holding none of the
+// node's locks, and every node of the ring needs the same hooks: an erasure
+// coded value is checked by the node that codes it, since its owner only
+// ever sees the manifest.
+func (w *NodeWrapper) AddWriteHook(name string, h WriteHook) {
+	w.node.hooks.lock.Lock()
+	w.node.hooks.write = append(w.node.hooks.write, namedHook{name: name, hook: h})
+	w.node.hooks.lock.Unlock()
+}
+
+// AddReadHook has the node run h over every value read from a key it owns,
+// or holds the replica of, before answering. As with write hooks, every node
+// of the ring needs the same read hooks, and they run on the read's
+// goroutine. The node and client caches keep what the hooks returned, so
+// a freshness check only sees the reads that reach the store.
+func (w *NodeWrapper) AddReadHook(name string, h ReadHook) {
+	w.node.hooks.lock.Lock()
+	w.node.hooks.read = append(w.node.hooks.read, namedHook{name: name, hook: h})
+	w.node.hooks.lock.Unlock()
+}
+
+// MaxValueSize is a write hook refusing values longer than max bytes.
+func MaxValueSize(max int) WriteHook {
+	return func(_, value string) (string, error) {
+		if len(value) > max {
+			return NULL, fmt.Errorf("%v bytes is over the limit of %v", len(value), max)
+		}
+		return value, nil
+	}
+}
@@ -0,0 +1,116 @@
+package chord
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// worker is one of the node's background loops: step runs a round of its
+// task and returns how long to wait for the next.
+type worker struct {
+	name string
+	step func() time.Duration
+}
+
+// periodic is a worker that runs task every interval while when holds.
+func periodic(name string, interval time.Duration, when func() bool, task func()) worker {
+	return worker{name: name, step: func() time.Duration {
+		if when() {
+			task()
+		}
+		return interval
+	}}
+}
+
+// workerPool runs the maintenance workers of one lifecycle of the node, from
+// run until quit, and starts them over on the next run or join. Each start
+// gets its own context, so a pool stopping never waits on the workers of
+// the next.
+type workerPool struct {
+	lock    sync.Mutex
+	cancel  context.CancelFunc
+	done    *sync.WaitGroup
+	running map[string]bool
+}
+
+// start starts workers unless they are running already, and tells whether
+// it did.
+func (p *workerPool) start(workers []worker) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.cancel != nil {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := new(sync.WaitGroup)
+	p.cancel, p.done = cancel, done
+	p.running = make(map[string]bool, len(workers))
+	for _, w := range workers {
+		p.running[w.name] = true
+		done.Add(1)
+		go func(w worker) {
+			defer done.Done()
+			timer := time.NewTimer(0)
+			defer timer.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-timer.C:
+				}
+				timer.Reset(w.step())
+			}
+		}(w)
+	}
+	return true
+}
+
+// stop stops the workers and waits up to timeout for the rounds in progress
+// to end. It tells whether they all did.
+func (p *workerPool) stop(timeout time.Duration) bool {
+	p.lock.Lock()
+	cancel, done := p.cancel, p.done
+	p.cancel, p.done, p.running = nil, nil, nil
+	p.lock.Unlock()
+	if cancel == nil {
+		return true
+	}
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		done.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (p *workerPool) names() []string {
+	p.lock.Lock()
+	ret := make([]string, 0, len(p.running))
+	for name := range p.running {
+		ret = append(ret, name)
+	}
+	p.lock.Unlock()
+	sort.Strings(ret)
+	return ret
+}
+
+// stopWorkers ends this lifecycle's maintenance. A worker still in its round
+// stops when the round ends.
+func (n *ChordNode) stopWorkers() {
+	if !n.workers.stop(workerStopTimeout) {
+		n.maintenanceLog().Errorf("Node [%v] stops with maintenance rounds still running.", n.addr)
+	}
+}
+
+// Workers returns the names of the maintenance workers running.
+func (w *NodeWrapper) Workers() []string {
+	return w.node.workers.names()
+}
@@ -0,0 +1,207 @@
+package chord
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ZoneTraffic counts the calls of one kind this node made, and the bytes
+// they sent and received.
+type ZoneTraffic struct {
+	Calls         uint64
+	Errors        uint64
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// ZoneMetrics split the calls this node made by the zones of the peers
+// called: Intra those within its own zone, Cross those to another, and
+// Unknown those to peers whose zone it has not learned, or that have none.
+// Every call is counted once, by the node that made it, with the bytes both
+// ways, so the metrics of all the nodes add up to the ring's rpc traffic.
+// Pings, which only open a connection, are not counted.
+type ZoneMetrics struct {
+	Zone    string
+	Intra   ZoneTraffic
+	Cross   ZoneTraffic
+	Unknown ZoneTraffic
+	// ByZone splits the calls by the peer's zone, and CrossByMethod the cross
+	// zone calls by method, to tell which traffic to keep within a zone.
+	ByZone        map[string]ZoneTraffic
+	CrossByMethod map[string]ZoneTraffic
+}
+
+type callTraffic struct {
+	sent     int64
+	received int64
+}
+
+func (z *ZoneTraffic) add(traffic callTraffic, err error) {
+	z.Calls++
+	if err != nil {
+		z.Errors++
+	}
+	z.BytesSent += uint64(traffic.sent)
+	z.BytesReceived += uint64(traffic.received)
+}
+
+type peerZone struct {
+	zone string
+	at   time.Time
+}
+
+// zoneTable holds this node's zone, the zones learned of its peers, and the
+// traffic to them. A peer's zone is asked for once per zoneCacheTime, off the
+// call path.
+type zoneTable struct {
+	lock          sync.Mutex
+	zone          string
+	peers         map[string]peerZone
+	intra         ZoneTraffic
+	cross         ZoneTraffic
+	unknown       ZoneTraffic
+	byZone        map[string]*ZoneTraffic
+	crossByMethod map[string]*ZoneTraffic
+	learning      repairTable
+}
+
+func (t *zoneTable) own() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.zone
+}
+
+func (t *zoneTable) peer(addr string) (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p, ok := t.peers[addr]
+	if !ok || time.Since(p.at) > zoneCacheTime {
+		return NULL, false
+	}
+	return p.zone, true
+}
+
+func (t *zoneTable) learned(addr, zone string) {
+	t.lock.Lock()
+	if t.peers == nil {
+		t.peers = make(map[string]peerZone)
+	}
+	t.peers[addr] = peerZone{zone: zone, at: time.Now()}
+	t.lock.Unlock()
+}
+
+func (t *zoneTable) metrics() ZoneMetrics {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ret := ZoneMetrics{
+		Zone:          t.zone,
+		Intra:         t.intra,
+		Cross:         t.cross,
+		Unknown:       t.unknown,
+		ByZone:        make(map[string]ZoneTraffic, len(t.byZone)),
+		CrossByMethod: make(map[string]ZoneTraffic, len(t.crossByMethod)),
+	}
+	for k, v := range t.byZone {
+		ret.ByZone[k] = *v
+	}
+	for k, v := range t.crossByMethod {
+		ret.CrossByMethod[k] = *v
+	}
+	return ret
+}
+
+// GetZone returns this node's zone, empty if it has none.
+func (n *ChordNode) GetZone(_ string, ret *string) error {
+	*ret = n.zones.own()
+	return nil
+}
+
+// learnZone asks addr for its zone off the call path. A peer that cannot
+// answer is taken to have none until the cache entry expires.
+func (n *ChordNode) learnZone(addr string) {
+	if !n.zones.learning.begin(addr) {
+		return
+	}
+	go func() {
+		defer n.zones.learning.end(addr)
+		var zone string
+		if err := n.countedCall(addr, "ChordNode.GetZone", NULL, &zone); isTransportError(err) {
+			return
+		}
+		n.zones.learned(addr, zone)
+	}()
+}
+
+// countedCall is a call made without call's bookkeeping of the peer's
+// health, as probes and zone lookups are, counted by zone all the same.
+func (n *ChordNode) countedCall(addr string, serviceMethod string, args interface{}, reply interface{}) error {
+	traffic, err := rpcCallMetered(addr, n.codec, serviceMethod, args, reply)
+	n.accountZoneTraffic(addr, serviceMethod, traffic, err)
+	return err
+}
+
+// accountZoneTraffic counts a call to addr by its zone, if this node has one.
+func (n *ChordNode) accountZoneTraffic(addr, serviceMethod string, traffic callTraffic, err error) {
+	own := n.zones.own()
+	if own == NULL {
+		return
+	}
+	zone, known := n.zones.peer(addr)
+	if !known {
+		n.learnZone(addr)
+	}
+	t := &n.zones
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch {
+	case !known || zone == NULL:
+		t.unknown.add(traffic, err)
+		return
+	case zone == own:
+		t.intra.add(traffic, err)
+	default:
+		t.cross.add(traffic, err)
+		if t.crossByMethod == nil {
+			t.crossByMethod = make(map[string]*ZoneTraffic)
+		}
+		m, ok := t.crossByMethod[serviceMethod]
+		if !ok {
+			m = new(ZoneTraffic)
+			t.crossByMethod[serviceMethod] = m
+		}
+		m.add(traffic, err)
+	}
+	if t.byZone == nil {
+		t.byZone = make(map[string]*ZoneTraffic)
+	}
+	z, ok := t.byZone[zone]
+	if !ok {
+		z = new(ZoneTraffic)
+		t.byZone[zone] = z
+	}
+	z.add(traffic, err)
+}
+
+func (n *ChordNode) serveZoneMetrics(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, n.zones.metrics())
+}
+
+// SetZone labels the node with the zone it runs in, such as a datacenter,
+// and starts counting its calls within and across zones; empty drops the
+// label. The counts so far are kept.
+func (w *NodeWrapper) SetZone(zone string) bool {
+	if strings.TrimSpace(zone) != zone {
+		w.node.log().Errorf("Invalid zone [%v].", zone)
+		return false
+	}
+	w.node.zones.lock.Lock()
+	w.node.zones.zone = zone
+	w.node.zones.lock.Unlock()
+	return true
+}
+
+func (w *NodeWrapper) ZoneMetrics() ZoneMetrics {
+	return w.node.zones.metrics()
+}
@@ -0,0 +1,159 @@
+package chord
+
+import (
+	"chord/ring"
+	"encoding/binary"
+	"math/big"
+	"strconv"
+	"testing"
+)
+
+// fuzzId reads an identifier from fuzz input, reduced onto the ring.
+func fuzzId(b []byte) *big.Int {
+	return ring.Mask(new(big.Int).SetBytes(b))
+}
+
+func turn(x, d *big.Int) *big.Int {
+	ret := new(big.Int).Add(x, d)
+	return ret.Mod(ret, ring.Mod)
+}
+
+var (
+	fuzzZero = []byte{0}
+	fuzzTop  = new(big.Int).Sub(ring.Mod, big.NewInt(1)).Bytes()
+	fuzzMid  = new(big.Int).Rsh(ring.Mod, 1).Bytes()
+)
+
+func FuzzWithin(f *testing.F) {
+	f.Add(fuzzZero, fuzzZero, fuzzZero, []byte{1}, false)
+	f.Add(fuzzZero, fuzzTop, fuzzMid, fuzzMid, true)
+	f.Add(fuzzTop, fuzzMid, fuzzZero, fuzzTop, false)
+	f.Add(fuzzMid, fuzzMid, fuzzMid, fuzzZero, true)
+	f.Add([]byte{5}, []byte{9}, []byte{2}, []byte{7}, false)
+	f.Fuzz(func(t *testing.T, xb, ab, bb, db []byte, closed bool) {
+		x, a, b, d := fuzzId(xb), fuzzId(ab), fuzzId(bb), fuzzId(db)
+		in := within(x, a, b, closed)
+		if in != within(turn(x, d), turn(a, d), turn(b, d), closed) {
+			t.Fatalf("within(%v, %v, %v, %v) changes when the ring is turned by %v", x, a, b, closed, d)
+		}
+		if in != ring.FromBig(x).Within(ring.FromBig(a), ring.FromBig(b), closed) {
+			t.Fatalf("within(%v, %v, %v, %v) disagrees with ID.Within", x, a, b, closed)
+		}
+		switch {
+		case a.Cmp(b) == 0:
+			if want := closed || x.Cmp(a) != 0; in != want {
+				t.Fatalf("within(%v, %v, %v, %v) on the whole ring is %v", x, a, b, closed, in)
+			}
+		case x.Cmp(a) == 0:
+			if in {
+				t.Fatalf("within(%v, %v, %v, %v) contains its start", x, a, b, closed)
+			}
+		case x.Cmp(b) == 0:
+			if in != closed {
+				t.Fatalf("within(%v, %v, %v, %v) gets its end wrong", x, a, b, closed)
+			}
+		default:
+			if in == within(x, b, a, closed) {
+				t.Fatalf("within(%v, %v, %v, %v) is not the complement of the reversed interval", x, a, b, closed)
+			}
+		}
+	})
+}
+
+func FuzzStart(f *testing.F) {
+	f.Add(fuzzZero, uint8(0))
+	f.Add(fuzzTop, uint8(0))
+	f.Add(fuzzTop, uint8(M-1))
+	f.Add(fuzzMid, uint8(M-1))
+	f.Fuzz(func(t *testing.T, nb []byte, ib uint8) {
+		n, i := fuzzId(nb), int(ib)%M
+		s := start(n, i)
+		if s.Sign() < 0 || s.Cmp(ring.Mod) >= 0 {
+			t.Fatalf("start(%v, %v) = %v is off the ring", n, i, s)
+		}
+		if d := ring.Distance(n, s); d.Cmp(new(big.Int).Lsh(big.NewInt(1), uint(i))) != 0 {
+			t.Fatalf("start(%v, %v) is %v past the node", n, i, d)
+		}
+		if ring.FromBig(s) != ring.FromBig(n).Start(i) {
+			t.Fatalf("start(%v, %v) disagrees with ID.Start", n, i)
+		}
+		if i+1 < M && !within(s, n, start(n, i+1), false) {
+			t.Fatalf("start(%v, %v) is not before the next finger start", n, i)
+		}
+	})
+}
+
+// FuzzClosestPrecedingFinger builds a correct finger table over the nodes
+// named by the eight byte words of names, with those set in down marked
+// unusable, and checks the finger chosen towards the key.
+func FuzzClosestPrecedingFinger(f *testing.F) {
+	f.Add([]byte("one node"), fuzzZero, uint32(0))
+	f.Add([]byte("a ring of four nodes, two down"), fuzzTop, uint32(6))
+	f.Add([]byte("every node but this one is down............"), fuzzMid, ^uint32(0))
+	f.Fuzz(func(t *testing.T, names, kb []byte, down uint32) {
+		var nodes []string
+		for len(names) > 0 && len(nodes) < 32 {
+			var word [8]byte
+			names = names[copy(word[:], names):]
+			nodes = append(nodes, "node-"+strconv.FormatUint(binary.BigEndian.Uint64(word[:]), 36))
+		}
+		if len(nodes) == 0 {
+			return
+		}
+		ids := make(map[string]*big.Int)
+		isDown := make(map[string]bool)
+		for i, addr := range nodes {
+			ids[addr] = id(addr)
+			isDown[addr] = isDown[addr] || i > 0 && down&(1<<uint(i)) != 0
+		}
+		nId := ids[nodes[0]]
+		isDown[nodes[0]] = false
+		successor := func(k *big.Int) string {
+			best := NULL
+			for _, addr := range nodes {
+				if best == NULL || within(ids[addr], k, ids[best], true) {
+					best = addr
+				}
+			}
+			return best
+		}
+		fingers := make([]string, M)
+		for i := range fingers {
+			fingers[i] = successor(start(nId, i))
+		}
+		kId := fuzzId(kb)
+		asked := make(map[string]int)
+		i := precedingFinger(nId, kId, fingers, func(addr string) bool {
+			asked[addr]++
+			return !isDown[addr]
+		})
+		if i < -1 || i >= len(fingers) {
+			t.Fatalf("finger index %v towards %v is out of range", i, kId)
+		}
+		for addr, times := range asked {
+			if times > 1 {
+				t.Fatalf("usable asked %v times about [%v] towards %v", times, addr, kId)
+			}
+		}
+		if i < 0 {
+			for _, f := range fingers {
+				if !isDown[f] && within(ids[f], nId, kId, false) {
+					t.Fatalf("no finger chosen towards %v though [%v] precedes it", kId, f)
+				}
+			}
+			return
+		}
+		got := fingers[i]
+		if isDown[got] || !within(ids[got], nId, kId, false) {
+			t.Fatalf("finger [%v] chosen towards %v is down or does not precede it", got, kId)
+		}
+		for j, f := range fingers {
+			if j > i && f == got {
+				t.Fatalf("finger %v chosen towards %v though finger %v holds the same [%v]", i, kId, j, got)
+			}
+			if !isDown[f] && within(ids[f], ids[got], kId, false) {
+				t.Fatalf("finger [%v] chosen towards %v though live [%v] is closer", got, kId, f)
+			}
+		}
+	})
+}
@@ -0,0 +1,152 @@
+// Package koorde routes lookups over a de Bruijn graph (Koorde) on top of the
+// chord package's successor maintenance, storage and backups. A node keeps
+// the predecessor of 2^DigitBits times its own id together with that node's
+// successor list as de Bruijn neighbours, and every de Bruijn hop consumes
+// DigitBits bits of the key.
+package koorde
+
+import (
+	"errors"
+	"math/big"
+	"net/rpc"
+	"sync"
+
+	"chord"
+	"chord/ring"
+)
+
+type LookupRequest struct {
+	Key    *big.Int
+	KShift *big.Int
+	I      *big.Int
+	Hops   int
+}
+
+type Router struct {
+	w        *chord.NodeWrapper
+	lock     sync.RWMutex
+	deBruijn []string
+}
+
+type Service struct {
+	r *Router
+}
+
+func init() {
+	chord.RegisterProtocol("koorde", func(w *chord.NodeWrapper) {
+		Install(w)
+	})
+}
+
+func Install(w *chord.NodeWrapper) *Router {
+	r := &Router{w: w}
+	w.SetRouter(r)
+	w.RegisterService("Koorde", &Service{r: r})
+	w.ClassifyRPC("Koorde.Lookup", chord.RPCClassRouting)
+	return r
+}
+
+func (s *Service) Lookup(req LookupRequest, ret *string) error {
+	var err error
+	*ret, err = s.r.lookup(req)
+	return err
+}
+
+// FindSuccessor starts the walk at the imaginary node that shares the most
+// low bits with the key's top bits while still lying in (node, successor],
+// so fewer de Bruijn hops are needed.
+func (r *Router) FindSuccessor(kId *big.Int) (string, error) {
+	suc, err := r.w.Successor()
+	if err != nil {
+		return NULL, err
+	}
+	m, sId := id(r.w.Addr()), id(suc)
+	if within(kId, m, sId, true) {
+		return suc, nil
+	}
+	start, kShift := new(big.Int).Add(m, big.NewInt(1)), kId
+	ring.Mask(start)
+	for bits := uint(chord.M - DigitBits); bits > 0; bits -= DigitBits {
+		keep := new(big.Int).Rsh(m, bits)
+		keep.Lsh(keep, bits)
+		i := new(big.Int).Or(keep, new(big.Int).Rsh(kId, chord.M-bits))
+		if within(i, m, sId, true) {
+			start, kShift = i, shiftOut(kId, bits)
+			break
+		}
+	}
+	return r.lookup(LookupRequest{Key: kId, KShift: kShift, I: start})
+}
+
+func (r *Router) lookup(req LookupRequest) (string, error) {
+	if req.Hops > 2*chord.M {
+		return NULL, errors.New("koorde lookup exceeded hop limit")
+	}
+	suc, err := r.w.Successor()
+	if err != nil {
+		return NULL, err
+	}
+	m, sId := id(r.w.Addr()), id(suc)
+	if within(req.Key, m, sId, true) {
+		return suc, nil
+	}
+	next := LookupRequest{Key: req.Key, KShift: req.KShift, I: req.I, Hops: req.Hops + 1}
+	var ret string
+	if within(req.I, m, sId, true) {
+		i := shift(req.I, req.KShift, DigitBits)
+		shifted := LookupRequest{Key: req.Key, KShift: shiftOut(req.KShift, DigitBits), I: i, Hops: req.Hops + 1}
+		// Any live neighbour before i is a valid next hop: it walks its
+		// successors until i is between it and its successor.
+		for _, d := range r.preceding(i) {
+			err = r.w.Call(d, "Koorde.Lookup", shifted, &ret)
+			if _, isServerError := err.(rpc.ServerError); err == nil || isServerError {
+				return ret, err
+			}
+		}
+	}
+	err = r.w.Call(suc, "Koorde.Lookup", next, &ret)
+	return ret, err
+}
+
+// preceding lists the de Bruijn neighbours before tar, closest first.
+func (r *Router) preceding(tar *big.Int) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var ret []string
+	for j, d := range r.deBruijn {
+		if j > 0 && !within(id(d), id(r.deBruijn[j-1]), tar, false) {
+			break
+		}
+		ret = append([]string{d}, ret...)
+	}
+	return ret
+}
+
+// Maintain refreshes the de Bruijn neighbours: the predecessor of
+// 2^DigitBits * id plus its successor list.
+func (r *Router) Maintain() {
+	m := id(r.w.Addr())
+	tar := shiftOut(m, DigitBits)
+	owner, err := r.FindSuccessor(tar)
+	if err != nil {
+		r.w.Logger().Errorf("Koorde maintenance lookup failed, error message: [%v].", err)
+		return
+	}
+	var d string
+	err = r.w.Call(owner, "ChordNode.GetPredecessor", NULL, &d)
+	if err != nil || d == NULL {
+		d = owner
+	}
+	var list [chord.SuccessorListLen]string
+	_ = r.w.Call(d, "ChordNode.GetSuccessorList", NULL, &list)
+	neighbours := []string{d}
+	for _, s := range list {
+		if s == NULL || s == d {
+			break
+		}
+		neighbours = append(neighbours, s)
+	}
+	r.lock.Lock()
+	r.deBruijn = neighbours
+	r.lock.Unlock()
+}
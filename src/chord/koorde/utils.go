@@ -0,0 +1,33 @@
+package koorde
+
+import (
+	"math/big"
+
+	"chord"
+	"chord/ring"
+)
+
+const (
+	// DigitBits is the number of key bits consumed per de Bruijn hop, giving
+	// every node 2^DigitBits de Bruijn neighbours.
+	DigitBits = 2
+	NULL      = chord.NULL
+)
+
+var (
+	id     = chord.NodeId
+	within = ring.Within
+)
+
+// shift appends the top bits bits of from to x, dropping x's own top bits.
+func shift(x, from *big.Int, bits uint) *big.Int {
+	top := new(big.Int).Rsh(from, chord.M-bits)
+	ret := new(big.Int).Lsh(x, bits)
+	ret.Or(ret, top)
+	return ring.Mask(ret)
+}
+
+func shiftOut(x *big.Int, bits uint) *big.Int {
+	ret := new(big.Int).Lsh(x, bits)
+	return ring.Mask(ret)
+}
@@ -0,0 +1,308 @@
+// Package pastry routes lookups by prefix (Pastry) on top of the chord
+// package's successor maintenance, storage and backups. Keys still belong to
+// their successor, so the leaf set is the node's predecessor and successor
+// lists, and the routing table only has to bring a lookup close to the key.
+// Table slots prefer the candidate with the lowest measured round trip, and
+// the closest nodes seen so far form the neighbourhood set.
+package pastry
+
+import (
+	"errors"
+	"math/big"
+	"math/rand"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+
+	"chord"
+)
+
+type RouteRequest struct {
+	Key  *big.Int
+	Hops int
+}
+
+type State struct {
+	Table         [Digits][Base]string
+	Neighbourhood []string
+}
+
+type entry struct {
+	addr string
+	rtt  time.Duration
+}
+
+type Router struct {
+	w             *chord.NodeWrapper
+	lock          sync.RWMutex
+	table         [Digits][Base]entry
+	neighbourhood []entry
+	row           int
+}
+
+type Service struct {
+	r *Router
+}
+
+func init() {
+	chord.RegisterProtocol("pastry", func(w *chord.NodeWrapper) {
+		Install(w)
+	})
+}
+
+func Install(w *chord.NodeWrapper) *Router {
+	r := &Router{w: w}
+	w.SetRouter(r)
+	w.RegisterService("Pastry", &Service{r: r})
+	w.ClassifyRPC("Pastry.Route", chord.RPCClassRouting)
+	return r
+}
+
+func (s *Service) Route(req RouteRequest, ret *string) error {
+	var err error
+	*ret, err = s.r.route(req)
+	return err
+}
+
+func (s *Service) GetState(_ string, ret *State) error {
+	*ret = s.r.state()
+	return nil
+}
+
+func (r *Router) FindSuccessor(kId *big.Int) (string, error) {
+	return r.route(RouteRequest{Key: kId})
+}
+
+// leafSet lists the predecessors, this node and the successors in ring order,
+// stopping where the two lists meet on small rings.
+func (r *Router) leafSet() []string {
+	pres, sucs := r.w.PredecessorList(), r.w.SuccessorList()
+	var ret []string
+	seen := map[string]bool{r.w.Addr(): true}
+	for i := len(pres) - 1; i >= 0; i-- {
+		if pres[i] != NULL && !seen[pres[i]] {
+			seen[pres[i]] = true
+			ret = append(ret, pres[i])
+		}
+	}
+	ret = append(ret, r.w.Addr())
+	for _, s := range sucs {
+		if s == NULL || seen[s] {
+			break
+		}
+		seen[s] = true
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+func (r *Router) route(req RouteRequest) (string, error) {
+	if req.Hops > hopLimit {
+		return NULL, errors.New("pastry route exceeded hop limit")
+	}
+	suc, err := r.w.Successor()
+	if err != nil {
+		return NULL, err
+	}
+	k, m := req.Key, id(r.w.Addr())
+	if within(k, m, id(suc), true) {
+		return suc, nil
+	}
+	leaves := r.leafSet()
+	if len(leaves) > 1 && within(k, id(leaves[0]), id(leaves[len(leaves)-1]), true) {
+		for j := 1; j < len(leaves); j++ {
+			if within(k, id(leaves[j-1]), id(leaves[j]), true) {
+				return leaves[j], nil
+			}
+		}
+	}
+	next := RouteRequest{Key: k, Hops: req.Hops + 1}
+	var ret string
+	for _, hop := range r.nextHops(k) {
+		err = r.w.Call(hop, "Pastry.Route", next, &ret)
+		if _, isServerError := err.(rpc.ServerError); err == nil || isServerError {
+			return ret, err
+		}
+		r.forget(hop)
+	}
+	err = r.w.Call(suc, "Pastry.Route", next, &ret)
+	return ret, err
+}
+
+// nextHops lists where to forward k: the table slot sharing one more digit
+// with k, then every known node sharing at least as long a prefix with k as
+// this node does while being clockwise closer to it.
+func (r *Router) nextHops(k *big.Int) []string {
+	m := id(r.w.Addr())
+	l := prefixLen(m, k)
+	if l == Digits {
+		return nil
+	}
+	var ret []string
+	r.lock.RLock()
+	if e := r.table[l][digit(k, l)]; e.addr != NULL {
+		ret = append(ret, e.addr)
+	}
+	type candidate struct {
+		addr string
+		dist *big.Int
+	}
+	var rare []candidate
+	own := distance(m, k)
+	seen := map[string]bool{r.w.Addr(): true}
+	consider := func(addr string) {
+		if addr == NULL || seen[addr] {
+			return
+		}
+		seen[addr] = true
+		x := id(addr)
+		if prefixLen(x, k) >= l {
+			if d := distance(x, k); d.Cmp(own) < 0 {
+				rare = append(rare, candidate{addr, d})
+			}
+		}
+	}
+	for i := l; i < Digits; i++ {
+		for j := 0; j < Base; j++ {
+			consider(r.table[i][j].addr)
+		}
+	}
+	for _, e := range r.neighbourhood {
+		consider(e.addr)
+	}
+	r.lock.RUnlock()
+	for _, leaf := range r.leafSet() {
+		consider(leaf)
+	}
+	sort.Slice(rare, func(i, j int) bool {
+		return rare[i].dist.Cmp(rare[j].dist) < 0
+	})
+	for _, c := range rare {
+		ret = append(ret, c.addr)
+	}
+	return ret
+}
+
+func (r *Router) state() State {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var ret State
+	for i := 0; i < Digits; i++ {
+		for j := 0; j < Base; j++ {
+			ret.Table[i][j] = r.table[i][j].addr
+		}
+	}
+	for _, e := range r.neighbourhood {
+		ret.Neighbourhood = append(ret.Neighbourhood, e.addr)
+	}
+	return ret
+}
+
+func (r *Router) forget(addr string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := 0; i < Digits; i++ {
+		for j := 0; j < Base; j++ {
+			if r.table[i][j].addr == addr {
+				r.table[i][j] = entry{}
+			}
+		}
+	}
+	for i, e := range r.neighbourhood {
+		if e.addr == addr {
+			r.neighbourhood = append(r.neighbourhood[:i], r.neighbourhood[i+1:]...)
+			break
+		}
+	}
+}
+
+// learn offers addr for its routing table slot and the neighbourhood set. A
+// slot only changes hands when it is empty or the newcomer is closer.
+func (r *Router) learn(addr string) {
+	if addr == NULL || addr == r.w.Addr() {
+		return
+	}
+	m, x := id(r.w.Addr()), id(addr)
+	l := prefixLen(m, x)
+	if l == Digits {
+		return
+	}
+	d := digit(x, l)
+	r.lock.RLock()
+	cur := r.table[l][d]
+	known := false
+	for _, e := range r.neighbourhood {
+		known = known || e.addr == addr
+	}
+	full := len(r.neighbourhood) >= NeighbourhoodSize
+	var farthest time.Duration
+	if full {
+		farthest = r.neighbourhood[len(r.neighbourhood)-1].rtt
+	}
+	r.lock.RUnlock()
+	if cur.addr == addr && known {
+		return
+	}
+	delay, ok := rtt(addr)
+	if !ok {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.table[l][d].addr == NULL || r.table[l][d].addr == addr || delay < r.table[l][d].rtt {
+		r.table[l][d] = entry{addr: addr, rtt: delay}
+	}
+	if known || (full && delay >= farthest) {
+		return
+	}
+	r.neighbourhood = append(r.neighbourhood, entry{addr: addr, rtt: delay})
+	sort.Slice(r.neighbourhood, func(i, j int) bool {
+		return r.neighbourhood[i].rtt < r.neighbourhood[j].rtt
+	})
+	if len(r.neighbourhood) > NeighbourhoodSize {
+		r.neighbourhood = r.neighbourhood[:NeighbourhoodSize]
+	}
+}
+
+// Maintain learns the leaf set and then, one row per round, asks a node of
+// that row (or a leaf while the row is empty) for its state.
+func (r *Router) Maintain() {
+	for _, leaf := range r.leafSet() {
+		r.learn(leaf)
+	}
+	r.lock.Lock()
+	row := r.row
+	r.row = (r.row + 1) % Digits
+	var peers []string
+	for j := 0; j < Base; j++ {
+		if r.table[row][j].addr != NULL {
+			peers = append(peers, r.table[row][j].addr)
+		}
+	}
+	r.lock.Unlock()
+	if len(peers) == 0 {
+		peers = r.leafSet()
+		row = -1
+	}
+	peer := peers[rand.Intn(len(peers))]
+	if peer == r.w.Addr() {
+		return
+	}
+	var s State
+	if err := r.w.Call(peer, "Pastry.GetState", NULL, &s); err != nil {
+		r.forget(peer)
+		return
+	}
+	for i := 0; i < Digits; i++ {
+		if row >= 0 && i != row {
+			continue
+		}
+		for j := 0; j < Base; j++ {
+			r.learn(s.Table[i][j])
+		}
+	}
+	for _, addr := range s.Neighbourhood {
+		r.learn(addr)
+	}
+}
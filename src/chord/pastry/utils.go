@@ -0,0 +1,47 @@
+package pastry
+
+import (
+	"math/big"
+	"time"
+
+	"chord"
+	"chord/ring"
+)
+
+const (
+	// DigitBits is the width of one routing digit; the routing table has one
+	// row per digit and one column per digit value.
+	DigitBits         = 4
+	Digits            = chord.M / DigitBits
+	Base              = 1 << DigitBits
+	NeighbourhoodSize = 8
+	NULL              = chord.NULL
+
+	hopLimit = 4 * Digits
+)
+
+var (
+	id       = chord.NodeId
+	within   = ring.Within
+	distance = ring.Distance
+)
+
+func digit(x *big.Int, i int) int {
+	d := new(big.Int).Rsh(x, uint(chord.M-(i+1)*DigitBits))
+	return int(d.Int64() & (Base - 1))
+}
+
+func prefixLen(a, b *big.Int) int {
+	for i := 0; i < Digits; i++ {
+		if digit(a, i) != digit(b, i) {
+			return i
+		}
+	}
+	return Digits
+}
+
+func rtt(addr string) (time.Duration, bool) {
+	begin := time.Now()
+	ok := chord.Ping(addr)
+	return time.Since(begin), ok
+}
@@ -0,0 +1,171 @@
+// Package ring is the identifier arithmetic of a consistent-hashing ring of
+// 2^Bits points: hashing names onto the ring, clockwise intervals, distances
+// and finger starts. It has no dependency on the node, so other projects can
+// reuse it as is.
+//
+// Every function comes in two forms. ID is a fixed-size value type that can
+// be compared with == and used as a map key; the *big.Int forms are what the
+// chord, koorde and pastry packages route with. Both agree on every input.
+package ring
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	// Bits is the width of an identifier.
+	Bits = 160
+	// Size is the width of an identifier in bytes.
+	Size = Bits / 8
+)
+
+var (
+	// Mod is 2^Bits, the number of points on the ring.
+	Mod  = new(big.Int).Lsh(big.NewInt(1), Bits)
+	mask = new(big.Int).Sub(Mod, big.NewInt(1))
+)
+
+// ID is a point on the ring, big-endian.
+type ID [Size]byte
+
+var errBadID = fmt.Errorf("identifier must be %v hex digits", 2*Size)
+
+// Hash maps a name, such as a node address or a key, onto the ring.
+func Hash(name string) ID {
+	return ID(sha1.Sum([]byte(name)))
+}
+
+// FromBig reduces x modulo 2^Bits.
+func FromBig(x *big.Int) ID {
+	var ret ID
+	new(big.Int).And(x, mask).FillBytes(ret[:])
+	return ret
+}
+
+// ParseID reads the form String writes.
+func ParseID(s string) (ID, error) {
+	var ret ID
+	if len(s) != 2*Size {
+		return ret, errBadID
+	}
+	_, err := hex.Decode(ret[:], []byte(s))
+	if err != nil {
+		return ret, errors.New("identifier is not hex")
+	}
+	return ret, nil
+}
+
+func (a ID) Big() *big.Int {
+	return new(big.Int).SetBytes(a[:])
+}
+
+// String is the identifier as 40 zero-padded hex digits.
+func (a ID) String() string {
+	return hex.EncodeToString(a[:])
+}
+
+func (a ID) Cmp(b ID) int {
+	for i := 0; i < Size; i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Add is a + b around the ring.
+func (a ID) Add(b ID) ID {
+	var ret ID
+	carry := 0
+	for i := Size - 1; i >= 0; i-- {
+		s := int(a[i]) + int(b[i]) + carry
+		ret[i] = byte(s)
+		carry = s >> 8
+	}
+	return ret
+}
+
+// Sub is a - b around the ring.
+func (a ID) Sub(b ID) ID {
+	var ret ID
+	borrow := 0
+	for i := Size - 1; i >= 0; i-- {
+		d := int(a[i]) - int(b[i]) - borrow
+		borrow = 0
+		if d < 0 {
+			d += 256
+			borrow = 1
+		}
+		ret[i] = byte(d)
+	}
+	return ret
+}
+
+// Distance is how far a has to go clockwise to reach b.
+func (a ID) Distance(b ID) ID {
+	return b.Sub(a)
+}
+
+// Pow2 is 2^i for 0 <= i < Bits.
+func Pow2(i int) ID {
+	var ret ID
+	ret[Size-1-i/8] = 1 << (i % 8)
+	return ret
+}
+
+// Start is the start of a's i-th finger interval, a + 2^i.
+func (a ID) Start(i int) ID {
+	return a.Add(Pow2(i))
+}
+
+// Within reports whether a lies in the clockwise interval (start, end), or
+// (start, end] when endClosed. With start == end the interval is the whole
+// ring except start, plus start itself when endClosed.
+func (a ID) Within(start, end ID, endClosed bool) bool {
+	return within(a.Cmp(start), a.Cmp(end), start.Cmp(end), endClosed)
+}
+
+func within(tarStart, tarEnd, startEnd int, endClosed bool) bool {
+	afterStart := tarStart > 0
+	beforeEnd := tarEnd < 0 || endClosed && tarEnd == 0
+	if startEnd < 0 {
+		return afterStart && beforeEnd
+	}
+	return afterStart || beforeEnd
+}
+
+// Id is Hash as a *big.Int.
+func Id(name string) *big.Int {
+	h := sha1.Sum([]byte(name))
+	return new(big.Int).SetBytes(h[:])
+}
+
+// Within is ID.Within on *big.Int identifiers, which must already lie in
+// [0, 2^Bits).
+func Within(tar, start, end *big.Int, endClosed bool) bool {
+	return within(tar.Cmp(start), tar.Cmp(end), start.Cmp(end), endClosed)
+}
+
+// Start is ID.Start on a *big.Int identifier.
+func Start(n *big.Int, i int) *big.Int {
+	ret := new(big.Int).Add(n, new(big.Int).Lsh(big.NewInt(1), uint(i)))
+	return ret.Mod(ret, Mod)
+}
+
+// Distance is ID.Distance on *big.Int identifiers.
+func Distance(x, k *big.Int) *big.Int {
+	d := new(big.Int).Sub(k, x)
+	return d.Mod(d, Mod)
+}
+
+// Mask drops the bits of x above Bits.
+func Mask(x *big.Int) *big.Int {
+	return x.And(x, mask)
+}
@@ -0,0 +1,280 @@
+package ring
+
+import (
+	"math/big"
+	"testing"
+)
+
+func big10(s string) *big.Int {
+	ret, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic(s)
+	}
+	return ret
+}
+
+var top = new(big.Int).Sub(Mod, big.NewInt(1))
+
+func TestId(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"", "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+		{"abc", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{"127.0.0.1:8000", Hash("127.0.0.1:8000").String()},
+	}
+	for _, test := range tests {
+		got := Id(test.name)
+		if FromBig(got).String() != test.want {
+			t.Errorf("Id(%q) = %x, want %v", test.name, got, test.want)
+		}
+		if Hash(test.name).String() != test.want {
+			t.Errorf("Hash(%q) = %v, want %v", test.name, Hash(test.name), test.want)
+		}
+		if got.Sign() < 0 || got.Cmp(Mod) >= 0 {
+			t.Errorf("Id(%q) = %v is off the ring", test.name, got)
+		}
+	}
+}
+
+func TestWithin(t *testing.T) {
+	tests := []struct {
+		tar, start, end *big.Int
+		endClosed       bool
+		want            bool
+	}{
+		// Plain intervals.
+		{big.NewInt(5), big.NewInt(1), big.NewInt(9), false, true},
+		{big.NewInt(1), big.NewInt(1), big.NewInt(9), false, false},
+		{big.NewInt(1), big.NewInt(1), big.NewInt(9), true, false},
+		{big.NewInt(9), big.NewInt(1), big.NewInt(9), false, false},
+		{big.NewInt(9), big.NewInt(1), big.NewInt(9), true, true},
+		{big.NewInt(10), big.NewInt(1), big.NewInt(9), true, false},
+		{big.NewInt(0), big.NewInt(1), big.NewInt(9), true, false},
+		// Intervals that wrap past the top of the ring.
+		{top, big.NewInt(9), big.NewInt(1), false, true},
+		{big.NewInt(0), big.NewInt(9), big.NewInt(1), false, true},
+		{big.NewInt(0), top, big.NewInt(0), false, false},
+		{big.NewInt(0), top, big.NewInt(0), true, true},
+		{top, top, big.NewInt(0), true, false},
+		{big.NewInt(5), big.NewInt(9), big.NewInt(1), true, false},
+		{big.NewInt(1), big.NewInt(9), big.NewInt(1), true, true},
+		// Equal endpoints are the whole ring but the start.
+		{big.NewInt(5), big.NewInt(5), big.NewInt(5), false, false},
+		{big.NewInt(5), big.NewInt(5), big.NewInt(5), true, true},
+		{big.NewInt(6), big.NewInt(5), big.NewInt(5), false, true},
+		{big.NewInt(4), big.NewInt(5), big.NewInt(5), false, true},
+		{big.NewInt(0), top, top, false, true},
+		{top, top, top, false, false},
+	}
+	for _, test := range tests {
+		got := Within(test.tar, test.start, test.end, test.endClosed)
+		if got != test.want {
+			t.Errorf("Within(%v, %v, %v, %v) = %v, want %v", test.tar, test.start, test.end, test.endClosed, got, test.want)
+		}
+		got = FromBig(test.tar).Within(FromBig(test.start), FromBig(test.end), test.endClosed)
+		if got != test.want {
+			t.Errorf("ID.Within(%v, %v, %v, %v) = %v, want %v", test.tar, test.start, test.end, test.endClosed, got, test.want)
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	tests := []struct {
+		n    *big.Int
+		i    int
+		want *big.Int
+	}{
+		{big.NewInt(0), 0, big.NewInt(1)},
+		{big.NewInt(0), 3, big.NewInt(8)},
+		{big.NewInt(5), 1, big.NewInt(7)},
+		{top, 0, big.NewInt(0)},
+		{top, 2, big.NewInt(3)},
+		{big.NewInt(0), Bits - 1, new(big.Int).Rsh(Mod, 1)},
+		{new(big.Int).Rsh(Mod, 1), Bits - 1, big.NewInt(0)},
+		{top, Bits - 1, new(big.Int).Sub(new(big.Int).Rsh(Mod, 1), big.NewInt(1))},
+	}
+	for _, test := range tests {
+		got := Start(test.n, test.i)
+		if got.Cmp(test.want) != 0 {
+			t.Errorf("Start(%v, %v) = %v, want %v", test.n, test.i, got, test.want)
+		}
+		if id := FromBig(test.n).Start(test.i); id != FromBig(test.want) {
+			t.Errorf("ID.Start(%v, %v) = %v, want %v", test.n, test.i, id.Big(), test.want)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		x, k, want *big.Int
+	}{
+		{big.NewInt(1), big.NewInt(9), big.NewInt(8)},
+		{big.NewInt(9), big.NewInt(1), new(big.Int).Sub(Mod, big.NewInt(8))},
+		{big.NewInt(7), big.NewInt(7), big.NewInt(0)},
+		{top, big.NewInt(0), big.NewInt(1)},
+		{big.NewInt(0), top, top},
+	}
+	for _, test := range tests {
+		got := Distance(test.x, test.k)
+		if got.Cmp(test.want) != 0 {
+			t.Errorf("Distance(%v, %v) = %v, want %v", test.x, test.k, got, test.want)
+		}
+		if id := FromBig(test.x).Distance(FromBig(test.k)); id != FromBig(test.want) {
+			t.Errorf("ID.Distance(%v, %v) = %v, want %v", test.x, test.k, id.Big(), test.want)
+		}
+	}
+}
+
+func TestMask(t *testing.T) {
+	tests := []struct {
+		x, want *big.Int
+	}{
+		{big.NewInt(0), big.NewInt(0)},
+		{top, top},
+		{new(big.Int).Set(Mod), big.NewInt(0)},
+		{new(big.Int).Add(Mod, big.NewInt(3)), big.NewInt(3)},
+		{big10("1461501637330902918203684832716283019655932542977"), big.NewInt(1)},
+	}
+	for _, test := range tests {
+		x := new(big.Int).Set(test.x)
+		if got := Mask(x); got.Cmp(test.want) != 0 {
+			t.Errorf("Mask(%v) = %v, want %v", test.x, got, test.want)
+		}
+		if got := FromBig(test.x); got != FromBig(test.want) || got.Big().Cmp(test.want) != 0 {
+			t.Errorf("FromBig(%v) = %v, want %v", test.x, got.Big(), test.want)
+		}
+	}
+}
+
+func TestParseID(t *testing.T) {
+	tests := []struct {
+		s  string
+		ok bool
+	}{
+		{"da39a3ee5e6b4b0d3255bfef95601890afd80709", true},
+		{"0000000000000000000000000000000000000000", true},
+		{"ffffffffffffffffffffffffffffffffffffffff", true},
+		{"da39a3ee5e6b4b0d3255bfef95601890afd8070", false},
+		{"da39a3ee5e6b4b0d3255bfef95601890afd807090", false},
+		{"za39a3ee5e6b4b0d3255bfef95601890afd80709", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		id, err := ParseID(test.s)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseID(%q) error = %v, want ok %v", test.s, err, test.ok)
+			continue
+		}
+		if test.ok && id.String() != test.s {
+			t.Errorf("ParseID(%q).String() = %v", test.s, id)
+		}
+	}
+}
+
+// fuzzBig reads an identifier from fuzz input, reduced onto the ring.
+func fuzzBig(b []byte) *big.Int {
+	return Mask(new(big.Int).SetBytes(b))
+}
+
+func turn(x, d *big.Int) *big.Int {
+	ret := new(big.Int).Add(x, d)
+	return ret.Mod(ret, Mod)
+}
+
+var (
+	fuzzZero = []byte{0}
+	fuzzTop  = top.Bytes()
+	fuzzMid  = new(big.Int).Rsh(Mod, 1).Bytes()
+)
+
+func FuzzWithin(f *testing.F) {
+	f.Add(fuzzZero, fuzzZero, fuzzZero, fuzzTop, false)
+	f.Add(fuzzZero, fuzzTop, fuzzMid, fuzzMid, true)
+	f.Add(fuzzTop, fuzzMid, fuzzZero, fuzzTop, false)
+	f.Add([]byte{5}, []byte{9}, []byte{2}, []byte{7}, true)
+	f.Fuzz(func(t *testing.T, xb, ab, bb, db []byte, endClosed bool) {
+		x, a, b, d := fuzzBig(xb), fuzzBig(ab), fuzzBig(bb), fuzzBig(db)
+		in := Within(x, a, b, endClosed)
+		if in != FromBig(x).Within(FromBig(a), FromBig(b), endClosed) {
+			t.Fatalf("Within(%v, %v, %v, %v) disagrees with ID.Within", x, a, b, endClosed)
+		}
+		if in != Within(turn(x, d), turn(a, d), turn(b, d), endClosed) {
+			t.Fatalf("Within(%v, %v, %v, %v) changes when the ring is turned by %v", x, a, b, endClosed, d)
+		}
+		switch {
+		case a.Cmp(b) == 0:
+			if want := endClosed || x.Cmp(a) != 0; in != want {
+				t.Fatalf("Within(%v, %v, %v, %v) on the whole ring is %v", x, a, b, endClosed, in)
+			}
+		case x.Cmp(a) == 0:
+			if in {
+				t.Fatalf("Within(%v, %v, %v, %v) contains its start", x, a, b, endClosed)
+			}
+		case x.Cmp(b) == 0:
+			if in != endClosed {
+				t.Fatalf("Within(%v, %v, %v, %v) gets its end wrong", x, a, b, endClosed)
+			}
+		default:
+			if in == Within(x, b, a, endClosed) {
+				t.Fatalf("Within(%v, %v, %v, %v) is not the complement of the reversed interval", x, a, b, endClosed)
+			}
+			// Inside (a, b) is exactly being closer to a than b is.
+			if want := Distance(a, x).Cmp(Distance(a, b)) < 0; in != want {
+				t.Fatalf("Within(%v, %v, %v, %v) disagrees with the distances", x, a, b, endClosed)
+			}
+		}
+	})
+}
+
+func FuzzStart(f *testing.F) {
+	f.Add(fuzzZero, uint8(0))
+	f.Add(fuzzTop, uint8(0))
+	f.Add(fuzzTop, uint8(Bits-1))
+	f.Add(fuzzMid, uint8(Bits-1))
+	f.Fuzz(func(t *testing.T, nb []byte, ib uint8) {
+		n, i := fuzzBig(nb), int(ib)%Bits
+		s := Start(n, i)
+		if s.Sign() < 0 || s.Cmp(Mod) >= 0 {
+			t.Fatalf("Start(%v, %v) = %v is off the ring", n, i, s)
+		}
+		if FromBig(s) != FromBig(n).Start(i) {
+			t.Fatalf("Start(%v, %v) disagrees with ID.Start", n, i)
+		}
+		if Distance(n, s).Cmp(Pow2(i).Big()) != 0 {
+			t.Fatalf("Start(%v, %v) is %v past the node", n, i, Distance(n, s))
+		}
+		if i+1 < Bits && !Within(s, n, Start(n, i+1), false) {
+			t.Fatalf("Start(%v, %v) is not before the next finger start", n, i)
+		}
+	})
+}
+
+func FuzzArithmetic(f *testing.F) {
+	f.Add(fuzzZero, fuzzZero)
+	f.Add(fuzzTop, []byte{1})
+	f.Add(fuzzMid, fuzzMid)
+	f.Add([]byte{1}, fuzzTop)
+	f.Fuzz(func(t *testing.T, ab, bb []byte) {
+		a, b := FromBig(fuzzBig(ab)), FromBig(fuzzBig(bb))
+		if a.Add(b).Sub(b) != a {
+			t.Fatalf("%v + %v - %v is not %v", a, b, b, a)
+		}
+		if a.Add(a.Distance(b)) != b {
+			t.Fatalf("%v plus its distance to %v misses it", a, b)
+		}
+		if FromBig(Distance(a.Big(), b.Big())) != a.Distance(b) {
+			t.Fatalf("Distance(%v, %v) disagrees with ID.Distance", a, b)
+		}
+		if want := FromBig(new(big.Int).Add(a.Big(), b.Big())); a.Add(b) != want {
+			t.Fatalf("%v + %v = %v, want %v", a, b, a.Add(b), want)
+		}
+		if c := a.Cmp(b); c != a.Big().Cmp(b.Big()) || c != -b.Cmp(a) {
+			t.Fatalf("Cmp(%v, %v) = %v disagrees", a, b, c)
+		}
+		if got, err := ParseID(a.String()); err != nil || got != a {
+			t.Fatalf("ParseID(%v) = %v, %v", a, got, err)
+		}
+	})
+}
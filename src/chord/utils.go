@@ -1,28 +1,183 @@
 package chord
 
 import (
-	"crypto/sha1"
+	"chord/ring"
 	"errors"
 	log "github.com/sirupsen/logrus"
 	"math/big"
 	"net"
 	"net/rpc"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	M                 = 160
-	NULL              = ""
-	attempt           = 3
-	SuccessorListLen  = 5
-	dialPauseTime     = 500 * time.Millisecond
-	pingPauseTime     = 500 * time.Millisecond
-	maintainPauseTime = 100 * time.Millisecond
+	M                  = ring.Bits
+	NULL               = ""
+	attempt            = 3
+	SuccessorListLen   = 5
+	PredecessorListLen = 3
+	dialPauseTime      = 500 * time.Millisecond
+	pingPauseTime      = 500 * time.Millisecond
+	maintainPauseTime  = 100 * time.Millisecond
+
+	snapshotChunkSize      = 1024
+	snapshotSessionTimeout = 30 * time.Second
+
+	adminMutexProfileFraction = 5
+	adminBlockProfileRate     = int(time.Millisecond)
+
+	hookQueueLen             = 256
+	eventSubscriberBufferLen = 256
+
+	slowOpLogLen           = 512
+	slowOpDefaultThreshold = 500 * time.Millisecond
+
+	hotKeySketchDepth = 4
+	hotKeySketchWidth = 2048
+	hotKeyCandidates  = 64
+	hotKeyDefaultTopN = 10
+
+	leafHeartbeatTime = time.Second
+	leafTimeout       = 5 * leafHeartbeatTime
+
+	accordionMinCapacity   = 16
+	accordionMaxCapacity   = 1024
+	accordionDefaultBudget = 200
+	accordionChurnFailures = 2
+	accordionProbeAttempts = 2
+	accordionAdjustTime    = time.Second
+	accordionEntryTimeout  = time.Minute
+
+	routingHopBuckets = 16
+
+	bulkLoadLookupWorkers = 16
+	bulkLoadBatchSize     = 4096
+
+	auditCheckTime = time.Second
+
+	backupCheckTime   = time.Second
+	journalShipTime   = time.Second
+	journalMaxPending = 1 << 20
+
+	peerScoreHalfLife  = 30 * time.Second
+	peerBlacklistScore = 6
+	peerBlacklistTime  = time.Minute
+
+	lookupMaxInFlight          = 512
+	lookupMaxInFlightPerOrigin = 64
+	lookupRetryPauseTime       = 50 * time.Millisecond
+
+	maintainMinPauseTime = 50 * time.Millisecond
+	maintainMaxPauseTime = 800 * time.Millisecond
+	maintainStableRounds = 20
+
+	livenessFreshness  = time.Second
+	livenessGossipLen  = 32
+	swimIndirectProbes = 3
+
+	diskStoreCompactMinSize = 1 << 20
+
+	tombstoneTTL        = time.Minute
+	tombstoneSweepEvery = 1024
+
+	drainTimeout  = time.Second
+	drainPollTime = 10 * time.Millisecond
+
+	joinLeaseTime     = 2 * time.Second
+	joinLeaseWait     = 10 * time.Second
+	joinLeasePollTime = 50 * time.Millisecond
+
+	joinThrottleRetries   = 20
+	joinThrottlePauseTime = 200 * time.Millisecond
+	joinThrottleQueueTime = 2 * time.Second
+
+	cacheWriteBackQueueLen  = 1024
+	cacheWriteBackPauseTime = 100 * time.Millisecond
+	cacheSweepTime          = time.Second
+
+	keyLeaseMaxTTL     = time.Minute
+	keyLeaseSweepEvery = 1024
+
+	aggregateGossipTime  = 200 * time.Millisecond
+	aggregateEpochRounds = 25
+
+	backupReclaimTime = 5 * time.Second
+
+	replicationQueueLen        = 4096
+	replicationQueueBatch      = 256
+	replicationQueuePollTime   = 100 * time.Millisecond
+	replicationQueueMaxBackoff = 5 * time.Second
+	replicationQueueBlockTime  = time.Second
+
+	hotCacheTTL           = 10 * time.Second
+	hotCacheLen           = 1024
+	negativeCacheLen      = 4096
+	keyFilterRefreshTime  = 2 * time.Second
+	keyFilterMinKeys      = 64
+	invalidationFeedLen   = 4096
+	invalidationFlushTime = 50 * time.Millisecond
+
+	membershipGossipTime   = time.Second
+	successorCheckTime     = 2 * time.Second
+	successorViolationsLen = 32
+	maintenanceRoundsLen   = 1024
+	rpcClassWaitTime       = time.Second
+	rpcMaxMessageSize      = 4 << 20
+	messagePairOverhead    = 16
+	transferOutboxTTL      = 30 * time.Second
+	membershipJournalLen   = 256
+
+	adoptNotifyAttempts  = 10
+	adoptNotifyPauseTime = 100 * time.Millisecond
+
+	rttSmoothing          = 8
+	rttDeviationSmoothing = 4
+	rttProbeTime          = 2 * time.Second
+	rttProbeStale         = 10 * time.Second
+	rttProbeBatch         = 4
+	rttExpireTime         = 5 * time.Minute
+	replicaCacheTime      = 10 * time.Second
+	zoneCacheTime         = time.Minute
+	ringFreezeTime        = 30 * time.Minute
+	dryRunPlaceBatch      = 256
+
+	standbySyncTime = 2 * time.Second
+
+	overloadHoldTime = 2 * time.Second
+	overloadStretch  = 4
+
+	clientRefreshTime    = 5 * time.Second
+	clientDownTime       = 2 * time.Second
+	clientForgetFailures = 5
+
+	clientCacheLen             = 1024
+	clientInvalidationPollTime = 100 * time.Millisecond
+
+	clientBatchLen       = 256
+	clientBatchFlushTime = 10 * time.Millisecond
+
+	workerStopTimeout = 2 * time.Second
+
+	quitHandoffAttempts = 3
+	quitRetryPauseTime  = 200 * time.Millisecond
+
+	churnInitialNodes = 3
+	ChurnMaxNodes     = 16
+	churnKeys         = 16
+	churnReplicas     = 1
+	churnStableRounds = 3
+	churnSettleRounds = 40
+	churnSettleTime   = 5 * time.Second
+
+	recoverySettleTime = 10 * time.Second
+	recoveryMaxWait    = 30 * time.Second
+	recoveryPollTime   = 10 * time.Millisecond
+
+	rejoinGoroutineSlack = 16
 )
 
 var (
-	two     = big.NewInt(2)
-	mod     = new(big.Int).Exp(two, big.NewInt(int64(M)), nil)
 	ordinal = [attempt]string{"first", "second", "third"}
 )
 
@@ -31,66 +186,63 @@ type Pair struct {
 	Second string
 }
 
-func id(x string) (ret *big.Int) {
-	h := sha1.New()
-	h.Write([]byte(x))
-	ret = new(big.Int)
-	ret.SetBytes(h.Sum(nil))
-	return
+func id(x string) *big.Int {
+	return ring.Id(x)
 }
 
-func powOf2(power int) *big.Int {
-	return new(big.Int).Exp(two, big.NewInt(int64(power)), nil)
+// NodeId is the identifier of the node at addr, the hash of its identity, so
+// that a relocated node keeps its place on the ring.
+func NodeId(addr string) *big.Int {
+	return id(Identity(addr))
 }
 
 func start(nId *big.Int, i int) *big.Int {
-	return new(big.Int).Mod(new(big.Int).Add(nId, powOf2(i)), mod)
+	return ring.Start(nId, i)
 }
 
 func within(tar, start, end *big.Int, endClosed bool) bool {
-	if start.Cmp(end) < 0 {
-		if endClosed {
-			return start.Cmp(tar) < 0 && tar.Cmp(end) <= 0
-		} else {
-			return start.Cmp(tar) < 0 && tar.Cmp(end) < 0
-		}
-	} else {
-		if endClosed {
-			return start.Cmp(tar) < 0 || tar.Cmp(end) <= 0
-		} else {
-			return start.Cmp(tar) < 0 || tar.Cmp(end) < 0
-		}
-	}
+	return ring.Within(tar, start, end, endClosed)
 }
 
-func Dial(addr string) (*rpc.Client, error) {
+func Dial(addr string, codec Codec) (*rpc.Client, error) {
+	client, _, err := dialMetered(addr, codec)
+	return client, err
+}
+
+// dialMetered is Dial, also returning the connection under the client to
+// count the bytes that go over it.
+func dialMetered(addr string, codec Codec) (*rpc.Client, *meteredConn, error) {
 	if addr == NULL {
 		log.Errorf("Dial a null address.")
-		return nil, errors.New("dial a null address")
+		return nil, nil, errors.New("dial a null address")
 	}
 	var client *rpc.Client
+	var metered *meteredConn
 	errorChannel := make(chan error)
 	for i := 0; i < attempt; i++ {
 		go func() {
-			var err error
-			client, err = rpc.Dial("tcp", addr)
+			conn, err := net.Dial("tcp", NetAddr(addr))
+			if err == nil {
+				metered = &meteredConn{Conn: conn}
+				client = rpc.NewClientWithCodec(codec.NewClientCodec(metered))
+			}
 			errorChannel <- err
 		}()
 		select {
 		case err := <-errorChannel:
 			if err == nil {
 				log.Tracef("Dial address %v success.", addr)
-				return client, nil
+				return client, metered, nil
 			} else {
 				log.Tracef("Dial address [%v] failed, error message: [%v]", addr, err)
-				return nil, err
+				return nil, nil, err
 			}
 		case <-time.After(dialPauseTime):
 			log.Tracef("Dial address %v the %v time encountered a time out error.", addr, ordinal[i])
 		}
 	}
 	log.Errorf("Dial address %v time out.", addr)
-	return nil, errors.New("dial time out")
+	return nil, nil, errors.New("dial time out")
 }
 
 func Ping(addr string) bool {
@@ -98,10 +250,11 @@ func Ping(addr string) bool {
 		log.Tracef("Ping a null address.")
 		return false
 	}
+	auditRemoteCall(addr, "Ping")
 	errorChannel := make(chan error)
 	for i := 0; i < attempt; i++ {
 		go func() {
-			client, err := rpc.Dial("tcp", addr)
+			client, err := rpc.Dial("tcp", NetAddr(addr))
 			if err == nil {
 				_ = client.Close()
 			}
@@ -128,6 +281,10 @@ func logErrorFunctionCall(addr, fromFunc, toFunc string, err error) {
 	log.Errorf("[Addr:%v] In call from [%v] to [%v] failed, error message: [%v].", addr, fromFunc, toFunc, err)
 }
 
+func (n *ChordNode) logErrorFunctionCall(addr, fromFunc, toFunc string, err error) {
+	n.log().Errorf("[Addr:%v] In call from [%v] to [%v] failed, error message: [%v].", addr, fromFunc, toFunc, err)
+}
+
 func CloseClient(client *rpc.Client) {
 	err := client.Close()
 	if err != nil {
@@ -135,33 +292,47 @@ func CloseClient(client *rpc.Client) {
 	}
 }
 
+// Accept serves connections on listener until the node shuts its server
+// down, which is the only accept error it does not log.
 func Accept(server *rpc.Server, listener net.Listener, n *ChordNode) {
 	for {
 		conn, err := listener.Accept()
-		select {
-		case <-n.quitSignal:
-			return
-		default:
-			if err != nil {
-				log.Print("rpc.Serve: accept:", err.Error())
-				return
+		if err != nil {
+			if !n.conns.isClosed() {
+				n.log().Print("rpc.Serve: accept:", err.Error())
 			}
-			go server.ServeConn(conn)
+			return
 		}
+		go n.serveConn(server, conn)
 	}
 }
 
 func RPCCall(addr string, serviceMethod string, args interface{}, reply interface{}) error {
-	client, err := Dial(addr)
+	return RPCCallWithCodec(addr, defaultCodec, serviceMethod, args, reply)
+}
+
+func RPCCallWithCodec(addr string, codec Codec, serviceMethod string, args interface{}, reply interface{}) error {
+	_, err := rpcCallMetered(addr, codec, serviceMethod, args, reply)
+	return err
+}
+
+// rpcCallMetered is RPCCallWithCodec, also returning the bytes the call sent
+// and received.
+func rpcCallMetered(addr string, codec Codec, serviceMethod string, args interface{}, reply interface{}) (traffic callTraffic, err error) {
+	auditRemoteCall(addr, serviceMethod)
+	begin := time.Now()
+	defer func() { rpcMetrics.observe(addr, serviceMethod, time.Since(begin), err) }()
+	client, conn, err := dialMetered(addr, codec)
 	if err != nil {
 		log.Errorf("Dial address [%v] failed in RPCCall, error message: [%v].", addr, err)
-		return err
+		return traffic, err
 	}
 	defer CloseClient(client)
 	err = client.Call(serviceMethod, args, reply)
+	traffic = callTraffic{sent: atomic.LoadInt64(&conn.written), received: atomic.LoadInt64(&conn.read)}
 	if err != nil {
 		log.Errorf("Calling function [%v] failed in RPCCall, error message: [%v].", serviceMethod, err)
-		return err
+		return traffic, err
 	}
-	return nil
+	return traffic, nil
 }
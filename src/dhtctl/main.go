@@ -0,0 +1,576 @@
+package main
+
+import (
+	"chord"
+	_ "chord/koorde"
+	_ "chord/pastry"
+	chordring "chord/ring"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	codecName  string
+	seed       int64
+	protocol   string
+	basePort   int
+	shrinkRuns int
+	recordPath string
+	bound      time.Duration
+	dryRun     bool
+	salt       string
+	hashTags   bool
+)
+
+func usage() {
+	fmt.Println("Usage: dhtctl [-codec <name>] [-dry-run] <command> [args]")
+	fmt.Println("--------------------------------------------------------------------------------")
+	fmt.Println("[ring <addr>]          Walk the ring from <addr> and print every node.")
+	fmt.Println("[lookup <addr> <key>]  Look <key> up from <addr> and print every hop.")
+	fmt.Println("[distribution <addr> [samples]]")
+	fmt.Println("                       Print each node's share of the identifiers, by span and by sampled lookups, and of the keys.")
+	fmt.Println("[churn [steps]]        Play the churn script of -seed on local nodes and record a failure.")
+	fmt.Println("[replay <record>]      Play a churn script or record on local nodes.")
+	fmt.Println("[recovery [nodes]]     Force quit one of a local ring of nodes and time the recovery.")
+	fmt.Println("[rejoin [cycles]]      Quit nodes of a local ring and join the same nodes again, checking each cycle.")
+	fmt.Println("[failover [nodes]]     Force quit the successor of a node of a local ring and read its keys back (-tags failovertest).")
+	fmt.Println("[membership <file>]    Check a static membership file and print it in ring order with ids.")
+	fmt.Println("[backups <location>]   List the backups in a directory or s3://bucket/prefix location.")
+	fmt.Println("[restore <addr> <location> [backup...]]")
+	fmt.Println("                       Write backups, or the newest of every node, into the ring of <addr>.")
+	fmt.Println("[restore-range <addr> <location> <time> <from> [to]]")
+	fmt.Println("                       Put keys from <from> up to <to> back as they were at RFC 3339 <time>.")
+	fmt.Println("[delete-prefix <addr> <prefix>]")
+	fmt.Println("                       Delete every key starting with <prefix>, and its backups, from the ring of <addr>.")
+	fmt.Println("[who-owns <addr> <key...>]")
+	fmt.Println("                       Print the node that would store each key, and its replicas, without writing.")
+	fmt.Println("[freeze <addr> <duration> [reason]]")
+	fmt.Println("                       Freeze the ring of <addr> against joins and migrations for <duration>.")
+	fmt.Println("[thaw <addr> [reason]] Thaw the ring of <addr> before its freeze runs out.")
+	fmt.Println("Build with -tags lockorder to also report lock-order problems found by churn.")
+	fmt.Println("Build with -tags failovertest to also report promoted keys left in a pre backup.")
+	fmt.Println("--------------------------------------------------------------------------------")
+}
+
+func main() {
+	flag.StringVar(&codecName, "codec", "gob", "rpc codec spoken by the ring")
+	flag.Int64Var(&seed, "seed", time.Now().UnixNano(), "seed for churn")
+	flag.StringVar(&protocol, "protocol", "chord", "routing protocol of churn nodes")
+	flag.IntVar(&basePort, "port", 26000, "first port of churn nodes")
+	flag.IntVar(&shrinkRuns, "shrink", 30, "runs spent shrinking a failing churn script")
+	flag.DurationVar(&bound, "bound", 5*time.Second, "recovery time the recovery command must meet")
+	flag.BoolVar(&dryRun, "dry-run", false, "have restore, restore-range and delete-prefix print the keys they would change instead")
+	flag.StringVar(&salt, "salt", "", "salt the ring hashes keys with, for lookup")
+	flag.BoolVar(&hashTags, "hash-tags", false, "have lookup hash only a key's {tag}, as a ring of chord.HashTagKeys does")
+	flag.StringVar(&recordPath, "record", "", "file a failing churn run is recorded to (default churn-<seed>.txt)")
+	flag.Usage = usage
+	flag.Parse()
+	log.SetOutput(io.Discard)
+	codec, ok := chord.LookupCodec(codecName)
+	if !ok {
+		fmt.Printf("Unknown codec %v.\n", codecName)
+		os.Exit(2)
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "ring":
+		if len(args) != 2 {
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(ring(args[1], codec))
+	case "lookup":
+		if len(args) != 3 {
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(lookup(args[1], args[2], codec))
+	case "distribution":
+		samples := 1000
+		if len(args) == 3 {
+			var err error
+			samples, err = strconv.Atoi(args[2])
+			if err != nil || samples < 0 {
+				usage()
+				os.Exit(2)
+			}
+		}
+		if len(args) < 2 || len(args) > 3 {
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(distribution(args[1], samples, codec))
+	case "churn":
+		steps := 40
+		if len(args) == 2 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil {
+				usage()
+				os.Exit(2)
+			}
+		}
+		os.Exit(churn(steps))
+	case "recovery":
+		nodes := 10
+		if len(args) == 2 {
+			var err error
+			nodes, err = strconv.Atoi(args[1])
+			if err != nil || nodes < 2 {
+				usage()
+				os.Exit(2)
+			}
+		}
+		os.Exit(recovery(nodes))
+	case "rejoin":
+		cycles := 10
+		if len(args) == 2 {
+			var err error
+			cycles, err = strconv.Atoi(args[1])
+			if err != nil || cycles < 1 {
+				usage()
+				os.Exit(2)
+			}
+		}
+		os.Exit(rejoin(cycles))
+	case "failover":
+		nodes := 5
+		if len(args) == 2 {
+			var err error
+			nodes, err = strconv.Atoi(args[1])
+			if err != nil || nodes < 2 {
+				usage()
+				os.Exit(2)
+			}
+		}
+		os.Exit(failover(nodes))
+	case "membership":
+		if len(args) != 2 {
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(membership(args[1]))
+	case "backups":
+		if len(args) != 2 {
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(backups(args[1]))
+	case "restore":
+		if len(args) < 3 {
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(restore(args[1], args[2], args[3:], codec))
+	case "restore-range":
+		if len(args) != 5 && len(args) != 6 {
+			usage()
+			os.Exit(2)
+		}
+		at, err := time.Parse(time.RFC3339Nano, args[3])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		r := chord.KeyRange{From: args[4]}
+		if len(args) == 6 {
+			r.To = args[5]
+		}
+		os.Exit(restoreRange(args[1], args[2], r, at, codec))
+	case "delete-prefix":
+		if len(args) != 3 {
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(deletePrefix(args[1], args[2], codec))
+	case "who-owns":
+		if len(args) < 3 {
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(whoOwns(args[1], args[2:], codec))
+	case "freeze":
+		if len(args) < 3 {
+			usage()
+			os.Exit(2)
+		}
+		d, err := time.ParseDuration(args[2])
+		if err != nil || d <= 0 {
+			fmt.Printf("Invalid duration %v.\n", args[2])
+			os.Exit(2)
+		}
+		os.Exit(freeze(args[1], d, strings.Join(args[3:], " "), codec))
+	case "thaw":
+		if len(args) < 2 {
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(thaw(args[1], strings.Join(args[2:], " "), codec))
+	case "replay":
+		if len(args) != 2 {
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(replay(args[1]))
+	default:
+		fmt.Printf("Unknown command %v.\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+}
+
+func ring(addr string, codec chord.Codec) int {
+	walk := chord.WalkRing(addr, codec)
+	fmt.Printf("%-4s %-40s %-22s %-22s %s\n", "#", "ID", "ADDRESS", "PREDECESSOR", "KEYS")
+	for i, info := range walk.Nodes {
+		fmt.Printf("%-4d %-40s %-22s %-22s %d\n", i+1, info.Id, info.Addr, info.Predecessor, info.Keys)
+	}
+	for _, p := range walk.Problems {
+		fmt.Println("!", p)
+	}
+	if !walk.Closed || len(walk.Problems) > 0 {
+		fmt.Printf("Ring from %v is inconsistent.\n", addr)
+		return 1
+	}
+	fmt.Printf("Ring of %v nodes is consistent.\n", len(walk.Nodes))
+	return 0
+}
+
+func lookup(addr, key string, codec chord.Codec) int {
+	var hasher chord.KeyHasher
+	switch {
+	case hashTags:
+		hasher = chord.HashTagKeys()
+	case salt != "":
+		hasher = chord.SaltedKeys(salt)
+	}
+	path, err := chord.LookupFrom(addr, key, hasher, codec)
+	if err != nil {
+		fmt.Printf("Lookup of %v from %v failed: %v\n", key, addr, err)
+		return 1
+	}
+	fmt.Printf("%-4s %-22s %s\n", "#", "HOP", "LATENCY")
+	for i, h := range path.Hops {
+		fmt.Printf("%-4d %-22s %v\n", i+1, h.Addr, h.Latency)
+	}
+	fmt.Printf("Key %v is owned by [%v], %v hops from %v.\n", key, path.Successor, len(path.Hops), addr)
+	return 0
+}
+
+func distribution(addr string, samples int, codec chord.Codec) int {
+	report := chord.MeasureDistribution(addr, codec, seed, samples)
+	fmt.Printf("%-22s %-40s %8s %8s %8s %8s\n", "ADDRESS", "ID", "SPAN", "SAMPLED", "KEYS", "SHARE")
+	for _, s := range report.Nodes {
+		fmt.Printf("%-22s %-40s %7.2f%% %7.2f%% %8d %7.2f%%\n", s.Addr, s.Id, 100*s.Span, 100*s.Sampled, s.Keys, 100*s.KeyShare)
+	}
+	for _, p := range report.Problems {
+		fmt.Println("!", p)
+	}
+	if len(report.Nodes) == 0 {
+		fmt.Printf("Ring from %v could not be walked.\n", addr)
+		return 1
+	}
+	fmt.Printf("%v nodes, %v keys, %v samples (%v failed) with seed %v.\n", len(report.Nodes), report.Keys, report.Samples, report.Failed, seed)
+	fmt.Printf("Largest span is %.2f times the mean, largest key share %.2f times.\n", report.Imbalance, report.KeyImbalance)
+	return 0
+}
+
+// runChurn gives every run its own ports, so nodes of an earlier run that
+// are still shutting down do not answer for the next one.
+func runChurn(script []chord.ChurnStep) chord.ChurnRecord {
+	record := chord.RunChurn(seed, script, protocol, basePort)
+	basePort += chord.ChurnMaxNodes
+	return record
+}
+
+func printViolations(record chord.ChurnRecord) {
+	for _, v := range record.Violations {
+		fmt.Println("!", v)
+	}
+	for _, r := range chord.LockAuditReports() {
+		fmt.Println("! lock audit:", r)
+	}
+	for _, r := range chord.FailoverViolations() {
+		fmt.Println("! failover:", r)
+	}
+}
+
+func churn(steps int) int {
+	record := runChurn(chord.GenerateChurn(seed, steps))
+	if len(record.Violations) == 0 {
+		fmt.Printf("Churn of %v steps with seed %v passed.\n", steps, seed)
+		return 0
+	}
+	printViolations(record)
+	fmt.Printf("Churn with seed %v failed, shrinking %v steps.\n", seed, len(record.Steps))
+	chord.ShrinkChurn(record.Steps, func(candidate []chord.ChurnStep) bool {
+		r := runChurn(candidate)
+		if len(r.Violations) > 0 {
+			record = r
+		}
+		return len(r.Violations) > 0
+	}, shrinkRuns)
+	if recordPath == "" {
+		recordPath = fmt.Sprintf("churn-%v.txt", seed)
+	}
+	file, err := os.Create(recordPath)
+	if err == nil {
+		err = record.Write(file)
+		_ = file.Close()
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+	_ = record.Write(os.Stdout)
+	fmt.Printf("Shortest failing run of %v steps recorded to %v.\n", len(record.Steps), recordPath)
+	return 1
+}
+
+func replay(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	record, err := chord.ParseChurnRecord(file)
+	_ = file.Close()
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if record.Seed != 0 {
+		seed = record.Seed
+	}
+	record = runChurn(record.Steps)
+	printViolations(record)
+	if len(record.Violations) > 0 {
+		fmt.Printf("Replay with seed %v failed.\n", seed)
+		return 1
+	}
+	fmt.Printf("Replay of %v steps with seed %v passed.\n", len(record.Steps), seed)
+	return 0
+}
+
+func recovery(nodes int) int {
+	report, err := chord.MeasureRecovery(seed, protocol, basePort, nodes, 200)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	fmt.Printf("Force quit [%v] of %v nodes with seed %v.\n", report.Victim, report.Nodes, seed)
+	fmt.Printf("Ring repaired after %v, %v keys readable after %v (%v unreadable).\n", report.RingRepaired, report.Keys, report.KeysReadable, report.Unreadable)
+	if !report.Within(bound) {
+		fmt.Printf("Recovery missed the %v bound.\n", bound)
+		return 1
+	}
+	fmt.Printf("Recovery met the %v bound.\n", bound)
+	return 0
+}
+
+func rejoin(cycles int) int {
+	report, err := chord.CycleRejoin(seed, protocol, basePort, 5, 100, cycles)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	fmt.Printf("Cycled %v nodes through %v quits and joins with seed %v.\n", report.Nodes, report.Cycles, seed)
+	fmt.Printf("Goroutines after each cycle: %v\n", report.Goroutines)
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	if len(report.Problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func failover(nodes int) int {
+	if !chord.FailoverTestEnabled {
+		fmt.Println("Build with -tags failovertest to fail nodes.")
+		return 2
+	}
+	check, err := chord.CheckFailover(protocol, basePort, nodes, 200, 100)
+	fmt.Printf("Force quit [%v], %v of its keys unreadable after %v stabilize rounds.\n", check.Successor, len(check.Unreadable), check.Rounds)
+	for _, v := range check.Violations {
+		fmt.Println("!", v)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("Failover of %v keys passed.\n", check.Keys)
+	return 0
+}
+
+func backups(location string) int {
+	dest, err := chord.OpenBackupDestination(location)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	names, err := dest.List("")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	sort.Strings(names)
+	latest, _ := chord.LatestBackups(dest)
+	newest := make(map[string]bool)
+	for _, name := range latest {
+		newest[name] = true
+	}
+	for _, name := range names {
+		if newest[name] {
+			fmt.Println(name, "(newest)")
+		} else {
+			fmt.Println(name)
+		}
+	}
+	fmt.Printf("%v backups of %v nodes in %v.\n", len(names), len(latest), location)
+	return 0
+}
+
+func restore(addr, location string, names []string, codec chord.Codec) int {
+	dest, err := chord.OpenBackupDestination(location)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if dryRun {
+		report, err := chord.RestoreBackupDryRun(addr, codec, dest, names...)
+		return printDryRun(report, err)
+	}
+	keys, err := chord.RestoreBackup(addr, codec, dest, names...)
+	if err != nil {
+		fmt.Printf("Restore into the ring of %v failed: %v\n", addr, err)
+		return 1
+	}
+	fmt.Printf("Restored %v keys into the ring of %v.\n", keys, addr)
+	return 0
+}
+
+func restoreRange(addr, location string, r chord.KeyRange, at time.Time, codec chord.Codec) int {
+	dest, err := chord.OpenBackupDestination(location)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if dryRun {
+		report, err := chord.RestoreRangeAtDryRun(addr, codec, dest, r, at)
+		return printDryRun(report, err)
+	}
+	report, err := chord.RestoreRangeAt(addr, codec, dest, r, at)
+	if err != nil {
+		fmt.Printf("Restore of [%v, %v) as of %v failed: %v\n", r.From, r.To, at, err)
+		return 1
+	}
+	fmt.Printf("Rebuilt [%v, %v) as of %v from %v backups and %v journal records.\n", r.From, r.To, at, report.Snapshots, report.Records)
+	fmt.Printf("Wrote %v keys and deleted %v in the ring of %v.\n", report.Written, report.Deleted, addr)
+	return 0
+}
+
+func deletePrefix(addr, prefix string, codec chord.Codec) int {
+	if dryRun {
+		return printDryRun(chord.DeletePrefixDryRun(addr, codec, prefix))
+	}
+	report, err := chord.DeletePrefix(addr, codec, prefix)
+	fmt.Printf("Deleted %v keys and %v backups with prefix %v on %v nodes.\n", report.Deleted, report.Backups, prefix, report.Nodes)
+	if len(report.Skipped) > 0 {
+		fmt.Printf("Skipped %v leased keys or keys their cache source kept: %v\n", len(report.Skipped), report.Skipped)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func printDryRun(report chord.DryRunReport, err error) int {
+	if err != nil && len(report.Effects) == 0 && len(report.Problems) == 0 {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("%-30s %-22s %s\n", "KEY", "NODE", "EFFECT")
+	for _, e := range report.Effects {
+		fmt.Printf("%-30s %-22s %s\n", e.Key, e.Node, e.Effect)
+	}
+	for _, p := range report.Problems {
+		fmt.Println("!", p)
+	}
+	effects := make([]string, 0, len(report.Counts))
+	for effect := range report.Counts {
+		effects = append(effects, effect)
+	}
+	sort.Strings(effects)
+	for _, effect := range effects {
+		fmt.Printf("%v %v, ", report.Counts[effect], effect)
+	}
+	fmt.Printf("on %v nodes. Nothing was changed.\n", len(report.Nodes))
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func freeze(addr string, d time.Duration, reason string, codec chord.Codec) int {
+	f, err := chord.FreezeRing(addr, codec, reason, d)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("Ring of %v frozen until %v.\n", addr, f.Until.Format(time.RFC3339))
+	return 0
+}
+
+func thaw(addr, reason string, codec chord.Codec) int {
+	if _, err := chord.ThawRing(addr, codec, reason); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("Ring of %v thawed.\n", addr)
+	return 0
+}
+
+func whoOwns(addr string, keys []string, codec chord.Codec) int {
+	var placements []chord.Placement
+	err := chord.RPCCallWithCodec(addr, codec, "ChordNode.LeafWhereWouldItGo", keys, &placements)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	ret := 0
+	fmt.Printf("%-20s %-40s %-22s %-22s %s\n", "KEY", "ID", "OWNER", "HOLDER", "REPLICAS")
+	for _, p := range placements {
+		if p.Error != "" {
+			fmt.Printf("%-20s %-40s %v\n", p.Key, p.Id, p.Error)
+			ret = 1
+			continue
+		}
+		fmt.Printf("%-20s %-40s %-22s %-22s %v\n", p.Key, p.Id, p.Owner, p.Holder, strings.Join(p.Replicas, " "))
+	}
+	return ret
+}
+
+func membership(path string) int {
+	m, err := chord.LoadMembership(path)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	for _, addr := range m.InRingOrder() {
+		fmt.Printf("%-22s %040x\n", addr, chordring.Id(chord.Identity(addr)))
+	}
+	return 0
+}
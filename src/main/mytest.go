@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"math/rand"
 	"os"
 	"strconv"
@@ -28,6 +29,10 @@ const (
 	MaxNodeSize = 1000
 )
 
+type exporter interface {
+	Export(addr string, out io.Writer) error
+}
+
 func removeNodeFromArray(s []int, num int) (ret []int, ok bool) {
 	ret = make([]int, 0, MaxNodeSize)
 	ok = false
@@ -71,6 +76,7 @@ func CommandLine() {
 			fmt.Println("[print map]            Print all k-v pair stored in system.")
 			fmt.Println("[print node]           Print all nodes in system.")
 			fmt.Println("[check]                Check whether dht is same with std.")
+			fmt.Println("[export <n> <file>]    Export node <n>'s store into <file> as json lines.")
 			fmt.Println("[exit]                 Exit CommandLine system.")
 			fmt.Println("--------------------------------------------------------------------------------")
 		case "add":
@@ -199,6 +205,25 @@ func CommandLine() {
 					fmt.Println("DHT system is same with std.")
 				}
 			}
+		case "export":
+			num, _ := strconv.Atoi(arg1)
+			num--
+			if num < 0 || num >= nodeCnt {
+				fmt.Println("Node serial number error!")
+				break
+			}
+			out, err := os.Create(arg2)
+			if err != nil {
+				fmt.Printf("Create file %v failed: %v\n", arg2, err)
+				break
+			}
+			err = nodes[num].(exporter).Export(nodeAddresses[num], out)
+			_ = out.Close()
+			if err != nil {
+				fmt.Printf("Export node No.%v failed: %v\n", num+1, err)
+			} else {
+				fmt.Println("Export successfully.")
+			}
 		case "exit":
 			flag = false
 			fmt.Println("Successfully exit CommandLine.")
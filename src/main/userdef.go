@@ -2,6 +2,8 @@ package main
 
 import (
 	"chord"
+	_ "chord/koorde"
+	_ "chord/pastry"
 	"strconv"
 )
 
@@ -9,9 +11,14 @@ import (
  * a struct which implements the interface "dhtNode".
  */
 
+/* Routing protocol of the nodes created by "NewNode": "chord", "koorde" or "pastry". */
+var protocol = "chord"
+
 func NewNode(port int) dhtNode {
 	// create a node and then return it.
-	var n chord.NodeWrapper
-	n.Initialize(GetLocalAddress() + ":" + strconv.Itoa(port))
-	return &n
+	n, err := chord.NewProtocolNode(protocol, GetLocalAddress()+":"+strconv.Itoa(port))
+	if err != nil {
+		panic(err)
+	}
+	return n
 }